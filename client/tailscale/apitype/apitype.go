@@ -5,7 +5,11 @@
 // Package apitype contains types for the Tailscale local API.
 package apitype
 
-import "tailscale.com/tailcfg"
+import (
+	"time"
+
+	"tailscale.com/tailcfg"
+)
 
 // WhoIsResponse is the JSON type returned by tailscaled debug server's /whois?ip=$IP handler.
 type WhoIsResponse struct {
@@ -27,3 +31,133 @@ type WaitingFile struct {
 	Name string
 	Size int64
 }
+
+// SSHSessionRecording describes a recorded Tailscale SSH session.
+type SSHSessionRecording struct {
+	// ID is the session's ID, as used in its log lines.
+	ID string
+
+	Start time.Time
+	End   time.Time // zero if the session is still active
+
+	SrcNode   string // source node's name
+	SrcNodeID tailcfg.StableNodeID
+	SrcIP     string
+	LoginName string // of the source node's user, or its tags
+	LocalUser string // local user the session ran as
+	Command   string `json:",omitempty"` // empty for interactive shells
+
+	// Input is whether the session's input (what the user typed)
+	// was recorded in addition to its output.
+	Input bool `json:",omitempty"`
+}
+
+// SSHSession describes an active Tailscale SSH session.
+type SSHSession struct {
+	ID    string // the session's ID, as used in its log lines
+	Start time.Time
+
+	SrcNode   string // source node's name
+	SrcNodeID tailcfg.StableNodeID
+	SrcIP     string
+	LoginName string // of the source node's user, or its tags
+	LocalUser string // local user the session runs as
+	Command   string `json:",omitempty"` // empty for interactive shells
+	Subsystem string `json:",omitempty"` // e.g. "sftp"
+	PTY       bool   `json:",omitempty"`
+}
+
+// SSHEventType is the type of an SSHEvent.
+type SSHEventType string
+
+const (
+	SSHEventPolicy       SSHEventType = "policy"        // SSH policy was evaluated for a connection
+	SSHEventSessionStart SSHEventType = "session-start" // a session was accepted and started
+	SSHEventSessionEnd   SSHEventType = "session-end"   // a session ended
+	SSHEventForward      SSHEventType = "forward"       // a port forward was requested
+)
+
+// SSHEvent is a structured audit event from the Tailscale SSH server.
+//
+// Not all fields are set for all event types.
+type SSHEvent struct {
+	Time time.Time
+	Type SSHEventType
+
+	// SessionID is the ID of the session the event is about, if any.
+	// It's empty for policy and forwarding events that happen
+	// outside of a session.
+	SessionID string `json:",omitempty"`
+
+	SrcNode   string               `json:",omitempty"` // source node's name
+	SrcNodeID tailcfg.StableNodeID `json:",omitempty"`
+	SrcIP     string               `json:",omitempty"`
+	LoginName string               `json:",omitempty"` // of the source node's user, or its tags
+	SSHUser   string               `json:",omitempty"` // the user requested by the client
+	LocalUser string               `json:",omitempty"` // local user the session runs as
+
+	// Action is the outcome of the policy evaluation for policy and
+	// forwarding events: "accept", "reject" or "hold" (when the
+	// decision was delegated to control).
+	Action string `json:",omitempty"`
+
+	// Rule is the 1-based index of the SSHPolicy rule that matched,
+	// for policy events. It's 0 if no rule matched, or if the action
+	// came from the coordination server after a "hold".
+	Rule int `json:",omitempty"`
+
+	Command   string `json:",omitempty"` // for session events; empty for interactive shells
+	Subsystem string `json:",omitempty"` // for session events, e.g. "sftp"
+
+	// Forward describes the requested port forward, for forwarding
+	// events, such as "local 127.0.0.1:8080", "remote 0.0.0.0:80" or
+	// "streamlocal /var/run/docker.sock".
+	Forward string `json:",omitempty"`
+
+	// For session-end events:
+	ExitCode int   `json:",omitempty"`
+	BytesIn  int64 `json:",omitempty"` // bytes read from the client
+	BytesOut int64 `json:",omitempty"` // bytes written to the client, including stderr
+
+	// Err is the error, if any, that ended the session or denied the
+	// request.
+	Err string `json:",omitempty"`
+}
+
+// FilterRuleStats are the hit counters of a packet filter rule, as
+// returned by the LocalAPI's /filter-stats handler.
+type FilterRuleStats struct {
+	// Rule is the rule as sent by the control plane.
+	Rule tailcfg.FilterRule
+
+	// Match is the rule as parsed by the packet filter.
+	Match string
+
+	// Packets and Bytes are the incoming packets accepted by the
+	// rule, including later packets of the flows it accepted.
+	Packets int64
+	Bytes   int64
+
+	// Flows is the number of incoming TCP, UDP and SCTP flows the
+	// rule accepted.
+	Flows int64
+}
+
+// FilterCheckResult is the packet filter's verdict on a hypothetical
+// flow, as returned by the LocalAPI's /filter-check handler.
+type FilterCheckResult struct {
+	Verdict string // "Accept" or "Drop"
+	Reason  string // why, as the packet filter would log it
+
+	// RuleIndex is the index of the rule that accepted the flow in
+	// the packet filter sent by the control plane, or -1 if none did.
+	RuleIndex int
+	// Rule is that rule, if any.
+	Rule *tailcfg.FilterRule `json:",omitempty"`
+	// Match is that rule, as parsed by the packet filter.
+	Match string `json:",omitempty"`
+
+	// ShieldsUp is whether the node is blocking all incoming
+	// connections.
+	ShieldsUp bool
+}
@@ -19,6 +19,7 @@
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os/exec"
 	"runtime"
@@ -28,12 +29,14 @@
 	"time"
 
 	"go4.org/mem"
+	"inet.af/netaddr"
 	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
 	"tailscale.com/version"
 )
 
@@ -435,6 +438,202 @@ func CurrentDERPMap(ctx context.Context) (*tailcfg.DERPMap, error) {
 	return &derpMap, nil
 }
 
+// SSHSessionRecordings returns the metadata of the Tailscale SSH
+// session recordings stored by the local Tailscale daemon.
+func SSHSessionRecordings(ctx context.Context) ([]*apitype.SSHSessionRecording, error) {
+	body, err := get200(ctx, "/localapi/v0/ssh-recordings/")
+	if err != nil {
+		return nil, err
+	}
+	var recs []*apitype.SSHSessionRecording
+	if err := json.Unmarshal(body, &recs); err != nil {
+		return nil, err
+	}
+	return recs, nil
+}
+
+// SSHSessionRecording returns the asciicast v2 recording of the
+// Tailscale SSH session with the provided ID.
+func SSHSessionRecording(ctx context.Context, id string) ([]byte, error) {
+	return get200(ctx, "/localapi/v0/ssh-recordings/"+url.PathEscape(id))
+}
+
+// SSHSessions returns the active Tailscale SSH sessions on the local
+// machine.
+func SSHSessions(ctx context.Context) ([]apitype.SSHSession, error) {
+	body, err := get200(ctx, "/localapi/v0/ssh-sessions/")
+	if err != nil {
+		return nil, err
+	}
+	var sessions []apitype.SSHSession
+	if err := json.Unmarshal(body, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// KillSSHSession terminates the active Tailscale SSH session with the
+// provided ID.
+func KillSSHSession(ctx context.Context, id string) error {
+	_, err := send(ctx, "DELETE", "/localapi/v0/ssh-sessions/"+url.PathEscape(id), http.StatusNoContent, nil)
+	return err
+}
+
+// SSHEvents returns the most recent Tailscale SSH audit events, oldest
+// first.
+func SSHEvents(ctx context.Context) ([]apitype.SSHEvent, error) {
+	body, err := get200(ctx, "/localapi/v0/ssh-events")
+	if err != nil {
+		return nil, err
+	}
+	var events []apitype.SSHEvent
+	if err := json.Unmarshal(body, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// FilterRuleStats returns the hit counters of the local node's packet
+// filter rules.
+func FilterRuleStats(ctx context.Context) ([]apitype.FilterRuleStats, error) {
+	body, err := get200(ctx, "/localapi/v0/filter-stats")
+	if err != nil {
+		return nil, err
+	}
+	var stats []apitype.FilterRuleStats
+	if err := json.Unmarshal(body, &stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// CheckFilter evaluates the local node's packet filter for a
+// hypothetical flow of IP protocol proto from src to dst:port, without
+// sending any packets. incoming is whether the flow is from the peer
+// at src to the local node, rather than from the local node to the
+// peer at dst.
+func CheckFilter(ctx context.Context, src, dst netaddr.IP, proto ipproto.Proto, port uint16, incoming bool) (*apitype.FilterCheckResult, error) {
+	v := url.Values{
+		"src":   {src.String()},
+		"dst":   {dst.String()},
+		"proto": {strconv.Itoa(int(proto))},
+		"port":  {strconv.Itoa(int(port))},
+		"dir":   {"in"},
+	}
+	if !incoming {
+		v.Set("dir", "out")
+	}
+	body, err := get200(ctx, "/localapi/v0/filter-check?"+v.Encode())
+	if err != nil {
+		return nil, err
+	}
+	res := new(apitype.FilterCheckResult)
+	if err := json.Unmarshal(body, res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// DebugPeerPaths returns the recent history of the network paths used
+// to reach the peer with Tailscale IP ip.
+func DebugPeerPaths(ctx context.Context, ip netaddr.IP) (*ipnstate.PeerPathHistory, error) {
+	body, err := get200(ctx, "/localapi/v0/debug-peer-paths?ip="+url.QueryEscape(ip.String()))
+	if err != nil {
+		return nil, err
+	}
+	h := new(ipnstate.PeerPathHistory)
+	if err := json.Unmarshal(body, h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// StreamDebugCapture streams a pcapng capture of the packets passing
+// through tailscaled, until ctx is done or the returned reader is
+// closed.
+func StreamDebugCapture(ctx context.Context) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://local-tailscaled.sock/localapi/v0/debug-capture", nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := doLocalRequestNiceError(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("HTTP %s: %s", res.Status, body)
+	}
+	return res.Body, nil
+}
+
+// DialTCP connects to the host's port via Tailscale, as tailscaled
+// would dial it. In userspace-networking mode, that's the only way to
+// reach Tailscale IPs from the local machine.
+//
+// The host may be a base DNS name (resolved from the netmap inside
+// tailscaled), a FQDN, or an IP address.
+func DialTCP(ctx context.Context, host string, port uint16) (net.Conn, error) {
+	connCh := make(chan net.Conn, 1)
+	trace := httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			connCh <- info.Conn
+		},
+	}
+	ctx = httptrace.WithClientTrace(ctx, &trace)
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://local-tailscaled.sock/localapi/v0/dial", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = http.Header{
+		"Upgrade":    []string{"ts-dial"},
+		"Connection": []string{"upgrade"},
+		"Dial-Host":  []string{host},
+		"Dial-Port":  []string{fmt.Sprint(port)},
+	}
+	res, err := doLocalRequestNiceError(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		return nil, fmt.Errorf("unexpected HTTP response: %s, %s", res.Status, body)
+	}
+	// From here on, the underlying net.Conn is ours to use, but there
+	// is still a read buffer attached to it within resp.Body. So, we
+	// must direct I/O through resp.Body, but we can still use the
+	// underlying net.Conn for stuff like deadlines.
+	var switchedConn net.Conn
+	select {
+	case switchedConn = <-connCh:
+	default:
+	}
+	if switchedConn == nil {
+		res.Body.Close()
+		return nil, fmt.Errorf("httptrace didn't provide a connection")
+	}
+	rwc, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		res.Body.Close()
+		return nil, errors.New("http Transport did not provide a writable body")
+	}
+	return &bodyConn{Conn: switchedConn, rwc: rwc}, nil
+}
+
+// bodyConn is a net.Conn whose I/O goes through the body of a 101
+// Switching Protocols response, which owns any already-buffered
+// bytes of the underlying connection.
+type bodyConn struct {
+	net.Conn
+	rwc io.ReadWriteCloser
+}
+
+func (c *bodyConn) Read(p []byte) (int, error)  { return c.rwc.Read(p) }
+func (c *bodyConn) Write(p []byte) (int, error) { return c.rwc.Write(p) }
+func (c *bodyConn) Close() error                { return c.rwc.Close() }
+
 // CertPair returns a cert and private key for the provided DNS domain.
 //
 // It returns a cached certificate from disk if it's still valid.
@@ -53,8 +53,16 @@
 	bootstrapDNS  = flag.String("bootstrap-dns-names", "", "optional comma-separated list of hostnames to make available at /bootstrap-dns")
 	verifyClients = flag.Bool("verify-clients", false, "verify clients to this DERP server through a local tailscaled instance.")
 
+	verifyClientAllowlist = flag.String("verify-client-allowlist", "", "if non-empty, path to a file listing the node public keys, one per line, of the clients allowed to use this DERP server. It's checked for changes every 10 seconds; clients no longer listed are disconnected, and if it goes missing or is invalid the last good list stays in effect.")
+	verifyClientURL       = flag.String("verify-client-url", "", "if non-empty, URL of an admission webhook to ask whether to accept each client. See derp.AdmitClientRequest.")
+
 	acceptConnLimit = flag.Float64("accept-connection-limit", math.Inf(+1), "rate limit for accepting new connection")
 	acceptConnBurst = flag.Int("accept-connection-burst", math.MaxInt, "burst limit for accepting new connection")
+
+	clientRateLimit = flag.Float64("client-rate-limit", 0, "if non-zero, the bytes per second of packets each client may send; packets over it are dropped. Can be overridden per client key in the config file.")
+	clientRateBurst = flag.Int("client-rate-burst", 0, "burst, in bytes, for --client-rate-limit; at least the maximum packet size")
+	globalRateLimit = flag.Float64("global-rate-limit", 0, "if non-zero, the bytes per second of packets all clients together may send; packets over it are dropped")
+	globalRateBurst = flag.Int("global-rate-burst", 0, "burst, in bytes, for --global-rate-limit; at least the maximum packet size")
 )
 
 var (
@@ -83,6 +91,11 @@ func init() {
 
 type config struct {
 	PrivateKey key.NodePrivate
+
+	// ClientRateLimits optionally overrides --client-rate-limit and
+	// --client-rate-burst for the clients with the given node keys.
+	// A zero limit exempts a client from them.
+	ClientRateLimits map[key.NodePublic]derp.RateLimit `json:",omitempty"`
 }
 
 func loadConfig() config {
@@ -158,6 +171,17 @@ func main() {
 
 	s := derp.NewServer(cfg.PrivateKey, log.Printf)
 	s.SetVerifyClient(*verifyClients)
+	if *verifyClientAllowlist != "" {
+		if err := s.SetVerifyClientAllowlist(*verifyClientAllowlist); err != nil {
+			log.Fatalf("derper: client allowlist: %v", err)
+		}
+	}
+	s.SetVerifyClientURL(*verifyClientURL)
+	s.SetClientRateLimit(derp.RateLimit{BytesPerSecond: *clientRateLimit, Burst: *clientRateBurst})
+	s.SetGlobalRateLimit(derp.RateLimit{BytesPerSecond: *globalRateLimit, Burst: *globalRateBurst})
+	for k, l := range cfg.ClientRateLimits {
+		s.SetClientRateLimitForKey(k, l)
+	}
 
 	if *meshPSKFile != "" {
 		b, err := ioutil.ReadFile(*meshPSKFile)
@@ -175,6 +175,7 @@ func Run(args []string) (err error) {
 			fileCmd,
 			bugReportCmd,
 			certCmd,
+			sshCmd,
 		},
 		FlagSet:   rootfs,
 		Exec:      func(context.Context, []string) error { return flag.ErrHelp },
@@ -19,6 +19,7 @@
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/tstest"
+	"tailscale.com/types/ipproto"
 	"tailscale.com/types/persist"
 	"tailscale.com/types/preftype"
 	"tailscale.com/version/distro"
@@ -646,6 +647,83 @@ func TestPrefsFromUpArgs(t *testing.T) {
 				NoSNAT:        true,
 			},
 		},
+		{
+			name: "local_filter",
+			args: upArgsT{
+				localFilter:   "allow:tcp:22:100.101.102.103,deny:tcp:22:*",
+				netfilterMode: "off",
+			},
+			want: &ipn.Prefs{
+				WantRunning:   true,
+				NetfilterMode: preftype.NetfilterOff,
+				NoSNAT:        true,
+				LocalFilter: []preftype.LocalFilterRule{
+					{Proto: ipproto.TCP, PortFirst: 22, PortLast: 22, Src: netaddr.MustParseIPPrefix("100.101.102.103/32")},
+					{Deny: true, Proto: ipproto.TCP, PortFirst: 22, PortLast: 22},
+				},
+			},
+		},
+		{
+			name: "error_local_filter",
+			args: upArgsT{
+				localFilter:   "reject:tcp:22:*",
+				netfilterMode: "off",
+			},
+			wantErr: `invalid action "reject" in local filter rule "reject:tcp:22:*"; want allow or deny`,
+		},
+		{
+			name: "mtu",
+			args: upArgsT{
+				mtu:           1400,
+				netfilterMode: "off",
+			},
+			want: &ipn.Prefs{
+				WantRunning:   true,
+				NetfilterMode: preftype.NetfilterOff,
+				NoSNAT:        true,
+				MTU:           1400,
+			},
+		},
+		{
+			name: "error_mtu_too_small",
+			args: upArgsT{
+				mtu:           576,
+				netfilterMode: "off",
+			},
+			wantErr: "invalid value --mtu=576; must be 0 or between 1280 and 65000",
+		},
+		{
+			name: "advertise_endpoints",
+			args: upArgsT{
+				advertiseEndpoints: "203.0.113.5:41641,[2001:db8::1]:41641",
+				netfilterMode:      "off",
+			},
+			want: &ipn.Prefs{
+				WantRunning:   true,
+				NetfilterMode: preftype.NetfilterOff,
+				NoSNAT:        true,
+				AdvertiseEndpoints: []netaddr.IPPort{
+					netaddr.MustParseIPPort("203.0.113.5:41641"),
+					netaddr.MustParseIPPort("[2001:db8::1]:41641"),
+				},
+			},
+		},
+		{
+			name: "error_advertise_endpoints_no_port",
+			args: upArgsT{
+				advertiseEndpoints: "203.0.113.5",
+				netfilterMode:      "off",
+			},
+			wantErr: `"203.0.113.5" is not a valid IP:port`,
+		},
+		{
+			name: "error_advertise_endpoints_unspecified",
+			args: upArgsT{
+				advertiseEndpoints: "0.0.0.0:41641",
+				netfilterMode:      "off",
+			},
+			wantErr: `"0.0.0.0:41641" is not a valid endpoint; it needs a specific IP and port`,
+		},
 		{
 			name: "warn_linux_netfilter_off",
 			goos: "linux",
@@ -796,6 +874,7 @@ func TestUpdatePrefs(t *testing.T) {
 			},
 			env: upCheckEnv{backendState: "Running"},
 			wantJustEditMP: &ipn.MaskedPrefs{
+				AdvertiseEndpointsSet:     true,
 				AdvertiseRoutesSet:        true,
 				AdvertiseTagsSet:          true,
 				AllowSingleHostsSet:       true,
@@ -805,9 +884,12 @@ func TestUpdatePrefs(t *testing.T) {
 				ExitNodeIDSet:             true,
 				ExitNodeIPSet:             true,
 				HostnameSet:               true,
+				LocalFilterSet:            true,
+				MTUSet:                    true,
 				NetfilterModeSet:          true,
 				NoSNATSet:                 true,
 				OperatorUserSet:           true,
+				PeerRelaySet:              true,
 				RouteAllSet:               true,
 				RunSSHSet:                 true,
 				ShieldsUpSet:              true,
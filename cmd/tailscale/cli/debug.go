@@ -15,17 +15,21 @@
 	"io"
 	"log"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
+	"inet.af/netaddr"
 	"tailscale.com/client/tailscale"
 	"tailscale.com/hostinfo"
 	"tailscale.com/ipn"
 	"tailscale.com/paths"
 	"tailscale.com/safesocket"
+	"tailscale.com/types/ipproto"
 )
 
 var debugCmd = &ffcli.Command{
@@ -96,6 +100,76 @@
 				return fs
 			})(),
 		},
+		{
+			Name:       "filter-check",
+			Exec:       runFilterCheck,
+			ShortUsage: "filter-check [--out] <src-ip> <dst-ip> <proto> [port]",
+			ShortHelp:  "evaluate the packet filter for a hypothetical flow",
+			LongHelp: strings.TrimSpace(`
+The 'tailscale debug filter-check' command reports whether the current
+packet filter would allow a flow from src-ip to dst-ip:port, and why.
+No packets are sent.
+
+The flow is from a Tailscale peer at src-ip to this node, unless --out
+is given, in which case it's from this node to the peer at dst-ip.
+The proto is tcp, udp, sctp, icmp or an IP protocol number.
+`),
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("filter-check")
+				fs.BoolVar(&filterCheckArgs.out, "out", false, "check an outgoing flow, from this node to a peer")
+				return fs
+			})(),
+		},
+		{
+			Name:       "capture",
+			Exec:       runCapture,
+			ShortUsage: "capture [-o file.pcapng]",
+			ShortHelp:  "stream a packet capture of Tailscale traffic",
+			LongHelp: strings.TrimSpace(`
+The 'tailscale debug capture' command streams the packets passing
+through tailscaled, in the pcapng format read by Wireshark and tcpdump,
+until interrupted. Packets are captured both before and after the
+packet filter, on the "tailscale-pre-filter" and "tailscale-post-filter"
+interfaces respectively. Each packet is annotated with its direction,
+and after the filter, with what became of it, such as the filter's
+verdict.
+
+It works in all networking modes, including --tun=userspace-networking.
+`),
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("capture")
+				fs.StringVar(&captureArgs.outFile, "o", "-", "file to write the capture to; - for stdout")
+				return fs
+			})(),
+		},
+		{
+			Name:       "peer-paths",
+			Exec:       runPeerPaths,
+			ShortUsage: "peer-paths [--json] <hostname-or-IP>",
+			ShortHelp:  "print the recent history of the paths to a peer",
+			LongHelp: strings.TrimSpace(`
+The 'tailscale debug peer-paths' command prints the recent history of
+the network paths used to reach a peer: its candidate direct addresses
+with their pong latencies and ping loss, and the recent switches between
+DERP and direct paths, with why they happened.
+`),
+			FlagSet: (func() *flag.FlagSet {
+				fs := newFlagSet("peer-paths")
+				fs.BoolVar(&peerPathsArgs.json, "json", false, "output in JSON format")
+				return fs
+			})(),
+		},
+		{
+			Name:       "nc",
+			Exec:       runNC,
+			ShortUsage: "nc <hostname-or-IP> <port>",
+			ShortHelp:  "connect stdin/stdout to a port on a peer, via tailscaled",
+			LongHelp: strings.TrimSpace(`
+The 'tailscale debug nc' command connects to a TCP port on a peer through
+tailscaled, so it works in userspace-networking mode too. It's used as
+the ProxyCommand of 'tailscale ssh'.
+`),
+		},
 		{
 			Name:      "watch-ipn",
 			Exec:      runWatchIPN,
@@ -227,6 +301,179 @@ func runPrefs(ctx context.Context, args []string) error {
 	return nil
 }
 
+var filterCheckArgs struct {
+	out bool
+}
+
+func runFilterCheck(ctx context.Context, args []string) error {
+	if len(args) != 3 && len(args) != 4 {
+		return errors.New("usage: filter-check [--out] <src-ip> <dst-ip> <proto> [port]")
+	}
+	src, err := netaddr.ParseIP(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid src-ip: %w", err)
+	}
+	dst, err := netaddr.ParseIP(args[1])
+	if err != nil {
+		return fmt.Errorf("invalid dst-ip: %w", err)
+	}
+	var proto ipproto.Proto
+	switch strings.ToLower(args[2]) {
+	case "tcp":
+		proto = ipproto.TCP
+	case "udp":
+		proto = ipproto.UDP
+	case "sctp":
+		proto = ipproto.SCTP
+	case "icmp":
+		proto = ipproto.ICMPv4
+		if src.Is6() {
+			proto = ipproto.ICMPv6
+		}
+	default:
+		n, err := strconv.ParseUint(args[2], 10, 8)
+		if err != nil {
+			return fmt.Errorf("invalid proto %q", args[2])
+		}
+		proto = ipproto.Proto(n)
+	}
+	var port uint64
+	if len(args) == 4 {
+		port, err = strconv.ParseUint(args[3], 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port %q", args[3])
+		}
+	}
+
+	res, err := tailscale.CheckFilter(ctx, src, dst, proto, uint16(port), !filterCheckArgs.out)
+	if err != nil {
+		return err
+	}
+	printf("%s: %s\n", res.Verdict, res.Reason)
+	if res.RuleIndex >= 0 {
+		printf("rule %d: %s\n", res.RuleIndex, res.Match)
+		if res.Rule != nil {
+			j, _ := json.Marshal(res.Rule)
+			printf("  %s\n", j)
+		}
+	}
+	if res.ShieldsUp {
+		printf("shields up: all incoming connections are blocked\n")
+	}
+	return nil
+}
+
+var captureArgs struct {
+	outFile string
+}
+
+func runCapture(ctx context.Context, args []string) error {
+	if len(args) > 0 {
+		return errors.New("unexpected arguments")
+	}
+	ctx, cancel := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	var out io.Writer = os.Stdout
+	if captureArgs.outFile != "-" {
+		f, err := os.Create(captureArgs.outFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+	rc, err := tailscale.StreamDebugCapture(ctx)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if captureArgs.outFile != "-" {
+		fmt.Fprintf(os.Stderr, "Writing capture to %s; press Ctrl-C to stop.\n", captureArgs.outFile)
+	}
+	if _, err := io.Copy(out, rc); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+var peerPathsArgs struct {
+	json bool
+}
+
+func runPeerPaths(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: peer-paths [--json] <hostname-or-IP>")
+	}
+	ipStr, self, err := tailscaleIPFromArg(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if self {
+		return errors.New("that's this node; peer-paths needs a peer")
+	}
+	ip, err := netaddr.ParseIP(ipStr)
+	if err != nil {
+		return err
+	}
+	h, err := tailscale.DebugPeerPaths(ctx, ip)
+	if err != nil {
+		return err
+	}
+	if peerPathsArgs.json {
+		j, _ := json.MarshalIndent(h, "", "\t")
+		outln(string(j))
+		return nil
+	}
+
+	curPath := h.CurPath
+	if curPath == "" {
+		curPath = "none"
+	}
+	printf("peer %v, now via %v\n", h.PublicKey.ShortString(), curPath)
+	for _, c := range h.Candidates {
+		best := ""
+		if c.Best {
+			best = " (best)"
+		}
+		printf("\n%v%v: %v pings sent, %v lost\n", c.Addr, best, c.PingsSent, c.PingsLost)
+		if c.MTU != 0 {
+			printf("  path MTU %v\n", c.MTU)
+		}
+		if len(c.Latency) > 0 {
+			min, max, sum := c.Latency[0].LatencySeconds, c.Latency[0].LatencySeconds, 0.0
+			for _, l := range c.Latency {
+				sum += l.LatencySeconds
+				if l.LatencySeconds < min {
+					min = l.LatencySeconds
+				}
+				if l.LatencySeconds > max {
+					max = l.LatencySeconds
+				}
+			}
+			last := c.Latency[len(c.Latency)-1]
+			printf("  latency min/avg/max %.1f/%.1f/%.1f ms over %v pongs; last %.1f ms at %v\n",
+				min*1000, sum/float64(len(c.Latency))*1000, max*1000, len(c.Latency),
+				last.LatencySeconds*1000, last.When.Format(time.RFC3339))
+		}
+	}
+	if len(h.Switches) > 0 {
+		printf("\npath switches:\n")
+	}
+	for _, ps := range h.Switches {
+		from := ps.From
+		if from == "" {
+			from = "none"
+		}
+		to := ps.To
+		if to == "" {
+			to = "none"
+		}
+		printf("  %v: %v => %v (%v)\n", ps.When.Format(time.RFC3339), from, to, ps.Reason)
+	}
+	return nil
+}
+
 var watchIPNArgs struct {
 	netmap bool
 }
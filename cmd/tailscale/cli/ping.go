@@ -133,6 +133,9 @@ func runPing(ctx context.Context, args []string) error {
 			if pr.DERPRegionID != 0 {
 				via = fmt.Sprintf("DERP(%s)", pr.DERPRegionCode)
 			}
+			if pr.PeerRelay != "" {
+				via = fmt.Sprintf("relay(%s)", pr.PeerRelay)
+			}
 			if pingArgs.tsmp {
 				// TODO(bradfitz): populate the rest of ipnstate.PingResult for TSMP queries?
 				// For now just say it came via TSMP.
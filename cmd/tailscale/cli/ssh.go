@@ -0,0 +1,200 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/peterbourgon/ff/v3/ffcli"
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale"
+	"tailscale.com/ipn/ipnstate"
+)
+
+var sshCmd = &ffcli.Command{
+	Name:       "ssh",
+	ShortUsage: "ssh [user@]<host> [args...]",
+	ShortHelp:  "SSH to a Tailscale machine",
+	LongHelp: strings.TrimSpace(`
+
+The 'tailscale ssh' command is an optional wrapper around the system 'ssh'
+command that's useful in some cases. Tailscale SSH does not require its use;
+most users running the Tailscale SSH server will prefer to just use the normal
+'ssh' command or their normal SSH client.
+
+The 'tailscale ssh' wrapper adds a few things:
+
+* It resolves the destination server name in its arguments using MagicDNS,
+  even if --accept-dns=false.
+* It works in userspace-networking mode, by supplying a ProxyCommand to the
+  system 'ssh' command that connects via a pipe through tailscaled.
+* It automatically checks the destination server's SSH host key against the
+  node's SSH host key as advertised via the Tailscale coordination server,
+  so there are no trust-on-first-use prompts.
+`),
+	Exec: runSSH,
+}
+
+func runSSH(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: ssh [user@]<host>")
+	}
+	arg, argRest := args[0], args[1:]
+	username, host, ok := strings.Cut(arg, "@")
+	if !ok {
+		host = arg
+		username = ""
+	}
+
+	st, err := tailscale.Status(ctx)
+	if err != nil {
+		return err
+	}
+	ps, ok := peerStatusFromArg(st, host)
+	if !ok {
+		return fmt.Errorf("unknown host %q; not found in your tailnet", host)
+	}
+	if len(ps.TailscaleIPs) == 0 {
+		return fmt.Errorf("host %q lacks a Tailscale IP", host)
+	}
+	ssh, err := exec.LookPath("ssh")
+	if err != nil {
+		return err
+	}
+	knownHostsFile, err := writeKnownHosts(st)
+	if err != nil {
+		return err
+	}
+
+	hostAlias := strings.TrimSuffix(ps.DNSName, ".")
+	if hostAlias == "" {
+		hostAlias = ps.TailscaleIPs[0].String()
+	}
+	target := ps.TailscaleIPs[0].String()
+	if username != "" {
+		target = username + "@" + target
+	}
+
+	argv := []string{ssh}
+	argv = append(argv,
+		"-o", "HostKeyAlias="+hostAlias,
+		"-o", "UserKnownHostsFile="+quoteSSHOpt(knownHostsFile),
+		"-o", "UpdateHostKeys=no",
+		"-o", "StrictHostKeyChecking=yes",
+	)
+	// In userspace-networking mode, Tailscale IPs aren't reachable from
+	// this machine directly, so tunnel the connection through
+	// tailscaled using "tailscale debug nc".
+	if !st.TUN {
+		self, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		argv = append(argv,
+			"-o", fmt.Sprintf("ProxyCommand=%s --socket=%s debug nc %%h %%p",
+				quoteSSHOpt(self),
+				quoteSSHOpt(rootArgs.socket),
+			))
+	}
+	argv = append(argv, target)
+	argv = append(argv, argRest...)
+
+	if os.Getenv("TS_DEBUG_SSH_EXEC") == "1" {
+		fmt.Fprintf(Stderr, "Running: %q, %q\n", ssh, argv)
+	}
+	return execSSH(ssh, argv)
+}
+
+// peerStatusFromArg returns the peer in st matching arg, which may be
+// a Tailscale IP, a MagicDNS name (with or without the trailing dot),
+// the first label of a MagicDNS name, or a peer's hostname.
+func peerStatusFromArg(st *ipnstate.Status, arg string) (*ipnstate.PeerStatus, bool) {
+	if ip, err := netaddr.ParseIP(arg); err == nil {
+		return peerMatchingIP(st, ip.String())
+	}
+	arg = strings.TrimSuffix(arg, ".")
+	for _, ps := range st.Peer {
+		dnsName := strings.TrimSuffix(ps.DNSName, ".")
+		if strings.EqualFold(arg, dnsName) {
+			return ps, true
+		}
+		if base, _, ok := strings.Cut(dnsName, "."); ok && strings.EqualFold(arg, base) {
+			return ps, true
+		}
+	}
+	for _, ps := range st.Peer {
+		if strings.EqualFold(arg, ps.HostName) {
+			return ps, true
+		}
+	}
+	return nil, false
+}
+
+// writeKnownHosts writes a known_hosts file containing the SSH host
+// keys advertised by the peers in st, keyed by their MagicDNS names
+// and Tailscale IPs, and returns its path.
+//
+// The file is rewritten on each run, so it's always current with the
+// netmap.
+func writeKnownHosts(st *ipnstate.Status) (knownHostsFile string, err error) {
+	confDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	tsConfDir := filepath.Join(confDir, "tailscale")
+	if err := os.MkdirAll(tsConfDir, 0700); err != nil {
+		return "", err
+	}
+	knownHostsFile = filepath.Join(tsConfDir, "ssh_known_hosts")
+	want := genKnownHosts(st)
+	if cur, err := os.ReadFile(knownHostsFile); err != nil || !bytes.Equal(cur, want) {
+		if err := os.WriteFile(knownHostsFile, want, 0644); err != nil {
+			return "", err
+		}
+	}
+	return knownHostsFile, nil
+}
+
+func genKnownHosts(st *ipnstate.Status) []byte {
+	var buf bytes.Buffer
+	for _, k := range st.Peers() {
+		ps := st.Peer[k]
+		if len(ps.SSH_HostKeys) == 0 {
+			continue
+		}
+		// addEntries adds one line for each of ps's host keys.
+		addEntries := func(host string) {
+			for _, hk := range ps.SSH_HostKeys {
+				hostKey := strings.TrimSpace(hk)
+				if strings.ContainsAny(hostKey, "\n\r") { // invalid
+					continue
+				}
+				fmt.Fprintf(&buf, "%s %s\n", host, hostKey)
+			}
+		}
+		if ps.DNSName != "" {
+			addEntries(strings.TrimSuffix(ps.DNSName, "."))
+		}
+		for _, ip := range ps.TailscaleIPs {
+			addEntries(ip.String())
+		}
+	}
+	return buf.Bytes()
+}
+
+// quoteSSHOpt quotes s for use in an ssh -o option value, if needed.
+func quoteSSHOpt(s string) string {
+	if !strings.ContainsAny(s, " \t\"'\\") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
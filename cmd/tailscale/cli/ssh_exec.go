@@ -0,0 +1,18 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package cli
+
+import (
+	"os"
+	"syscall"
+)
+
+// execSSH replaces the current process with ssh.
+func execSSH(ssh string, argv []string) error {
+	return syscall.Exec(ssh, argv, os.Environ())
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cli
+
+import (
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/types/key"
+)
+
+func TestPeerStatusFromArg(t *testing.T) {
+	foo := &ipnstate.PeerStatus{
+		HostName:     "foo-laptop",
+		DNSName:      "foo.example.ts.net.",
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1"), netaddr.MustParseIP("fd7a:115c:a1e0::1")},
+	}
+	bar := &ipnstate.PeerStatus{
+		HostName:     "bar",
+		DNSName:      "bar-1.example.ts.net.",
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.2")},
+	}
+	self := &ipnstate.PeerStatus{
+		HostName:     "self",
+		DNSName:      "self.example.ts.net.",
+		TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.3")},
+	}
+	st := &ipnstate.Status{
+		Self: self,
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): foo,
+			key.NewNode().Public(): bar,
+		},
+	}
+	tests := []struct {
+		arg  string
+		want *ipnstate.PeerStatus
+	}{
+		{"100.64.0.1", foo},
+		{"fd7a:115c:a1e0::1", foo},
+		{"100.64.0.3", self},
+		{"foo.example.ts.net", foo},
+		{"foo.example.ts.net.", foo},
+		{"FOO.example.ts.net", foo},
+		{"foo", foo},
+		{"foo-laptop", foo},
+		{"bar-1", bar},
+		{"bar", bar},
+		{"100.64.0.4", nil},
+		{"baz", nil},
+		{"foo.example", nil},
+	}
+	for _, tt := range tests {
+		got, ok := peerStatusFromArg(st, tt.arg)
+		if got != tt.want || ok != (tt.want != nil) {
+			t.Errorf("peerStatusFromArg(%q) = %v, %v; want %v", tt.arg, got, ok, tt.want)
+		}
+	}
+}
+
+func TestGenKnownHosts(t *testing.T) {
+	st := &ipnstate.Status{
+		Peer: map[key.NodePublic]*ipnstate.PeerStatus{
+			key.NewNode().Public(): {
+				DNSName:      "foo.example.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.1"), netaddr.MustParseIP("fd7a:115c:a1e0::1")},
+				SSH_HostKeys: []string{
+					"ssh-ed25519 AAAAfoo",
+					" ecdsa-sha2-nistp256 AAAAbar \n",
+					"ssh-rsa AAAA\nevil",
+				},
+			},
+			key.NewNode().Public(): {
+				DNSName:      "nossh.example.ts.net.",
+				TailscaleIPs: []netaddr.IP{netaddr.MustParseIP("100.64.0.2")},
+			},
+		},
+	}
+	const want = `foo.example.ts.net ssh-ed25519 AAAAfoo
+foo.example.ts.net ecdsa-sha2-nistp256 AAAAbar
+100.64.0.1 ssh-ed25519 AAAAfoo
+100.64.0.1 ecdsa-sha2-nistp256 AAAAbar
+fd7a:115c:a1e0::1 ssh-ed25519 AAAAfoo
+fd7a:115c:a1e0::1 ecdsa-sha2-nistp256 AAAAbar
+`
+	if got := string(genKnownHosts(st)); got != want {
+		t.Errorf("genKnownHosts = %q; want %q", got, want)
+	}
+}
@@ -134,6 +134,13 @@ func runStatus(ctx context.Context, args []string) error {
 		}
 		outln()
 	}
+	if len(st.LocalFilter) > 0 {
+		printf("# Local packet filter (see tailscale up --local-filter):\n")
+		for _, r := range st.LocalFilter {
+			printf("#     - %s\n", r)
+		}
+		outln()
+	}
 
 	var buf bytes.Buffer
 	f := func(format string, a ...any) { fmt.Fprintf(&buf, format, a...) }
@@ -169,7 +176,9 @@ func runStatus(ctx context.Context, args []string) error {
 			} else if ps.ExitNodeOption {
 				f("offers exit node; ")
 			}
-			if relay != "" && ps.CurAddr == "" {
+			if ps.PeerRelay != "" {
+				f("peer relay %s", ps.PeerRelay)
+			} else if relay != "" && ps.CurAddr == "" {
 				f("relay %q", relay)
 			} else if ps.CurAddr != "" {
 				f("direct %s", ps.CurAddr)
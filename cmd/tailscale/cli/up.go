@@ -98,12 +98,16 @@ func newUpFlagSet(goos string, upArgs *upArgsT) *flag.FlagSet {
 	upf.StringVar(&upArgs.exitNodeIP, "exit-node", "", "Tailscale exit node (IP or base name) for internet traffic, or empty string to not use an exit node")
 	upf.BoolVar(&upArgs.exitNodeAllowLANAccess, "exit-node-allow-lan-access", false, "Allow direct access to the local network when routing traffic via an exit node")
 	upf.BoolVar(&upArgs.shieldsUp, "shields-up", false, "don't allow incoming connections")
+	upf.StringVar(&upArgs.localFilter, "local-filter", "", "node-local packet filter rules, applied in order before the tailnet's (comma-separated ACTION:PROTO:PORTS:SRC, e.g. \"allow:tcp:22:100.101.102.103,deny:tcp:22:*\") or empty string for none")
 	if envknob.UseWIPCode() || inTest() {
 		upf.BoolVar(&upArgs.runSSH, "ssh", false, "run an SSH server, permitting access per tailnet admin's declared policy")
 	}
 	upf.StringVar(&upArgs.advertiseTags, "advertise-tags", "", "comma-separated ACL tags to request; each must start with \"tag:\" (e.g. \"tag:eng,tag:montreal,tag:ssh\")")
 	upf.StringVar(&upArgs.authKeyOrFile, "auth-key", "", `node authorization key; if it begins with "file:", then it's a path to a file containing the authkey`)
 	upf.StringVar(&upArgs.hostname, "hostname", "", "hostname to use instead of the one provided by the OS")
+	upf.IntVar(&upArgs.mtu, "mtu", 0, "MTU of the Tailscale interface, in bytes; peers sending larger packets are told to send smaller ones (0 for the default)")
+	upf.StringVar(&upArgs.advertiseEndpoints, "advertise-endpoints", "", "additional IP:port endpoints at which peers can reach this node, such as the public address of a static NAT mapping (comma-separated, e.g. \"203.0.113.5:41641\") or empty string for none")
+	upf.BoolVar(&upArgs.peerRelay, "peer-relay", false, "offer to relay UDP traffic between peers that can't reach each other directly")
 	upf.StringVar(&upArgs.advertiseRoutes, "advertise-routes", "", "routes to advertise to other nodes (comma-separated, e.g. \"10.0.0.0/8,192.168.0.0/24\") or empty string to not advertise routes")
 	upf.BoolVar(&upArgs.advertiseDefaultRoute, "advertise-exit-node", false, "offer to be an exit node for internet traffic for the tailnet")
 	if safesocket.GOOSUsesPeerCreds(goos) {
@@ -136,6 +140,7 @@ type upArgsT struct {
 	exitNodeIP             string
 	exitNodeAllowLANAccess bool
 	shieldsUp              bool
+	localFilter            string
 	runSSH                 bool
 	forceReauth            bool
 	forceDaemon            bool
@@ -146,6 +151,9 @@ type upArgsT struct {
 	netfilterMode          string
 	authKeyOrFile          string // "secret" or "file:/path/to/secret"
 	hostname               string
+	mtu                    int
+	advertiseEndpoints     string
+	peerRelay              bool
 	opUser                 string
 	json                   bool
 }
@@ -165,6 +173,13 @@ func (a upArgsT) getAuthKey() (string, error) {
 
 var upArgs upArgsT
 
+// minMTU and maxMTU are the range of values accepted by --mtu. The
+// Tailscale interface carries IPv6, which needs at least 1280 bytes.
+const (
+	minMTU = 1280
+	maxMTU = 65000
+)
+
 // Fields output when `tailscale up --json` is used. Two JSON blocks will be output.
 //
 // When "tailscale up" is run it first outputs a block with AuthURL and QR populated,
@@ -244,6 +259,43 @@ func calcAdvertiseRoutes(advertiseRoutes string, advertiseDefaultRoute bool) ([]
 	return routes, nil
 }
 
+// calcLocalFilter parses the comma-separated node-local packet filter
+// rules of the --local-filter flag.
+func calcLocalFilter(localFilter string) ([]preftype.LocalFilterRule, error) {
+	if localFilter == "" {
+		return nil, nil
+	}
+	var rules []preftype.LocalFilterRule
+	for _, s := range strings.Split(localFilter, ",") {
+		r, err := preftype.ParseLocalFilterRule(s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// calcAdvertiseEndpoints parses the comma-separated IP:port endpoints
+// of the --advertise-endpoints flag.
+func calcAdvertiseEndpoints(advertiseEndpoints string) ([]netaddr.IPPort, error) {
+	if advertiseEndpoints == "" {
+		return nil, nil
+	}
+	var eps []netaddr.IPPort
+	for _, s := range strings.Split(advertiseEndpoints, ",") {
+		ipp, err := netaddr.ParseIPPort(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a valid IP:port", s)
+		}
+		if ipp.IP().IsUnspecified() || ipp.Port() == 0 {
+			return nil, fmt.Errorf("%q is not a valid endpoint; it needs a specific IP and port", s)
+		}
+		eps = append(eps, ipp)
+	}
+	return eps, nil
+}
+
 // prefsFromUpArgs returns the ipn.Prefs for the provided args.
 //
 // Note that the parameters upArgs and warnf are named intentionally
@@ -256,6 +308,16 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 		return nil, err
 	}
 
+	localFilter, err := calcLocalFilter(upArgs.localFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints, err := calcAdvertiseEndpoints(upArgs.advertiseEndpoints)
+	if err != nil {
+		return nil, err
+	}
+
 	if upArgs.exitNodeIP == "" && upArgs.exitNodeAllowLANAccess {
 		return nil, fmt.Errorf("--exit-node-allow-lan-access can only be used with --exit-node")
 	}
@@ -275,6 +337,10 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 		return nil, fmt.Errorf("hostname too long: %d bytes (max 256)", len(upArgs.hostname))
 	}
 
+	if upArgs.mtu != 0 && (upArgs.mtu < minMTU || upArgs.mtu > maxMTU) {
+		return nil, fmt.Errorf("invalid value --mtu=%d; must be 0 or between %d and %d", upArgs.mtu, minMTU, maxMTU)
+	}
+
 	prefs := ipn.NewPrefs()
 	prefs.ControlURL = upArgs.server
 	prefs.WantRunning = true
@@ -294,10 +360,14 @@ func prefsFromUpArgs(upArgs upArgsT, warnf logger.Logf, st *ipnstate.Status, goo
 	prefs.CorpDNS = upArgs.acceptDNS
 	prefs.AllowSingleHosts = upArgs.singleRoutes
 	prefs.ShieldsUp = upArgs.shieldsUp
+	prefs.LocalFilter = localFilter
 	prefs.RunSSH = upArgs.runSSH
 	prefs.AdvertiseRoutes = routes
 	prefs.AdvertiseTags = tags
 	prefs.Hostname = upArgs.hostname
+	prefs.MTU = upArgs.mtu
+	prefs.AdvertiseEndpoints = endpoints
+	prefs.PeerRelay = upArgs.peerRelay
 	prefs.ForceDaemon = upArgs.forceDaemon
 	prefs.OperatorUser = upArgs.opUser
 
@@ -650,16 +720,20 @@ func init() {
 	// The rest are 1:1:
 	addPrefFlagMapping("accept-dns", "CorpDNS")
 	addPrefFlagMapping("accept-routes", "RouteAll")
+	addPrefFlagMapping("advertise-endpoints", "AdvertiseEndpoints")
 	addPrefFlagMapping("advertise-tags", "AdvertiseTags")
 	addPrefFlagMapping("host-routes", "AllowSingleHosts")
 	addPrefFlagMapping("hostname", "Hostname")
 	addPrefFlagMapping("login-server", "ControlURL")
+	addPrefFlagMapping("mtu", "MTU")
 	addPrefFlagMapping("netfilter-mode", "NetfilterMode")
 	addPrefFlagMapping("shields-up", "ShieldsUp")
+	addPrefFlagMapping("local-filter", "LocalFilter")
 	addPrefFlagMapping("snat-subnet-routes", "NoSNAT")
 	addPrefFlagMapping("exit-node-allow-lan-access", "ExitNodeAllowLANAccess")
 	addPrefFlagMapping("unattended", "ForceDaemon")
 	addPrefFlagMapping("operator", "OperatorUser")
+	addPrefFlagMapping("peer-relay", "PeerRelay")
 	addPrefFlagMapping("ssh", "RunSSH")
 }
 
@@ -863,6 +937,15 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]any) {
 			set(prefs.CorpDNS)
 		case "shields-up":
 			set(prefs.ShieldsUp)
+		case "local-filter":
+			var sb strings.Builder
+			for i, r := range prefs.LocalFilter {
+				if i > 0 {
+					sb.WriteByte(',')
+				}
+				sb.WriteString(r.String())
+			}
+			set(sb.String())
 		case "exit-node":
 			set(exitNodeIPStr())
 		case "exit-node-allow-lan-access":
@@ -871,6 +954,19 @@ func prefsToFlags(env upCheckEnv, prefs *ipn.Prefs) (flagVal map[string]any) {
 			set(strings.Join(prefs.AdvertiseTags, ","))
 		case "hostname":
 			set(prefs.Hostname)
+		case "mtu":
+			set(prefs.MTU)
+		case "advertise-endpoints":
+			var sb strings.Builder
+			for i, ep := range prefs.AdvertiseEndpoints {
+				if i > 0 {
+					sb.WriteByte(',')
+				}
+				sb.WriteString(ep.String())
+			}
+			set(sb.String())
+		case "peer-relay":
+			set(prefs.PeerRelay)
 		case "operator":
 			set(prefs.OperatorUser)
 		case "advertise-routes":
@@ -8,6 +8,7 @@
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto/ed25519"
 	crand "crypto/rand"
@@ -25,6 +26,7 @@
 	"math/rand"
 	"net"
 	"net/http"
+	"os"
 	"os/exec"
 	"runtime"
 	"strconv"
@@ -108,6 +110,11 @@ type Server struct {
 	metaCert    []byte // the encoded x509 cert to send after LetsEncrypt cert+intermediate
 	dupPolicy   dupPolicy
 
+	// Rate limits, set before serving begins:
+	clientRateLimit  RateLimit                    // default limit per client
+	clientRateLimits map[key.NodePublic]RateLimit // per-key overrides of clientRateLimit
+	globalLimiter    *rate.Limiter                // or nil for no global limit
+
 	// Counters:
 	packetsSent, bytesSent       expvar.Int
 	packetsRecv, bytesRecv       expvar.Int
@@ -136,6 +143,7 @@ type Server struct {
 	unknownFrames                expvar.Int
 	homeMovesIn                  expvar.Int // established clients announce home server moves in
 	homeMovesOut                 expvar.Int // established clients announce home server moves out
+	packetsRateLimitedGlobal     expvar.Int // rate-limited drops due to the global limit
 	multiForwarderCreated        expvar.Int
 	multiForwarderDeleted        expvar.Int
 	removePktForwardOther        expvar.Int
@@ -145,6 +153,18 @@ type Server struct {
 	// known peer in the network, as specified by a running tailscaled's client's local api.
 	verifyClients bool
 
+	// verifyAllowlist, if non-nil, only accepts clients whose keys
+	// it lists. It's reloaded until allowlistStop is closed.
+	verifyAllowlist *keyAllowlist
+	allowlistStop   chan struct{}
+
+	// verifyURL, if non-empty, is the URL of an admission webhook
+	// that clients must be accepted by. See AdmitClientRequest.
+	verifyURL  string
+	admitHTTP  *http.Client // for requests to verifyURL
+	admitMu    sync.Mutex
+	admitCache map[admitKey]admitDecision // recent webhook decisions
+
 	mu       sync.Mutex
 	closed   bool
 	netConns map[Conn]chan struct{} // chan is closed when conn closes
@@ -326,6 +346,8 @@ func NewServer(privateKey key.NodePrivate, logf logger.Logf) *Server {
 		s.packetsDroppedReason.Get("queue_head"),
 		s.packetsDroppedReason.Get("queue_tail"),
 		s.packetsDroppedReason.Get("write_error"),
+		s.packetsDroppedReason.Get("dup_client"),
+		s.packetsDroppedReason.Get("rate_limited"),
 	}
 	s.packetsDroppedTypeDisco = s.packetsDroppedType.Get("disco")
 	s.packetsDroppedTypeOther = s.packetsDroppedType.Get("other")
@@ -340,6 +362,78 @@ func (s *Server) SetMeshKey(v string) {
 	s.meshKey = v
 }
 
+// RateLimit is a token bucket limit on the bytes of packets sent
+// through a Server. The zero value means no limit.
+type RateLimit struct {
+	// BytesPerSecond is the rate at which the bucket refills.
+	// Zero means no limit.
+	BytesPerSecond float64 `json:",omitempty"`
+
+	// Burst is the size of the bucket, in bytes. It's at least
+	// MaxPacketSize, so that any packet can be sent.
+	Burst int `json:",omitempty"`
+}
+
+// newLimiter returns a limiter enforcing l, or nil if l is no limit.
+func (l RateLimit) newLimiter() *rate.Limiter {
+	if l.BytesPerSecond <= 0 {
+		return nil
+	}
+	burst := l.Burst
+	if burst < MaxPacketSize {
+		burst = MaxPacketSize
+	}
+	return rate.NewLimiter(rate.Limit(l.BytesPerSecond), burst)
+}
+
+// SetClientRateLimit sets the default limit on the packets each
+// client may send. Packets over the limit are dropped.
+//
+// It must be called before serving begins.
+func (s *Server) SetClientRateLimit(l RateLimit) {
+	s.clientRateLimit = l
+}
+
+// SetClientRateLimitForKey sets the limit on the packets the client
+// with key k may send, overriding the default limit. A zero l exempts
+// k from limits.
+//
+// It must be called before serving begins.
+func (s *Server) SetClientRateLimitForKey(k key.NodePublic, l RateLimit) {
+	if s.clientRateLimits == nil {
+		s.clientRateLimits = map[key.NodePublic]RateLimit{}
+	}
+	s.clientRateLimits[k] = l
+}
+
+// SetGlobalRateLimit sets the limit on the packets all clients may
+// send in total, including those forwarded from mesh peers. Packets
+// over the limit are dropped.
+//
+// It must be called before serving begins.
+func (s *Server) SetGlobalRateLimit(l RateLimit) {
+	s.globalLimiter = l.newLimiter()
+}
+
+// clientLimiter returns a new limiter for the client with key k, or
+// nil if it's not limited.
+func (s *Server) clientLimiter(k key.NodePublic) *rate.Limiter {
+	if l, ok := s.clientRateLimits[k]; ok {
+		return l.newLimiter()
+	}
+	return s.clientRateLimit.newLimiter()
+}
+
+// allowGlobal reports whether a packet of n bytes is within the global
+// rate limit.
+func (s *Server) allowGlobal(now time.Time, n int) bool {
+	if s.globalLimiter != nil && !s.globalLimiter.AllowN(now, n) {
+		s.packetsRateLimitedGlobal.Add(1)
+		return false
+	}
+	return true
+}
+
 // SetVerifyClients sets whether this DERP server verifies clients through tailscaled.
 //
 // It must be called before serving begins.
@@ -347,6 +441,89 @@ func (s *Server) SetVerifyClient(v bool) {
 	s.verifyClients = v
 }
 
+// SetVerifyClientAllowlist makes the server only accept clients whose
+// node public keys are listed in the file at path, one per line in
+// their "nodekey:" form. Blank lines and text after a '#' are ignored.
+// Mesh peers, which present the mesh key, needn't be listed.
+//
+// The file is checked for changes every allowlistReloadInterval.
+// Connected clients whose keys a change removes are disconnected. If
+// the file goes missing or can't be parsed, the last list read
+// successfully stays in effect.
+//
+// It returns an error if the file can't be read or parsed now.
+//
+// It must be called before serving begins.
+func (s *Server) SetVerifyClientAllowlist(path string) error {
+	a := &keyAllowlist{path: path, logf: s.logf}
+	if _, err := a.reload(); err != nil {
+		return err
+	}
+	s.verifyAllowlist = a
+	s.allowlistStop = make(chan struct{})
+	go s.reloadAllowlistLoop(s.allowlistStop)
+	return nil
+}
+
+// allowlistReloadInterval is how often the file of
+// SetVerifyClientAllowlist is checked for changes.
+const allowlistReloadInterval = 10 * time.Second
+
+func (s *Server) reloadAllowlistLoop(stop <-chan struct{}) {
+	t := time.NewTicker(allowlistReloadInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			s.reloadAllowlist()
+		}
+	}
+}
+
+// reloadAllowlist re-reads the client allowlist file if it's changed,
+// and disconnects the clients it no longer lists.
+func (s *Server) reloadAllowlist() {
+	if changed, _ := s.verifyAllowlist.reload(); !changed {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, set := range s.clients {
+		if s.verifyAllowlist.contains(k) {
+			continue
+		}
+		set.ForeachClient(func(c *sclient) {
+			if c.canMesh {
+				return
+			}
+			c.logf("no longer in client allowlist; closing")
+			go c.nc.Close()
+		})
+	}
+}
+
+// SetVerifyClientURL makes the server only accept clients that the
+// admission webhook at url admits. For each new client, the server
+// POSTs a JSON AdmitClientRequest to url, which must reply with a JSON
+// AdmitClientResponse. Clients are rejected if the request fails.
+// Redirects aren't followed, and decisions are cached for up to
+// admitAllowTTL. Mesh peers, which present the mesh key, aren't
+// checked.
+//
+// It must be called before serving begins.
+func (s *Server) SetVerifyClientURL(url string) {
+	s.verifyURL = url
+	s.admitHTTP = &http.Client{
+		Timeout: 5 * time.Second,
+		// Don't let the webhook send client keys elsewhere.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
 // HasMeshKey reports whether the server is configured with a mesh key.
 func (s *Server) HasMeshKey() bool { return s.meshKey != "" }
 
@@ -369,6 +546,10 @@ func (s *Server) Close() error {
 		return nil
 	}
 
+	if s.allowlistStop != nil {
+		close(s.allowlistStop)
+	}
+
 	var closedChs []chan struct{}
 
 	s.mu.Lock()
@@ -641,7 +822,8 @@ func (s *Server) accept(nc Conn, brw *bufio.ReadWriter, remoteAddr string, connN
 	if err != nil {
 		return fmt.Errorf("receive client key: %v", err)
 	}
-	if err := s.verifyClient(clientKey, clientInfo); err != nil {
+	remoteIPPort, _ := netaddr.ParseIPPort(remoteAddr)
+	if err := s.verifyClient(clientKey, clientInfo, remoteIPPort.IP()); err != nil {
 		return fmt.Errorf("client %x rejected: %v", clientKey, err)
 	}
 
@@ -651,8 +833,6 @@ func (s *Server) accept(nc Conn, brw *bufio.ReadWriter, remoteAddr string, connN
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	remoteIPPort, _ := netaddr.ParseIPPort(remoteAddr)
-
 	c := &sclient{
 		connNum:        connNum,
 		s:              s,
@@ -671,6 +851,9 @@ func (s *Server) accept(nc Conn, brw *bufio.ReadWriter, remoteAddr string, connN
 		peerGone:       make(chan key.NodePublic),
 		canMesh:        clientInfo.MeshKey != "" && clientInfo.MeshKey == s.meshKey,
 	}
+	if !c.canMesh {
+		c.sendLimiter = s.clientLimiter(clientKey)
+	}
 
 	if c.canMesh {
 		c.meshUpdate = make(chan struct{})
@@ -847,6 +1030,11 @@ func (c *sclient) handleFrameForwardPacket(ft frameType, fl uint32) error {
 	}
 	s.packetsForwardedIn.Add(1)
 
+	if !s.allowGlobal(timeNow(), len(contents)) {
+		s.recordDrop(contents, srcKey, dstKey, dropReasonRateLimited)
+		return nil
+	}
+
 	var dstLen int
 	var dst *sclient
 
@@ -897,6 +1085,11 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 		return fmt.Errorf("client %x: recvPacket: %v", c.key, err)
 	}
 
+	if !c.allowSend(len(contents)) {
+		s.recordDrop(contents, c.key, dstKey, dropReasonRateLimited)
+		return nil
+	}
+
 	var fwd PacketForwarder
 	var dstLen int
 	var dst *sclient
@@ -938,6 +1131,28 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	return c.sendPkt(dst, p)
 }
 
+// allowSend reports whether c may send a packet of n bytes, under its
+// own rate limit and the server's global one.
+func (c *sclient) allowSend(n int) bool {
+	now := timeNow()
+	if c.sendLimiter == nil {
+		return c.s.allowGlobal(now, n)
+	}
+	// Take the client's tokens first, but give them back if the
+	// packet is over the global limit, so that a client isn't
+	// charged for packets the server dropped.
+	r := c.sendLimiter.ReserveN(now, n)
+	if !r.OK() || r.DelayFrom(now) > 0 {
+		r.CancelAt(now)
+		return false
+	}
+	if !c.s.allowGlobal(now, n) {
+		r.CancelAt(now)
+		return false
+	}
+	return true
+}
+
 // dropReason is why we dropped a DERP frame.
 type dropReason int
 
@@ -951,6 +1166,7 @@ func (c *sclient) handleFrameSendPacket(ft frameType, fl uint32) error {
 	dropReasonQueueTail                          // destination queue is full, dropped packet at queue tail
 	dropReasonWriteError                         // OS write() failed
 	dropReasonDupClient                          // the public key is connected 2+ times (active/active, fighting)
+	dropReasonRateLimited                        // the sender or the server is over its rate limit
 )
 
 func (s *Server) recordDrop(packetBytes []byte, srcKey, dstKey key.NodePublic, reason dropReason) {
@@ -1033,7 +1249,18 @@ func (c *sclient) requestMeshUpdate() {
 	}
 }
 
-func (s *Server) verifyClient(clientKey key.NodePublic, info *clientInfo) error {
+// verifyClient returns an error if the client with key clientKey,
+// connecting from srcIP (zero if unknown), may not connect.
+func (s *Server) verifyClient(clientKey key.NodePublic, info *clientInfo, srcIP netaddr.IP) error {
+	isMesh := info != nil && info.MeshKey != "" && info.MeshKey == s.meshKey
+	if s.verifyAllowlist != nil && !isMesh && !s.verifyAllowlist.contains(clientKey) {
+		return fmt.Errorf("client %v not in allowlist", clientKey)
+	}
+	if s.verifyURL != "" && !isMesh {
+		if err := s.admitClient(clientKey, srcIP); err != nil {
+			return err
+		}
+	}
 	if !s.verifyClients {
 		return nil
 	}
@@ -1051,6 +1278,220 @@ func (s *Server) verifyClient(clientKey key.NodePublic, info *clientInfo) error
 	return nil
 }
 
+// AdmitClientRequest is the JSON body POSTed to the admission webhook
+// set by Server.SetVerifyClientURL.
+type AdmitClientRequest struct {
+	NodePublic key.NodePublic // the client's node public key
+	Source     netaddr.IP     // the client's IP address, if known
+}
+
+// AdmitClientResponse is the JSON response of the admission webhook
+// to an AdmitClientRequest.
+type AdmitClientResponse struct {
+	Allow bool // whether to accept the client
+}
+
+const (
+	// admitAllowTTL and admitDenyTTL are how long the admission
+	// webhook's decisions to accept and to reject a client are
+	// cached, so that reconnecting clients don't each cost a
+	// request.
+	admitAllowTTL = time.Minute
+	admitDenyTTL  = 10 * time.Second
+
+	// maxAdmitCache is the maximum number of cached admission
+	// webhook decisions.
+	maxAdmitCache = 10000
+)
+
+// admitKey is what the admission webhook decides on.
+type admitKey struct {
+	clientKey key.NodePublic
+	srcIP     netaddr.IP
+}
+
+// admitDecision is a cached decision of the admission webhook.
+type admitDecision struct {
+	allow   bool
+	expires time.Time
+}
+
+// admitClient returns an error if the admission webhook doesn't
+// accept the client with key clientKey, connecting from srcIP.
+func (s *Server) admitClient(clientKey key.NodePublic, srcIP netaddr.IP) error {
+	k := admitKey{clientKey, srcIP}
+	allow, ok := s.cachedAdmission(k)
+	if !ok {
+		var err error
+		allow, err = s.askAdmitWebhook(k)
+		if err != nil {
+			return err
+		}
+		s.cacheAdmission(k, allow)
+	}
+	if !allow {
+		return fmt.Errorf("client %v not admitted by webhook", clientKey)
+	}
+	return nil
+}
+
+// cachedAdmission returns the admission webhook's cached decision
+// for k, if there's one that hasn't expired.
+func (s *Server) cachedAdmission(k admitKey) (allow, ok bool) {
+	s.admitMu.Lock()
+	defer s.admitMu.Unlock()
+	d, ok := s.admitCache[k]
+	if !ok {
+		return false, false
+	}
+	if !timeNow().Before(d.expires) {
+		delete(s.admitCache, k)
+		return false, false
+	}
+	return d.allow, true
+}
+
+// cacheAdmission caches the admission webhook's decision for k.
+func (s *Server) cacheAdmission(k admitKey, allow bool) {
+	now := timeNow()
+	ttl := admitDenyTTL
+	if allow {
+		ttl = admitAllowTTL
+	}
+	s.admitMu.Lock()
+	defer s.admitMu.Unlock()
+	if s.admitCache == nil {
+		s.admitCache = map[admitKey]admitDecision{}
+	}
+	if len(s.admitCache) >= maxAdmitCache {
+		for ck, d := range s.admitCache {
+			if !now.Before(d.expires) {
+				delete(s.admitCache, ck)
+			}
+		}
+		if len(s.admitCache) >= maxAdmitCache {
+			// Still full; ask the webhook again next time.
+			return
+		}
+	}
+	s.admitCache[k] = admitDecision{allow: allow, expires: now.Add(ttl)}
+}
+
+// askAdmitWebhook asks the admission webhook whether to accept the
+// client described by k.
+func (s *Server) askAdmitWebhook(k admitKey) (allow bool, err error) {
+	body, err := json.Marshal(AdmitClientRequest{NodePublic: k.clientKey, Source: k.srcIP})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest("POST", s.verifyURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := s.admitHTTP.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("admission webhook: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("admission webhook: %v", res.Status)
+	}
+	var ar AdmitClientResponse
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&ar); err != nil {
+		return false, fmt.Errorf("admission webhook: %w", err)
+	}
+	return ar.Allow, nil
+}
+
+// keyAllowlist is a set of node public keys read from a file.
+type keyAllowlist struct {
+	path string
+	logf logger.Logf
+
+	mu      sync.Mutex
+	modTime time.Time // of the file when keys was read
+	size    int64     // of the file when keys was read
+	keys    map[key.NodePublic]bool
+}
+
+// contains reports whether k is in the allowlist.
+func (a *keyAllowlist) contains(k key.NodePublic) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.keys[k]
+}
+
+// reload re-reads the file if it's changed since it was last read,
+// reporting whether it did. If the file can't be read or
+// parsed, the previous keys are kept; it's only an error if there are
+// none yet.
+func (a *keyAllowlist) reload() (changed bool, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	keys, err := a.readLocked()
+	if err != nil {
+		if a.keys == nil {
+			return false, err
+		}
+		a.logf("derp: keeping previous client allowlist: %v", err)
+		return false, nil
+	}
+	if keys == nil {
+		return false, nil
+	}
+	a.keys = keys
+	a.logf("derp: loaded %d keys from client allowlist %s", len(keys), a.path)
+	return true, nil
+}
+
+// readLocked returns the keys in the file, or nil if it hasn't changed
+// since it was last read.
+//
+// a.mu must be held.
+func (a *keyAllowlist) readLocked() (map[key.NodePublic]bool, error) {
+	fi, err := os.Stat(a.path)
+	if err != nil {
+		return nil, err
+	}
+	if a.keys != nil && fi.ModTime().Equal(a.modTime) && fi.Size() == a.size {
+		return nil, nil
+	}
+	keys, err := readKeyAllowlist(a.path)
+	// Record the file's state even if it's malformed, so that it's
+	// not parsed and the error logged again until it changes.
+	a.modTime, a.size = fi.ModTime(), fi.Size()
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// readKeyAllowlist reads the node public keys in the allowlist file at
+// path.
+func readKeyAllowlist(path string) (map[key.NodePublic]bool, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[key.NodePublic]bool{}
+	for i, line := range strings.Split(string(b), "\n") {
+		if j := strings.IndexByte(line, '#'); j >= 0 {
+			line = line[:j]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var k key.NodePublic
+		if err := k.UnmarshalText([]byte(line)); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, i+1, err)
+		}
+		keys[k] = true
+	}
+	return keys, nil
+}
+
 func (s *Server) sendServerKey(lw *lazyBufioWriter) error {
 	buf := make([]byte, 0, len(magic)+key.NodePublicRawLen)
 	buf = append(buf, magic...)
@@ -1249,6 +1690,10 @@ type sclient struct {
 	// taking over ownership of a key.
 	replaceLimiter *rate.Limiter
 
+	// sendLimiter, if non-nil, limits the packets the client may
+	// send. Mesh peers aren't limited.
+	sendLimiter *rate.Limiter
+
 	// Owned by run, not thread-safe.
 	br          *bufio.Reader
 	connectedAt time.Time
@@ -1686,6 +2131,7 @@ func (s *Server) ExpVar() expvar.Var {
 	m.Set("multiforwarder_created", &s.multiForwarderCreated)
 	m.Set("multiforwarder_deleted", &s.multiForwarderDeleted)
 	m.Set("packet_forwarder_delete_other_value", &s.removePktForwardOther)
+	m.Set("counter_packets_rate_limited_global", &s.packetsRateLimitedGlobal)
 	m.Set("average_queue_duration_ms", expvar.Func(func() any {
 		return math.Float64frombits(atomic.LoadUint64(s.avgQueueDuration))
 	}))
@@ -18,13 +18,20 @@
 	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"go4.org/mem"
 	"golang.org/x/time/rate"
+	"inet.af/netaddr"
 	"tailscale.com/net/nettest"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
@@ -1165,6 +1172,262 @@ func TestLimiter(t *testing.T) {
 	}
 }
 
+func TestRateLimit(t *testing.T) {
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	if got, want := len(s.packetsDroppedReasonCounters), int(dropReasonRateLimited)+1; got != want {
+		t.Fatalf("have %d drop reason counters; want %d", got, want)
+	}
+
+	s.SetClientRateLimit(RateLimit{BytesPerSecond: 1})
+	exempt := key.NewNode().Public()
+	s.SetClientRateLimitForKey(exempt, RateLimit{})
+
+	limited := &sclient{s: s, sendLimiter: s.clientLimiter(key.NewNode().Public())}
+	if !limited.allowSend(MaxPacketSize) {
+		t.Fatal("first packet rate limited")
+	}
+	if limited.allowSend(100) {
+		t.Error("second packet allowed; want rate limited")
+	}
+	free := &sclient{s: s, sendLimiter: s.clientLimiter(exempt)}
+	for i := 0; i < 10; i++ {
+		if !free.allowSend(MaxPacketSize) {
+			t.Fatalf("exempt client rate limited after %d packets", i)
+		}
+	}
+
+	s.SetGlobalRateLimit(RateLimit{BytesPerSecond: 1, Burst: 2 * MaxPacketSize})
+	for i := 0; i < 2; i++ {
+		if !free.allowSend(MaxPacketSize) {
+			t.Fatalf("packet %d over global limit", i)
+		}
+	}
+	if free.allowSend(100) {
+		t.Error("packet allowed; want over global limit")
+	}
+	if got := s.packetsRateLimitedGlobal.Value(); got != 1 {
+		t.Errorf("packetsRateLimitedGlobal = %d; want 1", got)
+	}
+
+	// Packets over the global limit don't use up the client's own.
+	s.SetGlobalRateLimit(RateLimit{BytesPerSecond: 1})
+	if !free.allowSend(MaxPacketSize) {
+		t.Fatal("packet over fresh global limit")
+	}
+	limited = &sclient{s: s, sendLimiter: s.clientLimiter(key.NewNode().Public())}
+	for i := 0; i < 3; i++ {
+		if limited.allowSend(MaxPacketSize) {
+			t.Fatalf("packet %d allowed; want over global limit", i)
+		}
+	}
+	s.SetGlobalRateLimit(RateLimit{})
+	if !limited.allowSend(MaxPacketSize) {
+		t.Error("client rate limited by packets dropped over the global limit")
+	}
+}
+
+func TestVerifyClientAllowlist(t *testing.T) {
+	allowed, other := key.NewNode().Public(), key.NewNode().Public()
+	path := filepath.Join(t.TempDir(), "allowlist")
+	var writes int
+	writeList := func(contents string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		// Make sure the change is noticed, even on file systems
+		// with coarse modification times.
+		writes++
+		mtime := time.Now().Add(time.Duration(writes) * time.Minute)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	allowedText, _ := allowed.MarshalText()
+	writeList("# test\n\n" + string(allowedText) + " # laptop\n")
+
+	var kept int32 // times the previous list was kept
+	s := NewServer(key.NewNode(), func(format string, args ...interface{}) {
+		if strings.HasPrefix(format, "derp: keeping previous") {
+			atomic.AddInt32(&kept, 1)
+		}
+		t.Logf(format, args...)
+	})
+	defer s.Close()
+	s.SetMeshKey("mesh-key")
+	if err := s.SetVerifyClientAllowlist(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.verifyClient(allowed, &clientInfo{}, netaddr.IP{}); err != nil {
+		t.Errorf("allowed client rejected: %v", err)
+	}
+	if err := s.verifyClient(other, &clientInfo{}, netaddr.IP{}); err == nil {
+		t.Error("unlisted client accepted")
+	}
+	if err := s.verifyClient(other, &clientInfo{MeshKey: "mesh-key"}, netaddr.IP{}); err != nil {
+		t.Errorf("mesh peer rejected: %v", err)
+	}
+
+	otherText, _ := other.MarshalText()
+	writeList(string(otherText) + "\n")
+	s.reloadAllowlist()
+	if err := s.verifyClient(other, &clientInfo{}, netaddr.IP{}); err != nil {
+		t.Errorf("newly listed client rejected: %v", err)
+	}
+	if err := s.verifyClient(allowed, &clientInfo{}, netaddr.IP{}); err == nil {
+		t.Error("delisted client accepted")
+	}
+
+	// An invalid or missing file keeps the previous list. An
+	// invalid one is only parsed once.
+	writeList("not a key\n")
+	s.reloadAllowlist()
+	s.reloadAllowlist()
+	if err := s.verifyClient(other, &clientInfo{}, netaddr.IP{}); err != nil {
+		t.Errorf("after invalid update, client rejected: %v", err)
+	}
+	if got := atomic.LoadInt32(&kept); got != 1 {
+		t.Errorf("invalid file parsed %d times; want 1", got)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	s.reloadAllowlist()
+	if err := s.verifyClient(other, &clientInfo{}, netaddr.IP{}); err != nil {
+		t.Errorf("after removal, client rejected: %v", err)
+	}
+}
+
+func TestVerifyClientAllowlistDisconnects(t *testing.T) {
+	kept, dropped, mesh := key.NewNode().Public(), key.NewNode().Public(), key.NewNode().Public()
+	path := filepath.Join(t.TempDir(), "allowlist")
+	writeList := func(mtime time.Time, keys ...key.NodePublic) {
+		t.Helper()
+		var b bytes.Buffer
+		for _, k := range keys {
+			text, _ := k.MarshalText()
+			b.Write(text)
+			b.WriteByte('\n')
+		}
+		if err := os.WriteFile(path, b.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	writeList(now, kept, dropped)
+
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	if err := s.SetVerifyClientAllowlist(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// addClient registers a connected client with key k, returning
+	// the other end of its connection.
+	addClient := func(k key.NodePublic, canMesh bool) net.Conn {
+		c1, c2 := net.Pipe()
+		t.Cleanup(func() { c1.Close(); c2.Close() })
+		s.mu.Lock()
+		s.clients[k] = singleClient{&sclient{key: k, nc: c1, canMesh: canMesh, logf: t.Logf}}
+		s.mu.Unlock()
+		return c2
+	}
+	keptConn := addClient(kept, false)
+	droppedConn := addClient(dropped, false)
+	meshConn := addClient(mesh, true)
+
+	writeList(now.Add(time.Minute), kept)
+	s.reloadAllowlist()
+
+	// isClosed reports whether the server closed c's other end.
+	isClosed := func(c net.Conn) bool {
+		c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err := c.Read(make([]byte, 1))
+		return err == io.EOF
+	}
+	if !isClosed(droppedConn) {
+		t.Error("delisted client not disconnected")
+	}
+	if isClosed(keptConn) {
+		t.Error("listed client disconnected")
+	}
+	if isClosed(meshConn) {
+		t.Error("mesh peer disconnected")
+	}
+}
+
+func TestVerifyClientURL(t *testing.T) {
+	allowed := key.NewNode().Public()
+	srcIP := netaddr.MustParseIP("1.2.3.4")
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		var req AdmitClientRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Source != srcIP {
+			http.Error(w, "wrong source", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(AdmitClientResponse{Allow: req.NodePublic == allowed})
+	}))
+	defer ts.Close()
+
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	s := NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.SetVerifyClientURL(ts.URL)
+	denied := key.NewNode().Public()
+	for i := 0; i < 2; i++ {
+		if err := s.verifyClient(allowed, &clientInfo{}, srcIP); err != nil {
+			t.Errorf("admitted client rejected: %v", err)
+		}
+		if err := s.verifyClient(denied, &clientInfo{}, srcIP); err == nil {
+			t.Error("unadmitted client accepted")
+		}
+	}
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Errorf("webhook got %d requests; want 2, with the decisions cached", got)
+	}
+
+	// Cached decisions outlive the webhook until they expire.
+	ts.Close()
+	now = now.Add(admitDenyTTL)
+	if err := s.verifyClient(allowed, &clientInfo{}, srcIP); err != nil {
+		t.Errorf("cached admitted client rejected: %v", err)
+	}
+	if err := s.verifyClient(denied, &clientInfo{}, srcIP); err == nil {
+		t.Error("unadmitted client accepted with webhook down")
+	}
+	now = now.Add(admitAllowTTL)
+	if err := s.verifyClient(allowed, &clientInfo{}, srcIP); err == nil {
+		t.Error("client accepted with webhook down")
+	}
+
+	// Redirects aren't followed.
+	allowAll := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(AdmitClientResponse{Allow: true})
+	}))
+	defer allowAll.Close()
+	redirect := httptest.NewServer(http.RedirectHandler(allowAll.URL, http.StatusTemporaryRedirect))
+	defer redirect.Close()
+	s = NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+	s.SetVerifyClientURL(redirect.URL)
+	if err := s.verifyClient(allowed, &clientInfo{}, srcIP); err == nil {
+		t.Error("client accepted through a redirect")
+	}
+}
+
 func BenchmarkSendRecv(b *testing.B) {
 	for _, size := range []int{10, 100, 1000, 10000} {
 		b.Run(fmt.Sprintf("msgsize=%d", size), func(b *testing.B) { benchmarkSendRecvSize(b, size) })
@@ -81,6 +81,16 @@ type Client struct {
 	serverPubKey key.NodePublic
 	tlsState     *tls.ConnectionState
 	pingOut      map[derp.PingMessage]chan<- bool // chan to send to on pong
+
+	// websocketFallback is whether the current (or last)
+	// connection is over WebSockets because the DERP HTTP upgrade
+	// failed, as it does behind proxies that don't pass it through.
+	// Each new connection tries the upgrade again.
+	websocketFallback bool
+
+	// wsHTTPClient is the HTTP client WebSockets are dialed with;
+	// see websocketHTTPClientLocked.
+	wsHTTPClient *http.Client
 }
 
 // NewRegionClient returns a new DERP-over-HTTP client. It connects lazily.
@@ -227,7 +237,8 @@ func (c *Client) preferIPv6() bool {
 }
 
 // dialWebsocketFunc is non-nil (set by websocket.go's init) when compiled in.
-var dialWebsocketFunc func(ctx context.Context, urlStr string) (net.Conn, error)
+// It dials urlStr using hc, which is nil in js builds.
+var dialWebsocketFunc func(ctx context.Context, urlStr string, hc *http.Client) (net.Conn, error)
 
 func useWebsockets() bool {
 	if runtime.GOOS == "js" {
@@ -290,41 +301,12 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 		}
 	}()
 
+	c.websocketFallback = false
+
 	var node *tailcfg.DERPNode // nil when using c.url to dial
 	switch {
 	case useWebsockets():
-		var urlStr string
-		if c.url != nil {
-			urlStr = c.url.String()
-		} else {
-			urlStr = c.urlString(reg.Nodes[0])
-		}
-		c.logf("%s: connecting websocket to %v", caller, urlStr)
-		conn, err := dialWebsocketFunc(ctx, urlStr)
-		if err != nil {
-			c.logf("%s: websocket to %v error: %v", caller, urlStr, err)
-			return nil, 0, err
-		}
-		brw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
-		derpClient, err := derp.NewClient(c.privateKey, conn, brw, c.logf,
-			derp.MeshKey(c.MeshKey),
-			derp.CanAckPings(c.canAckPings),
-			derp.IsProber(c.IsProber),
-		)
-		if err != nil {
-			return nil, 0, err
-		}
-		if c.preferred {
-			if err := derpClient.NotePreferred(true); err != nil {
-				go conn.Close()
-				return nil, 0, err
-			}
-		}
-		c.serverPubKey = derpClient.ServerPublicKey()
-		c.client = derpClient
-		c.netConn = tcpConn
-		c.connGen++
-		return c.client, c.connGen, nil
+		return c.connectWebsocketLocked(ctx, caller, reg)
 	case c.url != nil:
 		c.logf("%s: connecting to %v", caller, c.url)
 		tcpConn, err = c.dialURL(ctx)
@@ -429,12 +411,12 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 
 		resp, err := http.ReadResponse(brw.Reader, req)
 		if err != nil {
-			return nil, 0, err
+			return c.upgradeFailedLocked(ctx, caller, reg, tcpConn, err)
 		}
 		if resp.StatusCode != http.StatusSwitchingProtocols {
 			b, _ := ioutil.ReadAll(resp.Body)
 			resp.Body.Close()
-			return nil, 0, fmt.Errorf("GET failed: %v: %s", err, b)
+			return c.upgradeFailedLocked(ctx, caller, reg, tcpConn, fmt.Errorf("GET failed: %v: %s", resp.Status, b))
 		}
 	}
 	derpClient, err = derp.NewClient(c.privateKey, httpConn, brw, c.logf,
@@ -461,6 +443,144 @@ func (c *Client) connect(ctx context.Context, caller string) (client *derp.Clien
 	return c.client, c.connGen, nil
 }
 
+// upgradeFailedLocked handles err, a failure of the DERP HTTP upgrade
+// over tcpConn in connect: a response other than 101 Switching
+// Protocols, or one that couldn't be read. If WebSockets are compiled
+// in, it closes tcpConn and falls back to connecting with them, for
+// this connection only. Otherwise, or if ctx is done, it returns err.
+//
+// c.mu must be held.
+func (c *Client) upgradeFailedLocked(ctx context.Context, caller string, reg *tailcfg.DERPRegion, tcpConn net.Conn, err error) (*derp.Client, int, error) {
+	if dialWebsocketFunc == nil || ctx.Err() != nil {
+		return nil, 0, err
+	}
+	go tcpConn.Close()
+	c.logf("%s: DERP upgrade to %v failed (%v); falling back to WebSockets", caller, c.targetString(reg), err)
+	client, connGen, err := c.connectWebsocketLocked(ctx, caller, reg)
+	if err == nil {
+		c.websocketFallback = true
+	}
+	return client, connGen, err
+}
+
+// connectWebsocketLocked is the part of connect that connects with
+// WebSockets.
+//
+// c.mu must be held.
+func (c *Client) connectWebsocketLocked(ctx context.Context, caller string, reg *tailcfg.DERPRegion) (*derp.Client, int, error) {
+	c.logf("%s: connecting websocket to %v", caller, c.targetString(reg))
+	conn, err := c.dialWebsocket(ctx, reg)
+	if err != nil {
+		c.logf("%s: websocket to %v error: %v", caller, c.targetString(reg), err)
+		return nil, 0, err
+	}
+	brw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	derpClient, err := derp.NewClient(c.privateKey, conn, brw, c.logf,
+		derp.MeshKey(c.MeshKey),
+		derp.CanAckPings(c.canAckPings),
+		derp.IsProber(c.IsProber),
+	)
+	if err != nil {
+		go conn.Close()
+		return nil, 0, err
+	}
+	if c.preferred {
+		if err := derpClient.NotePreferred(true); err != nil {
+			go conn.Close()
+			return nil, 0, err
+		}
+	}
+	c.serverPubKey = derpClient.ServerPublicKey()
+	c.client = derpClient
+	c.netConn = conn
+	c.tlsState = nil
+	c.connGen++
+	return c.client, c.connGen, nil
+}
+
+// dialWebsocket returns a WebSocket connection to c.url or, trying each
+// node in order, to reg.
+//
+// c.mu must be held.
+func (c *Client) dialWebsocket(ctx context.Context, reg *tailcfg.DERPRegion) (net.Conn, error) {
+	hc := c.websocketHTTPClientLocked()
+	if c.url != nil {
+		return dialWebsocketFunc(ctx, c.url.String(), hc)
+	}
+	var firstErr error
+	for _, n := range reg.Nodes {
+		if n.STUNOnly {
+			continue
+		}
+		nctx := context.WithValue(ctx, websocketNodeKey{}, n)
+		conn, err := dialWebsocketFunc(nctx, c.urlString(n), hc)
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr == nil {
+		firstErr = fmt.Errorf("no non-STUNOnly nodes for %s", c.targetString(reg))
+	}
+	return nil, firstErr
+}
+
+// websocketNodeKey is the context key of the *tailcfg.DERPNode that a
+// WebSocket is being dialed to with c.wsHTTPClient.
+type websocketNodeKey struct{}
+
+// websocketHTTPClientLocked returns the HTTP client with which to dial
+// WebSockets, creating it on first use. Its connections are made the
+// same way as for the DERP upgrade, including through an HTTP CONNECT
+// proxy if one is configured, to the node in the request context's
+// websocketNodeKey or, if there's none, to c.url.
+//
+// c.mu must be held.
+func (c *Client) websocketHTTPClientLocked() *http.Client {
+	if c.wsHTTPClient != nil {
+		return c.wsHTTPClient
+	}
+	dial := func(ctx context.Context) (net.Conn, *tailcfg.DERPNode, error) {
+		node, _ := ctx.Value(websocketNodeKey{}).(*tailcfg.DERPNode)
+		if node == nil {
+			nc, err := c.dialURL(ctx)
+			return nc, nil, err
+		}
+		nc, err := c.dialNode(ctx, node)
+		return nc, node, err
+	}
+	c.wsHTTPClient = &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			nc, _, err := dial(ctx)
+			return nc, err
+		},
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			nc, node, err := dial(ctx)
+			if err != nil {
+				return nil, err
+			}
+			tlsConn := c.tlsClient(nc, node)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				go nc.Close()
+				return nil, err
+			}
+			return tlsConn, nil
+		},
+	}}
+	return c.wsHTTPClient
+}
+
+// UsingWebsocketFallback reports whether c's current (or last)
+// connection is over WebSockets because the DERP HTTP upgrade failed.
+// That works, but at some cost in overhead.
+func (c *Client) UsingWebsocketFallback() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.websocketFallback
+}
+
 // SetURLDialer sets the dialer to use for dialing URLs.
 // This dialer is only use for clients created with NewClient, not NewRegionClient.
 // If unset or nil, the default dialer is used.
@@ -525,6 +645,12 @@ func (c *Client) dialRegion(ctx context.Context, reg *tailcfg.DERPRegion) (net.C
 }
 
 func (c *Client) tlsClient(nc net.Conn, node *tailcfg.DERPNode) *tls.Conn {
+	return tls.Client(nc, c.tlsConfig(node))
+}
+
+// tlsConfig returns the TLS config for connecting to node, or to c.url
+// if node is nil.
+func (c *Client) tlsConfig(node *tailcfg.DERPNode) *tls.Config {
 	tlsConf := tlsdial.Config(c.tlsServerName(node), c.TLSConfig)
 	if node != nil {
 		if node.InsecureForTests {
@@ -535,7 +661,7 @@ func (c *Client) tlsClient(nc net.Conn, node *tailcfg.DERPNode) *tls.Conn {
 			tlsdial.SetConfigExpectedCert(tlsConf, node.CertName)
 		}
 	}
-	return tls.Client(nc, tlsConf)
+	return tlsConf
 }
 
 func (c *Client) DialRegionTLS(ctx context.Context, reg *tailcfg.DERPRegion) (tlsConn *tls.Conn, connClose io.Closer, err error) {
@@ -992,6 +1118,9 @@ func (c *Client) Close() error {
 	if c.netConn != nil {
 		c.netConn.Close()
 	}
+	if c.wsHTTPClient != nil {
+		c.wsHTTPClient.CloseIdleConnections()
+	}
 	return nil
 }
 
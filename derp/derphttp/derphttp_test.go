@@ -5,15 +5,21 @@
 package derphttp
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
+	"fmt"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"nhooyr.io/websocket"
 	"tailscale.com/derp"
+	"tailscale.com/derp/wsconn"
+	"tailscale.com/syncs"
 	"tailscale.com/types/key"
 )
 
@@ -206,3 +212,139 @@ func TestPing(t *testing.T) {
 		t.Fatalf("Ping: %v", err)
 	}
 }
+
+func TestWebsocketFallback(t *testing.T) {
+	if dialWebsocketFunc == nil {
+		t.Skip("WebSockets not compiled in")
+	}
+	s := derp.NewServer(key.NewNode(), t.Logf)
+	defer s.Close()
+
+	// Act like a proxy that breaks the DERP upgrade (until told not
+	// to) but passes WebSockets through.
+	var blockUpgrade syncs.AtomicBool
+	blockUpgrade.Set(true)
+	var websockets syncs.AtomicUint32
+	httpsrv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+				if blockUpgrade.Get() {
+					http.Error(w, "upgrade blocked", http.StatusForbidden)
+					return
+				}
+				Handler(s).ServeHTTP(w, r)
+				return
+			}
+			websockets.Set(websockets.Get() + 1)
+			c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+				Subprotocols: []string{"derp"},
+			})
+			if err != nil {
+				return
+			}
+			defer c.Close(websocket.StatusInternalError, "closing")
+			wc := wsconn.New(c)
+			brw := bufio.NewReadWriter(bufio.NewReader(wc), bufio.NewWriter(wc))
+			s.Accept(wc, brw, r.RemoteAddr)
+		}),
+	}
+
+	ln, err := net.Listen("tcp4", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverURL := "http://" + ln.Addr().String()
+	go httpsrv.Serve(ln)
+	defer httpsrv.Close()
+
+	c, err := NewClient(key.NewNode(), serverURL, t.Logf)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("client Connect: %v", err)
+	}
+	if !c.UsingWebsocketFallback() {
+		t.Error("UsingWebsocketFallback = false; want true")
+	}
+	waitConnect(t, c)
+
+	recvc := make(chan error, 1)
+	go func() {
+		for {
+			if _, err := c.Recv(); err != nil {
+				recvc <- err
+				return
+			}
+		}
+	}()
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+
+	// Once the upgrade works again, the next connection uses it.
+	blockUpgrade.Set(false)
+	c.mu.Lock()
+	dc := c.client
+	c.mu.Unlock()
+	c.closeForReconnect(dc)
+	<-recvc
+	if err := c.Connect(context.Background()); err != nil {
+		t.Fatalf("client reconnect: %v", err)
+	}
+	if c.UsingWebsocketFallback() {
+		t.Error("after reconnect, UsingWebsocketFallback = true; want false")
+	}
+	if got := websockets.Get(); got != 1 {
+		t.Errorf("server got %d WebSockets; want 1", got)
+	}
+}
+
+func TestNoWebsocketFallbackAfterUpgrade(t *testing.T) {
+	if dialWebsocketFunc == nil {
+		t.Skip("WebSockets not compiled in")
+	}
+	// Act like a server that accepts the DERP upgrade but then
+	// fails the DERP handshake. That's not a proxy's doing, so
+	// shouldn't fall back to WebSockets.
+	var websockets syncs.AtomicUint32
+	httpsrv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+				websockets.Set(websockets.Get() + 1)
+				http.Error(w, "no", http.StatusForbidden)
+				return
+			}
+			conn, brw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: DERP\r\nConnection: Upgrade\r\n\r\n")
+			brw.Flush()
+		}),
+	}
+
+	ln, err := net.Listen("tcp4", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go httpsrv.Serve(ln)
+	defer httpsrv.Close()
+
+	c, err := NewClient(key.NewNode(), "http://"+ln.Addr().String(), t.Logf)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+	if err := c.Connect(context.Background()); err == nil {
+		t.Fatal("Connect succeeded; want error")
+	}
+	if c.UsingWebsocketFallback() {
+		t.Error("UsingWebsocketFallback = true; want false")
+	}
+	if got := websockets.Get(); got != 0 {
+		t.Errorf("server got %d WebSocket requests; want 0", got)
+	}
+}
@@ -2,15 +2,15 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
-//go:build linux || js
-// +build linux js
+//go:build !js && !ios
+// +build !js,!ios
 
 package derphttp
 
 import (
 	"context"
-	"log"
 	"net"
+	"net/http"
 
 	"nhooyr.io/websocket"
 	"tailscale.com/derp/wsconn"
@@ -20,14 +20,13 @@ func init() {
 	dialWebsocketFunc = dialWebsocket
 }
 
-func dialWebsocket(ctx context.Context, urlStr string) (net.Conn, error) {
-	c, res, err := websocket.Dial(ctx, urlStr, &websocket.DialOptions{
+func dialWebsocket(ctx context.Context, urlStr string, hc *http.Client) (net.Conn, error) {
+	c, _, err := websocket.Dial(ctx, urlStr, &websocket.DialOptions{
+		HTTPClient:   hc,
 		Subprotocols: []string{"derp"},
 	})
 	if err != nil {
-		log.Printf("websocket Dial: %v, %+v", err, res)
 		return nil, err
 	}
-	log.Printf("websocket: connected to %v", urlStr)
 	return wsconn.New(c), nil
 }
@@ -117,14 +117,24 @@ type Ping struct {
 	// netmap data to reduce the discokey:nodekey relation from 1:N to
 	// 1:1.
 	NodeKey key.NodePublic
+
+	// Padding is the number of zero bytes appended to the message,
+	// to make it as big as a full-size WireGuard packet for path MTU
+	// probing. Receivers ignore it, as they do all trailing bytes.
+	// A message with padding always has room for the NodeKey, even
+	// if it's zero.
+	Padding int
 }
 
 func (m *Ping) AppendMarshal(b []byte) []byte {
 	dataLen := 12
-	hasKey := !m.NodeKey.IsZero()
+	hasKey := !m.NodeKey.IsZero() || m.Padding > 0
 	if hasKey {
 		dataLen += key.NodePublicRawLen
 	}
+	if m.Padding > 0 {
+		dataLen += m.Padding
+	}
 	ret, d := appendMsgHeader(b, TypePing, v0, dataLen)
 	n := copy(d, m.TxID[:])
 	if hasKey {
@@ -143,6 +153,7 @@ func parsePing(ver uint8, p []byte) (m *Ping, err error) {
 	// compatibility.
 	if len(p) >= key.NodePublicRawLen {
 		m.NodeKey = key.NodePublicFromRaw32(mem.B(p[:key.NodePublicRawLen]))
+		m.Padding = len(p) - key.NodePublicRawLen
 	}
 	return m, nil
 }
@@ -244,6 +255,9 @@ func parsePong(ver uint8, p []byte) (m *Pong, err error) {
 func MessageSummary(m Message) string {
 	switch m := m.(type) {
 	case *Ping:
+		if m.Padding > 0 {
+			return fmt.Sprintf("ping tx=%x padding=%d", m.TxID[:6], m.Padding)
+		}
 		return fmt.Sprintf("ping tx=%x", m.TxID[:6])
 	case *Pong:
 		return fmt.Sprintf("pong tx=%x", m.TxID[:6])
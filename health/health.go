@@ -39,6 +39,7 @@
 	derpRegionConnected     = map[int]bool{}
 	derpRegionHealthProblem = map[int]string{}
 	derpRegionLastFrame     = map[int]time.Time{}
+	derpRegionWebsocket     = map[int]bool{}
 	lastMapRequestHeard     time.Time // time we got a 200 from control for a MapRequest
 	ipnState                string
 	ipnWantRunning          bool
@@ -255,6 +256,20 @@ func SetDERPRegionHealth(region int, problem string) {
 	selfCheckLocked()
 }
 
+// SetDERPRegionWebsocketFallback sets whether the connection to the
+// provided DERP region uses WebSockets because the DERP HTTP upgrade
+// was blocked, typically by a proxy.
+func SetDERPRegionWebsocketFallback(region int, v bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	if v {
+		derpRegionWebsocket[region] = true
+	} else {
+		delete(derpRegionWebsocket, region)
+	}
+	selfCheckLocked()
+}
+
 func NoteDERPRegionReceivedFrame(region int) {
 	mu.Lock()
 	defer mu.Unlock()
@@ -367,6 +382,9 @@ func overallErrorLocked() error {
 	for regionID, problem := range derpRegionHealthProblem {
 		errs = append(errs, fmt.Errorf("derp%d: %v", regionID, problem))
 	}
+	for regionID := range derpRegionWebsocket {
+		errs = append(errs, fmt.Errorf("derp%d: connected over WebSockets, as the DERP HTTP upgrade failed (blocked by a proxy?)", regionID))
+	}
 	for _, s := range controlHealth {
 		errs = append(errs, errors.New(s))
 	}
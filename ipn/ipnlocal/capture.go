@@ -0,0 +1,39 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"context"
+	"io"
+
+	"tailscale.com/wgengine/capture"
+)
+
+// StreamDebugCapture writes a pcapng capture of the packets passing
+// through the engine's TUN wrapper to w, until ctx is done or writing
+// to w fails.
+func (b *LocalBackend) StreamDebugCapture(ctx context.Context, w io.Writer) error {
+	b.mu.Lock()
+	if b.debugSink == nil {
+		b.debugSink = capture.New()
+	}
+	s := b.debugSink
+	b.numDebugCaptures++
+	if b.numDebugCaptures == 1 {
+		b.e.InstallCaptureHook(s.LogPacket)
+	}
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.numDebugCaptures--
+		if b.numDebugCaptures == 0 {
+			// Stop paying for captures nobody reads.
+			b.e.InstallCaptureHook(nil)
+		}
+	}()
+	return s.Stream(ctx, w)
+}
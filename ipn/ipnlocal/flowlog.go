@@ -0,0 +1,145 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"encoding/json"
+	"errors"
+
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/envknob"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/wgengine/filter"
+)
+
+// flowLogsEnabled is whether new flows accepted or dropped by the
+// packet filter are logged.
+var flowLogsEnabled = envknob.Bool("TS_FLOW_LOGS")
+
+// flowLogQueueSize is the number of flows that may be waiting to be
+// logged before new ones are dropped.
+const flowLogQueueSize = 128
+
+// flowLogEntry is the JSON form of a flow log line.
+type flowLogEntry struct {
+	Proto    string
+	Src      netaddr.IPPort
+	Dst      netaddr.IPPort
+	Incoming bool   // initiated by the peer
+	Verdict  string // "accept" or "drop"
+	Rule     string `json:",omitempty"` // the filter rule that accepted the flow
+
+	// Peer and PeerUser identify the Tailscale peer on the other end
+	// of the flow, if known.
+	Peer     string `json:",omitempty"`
+	PeerUser string `json:",omitempty"`
+}
+
+// queueFlow queues fl to be logged by flowLogLoop. It's called by the
+// packet filter, so it must not block.
+func (b *LocalBackend) queueFlow(fl filter.Flow) {
+	select {
+	case b.flowLogs <- fl:
+	default:
+		// Queue full; drop it rather than stall packets.
+	}
+}
+
+// flowLogLoop logs the flows queued by queueFlow until b is closed.
+func (b *LocalBackend) flowLogLoop() {
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case fl := <-b.flowLogs:
+			b.logFlow(fl)
+		}
+	}
+}
+
+func (b *LocalBackend) logFlow(fl filter.Flow) {
+	e := flowLogEntry{
+		Proto:    fl.Proto.String(),
+		Src:      fl.Src,
+		Dst:      fl.Dst,
+		Incoming: fl.Incoming,
+		Verdict:  "accept",
+		Rule:     fl.Rule,
+	}
+	if fl.Verdict != filter.Accept {
+		e.Verdict = "drop"
+	}
+	peer := fl.Dst.IP()
+	if fl.Incoming {
+		peer = fl.Src.IP()
+	}
+	if n, u, ok := b.WhoIs(netaddr.IPPortFrom(peer, 0)); ok {
+		e.Peer = n.Name
+		e.PeerUser = u.LoginName
+	}
+	j, err := json.Marshal(e)
+	if err != nil {
+		b.logf("flow: %v", err)
+		return
+	}
+	b.logf("flow: %s", j)
+}
+
+// PacketFilterStats returns the hit counters of the packet filter's
+// rules, along with the rules they're for.
+func (b *LocalBackend) PacketFilterStats() []apitype.FilterRuleStats {
+	f, _ := b.filterAtomic.Load().(*filter.Filter)
+	if f == nil {
+		return nil
+	}
+	b.mu.Lock()
+	nm := b.netMap
+	b.mu.Unlock()
+
+	stats := f.RuleStats()
+	ret := make([]apitype.FilterRuleStats, len(stats))
+	for i, st := range stats {
+		ret[i] = apitype.FilterRuleStats{
+			Match:   st.Match,
+			Packets: st.Packets,
+			Bytes:   st.Bytes,
+			Flows:   st.Flows,
+		}
+		// The filter's rules are parsed one to one from the
+		// netmap's, unless the filter is out of date.
+		if nm != nil && len(nm.PacketFilterRules) == len(stats) {
+			ret[i].Rule = nm.PacketFilterRules[i]
+		}
+	}
+	return ret
+}
+
+// CheckPacketFilter evaluates the current packet filter for a
+// hypothetical flow of protocol proto from src to dst, without
+// injecting any packets. incoming is whether the flow is from a
+// Tailscale peer to this node.
+func (b *LocalBackend) CheckPacketFilter(proto ipproto.Proto, src, dst netaddr.IPPort, incoming bool) (apitype.FilterCheckResult, error) {
+	f := b.e.GetFilter()
+	if f == nil {
+		return apitype.FilterCheckResult{}, errors.New("no packet filter")
+	}
+	b.mu.Lock()
+	nm := b.netMap
+	b.mu.Unlock()
+
+	cr := f.Check(proto, src, dst, incoming)
+	res := apitype.FilterCheckResult{
+		Verdict:   cr.Verdict.String(),
+		Reason:    cr.Reason,
+		RuleIndex: cr.Rule,
+		Match:     cr.Match,
+		ShieldsUp: f.ShieldsUp(),
+	}
+	if nm != nil && cr.Rule >= 0 && cr.Rule < len(nm.PacketFilterRules) {
+		res.Rule = &nm.PacketFilterRules[cr.Rule]
+	}
+	return res, nil
+}
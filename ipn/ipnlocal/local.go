@@ -43,6 +43,7 @@
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/dnstype"
 	"tailscale.com/types/empty"
+	"tailscale.com/types/ipproto"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
@@ -57,6 +58,7 @@
 	"tailscale.com/version"
 	"tailscale.com/version/distro"
 	"tailscale.com/wgengine"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/magicsock"
 	"tailscale.com/wgengine/router"
@@ -103,6 +105,8 @@ type LocalBackend struct {
 	newDecompressor       func() (controlclient.Decompressor, error)
 	varRoot               string // or empty if SetVarRoot never called
 	sshAtomicBool         syncs.AtomicBool
+	sshAudit              sshAudit         // active SSH sessions and recent audit events
+	flowLogs              chan filter.Flow // flows to log, or nil if flow logs are disabled
 
 	filterHash deephash.Sum
 
@@ -154,6 +158,11 @@ type LocalBackend struct {
 	directFileRoot          string
 	directFileDoFinalRename bool // false on macOS, true on Synology & TrueNAS
 
+	// debugSink is where the engine's packets are captured to
+	// while numDebugCaptures > 0; see StreamDebugCapture.
+	debugSink        *capture.Sink
+	numDebugCaptures int
+
 	// statusLock must be held before calling statusChanged.Wait() or
 	// statusChanged.Broadcast().
 	statusLock    sync.Mutex
@@ -204,6 +213,11 @@ func NewLocalBackend(logf logger.Logf, logid string, store ipn.StateStore, diale
 		loginFlags:     loginFlags,
 	}
 
+	if flowLogsEnabled {
+		b.flowLogs = make(chan filter.Flow, flowLogQueueSize)
+		go b.flowLogLoop()
+	}
+
 	// Default filter blocks everything and logs nothing, until Start() is called.
 	b.setFilter(filter.NewAllowNone(logf, &netaddr.IPSet{}))
 
@@ -374,6 +388,12 @@ func (b *LocalBackend) updateStatus(sb *ipnstate.StatusBuilder, extraLocked func
 		s.Version = version.Long
 		s.BackendState = b.state.String()
 		s.AuthURL = b.authURLSticky
+		s.TUN = b.dialer.UseNetstackForIP == nil
+		if b.prefs != nil {
+			for _, r := range b.prefs.LocalFilter {
+				s.LocalFilter = append(s.LocalFilter, r.String())
+			}
+		}
 
 		if err := health.OverallError(); err != nil {
 			switch e := err.(type) {
@@ -471,6 +491,7 @@ func (b *LocalBackend) populatePeerStatusLocked(sb *ipnstate.StatusBuilder) {
 			ShareeNode:     p.Hostinfo.ShareeNode(),
 			ExitNode:       p.StableID != "" && p.StableID == b.prefs.ExitNodeID,
 			ExitNodeOption: exitNodeOption,
+			SSH_HostKeys:   p.Hostinfo.SSH_HostKeys().AsSlice(),
 		})
 	}
 }
@@ -913,9 +934,13 @@ func (b *LocalBackend) Start(opts ipn.Options) error {
 
 	b.setNetMapLocked(nil)
 	persistv := b.prefs.Persist
+	staticEndpoints := b.prefs.AdvertiseEndpoints
+	peerRelay := b.prefs.PeerRelay
 	b.mu.Unlock()
 
 	b.updateFilter(nil, nil)
+	b.e.SetStaticEndpoints(staticEndpoints)
+	b.e.SetPeerRelay(peerRelay)
 
 	if b.portpoll != nil {
 		b.portpollOnce.Do(func() {
@@ -1028,6 +1053,7 @@ func (b *LocalBackend) updateFilter(netMap *netmap.NetworkMap, prefs *ipn.Prefs)
 		localNetsB   netaddr.IPSetBuilder
 		logNetsB     netaddr.IPSetBuilder
 		shieldsUp    = prefs == nil || prefs.ShieldsUp // Be conservative when not ready
+		localFilter  []preftype.LocalFilterRule
 	)
 	// Log traffic for Tailscale IPs.
 	logNetsB.AddPrefix(tsaddr.CGNATRange())
@@ -1041,6 +1067,7 @@ func (b *LocalBackend) updateFilter(netMap *netmap.NetworkMap, prefs *ipn.Prefs)
 		packetFilter = netMap.PacketFilter
 	}
 	if prefs != nil {
+		localFilter = prefs.LocalFilter
 		for _, r := range prefs.AdvertiseRoutes {
 			if r.Bits() == 0 {
 				// When offering a default route to the world, we
@@ -1072,7 +1099,7 @@ func (b *LocalBackend) updateFilter(netMap *netmap.NetworkMap, prefs *ipn.Prefs)
 	localNets, _ := localNetsB.IPSet()
 	logNets, _ := logNetsB.IPSet()
 
-	changed := deephash.Update(&b.filterHash, haveNetmap, addrs, packetFilter, localNets.Ranges(), logNets.Ranges(), shieldsUp)
+	changed := deephash.Update(&b.filterHash, haveNetmap, addrs, packetFilter, localNets.Ranges(), logNets.Ranges(), shieldsUp, localFilter)
 	if !changed {
 		return
 	}
@@ -1088,12 +1115,52 @@ func (b *LocalBackend) updateFilter(netMap *netmap.NetworkMap, prefs *ipn.Prefs)
 		b.logf("[v1] netmap packet filter: (shields up)")
 		b.setFilter(filter.NewShieldsUpFilter(localNets, logNets, oldFilter, b.logf))
 	} else {
-		b.logf("[v1] netmap packet filter: %v filters", len(packetFilter))
-		b.setFilter(filter.New(packetFilter, localNets, logNets, oldFilter, b.logf))
+		b.logf("[v1] netmap packet filter: %v filters, %v local rules", len(packetFilter), len(localFilter))
+		f := filter.New(packetFilter, localNets, logNets, oldFilter, b.logf)
+		f.SetLocalRules(localFilterRules(localFilter))
+		b.setFilter(f)
 	}
 }
 
+// localFilterRules converts the node-local packet filter rules from
+// prefs into the packet filter's form.
+func localFilterRules(rules []preftype.LocalFilterRule) []filter.LocalRule {
+	if len(rules) == 0 {
+		return nil
+	}
+	var allProtos []ipproto.Proto
+	for p := 1; p < 255; p++ {
+		allProtos = append(allProtos, ipproto.Proto(p))
+	}
+	ret := make([]filter.LocalRule, len(rules))
+	for i, r := range rules {
+		m := filter.Match{
+			IPProto: allProtos,
+			Srcs:    []netaddr.IPPrefix{r.Src},
+		}
+		if r.Proto != 0 {
+			m.IPProto = []ipproto.Proto{r.Proto}
+		}
+		if r.Src.IsZero() {
+			m.Srcs = []netaddr.IPPrefix{
+				netaddr.IPPrefixFrom(netaddr.IPv4(0, 0, 0, 0), 0),
+				netaddr.IPPrefixFrom(netaddr.IPv6Unspecified(), 0),
+			}
+		}
+		ports := filter.PortRange{First: r.PortFirst, Last: r.PortLast}
+		m.Dsts = []filter.NetPortRange{
+			{Net: netaddr.IPPrefixFrom(netaddr.IPv4(0, 0, 0, 0), 0), Ports: ports},
+			{Net: netaddr.IPPrefixFrom(netaddr.IPv6Unspecified(), 0), Ports: ports},
+		}
+		ret[i] = filter.LocalRule{Match: m, Deny: r.Deny}
+	}
+	return ret
+}
+
 func (b *LocalBackend) setFilter(f *filter.Filter) {
+	if b.flowLogs != nil {
+		f.SetFlowLogger(b.queueFlow)
+	}
 	b.filterAtomic.Store(f)
 	b.e.SetFilter(f)
 }
@@ -1779,6 +1846,8 @@ func (b *LocalBackend) setPrefsLockedOnEntry(caller string, newp *ipn.Prefs) {
 	}
 
 	b.updateFilter(netMap, newp)
+	b.e.SetStaticEndpoints(newp.AdvertiseEndpoints)
+	b.e.SetPeerRelay(newp.PeerRelay)
 
 	if netMap != nil {
 		b.e.SetDERPMap(netMap.DERPMap)
@@ -2374,6 +2443,7 @@ func (b *LocalBackend) routerConfig(cfg *wgcfg.Config, prefs *ipn.Prefs) *router
 		SNATSubnetRoutes: !prefs.NoSNAT,
 		NetfilterMode:    prefs.NetfilterMode,
 		Routes:           peerRoutes(cfg.Peers, 10_000),
+		MTU:              prefs.MTU,
 	}
 
 	if distro.Get() == distro.Synology {
@@ -2453,6 +2523,7 @@ func (b *LocalBackend) applyPrefsToHostinfo(hi *tailcfg.Hostinfo, prefs *ipn.Pre
 	hi.RoutableIPs = append(prefs.AdvertiseRoutes[:0:0], prefs.AdvertiseRoutes...)
 	hi.RequestTags = append(prefs.AdvertiseTags[:0:0], prefs.AdvertiseTags...)
 	hi.ShieldsUp = prefs.ShieldsUp
+	hi.PeerRelay = prefs.PeerRelay
 
 	var sshHostKeys []string
 	if prefs.RunSSH {
@@ -3230,6 +3301,26 @@ func (b *LocalBackend) DebugReSTUN() error {
 	return nil
 }
 
+// DebugPeerPaths returns the recent history of the paths used to reach
+// the peer with Tailscale IP ip.
+func (b *LocalBackend) DebugPeerPaths(ip netaddr.IP) (*ipnstate.PeerPathHistory, error) {
+	b.mu.Lock()
+	n, ok := b.nodeByAddr[ip]
+	b.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no node with IP %v", ip)
+	}
+	mc, err := b.magicConn()
+	if err != nil {
+		return nil, err
+	}
+	h, ok := mc.PeerPathHistory(n.Key)
+	if !ok {
+		return nil, fmt.Errorf("%v is not a peer", ip)
+	}
+	return h, nil
+}
+
 func (b *LocalBackend) magicConn() (*magicsock.Conn, error) {
 	ig, ok := b.e.(wgengine.InternalsGetter)
 	if !ok {
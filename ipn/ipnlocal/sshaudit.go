@@ -0,0 +1,117 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// maxSSHEvents is the number of most recent SSH audit events kept in
+// memory for the LocalAPI.
+const maxSSHEvents = 1000
+
+// sshAudit tracks the active Tailscale SSH sessions and the most recent
+// SSH audit events.
+type sshAudit struct {
+	mu       sync.Mutex
+	events   []apitype.SSHEvent // ring buffer of at most maxSSHEvents
+	next     int                // index in events of the oldest event, once full
+	sessions map[string]*activeSSHSession
+}
+
+type activeSSHSession struct {
+	info apitype.SSHSession
+	kill func()
+}
+
+func (a *sshAudit) addEvent(ev apitype.SSHEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.events) < maxSSHEvents {
+		a.events = append(a.events, ev)
+		return
+	}
+	a.events[a.next] = ev
+	a.next = (a.next + 1) % maxSSHEvents
+}
+
+// LogSSHEvent records an SSH audit event, both in memory for
+// SSHEvents and as a JSON line in the logs.
+func (b *LocalBackend) LogSSHEvent(ev apitype.SSHEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	b.sshAudit.addEvent(ev)
+	j, err := json.Marshal(ev)
+	if err != nil {
+		b.logf("ssh-event: %v", err)
+		return
+	}
+	b.logf("ssh-event: %s", j)
+}
+
+// SSHEvents returns the most recent SSH audit events, oldest first.
+func (b *LocalBackend) SSHEvents() []apitype.SSHEvent {
+	a := &b.sshAudit
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	ret := make([]apitype.SSHEvent, 0, len(a.events))
+	ret = append(ret, a.events[a.next:]...)
+	ret = append(ret, a.events[:a.next]...)
+	return ret
+}
+
+// RegisterSSHSession registers an active SSH session, along with a
+// func to terminate it. The returned func unregisters it and must be
+// called when the session ends.
+func (b *LocalBackend) RegisterSSHSession(s apitype.SSHSession, kill func()) (unregister func()) {
+	a := &b.sshAudit
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.sessions == nil {
+		a.sessions = make(map[string]*activeSSHSession)
+	}
+	as := &activeSSHSession{info: s, kill: kill}
+	a.sessions[s.ID] = as
+	return func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if a.sessions[s.ID] == as {
+			delete(a.sessions, s.ID)
+		}
+	}
+}
+
+// SSHSessions returns the active SSH sessions, oldest first.
+func (b *LocalBackend) SSHSessions() []apitype.SSHSession {
+	a := &b.sshAudit
+	a.mu.Lock()
+	ret := make([]apitype.SSHSession, 0, len(a.sessions))
+	for _, as := range a.sessions {
+		ret = append(ret, as.info)
+	}
+	a.mu.Unlock()
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Start.Before(ret[j].Start) })
+	return ret
+}
+
+// KillSSHSession terminates the active SSH session with the provided ID.
+func (b *LocalBackend) KillSSHSession(id string) error {
+	a := &b.sshAudit
+	a.mu.Lock()
+	as, ok := a.sessions[id]
+	a.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no active SSH session %q", id)
+	}
+	as.kill()
+	return nil
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"fmt"
+	"testing"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/types/logger"
+)
+
+func TestSSHEventsRing(t *testing.T) {
+	b := &LocalBackend{logf: logger.Discard}
+	const n = maxSSHEvents + 10
+	for i := 0; i < n; i++ {
+		b.LogSSHEvent(apitype.SSHEvent{SessionID: fmt.Sprint(i)})
+	}
+	evs := b.SSHEvents()
+	if len(evs) != maxSSHEvents {
+		t.Fatalf("got %d events; want %d", len(evs), maxSSHEvents)
+	}
+	for i, ev := range evs {
+		if want := fmt.Sprint(n - maxSSHEvents + i); ev.SessionID != want {
+			t.Fatalf("event %d has ID %q; want %q", i, ev.SessionID, want)
+		}
+		if ev.Time.IsZero() {
+			t.Fatalf("event %d has zero time", i)
+		}
+	}
+}
+
+func TestSSHSessions(t *testing.T) {
+	b := &LocalBackend{logf: logger.Discard}
+	killed := false
+	unregister := b.RegisterSSHSession(apitype.SSHSession{ID: "a"}, func() { killed = true })
+	if got := b.SSHSessions(); len(got) != 1 || got[0].ID != "a" {
+		t.Fatalf("SSHSessions = %+v; want session a", got)
+	}
+	if err := b.KillSSHSession("b"); err == nil {
+		t.Error("KillSSHSession of unknown session succeeded")
+	}
+	if err := b.KillSSHSession("a"); err != nil {
+		t.Fatal(err)
+	}
+	if !killed {
+		t.Error("session not killed")
+	}
+	unregister()
+	if got := b.SSHSessions(); len(got) != 0 {
+		t.Fatalf("SSHSessions after unregister = %+v; want none", got)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"tailscale.com/client/tailscale/apitype"
+)
+
+// SSHRecordingsDir returns the directory in which Tailscale SSH
+// session recordings are stored, creating it if needed.
+//
+// Each recording is an asciicast v2 file named ID+".cast" with its
+// apitype.SSHSessionRecording metadata alongside in ID+".json".
+func (b *LocalBackend) SSHRecordingsDir() (string, error) {
+	root := b.TailscaleVarRoot()
+	if root == "" {
+		return "", errors.New("no var root for ssh session recordings")
+	}
+	dir := filepath.Join(root, "ssh-sessions")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// SSHSessionRecordings returns the metadata of the SSH session
+// recordings on disk, oldest first.
+func (b *LocalBackend) SSHSessionRecordings() ([]*apitype.SSHSessionRecording, error) {
+	dir, err := b.SSHRecordingsDir()
+	if err != nil {
+		return nil, err
+	}
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ret := []*apitype.SSHSessionRecording{}
+	for _, de := range des {
+		name := de.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		j, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		rec := new(apitype.SSHSessionRecording)
+		if err := json.Unmarshal(j, rec); err != nil {
+			b.logf("ignoring invalid SSH recording metadata %q: %v", name, err)
+			continue
+		}
+		ret = append(ret, rec)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Start.Before(ret[j].Start) })
+	return ret, nil
+}
+
+// PruneSSHSessionRecordings removes the oldest SSH session recordings
+// so that at most keep remain, not counting those for which active
+// reports true. Those are still being written, so they're never
+// removed. A nil active means none are.
+func (b *LocalBackend) PruneSSHSessionRecordings(keep int, active func(id string) bool) error {
+	recs, err := b.SSHSessionRecordings()
+	if err != nil {
+		return err
+	}
+	done := recs[:0]
+	for _, rec := range recs {
+		if active == nil || !active(rec.ID) {
+			done = append(done, rec)
+		}
+	}
+	if len(done) <= keep {
+		return nil
+	}
+	dir, err := b.SSHRecordingsDir()
+	if err != nil {
+		return err
+	}
+	for _, rec := range done[:len(done)-keep] {
+		if !validSSHRecordingID(rec.ID) {
+			continue
+		}
+		for _, ext := range []string{".cast", ".json"} {
+			if err := os.Remove(filepath.Join(dir, rec.ID+ext)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// OpenSSHSessionRecording opens the asciicast file of the SSH session
+// recording with the provided ID.
+func (b *LocalBackend) OpenSSHSessionRecording(id string) (*os.File, error) {
+	if !validSSHRecordingID(id) {
+		return nil, fmt.Errorf("invalid recording ID %q", id)
+	}
+	dir, err := b.SSHRecordingsDir()
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(dir, id+".cast"))
+}
+
+// validSSHRecordingID reports whether id looks like an SSH session ID,
+// so it's safe to use as a file name.
+func validSSHRecordingID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package ipnlocal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/types/logger"
+)
+
+func TestValidSSHRecordingID(t *testing.T) {
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{"20220405T101112-0102030405", true},
+		{"abc", true},
+		{"", false},
+		{"../foo", false},
+		{"foo/bar", false},
+		{"foo.cast", false},
+	}
+	for _, tt := range tests {
+		if got := validSSHRecordingID(tt.id); got != tt.want {
+			t.Errorf("validSSHRecordingID(%q) = %v; want %v", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestPruneSSHSessionRecordings(t *testing.T) {
+	b := &LocalBackend{logf: logger.Discard, varRoot: t.TempDir()}
+	dir, err := b.SSHRecordingsDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2022, 4, 5, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		id := fmt.Sprintf("rec-%d", i)
+		j, err := json.Marshal(apitype.SSHSessionRecording{ID: id, Start: start.Add(time.Duration(i) * time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, id+".json"), j, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, id+".cast"), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkIDs := func(want string) {
+		t.Helper()
+		recs, err := b.SSHSessionRecordings()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, rec := range recs {
+			ids = append(ids, rec.ID)
+		}
+		if got := fmt.Sprint(ids); got != want {
+			t.Errorf("after pruning, recordings = %v; want %v", got, want)
+		}
+	}
+
+	// Recordings of active sessions are kept, and don't count.
+	active := func(id string) bool { return id == "rec-1" }
+	if err := b.PruneSSHSessionRecordings(2, active); err != nil {
+		t.Fatal(err)
+	}
+	checkIDs("[rec-1 rec-3 rec-4]")
+
+	if err := b.PruneSSHSessionRecordings(2, nil); err != nil {
+		t.Fatal(err)
+	}
+	checkIDs("[rec-3 rec-4]")
+	if _, err := os.Stat(filepath.Join(dir, "rec-0.cast")); !os.IsNotExist(err) {
+		t.Errorf("pruned recording's cast file still exists: %v", err)
+	}
+}
@@ -34,6 +34,11 @@ type Status struct {
 	//  "Starting", "Running".
 	BackendState string
 
+	// TUN is whether a kernel TUN interface is in use. If false,
+	// the daemon is running in userspace-networking mode and the
+	// host can't reach Tailscale IPs directly.
+	TUN bool
+
 	AuthURL      string       // current URL provided by control to authorize client
 	TailscaleIPs []netaddr.IP // Tailscale IP(s) assigned to this node
 	Self         *PeerStatus
@@ -43,6 +48,10 @@ type Status struct {
 	// problems are detected)
 	Health []string
 
+	// LocalFilter are the node-local packet filter rules, in their
+	// text form (see preftype.LocalFilterRule), if any.
+	LocalFilter []string `json:",omitempty"`
+
 	// This field is the legacy name of CurrentTailnet.MagicDNSSuffix.
 	//
 	// Deprecated: use CurrentTailnet.MagicDNSSuffix instead.
@@ -124,6 +133,16 @@ type PeerStatus struct {
 	CurAddr string // one of Addrs, or unique if roaming
 	Relay   string // DERP region
 
+	// PeerRelay is the Tailscale IP of the peer relaying packets
+	// to this peer, if a peer relay rather than a direct path or
+	// DERP is in use.
+	PeerRelay string `json:",omitempty"`
+
+	// PathMTU is the largest tunneled packet size, in bytes, that
+	// path MTU probing has found CurAddr to carry. It's zero if
+	// unknown or if CurAddr is empty.
+	PathMTU int `json:",omitempty"`
+
 	RxBytes        int64
 	TxBytes        int64
 	Created        time.Time // time registered with tailcontrol
@@ -145,6 +164,9 @@ type PeerStatus struct {
 	PeerAPIURL   []string
 	Capabilities []string `json:",omitempty"`
 
+	// SSH_HostKeys are the node's SSH host keys, if known.
+	SSH_HostKeys []string `json:"sshHostKeys,omitempty"`
+
 	// ShareeNode indicates this node exists in the netmap because
 	// it's owned by a shared-to user and that node might connect
 	// to us. These nodes should be hidden by "tailscale status"
@@ -284,12 +306,21 @@ func (sb *StatusBuilder) AddPeer(peer key.NodePublic, st *PeerStatus) {
 	if v := st.OS; v != "" {
 		e.OS = st.OS
 	}
+	if v := st.SSH_HostKeys; v != nil {
+		e.SSH_HostKeys = v
+	}
 	if v := st.Addrs; v != nil {
 		e.Addrs = v
 	}
 	if v := st.CurAddr; v != "" {
 		e.CurAddr = v
 	}
+	if v := st.PeerRelay; v != "" {
+		e.PeerRelay = v
+	}
+	if v := st.PathMTU; v != 0 {
+		e.PathMTU = v
+	}
 	if v := st.RxBytes; v != 0 {
 		e.RxBytes = v
 	}
@@ -436,10 +467,15 @@ func (st *Status) WriteHTML(w io.Writer) {
 		f("<td>")
 
 		if ps.Active {
-			if ps.Relay != "" && ps.CurAddr == "" {
+			if ps.PeerRelay != "" {
+				f("peer relay <b>%s</b>", html.EscapeString(ps.PeerRelay))
+			} else if ps.Relay != "" && ps.CurAddr == "" {
 				f("relay <b>%s</b>", html.EscapeString(ps.Relay))
 			} else if ps.CurAddr != "" {
 				f("direct <b>%s</b>", html.EscapeString(ps.CurAddr))
+				if ps.PathMTU != 0 {
+					f(" mtu %d", ps.PathMTU)
+				}
 			}
 		}
 
@@ -494,6 +530,11 @@ type PingResult struct {
 	// It is not currently set for TSMP pings.
 	DERPRegionCode string
 
+	// PeerRelay is the Tailscale IP of the peer that relayed the
+	// ping, if a peer relay was used.
+	// It is not currently set for TSMP pings.
+	PeerRelay string `json:",omitempty"`
+
 	// PeerAPIPort is set by TSMP ping responses for peers that
 	// are running a peerapi server. This is the port they're
 	// running the server on.
@@ -506,6 +547,56 @@ type PingResult struct {
 	// TODO(bradfitz): details like whether port mapping was used on either side? (Once supported)
 }
 
+// PeerPathHistory is the recent history of the network paths used to
+// reach a peer, for debugging flapping connections after the fact.
+//
+// Paths are described as a direct "ip:port", as "derp-N" for DERP
+// region N, or as both joined with a "+" while a direct path is being
+// (re)confirmed and packets are sent both ways.
+type PeerPathHistory struct {
+	PublicKey key.NodePublic
+	CurPath   string // path packets are currently sent over; empty if none
+
+	// Candidates are the peer's candidate direct addresses, sorted
+	// by address.
+	Candidates []PathCandidate
+
+	// Switches are the recent changes of path, oldest first.
+	Switches []PathSwitch
+}
+
+// PathCandidate is the recent history of a candidate direct address
+// of a peer.
+type PathCandidate struct {
+	Addr string // ip:port
+	Best bool   // whether it's the best direct address
+
+	// PingsSent and PingsLost are the number of disco pings sent to
+	// Addr, and of those that timed out without a pong, since Addr
+	// became a candidate. Path MTU probes aren't counted.
+	PingsSent int
+	PingsLost int
+
+	// Latency are the recent pong latencies of Addr, oldest first.
+	Latency []PathLatency
+
+	MTU int `json:",omitempty"` // probed path MTU, if known
+}
+
+// PathLatency is a pong latency sample of a path.
+type PathLatency struct {
+	When           time.Time
+	LatencySeconds float64
+}
+
+// PathSwitch is a change of the path used to send to a peer.
+type PathSwitch struct {
+	When   time.Time
+	From   string // empty if it's the first path used
+	To     string // empty if there's no path left
+	Reason string
+}
+
 func SortPeers(peers []*PeerStatus) {
 	sort.Slice(peers, func(i, j int) bool { return sortKey(peers[i]) < sortKey(peers[j]) })
 }
@@ -12,9 +12,11 @@
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"reflect"
 	"runtime"
 	"strconv"
@@ -26,7 +28,9 @@
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/netutil"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/ipproto"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/clientmetric"
 	"tailscale.com/version"
@@ -95,6 +99,14 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveCert(w, r)
 		return
 	}
+	if strings.HasPrefix(r.URL.Path, "/localapi/v0/ssh-recordings/") {
+		h.serveSSHRecordings(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, "/localapi/v0/ssh-sessions/") {
+		h.serveSSHSessions(w, r)
+		return
+	}
 	switch r.URL.Path {
 	case "/localapi/v0/whois":
 		h.serveWhoIs(w, r)
@@ -124,6 +136,18 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		h.serveDebug(w, r)
 	case "/localapi/v0/set-expiry-sooner":
 		h.serveSetExpirySooner(w, r)
+	case "/localapi/v0/dial":
+		h.serveDial(w, r)
+	case "/localapi/v0/ssh-events":
+		h.serveSSHEvents(w, r)
+	case "/localapi/v0/filter-stats":
+		h.serveFilterStats(w, r)
+	case "/localapi/v0/filter-check":
+		h.serveFilterCheck(w, r)
+	case "/localapi/v0/debug-capture":
+		h.serveDebugCapture(w, r)
+	case "/localapi/v0/debug-peer-paths":
+		h.serveDebugPeerPaths(w, r)
 	case "/":
 		io.WriteString(w, "tailscaled\n")
 	default:
@@ -382,6 +406,270 @@ func (h *Handler) serveFiles(w http.ResponseWriter, r *http.Request) {
 	io.Copy(w, rc)
 }
 
+// serveSSHRecordings lists the Tailscale SSH session recordings
+// (for /localapi/v0/ssh-recordings/) or serves one as an asciicast
+// file (for /localapi/v0/ssh-recordings/$ID).
+func (h *Handler) serveSSHRecordings(w http.ResponseWriter, r *http.Request) {
+	// Recordings contain everything shown in (and maybe typed into)
+	// the sessions, so require write access.
+	if !h.PermitWrite {
+		http.Error(w, "ssh recording access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/localapi/v0/ssh-recordings/")
+	if id == "" {
+		recs, err := h.b.SSHSessionRecordings()
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(recs)
+		return
+	}
+	f, err := h.b.OpenSSHSessionRecording(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "no such recording", 404)
+			return
+		}
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/x-asciicast")
+	io.Copy(w, f)
+}
+
+// serveSSHSessions lists the active Tailscale SSH sessions (GET
+// /localapi/v0/ssh-sessions/) or terminates one (DELETE
+// /localapi/v0/ssh-sessions/$ID).
+func (h *Handler) serveSSHSessions(w http.ResponseWriter, r *http.Request) {
+	// Sessions include the commands run and the local users they run
+	// as, so like recordings, they require write access.
+	if !h.PermitWrite {
+		http.Error(w, "ssh sessions access denied", http.StatusForbidden)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/localapi/v0/ssh-sessions/")
+	switch r.Method {
+	case "GET":
+		if id != "" {
+			http.Error(w, "want GET of /localapi/v0/ssh-sessions/", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.b.SSHSessions())
+	case "DELETE":
+		if err := h.b.KillSSHSession(id); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "want GET or DELETE", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveSSHEvents serves the most recent Tailscale SSH audit events,
+// oldest first.
+func (h *Handler) serveSSHEvents(w http.ResponseWriter, r *http.Request) {
+	// Events include the commands run, local users and forwarding
+	// targets, so require write access.
+	if !h.PermitWrite {
+		http.Error(w, "ssh events access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.b.SSHEvents())
+}
+
+// serveDebugCapture streams a pcapng capture of the packets passing
+// through tailscaled until the client goes away.
+func (h *Handler) serveDebugCapture(w http.ResponseWriter, r *http.Request) {
+	// Packet contents are as sensitive as it gets.
+	if !h.PermitWrite {
+		http.Error(w, "debug capture access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "want POST", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pcapng")
+	w.WriteHeader(http.StatusOK)
+	if err := h.b.StreamDebugCapture(r.Context(), w); err != nil {
+		h.logf("debug capture: %v", err)
+	}
+}
+
+// serveDebugPeerPaths serves the recent history of the paths used to
+// reach the peer with the Tailscale IP in the ip parameter.
+func (h *Handler) serveDebugPeerPaths(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "debug access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	ip, err := netaddr.ParseIP(r.FormValue("ip"))
+	if err != nil {
+		http.Error(w, "invalid 'ip' parameter", 400)
+		return
+	}
+	res, err := h.b.DebugPeerPaths(ip)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// serveFilterStats serves the hit counters of the packet filter's
+// rules, in the order the control plane sent the rules.
+func (h *Handler) serveFilterStats(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "filter stats access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.b.PacketFilterStats())
+}
+
+// serveFilterCheck evaluates the packet filter for the hypothetical
+// flow described by the src and dst IPs, the IP protocol number proto
+// and the destination port. The flow is incoming (from the peer at src
+// to this node) unless dir is "out".
+func (h *Handler) serveFilterCheck(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitRead {
+		http.Error(w, "filter check access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "want GET", http.StatusMethodNotAllowed)
+		return
+	}
+	src, err := netaddr.ParseIP(r.FormValue("src"))
+	if err != nil {
+		http.Error(w, "invalid 'src' parameter", 400)
+		return
+	}
+	dst, err := netaddr.ParseIP(r.FormValue("dst"))
+	if err != nil {
+		http.Error(w, "invalid 'dst' parameter", 400)
+		return
+	}
+	proto, err := strconv.ParseUint(r.FormValue("proto"), 10, 8)
+	if err != nil {
+		http.Error(w, "invalid 'proto' parameter", 400)
+		return
+	}
+	var port uint64
+	if v := r.FormValue("port"); v != "" {
+		port, err = strconv.ParseUint(v, 10, 16)
+		if err != nil {
+			http.Error(w, "invalid 'port' parameter", 400)
+			return
+		}
+	}
+	var incoming bool
+	switch r.FormValue("dir") {
+	case "", "in":
+		incoming = true
+	case "out":
+	default:
+		http.Error(w, "invalid 'dir' parameter; want 'in' or 'out'", 400)
+		return
+	}
+	res, err := h.b.CheckPacketFilter(ipproto.Proto(proto), netaddr.IPPortFrom(src, 0), netaddr.IPPortFrom(dst, uint16(port)), incoming)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// serveDial dials the TCP address in the Dial-Host and Dial-Port
+// request headers as tailscaled would (including over netstack in
+// userspace-networking mode) and, after a 101 Switching Protocols
+// response, proxies the hijacked HTTP connection to it.
+func (h *Handler) serveDial(w http.ResponseWriter, r *http.Request) {
+	if !h.PermitWrite {
+		http.Error(w, "dial access denied", http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "POST required", http.StatusMethodNotAllowed)
+		return
+	}
+	const upgradeProto = "ts-dial"
+	if !strings.Contains(r.Header.Get("Connection"), "upgrade") ||
+		r.Header.Get("Upgrade") != upgradeProto {
+		http.Error(w, "bad ts-dial upgrade", http.StatusBadRequest)
+		return
+	}
+	hostStr, portStr := r.Header.Get("Dial-Host"), r.Header.Get("Dial-Port")
+	if hostStr == "" || portStr == "" {
+		http.Error(w, "missing Dial-Host or Dial-Port header", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "make request over HTTP/1", http.StatusBadRequest)
+		return
+	}
+
+	addr := net.JoinHostPort(hostStr, portStr)
+	outConn, err := h.b.Dialer().UserDial(r.Context(), "tcp", addr)
+	if err != nil {
+		http.Error(w, "dial failure: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer outConn.Close()
+
+	w.Header().Set("Upgrade", upgradeProto)
+	w.Header().Set("Connection", "upgrade")
+	w.WriteHeader(http.StatusSwitchingProtocols)
+
+	reqConn, brw, err := hijacker.Hijack()
+	if err != nil {
+		h.logf("localapi dial Hijack error: %v", err)
+		return
+	}
+	defer reqConn.Close()
+	if err := brw.Flush(); err != nil {
+		return
+	}
+	reqConn = netutil.NewDrainBufConn(reqConn, brw.Reader)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(reqConn, outConn)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(outConn, reqConn)
+		errc <- err
+	}()
+	<-errc
+}
+
 func writeErrorJSON(w http.ResponseWriter, err error) {
 	if err == nil {
 		err = errors.New("unexpected nil error")
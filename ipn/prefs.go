@@ -131,6 +131,13 @@ type Prefs struct {
 	// connections. This overrides tailcfg.Hostinfo's ShieldsUp.
 	ShieldsUp bool
 
+	// LocalFilter are node-local packet filter rules, which further
+	// restrict the incoming connections that the control-provided
+	// packet filter allows. They're evaluated in order; the first
+	// one matching a new incoming connection decides whether it's
+	// refused or left to the control-provided packet filter.
+	LocalFilter []preftype.LocalFilterRule `json:",omitempty"`
+
 	// AdvertiseTags specifies groups that this node wants to join, for
 	// purposes of ACL enforcement. These can be referenced from the ACL
 	// security policy. Note that advertising a tag doesn't guarantee that
@@ -162,6 +169,24 @@ type Prefs struct {
 	// for Linux/etc, which always operate in daemon mode.
 	ForceDaemon bool `json:"ForceDaemon,omitempty"`
 
+	// MTU is the MTU of the Tailscale interface, in bytes. Peers
+	// sending larger packets are told, via TSMP, to send smaller
+	// ones. Zero means the default MTU. The interface's MTU is
+	// currently only changed on Linux.
+	MTU int `json:",omitempty"`
+
+	// AdvertiseEndpoints are ip:port endpoints, such as the public
+	// address of a static 1:1 NAT or port forward to this node, to
+	// advertise to peers in addition to the endpoints discovered via
+	// STUN, port mapping and local interfaces.
+	AdvertiseEndpoints []netaddr.IPPort `json:",omitempty"`
+
+	// PeerRelay specifies whether to offer to relay UDP packets
+	// between peers that can't reach each other directly, as an
+	// alternative to DERP. It's advertised to peers in
+	// tailcfg.Hostinfo.
+	PeerRelay bool `json:",omitempty"`
+
 	// The following block of options only have an effect on Linux.
 
 	// AdvertiseRoutes specifies CIDR prefixes to advertise into the
@@ -212,10 +237,14 @@ type MaskedPrefs struct {
 	WantRunningSet            bool `json:",omitempty"`
 	LoggedOutSet              bool `json:",omitempty"`
 	ShieldsUpSet              bool `json:",omitempty"`
+	LocalFilterSet            bool `json:",omitempty"`
 	AdvertiseTagsSet          bool `json:",omitempty"`
 	HostnameSet               bool `json:",omitempty"`
 	NotepadURLsSet            bool `json:",omitempty"`
 	ForceDaemonSet            bool `json:",omitempty"`
+	MTUSet                    bool `json:",omitempty"`
+	AdvertiseEndpointsSet     bool `json:",omitempty"`
+	PeerRelaySet              bool `json:",omitempty"`
 	AdvertiseRoutesSet        bool `json:",omitempty"`
 	NoSNATSet                 bool `json:",omitempty"`
 	NetfilterModeSet          bool `json:",omitempty"`
@@ -308,6 +337,9 @@ func (p *Prefs) pretty(goos string) string {
 	if p.ShieldsUp {
 		sb.WriteString("shields=true ")
 	}
+	if len(p.LocalFilter) > 0 {
+		fmt.Fprintf(&sb, "localfilter=%v ", p.LocalFilter)
+	}
 	if !p.ExitNodeIP.IsZero() {
 		fmt.Fprintf(&sb, "exit=%v lan=%t ", p.ExitNodeIP, p.ExitNodeAllowLANAccess)
 	} else if !p.ExitNodeID.IsZero() {
@@ -331,6 +363,15 @@ func (p *Prefs) pretty(goos string) string {
 	if p.Hostname != "" {
 		fmt.Fprintf(&sb, "host=%q ", p.Hostname)
 	}
+	if p.MTU != 0 {
+		fmt.Fprintf(&sb, "mtu=%d ", p.MTU)
+	}
+	if len(p.AdvertiseEndpoints) > 0 {
+		fmt.Fprintf(&sb, "endpoints=%v ", p.AdvertiseEndpoints)
+	}
+	if p.PeerRelay {
+		sb.WriteString("peerrelay=true ")
+	}
 	if p.OperatorUser != "" {
 		fmt.Fprintf(&sb, "op=%q ", p.OperatorUser)
 	}
@@ -372,11 +413,15 @@ func (p *Prefs) Equals(p2 *Prefs) bool {
 		p.LoggedOut == p2.LoggedOut &&
 		p.NotepadURLs == p2.NotepadURLs &&
 		p.ShieldsUp == p2.ShieldsUp &&
+		compareLocalFilters(p.LocalFilter, p2.LocalFilter) &&
 		p.NoSNAT == p2.NoSNAT &&
 		p.NetfilterMode == p2.NetfilterMode &&
 		p.OperatorUser == p2.OperatorUser &&
 		p.Hostname == p2.Hostname &&
 		p.ForceDaemon == p2.ForceDaemon &&
+		p.MTU == p2.MTU &&
+		compareIPPorts(p.AdvertiseEndpoints, p2.AdvertiseEndpoints) &&
+		p.PeerRelay == p2.PeerRelay &&
 		compareIPNets(p.AdvertiseRoutes, p2.AdvertiseRoutes) &&
 		compareStrings(p.AdvertiseTags, p2.AdvertiseTags) &&
 		p.Persist.Equals(p2.Persist)
@@ -394,6 +439,30 @@ func compareIPNets(a, b []netaddr.IPPrefix) bool {
 	return true
 }
 
+func compareIPPorts(a, b []netaddr.IPPort) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func compareLocalFilters(a, b []preftype.LocalFilterRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func compareStrings(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
@@ -22,7 +22,9 @@ func (src *Prefs) Clone() *Prefs {
 	}
 	dst := new(Prefs)
 	*dst = *src
+	dst.LocalFilter = append(src.LocalFilter[:0:0], src.LocalFilter...)
 	dst.AdvertiseTags = append(src.AdvertiseTags[:0:0], src.AdvertiseTags...)
+	dst.AdvertiseEndpoints = append(src.AdvertiseEndpoints[:0:0], src.AdvertiseEndpoints...)
 	dst.AdvertiseRoutes = append(src.AdvertiseRoutes[:0:0], src.AdvertiseRoutes...)
 	if dst.Persist != nil {
 		dst.Persist = new(persist.Persist)
@@ -44,10 +46,14 @@ func (src *Prefs) Clone() *Prefs {
 	WantRunning            bool
 	LoggedOut              bool
 	ShieldsUp              bool
+	LocalFilter            []preftype.LocalFilterRule
 	AdvertiseTags          []string
 	Hostname               string
 	NotepadURLs            bool
 	ForceDaemon            bool
+	MTU                    int
+	AdvertiseEndpoints     []netaddr.IPPort
+	PeerRelay              bool
 	AdvertiseRoutes        []netaddr.IPPrefix
 	NoSNAT                 bool
 	NetfilterMode          preftype.NetfilterMode
@@ -47,10 +47,14 @@ func TestPrefsEqual(t *testing.T) {
 		"WantRunning",
 		"LoggedOut",
 		"ShieldsUp",
+		"LocalFilter",
 		"AdvertiseTags",
 		"Hostname",
 		"NotepadURLs",
 		"ForceDaemon",
+		"MTU",
+		"AdvertiseEndpoints",
+		"PeerRelay",
 		"AdvertiseRoutes",
 		"NoSNAT",
 		"NetfilterMode",
@@ -224,6 +228,54 @@ func TestPrefsEqual(t *testing.T) {
 			true,
 		},
 
+		{
+			&Prefs{LocalFilter: nil},
+			&Prefs{LocalFilter: []preftype.LocalFilterRule{}},
+			true,
+		},
+		{
+			&Prefs{LocalFilter: []preftype.LocalFilterRule{{Deny: true, PortFirst: 22, PortLast: 22}}},
+			&Prefs{LocalFilter: []preftype.LocalFilterRule{{Deny: false, PortFirst: 22, PortLast: 22}}},
+			false,
+		},
+		{
+			&Prefs{LocalFilter: []preftype.LocalFilterRule{{Deny: true, PortFirst: 22, PortLast: 22}}},
+			&Prefs{LocalFilter: []preftype.LocalFilterRule{{Deny: true, PortFirst: 22, PortLast: 22}}},
+			true,
+		},
+
+		{
+			&Prefs{MTU: 1400},
+			&Prefs{MTU: 0},
+			false,
+		},
+		{
+			&Prefs{MTU: 1400},
+			&Prefs{MTU: 1400},
+			true,
+		},
+
+		{
+			&Prefs{AdvertiseEndpoints: nil},
+			&Prefs{AdvertiseEndpoints: []netaddr.IPPort{}},
+			true,
+		},
+		{
+			&Prefs{AdvertiseEndpoints: []netaddr.IPPort{netaddr.MustParseIPPort("1.2.3.4:41641")}},
+			&Prefs{AdvertiseEndpoints: []netaddr.IPPort{netaddr.MustParseIPPort("1.2.3.4:41642")}},
+			false,
+		},
+		{
+			&Prefs{AdvertiseEndpoints: []netaddr.IPPort{netaddr.MustParseIPPort("1.2.3.4:41641")}},
+			&Prefs{AdvertiseEndpoints: []netaddr.IPPort{netaddr.MustParseIPPort("1.2.3.4:41641")}},
+			true,
+		},
+		{
+			&Prefs{PeerRelay: true},
+			&Prefs{PeerRelay: false},
+			false,
+		},
+
 		{
 			&Prefs{AdvertiseRoutes: nil},
 			&Prefs{AdvertiseRoutes: []netaddr.IPPrefix{}},
@@ -88,6 +88,20 @@ func (c *Cache) Remove(key Tuple) {
 	}
 }
 
+// Oldest returns the least recently used key and its value, if any,
+// without changing its position in the cache.
+func (c *Cache) Oldest() (key Tuple, value any, ok bool) {
+	if c.ll == nil {
+		return Tuple{}, nil, false
+	}
+	ele := c.ll.Back()
+	if ele == nil {
+		return Tuple{}, nil, false
+	}
+	e := ele.Value.(*entry)
+	return e.key, e.value, true
+}
+
 // RemoveOldest removes the oldest item from the cache, if any.
 func (c *Cache) RemoveOldest() {
 	if c.ll != nil {
@@ -43,6 +43,9 @@ func TestCache(t *testing.T) {
 	}
 
 	wantLen(0)
+	if _, _, ok := c.Oldest(); ok {
+		t.Fatal("Oldest of empty cache returned an entry")
+	}
 	c.RemoveOldest() // shouldn't panic
 	c.Remove(k4)     // shouldn't panic
 
@@ -54,6 +57,9 @@ func TestCache(t *testing.T) {
 	wantLen(2) // hit the max
 
 	wantMissing(k1)
+	if k, v, ok := c.Oldest(); !ok || k != k2 || v != 2 {
+		t.Fatalf("Oldest = %v, %v, %v; want %v, 2, true", k, v, ok, k2)
+	}
 	c.Remove(k1)
 	wantLen(2) // no change; k1 should've been the deleted one per LRU
 
@@ -6,6 +6,7 @@
 package netutil
 
 import (
+	"bufio"
 	"io"
 	"net"
 	"sync"
@@ -63,3 +64,37 @@ func (dummyListener) Accept() (c net.Conn, err error) { return nil, io.EOF }
 
 func (a dummyAddr) Network() string { return string(a) }
 func (a dummyAddr) String() string  { return string(a) }
+
+// NewDrainBufConn returns a net.Conn that reads from c, but first
+// returns any bytes already buffered in r, such as after hijacking an
+// HTTP connection or reading an HTTP response from c.
+//
+// r may be nil, in which case c is returned as-is.
+func NewDrainBufConn(c net.Conn, r *bufio.Reader) net.Conn {
+	if r == nil || r.Buffered() == 0 {
+		return c
+	}
+	return &drainBufConn{Conn: c, buf: r}
+}
+
+type drainBufConn struct {
+	net.Conn
+
+	mu  sync.Mutex
+	buf *bufio.Reader // nil once drained
+}
+
+func (c *drainBufConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.buf != nil {
+		if n := c.buf.Buffered(); n > 0 {
+			if n > len(p) {
+				n = len(p)
+			}
+			return c.buf.Read(p[:n])
+		}
+		c.buf = nil
+	}
+	return c.Conn.Read(p)
+}
@@ -5,8 +5,10 @@
 package netutil
 
 import (
+	"bufio"
 	"io"
 	"net"
+	"strings"
 	"testing"
 )
 
@@ -52,3 +54,24 @@ func TestOneConnListener(t *testing.T) {
 		t.Errorf("nil Addr")
 	}
 }
+
+func TestDrainBufConn(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	br := bufio.NewReader(strings.NewReader("hello, world"))
+	if _, err := br.Peek(1); err != nil {
+		t.Fatal(err)
+	}
+	c := NewDrainBufConn(c1, br)
+	go c2.Write([]byte("!"))
+
+	got, err := io.ReadAll(io.LimitReader(c, int64(len("hello, world!"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello, world!" {
+		t.Errorf("got %q; want %q", got, "hello, world!")
+	}
+}
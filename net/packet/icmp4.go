@@ -47,6 +47,10 @@ func (t ICMP4Type) String() string {
 
 const (
 	ICMP4NoCode ICMP4Code = 0
+
+	// ICMP4FragmentationNeeded is the ICMP4Unreachable code for a
+	// packet that was too big and had its "don't fragment" bit set.
+	ICMP4FragmentationNeeded ICMP4Code = 4
 )
 
 // ICMP4Header is an IPv4+ICMPv4 header.
@@ -75,3 +75,30 @@ func (h IP6Header) marshalPseudo(buf []byte, proto ipproto.Proto) error {
 	buf[39] = byte(proto) // NextProto
 	return nil
 }
+
+// IPv6 extension headers that Parsed.Decode walks past to find the
+// IP subprotocol.
+const (
+	ip6HopByHop = ipproto.Proto(0)
+	ip6Routing  = ipproto.Proto(43)
+	ip6Fragment = ipproto.Proto(44)
+	ip6DestOpts = ipproto.Proto(60)
+)
+
+// ip6ExtHeaderMinLength is the length of the smallest IPv6 extension
+// headers, and the exact length of the fragment header.
+const ip6ExtHeaderMinLength = 8
+
+// maxIP6ExtHeaders is the maximum number of IPv6 extension headers
+// that Parsed.Decode walks past.
+const maxIP6ExtHeaders = 8
+
+// isIP6ExtHeader reports whether p is an IPv6 extension header that
+// Parsed.Decode knows how to skip.
+func isIP6ExtHeader(p ipproto.Proto) bool {
+	switch p {
+	case ip6HopByHop, ip6Routing, ip6Fragment, ip6DestOpts:
+		return true
+	}
+	return false
+}
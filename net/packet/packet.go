@@ -58,6 +58,22 @@ type Parsed struct {
 	Dst netaddr.IPPort
 	// TCPFlags is the packet's TCP flag bits. Valid iff IPProto == TCP.
 	TCPFlags TCPFlag
+
+	// FragID is the identification of the original packet that the
+	// packet is a fragment of: the 16 bit IPv4 ID, or the 32 bit ID
+	// of the IPv6 fragment header. Valid iff IsFragment.
+	FragID uint32
+	// FragOffset is the offset, in bytes, of the fragment's data in
+	// the original packet's payload. Valid iff IsFragment.
+	FragOffset uint16
+	// MoreFrags is whether fragments follow this one in the
+	// original packet. Valid iff IsFragment.
+	MoreFrags bool
+	// FragProto is the protocol of the original packet's payload:
+	// the IPv4 protocol, or the next header field of the IPv6
+	// fragment header. Unlike IPProto, it's the same for all the
+	// fragments of a packet. Valid iff IsFragment.
+	FragProto ipproto.Proto
 }
 
 func (p *Parsed) String() string {
@@ -84,6 +100,10 @@ func (p *Parsed) String() string {
 // and shouldn't need any memory allocation.
 func (q *Parsed) Decode(b []byte) {
 	q.b = b
+	q.FragID = 0
+	q.FragOffset = 0
+	q.MoreFrags = false
+	q.FragProto = 0
 
 	if len(b) < 1 {
 		q.IPVersion = 0
@@ -135,7 +155,7 @@ func (q *Parsed) decode4(b []byte) {
 		q.IPProto = unknown
 		return
 	}
-	sub := b[q.subofs:]
+	sub := b[q.subofs:q.length]
 	sub = sub[:len(sub):len(sub)] // help the compiler do bounds check elimination
 
 	// We don't care much about IP fragmentation, except insofar as it's
@@ -151,8 +171,14 @@ func (q *Parsed) decode4(b []byte) {
 	// it as Unknown. We can also treat any subsequent fragment that starts
 	// at such a low offset as Unknown.
 	fragFlags := binary.BigEndian.Uint16(b[6:8])
-	moreFrags := (fragFlags & 0x20) != 0
+	moreFrags := (fragFlags & 0x2000) != 0
 	fragOfs := fragFlags & 0x1FFF
+	if moreFrags || fragOfs != 0 {
+		q.FragID = uint32(binary.BigEndian.Uint16(b[4:6]))
+		q.FragOffset = fragOfs << 3
+		q.MoreFrags = moreFrags
+		q.FragProto = q.IPProto
+	}
 	if fragOfs == 0 {
 		// This is the first fragment
 		if moreFrags && len(sub) < minFrag {
@@ -254,22 +280,73 @@ func (q *Parsed) decode6(b []byte) {
 	q.Src = q.Src.WithIP(srcIP)
 	q.Dst = q.Dst.WithIP(dstIP)
 
-	// We don't support any IPv6 extension headers. Don't try to
-	// be clever. Therefore, the IP subprotocol always starts at
-	// byte 40.
+	// Walk the extension headers to find the IP subprotocol.
 	//
-	// Note that this means we don't support fragmentation in
-	// IPv6. This is fine, because IPv6 strongly mandates that you
-	// should not fragment, which makes fragmentation on the open
-	// internet extremely uncommon.
-	//
-	// This also means we don't support IPSec headers (AH/ESP), or
-	// IPv6 jumbo frames. Those will get marked Unknown and
-	// dropped.
-	q.subofs = 40
-	sub := b[q.subofs:]
+	// We support the hop-by-hop options, routing, destination
+	// options and fragment headers. We don't support IPSec headers
+	// (AH/ESP) or IPv6 jumbo frames; those will get marked Unknown
+	// and dropped.
+	q.subofs = ip6HeaderLength
+	for n := 0; isIP6ExtHeader(q.IPProto); n++ {
+		if n == maxIP6ExtHeaders {
+			// Don't let a peer make us walk an arbitrarily long
+			// chain of headers.
+			q.IPProto = unknown
+			return
+		}
+		if q.length-q.subofs < ip6ExtHeaderMinLength {
+			q.IPProto = unknown
+			return
+		}
+		ext := b[q.subofs:q.length]
+		next := ipproto.Proto(ext[0])
+		extLen := ip6ExtHeaderMinLength
+		if q.IPProto == ip6Fragment {
+			// The fragment header is fixed size, and its
+			// length byte is reserved.
+			fragField := binary.BigEndian.Uint16(ext[2:4])
+			q.FragOffset = fragField &^ 0x7
+			q.MoreFrags = fragField&0x1 != 0
+			q.FragID = binary.BigEndian.Uint32(ext[4:8])
+			q.FragProto = next
+			if q.FragOffset != 0 {
+				// What follows is the payload of a later
+				// fragment, not more headers, whatever the
+				// next header field says.
+				q.IPProto = next
+				q.subofs += extLen
+				break
+			}
+		} else {
+			extLen = (int(ext[1]) + 1) * 8
+			if len(ext) < extLen {
+				q.IPProto = unknown
+				return
+			}
+		}
+		q.IPProto = next
+		q.subofs += extLen
+	}
+	sub := b[q.subofs:q.length]
 	sub = sub[:len(sub):len(sub)] // help the compiler do bounds check elimination
 
+	// As for IPv4, see decode4, drop suspiciously short first
+	// fragments and the fragments that follow them, and let other
+	// non-first fragments, which have no subprotocol header,
+	// through.
+	if q.FragOffset != 0 {
+		if q.FragOffset < minFrag {
+			q.IPProto = unknown
+			return
+		}
+		q.IPProto = ipproto.Fragment
+		return
+	}
+	if q.MoreFrags && len(sub) < minFrag {
+		q.IPProto = unknown
+		return
+	}
+
 	switch q.IPProto {
 	case ipproto.ICMPv6:
 		if len(sub) < icmp6HeaderLength {
@@ -390,6 +467,13 @@ func (q *Parsed) IsTCPSyn() bool {
 	return (q.TCPFlags & TCPSynAck) == TCPSyn
 }
 
+// IsFragment reports whether q is a fragment of a larger IP packet.
+// Only the first fragment of a packet (with FragOffset 0) has its
+// subprotocol header; later ones have an IPProto of ipproto.Fragment.
+func (q *Parsed) IsFragment() bool {
+	return q.MoreFrags || q.FragOffset != 0
+}
+
 // IsError reports whether q is an ICMP "Error" packet.
 func (q *Parsed) IsError() bool {
 	switch q.IPProto {
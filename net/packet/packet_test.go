@@ -6,6 +6,7 @@
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"reflect"
 	"regexp"
@@ -427,6 +428,185 @@ func TestDecode(t *testing.T) {
 	}
 }
 
+// ip6Packet returns an IPv6 packet from tcp6RequestBuffer's addresses
+// with the given first next header and payload.
+func ip6Packet(next ipproto.Proto, payload ...[]byte) []byte {
+	b := append([]byte(nil), tcp6RequestBuffer[:ip6HeaderLength]...)
+	b[6] = byte(next)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(b)-ip6HeaderLength))
+	return b
+}
+
+// ip6Ext returns an IPv6 extension header with the given next header
+// and total length, a multiple of 8.
+func ip6Ext(next ipproto.Proto, length int) []byte {
+	b := make([]byte, length)
+	b[0] = byte(next)
+	b[1] = byte(length/8 - 1)
+	return b
+}
+
+// ip6Frag returns an IPv6 fragment header.
+func ip6Frag(next ipproto.Proto, offset uint16, more bool, id uint32) []byte {
+	b := make([]byte, 8)
+	b[0] = byte(next)
+	field := offset
+	if more {
+		field |= 1
+	}
+	binary.BigEndian.PutUint16(b[2:4], field)
+	binary.BigEndian.PutUint32(b[4:8], id)
+	return b
+}
+
+func TestDecodeIPv6ExtensionHeaders(t *testing.T) {
+	tcp := tcp6RequestBuffer[ip6HeaderLength:]
+	udp := udp6RequestBuffer[ip6HeaderLength:]
+	bigUDP := append(append([]byte(nil), udp...), make([]byte, 100)...)
+
+	tooMany := []byte{}
+	for i := 0; i < maxIP6ExtHeaders; i++ {
+		tooMany = append(tooMany, ip6Ext(ip6DestOpts, 8)...)
+	}
+	tooMany[len(tooMany)-8] = byte(UDP)
+
+	tests := []struct {
+		name       string
+		buf        []byte
+		proto      ipproto.Proto
+		dstPort    uint16
+		subofs     int
+		fragID     uint32
+		fragOffset uint16
+		moreFrags  bool
+	}{
+		{"hop_by_hop", ip6Packet(ip6HopByHop, ip6Ext(TCP, 8), tcp), TCP, 80, 48, 0, 0, false},
+		{"chain", ip6Packet(ip6HopByHop, ip6Ext(ip6DestOpts, 8), ip6Ext(ip6Routing, 24), ip6Ext(UDP, 16), udp), UDP, 443, 88, 0, 0, false},
+		{"max_headers", ip6Packet(ip6DestOpts, tooMany, udp), UDP, 443, 40 + 8*maxIP6ExtHeaders, 0, 0, false},
+		{"too_many_headers", ip6Packet(ip6DestOpts, ip6Ext(ip6DestOpts, 8), tooMany, udp), Unknown, 0, 0, 0, 0, false},
+		{"truncated_header", ip6Packet(ip6HopByHop, ip6Ext(TCP, 16)[:8]), Unknown, 0, 0, 0, 0, false},
+		{"first_fragment", ip6Packet(ip6Fragment, ip6Frag(UDP, 0, true, 0x12345678), bigUDP), UDP, 443, 48, 0x12345678, 0, true},
+		{"short_first_fragment", ip6Packet(ip6Fragment, ip6Frag(UDP, 0, true, 1), udp), Unknown, 0, 0, 0, 0, false},
+		{"atomic_fragment", ip6Packet(ip6Fragment, ip6Frag(UDP, 0, false, 1), udp), UDP, 443, 48, 1, 0, false},
+		{"later_fragment", ip6Packet(ip6Fragment, ip6Frag(UDP, 1448, false, 0x12345678), udp), Fragment, 0, 48, 0x12345678, 1448, false},
+		{"overlapping_fragment", ip6Packet(ip6Fragment, ip6Frag(UDP, 8, true, 1), udp), Unknown, 0, 0, 0, 0, false},
+		// The payload of later fragments isn't headers, even if the
+		// next header field says so.
+		{"later_fragment_frag_payload", ip6Packet(ip6Fragment, ip6Frag(ip6Fragment, 1448, false, 0x12345678), ip6Frag(UDP, 0, false, 0xdead), udp), Fragment, 0, 48, 0x12345678, 1448, false},
+		{"later_fragment_opts_payload", ip6Packet(ip6Fragment, ip6Frag(ip6DestOpts, 1448, true, 0x12345678), ip6Ext(UDP, 2048)[:16], udp), Fragment, 0, 48, 0x12345678, 1448, true},
+		{"esp", ip6Packet(50, udp), Unknown, 0, 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Parsed
+			got.Decode(tt.buf)
+			if got.IPProto != tt.proto {
+				t.Fatalf("IPProto = %v; want %v", got.IPProto, tt.proto)
+			}
+			if tt.proto == Unknown {
+				return
+			}
+			if got.Dst.Port() != tt.dstPort || got.subofs != tt.subofs {
+				t.Errorf("Dst port, subofs = %d, %d; want %d, %d", got.Dst.Port(), got.subofs, tt.dstPort, tt.subofs)
+			}
+			if got.FragID != tt.fragID || got.FragOffset != tt.fragOffset || got.MoreFrags != tt.moreFrags {
+				t.Errorf("fragment = %#x, %d, %v; want %#x, %d, %v", got.FragID, got.FragOffset, got.MoreFrags, tt.fragID, tt.fragOffset, tt.moreFrags)
+			}
+			if got.IsFragment() {
+				if want := ipproto.Proto(tt.buf[ip6HeaderLength]); got.FragProto != want {
+					t.Errorf("FragProto = %v; want %v", got.FragProto, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeIPv4Fragments(t *testing.T) {
+	h := UDP4Header{
+		IP4Header: IP4Header{
+			IPID: 0x1234,
+			Src:  netaddr.MustParseIP("1.2.3.4"),
+			Dst:  netaddr.MustParseIP("5.6.7.8"),
+		},
+		SrcPort: 123,
+		DstPort: 456,
+	}
+	pkt := func(flags uint16, payloadLen int) []byte {
+		b := Generate(h, make([]byte, payloadLen))
+		binary.BigEndian.PutUint16(b[6:8], flags)
+		return b
+	}
+	tests := []struct {
+		name       string
+		buf        []byte
+		proto      ipproto.Proto
+		fragment   bool
+		fragOffset uint16
+		moreFrags  bool
+	}{
+		{"unfragmented", pkt(0, 100), UDP, false, 0, false},
+		{"dont_fragment", pkt(0x4000, 100), UDP, false, 0, false},
+		{"first_fragment", pkt(0x2000, 100), UDP, true, 0, true},
+		{"short_first_fragment", pkt(0x2000, 8), Unknown, true, 0, true},
+		{"later_fragment", pkt(0x2000|185, 100), Fragment, true, 1480, true},
+		{"last_fragment", pkt(185, 100), Fragment, true, 1480, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Parsed
+			got.Decode(tt.buf)
+			if got.IPProto != tt.proto {
+				t.Errorf("IPProto = %v; want %v", got.IPProto, tt.proto)
+			}
+			if got.IsFragment() != tt.fragment || got.FragOffset != tt.fragOffset || got.MoreFrags != tt.moreFrags {
+				t.Errorf("fragment = %v, %d, %v; want %v, %d, %v", got.IsFragment(), got.FragOffset, got.MoreFrags, tt.fragment, tt.fragOffset, tt.moreFrags)
+			}
+			if tt.fragment && (got.FragID != 0x1234 || got.FragProto != UDP) {
+				t.Errorf("FragID, FragProto = %#x, %v; want 0x1234, %v", got.FragID, got.FragProto, UDP)
+			}
+		})
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, b := range [][]byte{
+		icmp4RequestBuffer, icmp6PacketBuffer, tcp4PacketBuffer, tcp6RequestBuffer,
+		udp4RequestBuffer, udp6RequestBuffer, igmpPacketBuffer, unknownPacketBuffer,
+		invalid4RequestBuffer, ipv4TSMPBuffer, sctpBuffer,
+		ip6Packet(ip6HopByHop, ip6Ext(ip6Fragment, 8), ip6Frag(TCP, 0, true, 1), tcp6RequestBuffer[ip6HeaderLength:]),
+	} {
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var q Parsed
+		q.Decode(b)
+		_ = q.String()
+		if q.IPVersion == 0 || q.IPProto == Unknown {
+			return
+		}
+		if q.subofs > q.length || q.length > len(b) {
+			t.Fatalf("subofs %d, length %d out of bounds of %d byte packet", q.subofs, q.length, len(b))
+		}
+		_ = q.Transport()
+		switch q.IPProto {
+		case UDP:
+			_ = q.Payload()
+		case ICMPv4, ICMPv6:
+			_ = q.Payload()
+			q.IsEchoRequest()
+			q.IsEchoResponse()
+			q.IsError()
+		case TSMP:
+			q.AsTSMPPing()
+			q.AsTSMPPong()
+			q.AsTailscaleRejectedHeader()
+		}
+	})
+}
+
 func BenchmarkDecode(b *testing.B) {
 	benches := []struct {
 		name string
@@ -14,6 +14,7 @@
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"net"
 
 	"inet.af/netaddr"
 	"tailscale.com/net/flowtrack"
@@ -76,6 +77,9 @@ func (rh TailscaleRejectedHeader) String() string {
 
 	// TSMPTypePong is the type byte for a TailscalePongResponse.
 	TSMPTypePong TSMPType = 'o'
+
+	// TSMPTypePacketTooBig is the type byte for a TSMPPacketTooBig.
+	TSMPTypePacketTooBig TSMPType = 'm'
 )
 
 type TailscaleRejectReason byte
@@ -263,3 +267,165 @@ func (h TSMPPongReply) Marshal(buf []byte) error {
 	binary.BigEndian.PutUint16(buf[9:11], h.PeerAPIPort)
 	return nil
 }
+
+// TSMPPacketTooBig is a TSMP message that says that a Tailscale node
+// dropped a packet from another because it was larger than the MTU of
+// its Tailscale interface. It's the TSMP equivalent of an ICMP "packet
+// too big" message, which the receiving node synthesizes from it for
+// its local network stack.
+//
+// On the wire, after the IP header, it's 3 bytes followed by the start
+// of the packet that was too big:
+//     * 'm' (TSMPTypePacketTooBig)
+//     * MTU big endian uint16
+//     * up to MaxTSMPPacketTooBigQuote bytes of the dropped packet
+type TSMPPacketTooBig struct {
+	IPSrc netaddr.IP // IPv4 or IPv6 header's src IP
+	IPDst netaddr.IP // IPv4 or IPv6 header's dst IP
+	MTU   uint16     // largest packet the sender of the message accepts
+
+	// Quote is the start of the packet that was too big, including
+	// its IP header.
+	Quote []byte
+}
+
+// MaxTSMPPacketTooBigQuote is the maximum number of bytes of the
+// dropped packet included in a TSMPPacketTooBig. It's enough for the
+// IP and transport headers that a network stack needs to find the
+// socket the packet came from.
+const MaxTSMPPacketTooBigQuote = 128
+
+func (h TSMPPacketTooBig) String() string {
+	return fmt.Sprintf("TSMP-packet-too-big{%s > %s}: mtu %d", h.IPSrc, h.IPDst, h.MTU)
+}
+
+func (h TSMPPacketTooBig) quote() []byte {
+	if len(h.Quote) > MaxTSMPPacketTooBigQuote {
+		return h.Quote[:MaxTSMPPacketTooBigQuote]
+	}
+	return h.Quote
+}
+
+func (h TSMPPacketTooBig) Len() int {
+	v := 1 + // TSMPType byte
+		2 + // MTU
+		len(h.quote())
+	if h.IPSrc.Is4() {
+		v += ip4HeaderLength
+	} else if h.IPSrc.Is6() {
+		v += ip6HeaderLength
+	}
+	return v
+}
+
+func (h TSMPPacketTooBig) Marshal(buf []byte) error {
+	if len(buf) < h.Len() {
+		return errSmallBuffer
+	}
+	if len(buf) > maxPacketLength {
+		return errLargePacket
+	}
+	if h.IPSrc.Is4() {
+		iph := IP4Header{
+			IPProto: ipproto.TSMP,
+			Src:     h.IPSrc,
+			Dst:     h.IPDst,
+		}
+		if err := iph.Marshal(buf); err != nil {
+			return err
+		}
+		buf = buf[ip4HeaderLength:]
+	} else if h.IPSrc.Is6() {
+		iph := IP6Header{
+			IPProto: ipproto.TSMP,
+			Src:     h.IPSrc,
+			Dst:     h.IPDst,
+		}
+		if err := iph.Marshal(buf); err != nil {
+			return err
+		}
+		buf = buf[ip6HeaderLength:]
+	} else {
+		return errors.New("bogus src IP")
+	}
+	buf[0] = byte(TSMPTypePacketTooBig)
+	binary.BigEndian.PutUint16(buf[1:3], h.MTU)
+	copy(buf[3:], h.quote())
+	return nil
+}
+
+// QuotedAddrs returns the source and destination IPs of the quoted
+// packet, and whether the quote starts with a complete IPv4 or IPv6
+// header of the same family as the message itself.
+func (h TSMPPacketTooBig) QuotedAddrs() (src, dst netaddr.IP, ok bool) {
+	q := h.Quote
+	if len(q) == 0 {
+		return
+	}
+	switch q[0] >> 4 {
+	case 4:
+		if !h.IPSrc.Is4() || len(q) < ip4HeaderLength {
+			return
+		}
+		src = netaddr.IPv4(q[12], q[13], q[14], q[15])
+		dst = netaddr.IPv4(q[16], q[17], q[18], q[19])
+	case 6:
+		if !h.IPSrc.Is6() || len(q) < ip6HeaderLength {
+			return
+		}
+		src, _ = netaddr.FromStdIP(net.IP(q[8:24]))
+		dst, _ = netaddr.FromStdIP(net.IP(q[24:40]))
+	default:
+		return
+	}
+	return src, dst, true
+}
+
+// AsTSMPPacketTooBig returns pp as a TSMPPacketTooBig and whether it
+// is one. The returned Quote aliases pp's packet buffer.
+func (pp *Parsed) AsTSMPPacketTooBig() (h TSMPPacketTooBig, ok bool) {
+	if pp.IPProto != ipproto.TSMP {
+		return
+	}
+	p := pp.Payload()
+	if len(p) < 3 || p[0] != byte(TSMPTypePacketTooBig) {
+		return
+	}
+	h = TSMPPacketTooBig{
+		IPSrc: pp.Src.IP(),
+		IPDst: pp.Dst.IP(),
+		MTU:   binary.BigEndian.Uint16(p[1:3]),
+		Quote: p[3:],
+	}
+	return h, true
+}
+
+// ICMP returns the ICMPv4 "fragmentation needed" or ICMPv6 "packet too
+// big" message that corresponds to h, to be delivered to the local
+// network stack of the node that sent the packet that was too big. It
+// returns nil if h's IPs are of neither family.
+func (h TSMPPacketTooBig) ICMP() []byte {
+	q := h.quote()
+	switch {
+	case h.IPSrc.Is4():
+		// 2 unused bytes, then the next-hop MTU (RFC 1191).
+		payload := make([]byte, 4+len(q))
+		binary.BigEndian.PutUint16(payload[2:4], h.MTU)
+		copy(payload[4:], q)
+		return Generate(ICMP4Header{
+			IP4Header: IP4Header{Src: h.IPSrc, Dst: h.IPDst},
+			Type:      ICMP4Unreachable,
+			Code:      ICMP4FragmentationNeeded,
+		}, payload)
+	case h.IPSrc.Is6():
+		payload := make([]byte, 4+len(q))
+		binary.BigEndian.PutUint32(payload[0:4], uint32(h.MTU))
+		copy(payload[4:], q)
+		return Generate(ICMP6Header{
+			IP6Header: IP6Header{Src: h.IPSrc, Dst: h.IPDst},
+			Type:      ICMP6PacketTooBig,
+			Code:      ICMP6NoCode,
+		}, payload)
+	}
+	return nil
+}
@@ -5,9 +5,12 @@
 package packet
 
 import (
+	"bytes"
+	"encoding/binary"
 	"testing"
 
 	"inet.af/netaddr"
+	"tailscale.com/types/ipproto"
 )
 
 func TestTailscaleRejectedHeader(t *testing.T) {
@@ -73,3 +76,92 @@ func TestTailscaleRejectedHeader(t *testing.T) {
 		}
 	}
 }
+
+func TestTSMPPacketTooBig(t *testing.T) {
+	big := Generate(UDP4Header{
+		IP4Header: IP4Header{
+			Src: netaddr.MustParseIP("1.2.3.4"),
+			Dst: netaddr.MustParseIP("5.6.7.8"),
+		},
+		SrcPort: 567,
+		DstPort: 443,
+	}, make([]byte, 1400))
+	big6 := Generate(UDP6Header{
+		IP6Header: IP6Header{
+			Src: netaddr.MustParseIP("1::1"),
+			Dst: netaddr.MustParseIP("2::2"),
+		},
+		SrcPort: 567,
+		DstPort: 443,
+	}, make([]byte, 1400))
+
+	tests := []struct {
+		h         TSMPPacketTooBig
+		wantStr   string
+		wantProto ipproto.Proto
+		wantType  uint8
+	}{
+		{
+			h: TSMPPacketTooBig{
+				IPSrc: netaddr.MustParseIP("5.6.7.8"),
+				IPDst: netaddr.MustParseIP("1.2.3.4"),
+				MTU:   1280,
+				Quote: big,
+			},
+			wantStr:   "TSMP-packet-too-big{5.6.7.8 > 1.2.3.4}: mtu 1280",
+			wantProto: ICMPv4,
+			wantType:  uint8(ICMP4Unreachable),
+		},
+		{
+			h: TSMPPacketTooBig{
+				IPSrc: netaddr.MustParseIP("2::2"),
+				IPDst: netaddr.MustParseIP("1::1"),
+				MTU:   1280,
+				Quote: big6,
+			},
+			wantStr:   "TSMP-packet-too-big{2::2 > 1::1}: mtu 1280",
+			wantProto: ICMPv6,
+			wantType:  uint8(ICMP6PacketTooBig),
+		},
+	}
+	for i, tt := range tests {
+		if got := tt.h.String(); got != tt.wantStr {
+			t.Errorf("%v. String = %q; want %q", i, got, tt.wantStr)
+		}
+		pkt := Generate(tt.h, nil)
+
+		var p Parsed
+		p.Decode(pkt)
+		back, ok := p.AsTSMPPacketTooBig()
+		if !ok {
+			t.Errorf("%v. %02x didn't parse back", i, pkt)
+			continue
+		}
+		if back.IPSrc != tt.h.IPSrc || back.IPDst != tt.h.IPDst || back.MTU != tt.h.MTU {
+			t.Errorf("%v. parsed back as %v", i, back)
+		}
+		if !bytes.Equal(back.Quote, tt.h.Quote[:MaxTSMPPacketTooBigQuote]) {
+			t.Errorf("%v. quote = %02x; want %02x", i, back.Quote, tt.h.Quote[:MaxTSMPPacketTooBigQuote])
+		}
+		if src, dst, ok := back.QuotedAddrs(); !ok || src != tt.h.IPDst || dst != tt.h.IPSrc {
+			t.Errorf("%v. QuotedAddrs = %v, %v, %v; want %v, %v, true", i, src, dst, ok, tt.h.IPDst, tt.h.IPSrc)
+		}
+
+		var icmp Parsed
+		icmp.Decode(back.ICMP())
+		if icmp.IPProto != tt.wantProto || icmp.Src.IP() != tt.h.IPSrc || icmp.Dst.IP() != tt.h.IPDst {
+			t.Errorf("%v. ICMP = %v; want %v %v > %v", i, icmp.String(), tt.wantProto, tt.h.IPSrc, tt.h.IPDst)
+			continue
+		}
+		tr := icmp.Transport()
+		if tr[0] != tt.wantType {
+			t.Errorf("%v. ICMP type = %d; want %d", i, tr[0], tt.wantType)
+		}
+		if mtu := binary.BigEndian.Uint16(tr[6:8]); mtu != tt.h.MTU {
+			t.Errorf("%v. ICMP MTU = %d; want %d", i, mtu, tt.h.MTU)
+		}
+		if !bytes.Equal(tr[8:], tt.h.Quote[:MaxTSMPPacketTooBigQuote]) {
+			t.Errorf("%v. ICMP quote = %02x; want %02x", i, tr[8:], tt.h.Quote[:MaxTSMPPacketTooBigQuote])
+		}
+	}
+}
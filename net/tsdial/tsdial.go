@@ -38,6 +38,11 @@ type Dialer struct {
 	// If nil, it's not used.
 	NetstackDialTCP func(context.Context, netaddr.IPPort) (net.Conn, error)
 
+	// NetstackDialUDP dials the provided IPPort over UDP using
+	// netstack. If nil, UDP dials to IPs selected by
+	// UseNetstackForIP fail.
+	NetstackDialUDP func(context.Context, netaddr.IPPort) (net.Conn, error)
+
 	peerDialControlFuncAtomic atomic.Value // of func() func(network, address string, c syscall.RawConn) error
 
 	peerClientOnce sync.Once
@@ -205,6 +210,12 @@ func (d *Dialer) UserDial(ctx context.Context, network, addr string) (net.Conn,
 		return nil, err
 	}
 	if d.UseNetstackForIP != nil && d.UseNetstackForIP(ipp.IP()) {
+		if strings.HasPrefix(network, "udp") {
+			if d.NetstackDialUDP == nil {
+				return nil, errors.New("Dialer not initialized correctly for UDP")
+			}
+			return d.NetstackDialUDP(ctx, ipp)
+		}
 		if d.NetstackDialTCP == nil {
 			return nil, errors.New("Dialer not initialized correctly")
 		}
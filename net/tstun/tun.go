@@ -36,6 +36,10 @@ func init() {
 	}
 }
 
+// DefaultMTU returns the MTU that New creates TUN interfaces with,
+// which is used when no other MTU is configured.
+func DefaultMTU() int { return tunMTU }
+
 // createTAP is non-nil on Linux.
 var createTAP func(tapName, bridgeName string) (tun.Device, error)
 
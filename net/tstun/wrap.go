@@ -28,6 +28,7 @@
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/util/clientmetric"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/filter"
 )
 
@@ -42,6 +43,14 @@
 // of a packet that can be injected into a tstun.Wrapper.
 const MaxPacketSize = device.MaxContentSize
 
+// minMTU4 and minMTU6 are the smallest path MTUs that a peer can
+// report to us. 576 bytes is the smallest IPv4 datagram all hosts must
+// accept (RFC 791), and 1280 bytes the IPv6 minimum link MTU (RFC 8200).
+const (
+	minMTU4 = 576
+	minMTU6 = 1280
+)
+
 const tapDebug = false // for super verbose TAP debugging
 
 var (
@@ -147,6 +156,20 @@ type Wrapper struct {
 	// running for the given IP address.
 	PeerAPIPort func(netaddr.IP) (port uint16, ok bool)
 
+	// PeerMTU, if non-nil, returns the path MTU to the peer that
+	// packets to the given IP address are sent to, if known.
+	// Outgoing packets larger than it are dropped, and the local
+	// network stack is told about it with ICMP. It's only called for
+	// packets larger than the IPv6 minimum MTU.
+	PeerMTU func(netaddr.IP) (mtu int, ok bool)
+
+	// captureHook is the function called with each packet passing
+	// through the Wrapper, if a capture is in progress.
+	captureHook atomic.Value // of capture.Callback
+
+	// mtu is the MTU set by SetMTU, or zero if unset.
+	mtu int32 // atomic
+
 	// disableFilter disables all filtering when set. This should only be used in tests.
 	disableFilter bool
 
@@ -414,6 +437,13 @@ func (t *Wrapper) sendOutbound(r tunReadResult) {
 )
 
 func (t *Wrapper) filterOut(p *packet.Parsed) filter.Response {
+	res, _ := t.runFilterOut(p)
+	return res
+}
+
+// runFilterOut is filterOut, also returning a description of what
+// became of the packet for captures.
+func (t *Wrapper) runFilterOut(p *packet.Parsed) (_ filter.Response, note string) {
 	// Fake ICMP echo responses to MagicDNS (100.100.100.100).
 	if p.IsEchoRequest() {
 		switch p.Dst {
@@ -422,13 +452,13 @@ func (t *Wrapper) filterOut(p *packet.Parsed) filter.Response {
 			header.ToResponse()
 			outp := packet.Generate(&header, p.Payload())
 			t.InjectInboundCopy(outp)
-			return filter.DropSilently // don't pass on to OS; already handled
+			return filter.DropSilently, "handled by tailscaled" // don't pass on to OS; already handled
 		case magicDNSIPPortv6:
 			header := p.ICMP6Header()
 			header.ToResponse()
 			outp := packet.Generate(&header, p.Payload())
 			t.InjectInboundCopy(outp)
-			return filter.DropSilently // don't pass on to OS; already handled
+			return filter.DropSilently, "handled by tailscaled" // don't pass on to OS; already handled
 		}
 	}
 
@@ -440,34 +470,47 @@ func (t *Wrapper) filterOut(p *packet.Parsed) filter.Response {
 		t.isSelfDisco(p) {
 		t.limitedLogf("[unexpected] received self disco out packet over tstun; dropping")
 		metricPacketOutDropSelfDisco.Add(1)
-		return filter.DropSilently
+		return filter.DropSilently, "dropped self disco"
 	}
 
 	if t.PreFilterOut != nil {
 		if res := t.PreFilterOut(p, t); res.IsDrop() {
 			// Handled by userspaceEngine.handleLocalPackets (quad-100 DNS primarily).
-			return res
+			return res, "handled by tailscaled before filter"
 		}
 	}
 
 	filt, _ := t.filter.Load().(*filter.Filter)
 
 	if filt == nil {
-		return filter.Drop
+		return filter.Drop, "dropped: no filter"
 	}
 
 	if filt.RunOut(p, t.filterFlags) != filter.Accept {
 		metricPacketOutDropFilter.Add(1)
-		return filter.Drop
+		return filter.Drop, "dropped by filter"
+	}
+
+	if n := len(p.Buffer()); n > minMTU6 && t.PeerMTU != nil {
+		if mtu, ok := t.PeerMTU(p.Dst.IP()); ok && n > mtu {
+			metricPacketOutDropTooBig.Add(1)
+			t.injectInboundPacketTooBig(packet.TSMPPacketTooBig{
+				IPSrc: p.Dst.IP(),
+				IPDst: p.Src.IP(),
+				MTU:   uint16(mtu),
+				Quote: p.Buffer(),
+			})
+			return filter.Drop, "dropped: larger than path MTU"
+		}
 	}
 
 	if t.PostFilterOut != nil {
 		if res := t.PostFilterOut(p, t); res.IsDrop() {
-			return res
+			return res, "dropped after filter"
 		}
 	}
 
-	return filter.Accept
+	return filter.Accept, "accepted by filter"
 }
 
 // noteActivity records that there was a read or write at the current time.
@@ -516,12 +559,20 @@ func (t *Wrapper) Read(buf []byte, offset int) (int, error) {
 	}
 
 	// Do not filter injected packets.
-	if !isInjectedPacket && !t.disableFilter {
-		response := t.filterOut(p)
-		if response != filter.Accept {
-			metricPacketOutDrop.Add(1)
-			// Wireguard considers read errors fatal; pretend nothing was read
-			return 0, nil
+	if isInjectedPacket {
+		t.capture(capture.SynthesizedToPeer, capture.PostFilter, buf[offset:offset+n], "")
+	} else {
+		t.capture(capture.FromLocal, capture.PreFilter, buf[offset:offset+n], "")
+		if t.disableFilter {
+			t.capture(capture.FromLocal, capture.PostFilter, buf[offset:offset+n], "filter disabled")
+		} else {
+			response, note := t.runFilterOut(p)
+			t.capture(capture.FromLocal, capture.PostFilter, buf[offset:offset+n], note)
+			if response != filter.Accept {
+				metricPacketOutDrop.Add(1)
+				// Wireguard considers read errors fatal; pretend nothing was read
+				return 0, nil
+			}
 		}
 	}
 
@@ -530,6 +581,13 @@ func (t *Wrapper) Read(buf []byte, offset int) (int, error) {
 }
 
 func (t *Wrapper) filterIn(buf []byte) filter.Response {
+	res, _ := t.runFilterIn(buf)
+	return res
+}
+
+// runFilterIn is filterIn, also returning a description of what
+// became of the packet for captures.
+func (t *Wrapper) runFilterIn(buf []byte) (_ filter.Response, note string) {
 	p := parsedPacketPool.Get().(*packet.Parsed)
 	defer parsedPacketPool.Put(p)
 	p.Decode(buf)
@@ -538,11 +596,18 @@ func (t *Wrapper) filterIn(buf []byte) filter.Response {
 		if pingReq, ok := p.AsTSMPPing(); ok {
 			t.noteActivity()
 			t.injectOutboundPong(p, pingReq)
-			return filter.DropSilently
+			return filter.DropSilently, "TSMP ping handled by tailscaled"
 		} else if data, ok := p.AsTSMPPong(); ok {
 			if f := t.OnTSMPPongReceived; f != nil {
 				f(data)
 			}
+		} else if ptb, ok := p.AsTSMPPacketTooBig(); ok {
+			if !t.validPacketTooBig(ptb) {
+				metricPacketInDropTSMPPacketTooBig.Add(1)
+				return filter.Drop, "dropped: TSMP packet too big about another flow"
+			}
+			t.injectInboundPacketTooBig(ptb)
+			return filter.DropSilently, "TSMP packet too big handled by tailscaled"
 		}
 	}
 
@@ -554,19 +619,19 @@ func (t *Wrapper) filterIn(buf []byte) filter.Response {
 		t.isSelfDisco(p) {
 		t.limitedLogf("[unexpected] received self disco in packet over tstun; dropping")
 		metricPacketInDropSelfDisco.Add(1)
-		return filter.DropSilently
+		return filter.DropSilently, "dropped self disco"
 	}
 
 	if t.PreFilterIn != nil {
 		if res := t.PreFilterIn(p, t); res.IsDrop() {
-			return res
+			return res, "dropped before filter"
 		}
 	}
 
 	filt, _ := t.filter.Load().(*filter.Filter)
 
 	if filt == nil {
-		return filter.Drop
+		return filter.Drop, "dropped: no filter"
 	}
 
 	outcome := filt.RunIn(p, t.filterFlags)
@@ -607,24 +672,37 @@ func (t *Wrapper) filterIn(buf []byte) filter.Response {
 			// TODO(bradfitz): also send a TCP RST, after the TSMP message.
 		}
 
-		return filter.Drop
+		return filter.Drop, "dropped by filter"
+	}
+
+	// Tell the peer, via TSMP, that the packet was too big for our
+	// MTU, so its network stack can lower its path MTU rather than
+	// retransmitting the packet forever.
+	if mtu := t.getMTU(); mtu > 0 && len(buf) > mtu && p.IPProto != ipproto.TSMP {
+		metricPacketInDropTooBig.Add(1)
+		t.injectOutboundPacketTooBig(p, mtu)
+		return filter.Drop, "dropped: larger than MTU"
 	}
 
 	if t.PostFilterIn != nil {
 		if res := t.PostFilterIn(p, t); res.IsDrop() {
-			return res
+			// Primarily netstack, in userspace-networking mode.
+			return res, "accepted by filter, handled by tailscaled"
 		}
 	}
 
-	return filter.Accept
+	return filter.Accept, "accepted by filter"
 }
 
 // Write accepts an incoming packet. The packet begins at buf[offset:],
 // like wireguard-go/tun.Device.Write.
 func (t *Wrapper) Write(buf []byte, offset int) (int, error) {
 	metricPacketIn.Add(1)
+	t.capture(capture.FromPeer, capture.PreFilter, buf[offset:], "")
 	if !t.disableFilter {
-		if t.filterIn(buf[offset:]) != filter.Accept {
+		res, note := t.runFilterIn(buf[offset:])
+		t.capture(capture.FromPeer, capture.PostFilter, buf[offset:], note)
+		if res != filter.Accept {
 			metricPacketInDrop.Add(1)
 			// If we're not accepting the packet, lie to wireguard-go and pretend
 			// that everything is okay with a nil error, so wireguard-go
@@ -641,6 +719,8 @@ func (t *Wrapper) Write(buf []byte, offset int) (int, error) {
 			// TODO(bradfitz): fix upstream interface docs, implementation.
 			return len(buf), nil
 		}
+	} else {
+		t.capture(capture.FromPeer, capture.PostFilter, buf[offset:], "filter disabled")
 	}
 
 	t.noteActivity()
@@ -682,6 +762,8 @@ func (t *Wrapper) InjectInboundDirect(buf []byte, offset int) error {
 		return errOffsetTooSmall
 	}
 
+	t.capture(capture.SynthesizedToLocal, capture.PostFilter, buf[offset:], "")
+
 	// Write to the underlying device to skip filters.
 	_, err := t.tdevWrite(buf, offset)
 	return err
@@ -729,6 +811,47 @@ func (t *Wrapper) injectOutboundPong(pp *packet.Parsed, req packet.TSMPPingReque
 	t.InjectOutbound(packet.Generate(pong, nil))
 }
 
+// injectOutboundPacketTooBig tells the sender of pp, which is larger
+// than mtu, that it was dropped.
+func (t *Wrapper) injectOutboundPacketTooBig(pp *packet.Parsed, mtu int) {
+	ptb := packet.TSMPPacketTooBig{
+		IPSrc: pp.Dst.IP(),
+		IPDst: pp.Src.IP(),
+		MTU:   uint16(mtu),
+		Quote: pp.Buffer(),
+	}
+	t.InjectOutbound(packet.Generate(ptb, nil))
+}
+
+// validPacketTooBig reports whether ptb, received from a peer, is
+// about a packet this node sent to that peer. Otherwise, any peer could
+// lower our path MTU towards the others.
+func (t *Wrapper) validPacketTooBig(ptb packet.TSMPPacketTooBig) bool {
+	filt, _ := t.filter.Load().(*filter.Filter)
+	if filt == nil {
+		return false
+	}
+	src, dst, ok := ptb.QuotedAddrs()
+	return ok && src == ptb.IPDst && dst == ptb.IPSrc && filt.IsLocal(src)
+}
+
+// injectInboundPacketTooBig delivers the ICMP equivalent of ptb, which
+// a peer sent (or PeerMTU implied) about a packet of ours that was too
+// big for it, to the local network stack.
+func (t *Wrapper) injectInboundPacketTooBig(ptb packet.TSMPPacketTooBig) {
+	// Don't let a peer lower our path MTU below what the protocol
+	// requires links to support.
+	min := uint16(minMTU6)
+	if ptb.IPSrc.Is4() {
+		min = minMTU4
+	}
+	if ptb.MTU < min {
+		ptb.MTU = min
+	}
+	metricPacketInTSMPPacketTooBig.Add(1)
+	t.InjectInboundCopy(ptb.ICMP())
+}
+
 // InjectOutbound makes the Wrapper device behave as if a packet
 // with the given contents was sent to the network.
 // It does not block, but takes ownership of the packet.
@@ -745,6 +868,42 @@ func (t *Wrapper) InjectOutbound(packet []byte) error {
 	return nil
 }
 
+// InstallCaptureHook sets the function called with each packet passing
+// through t, or clears it if cb is nil.
+//
+// Packets are captured both before the packet filter, as they
+// arrived, and after it, annotated with what became of them, so that
+// packets dropped before the filter runs are seen too. Captures
+// include the packets injected by tailscaled and, in
+// userspace-networking mode, sent and received by netstack.
+func (t *Wrapper) InstallCaptureHook(cb capture.Callback) {
+	t.captureHook.Store(cb)
+}
+
+// capture passes pkt to the capture hook, if any.
+func (t *Wrapper) capture(path capture.Path, stage capture.Stage, pkt []byte, note string) {
+	if cb, _ := t.captureHook.Load().(capture.Callback); cb != nil {
+		cb(path, stage, time.Now(), pkt, note)
+	}
+}
+
+// SetMTU sets the MTU of t's interface, as configured by the user.
+// Packets from peers that are larger than it are dropped, and the
+// peer is told about it via TSMP, so that its network stack can lower
+// its path MTU for us. Zero means to not check the size of packets.
+//
+// SetMTU doesn't change the MTU of the underlying tun.Device.
+func (t *Wrapper) SetMTU(mtu int) {
+	if mtu > MaxPacketSize {
+		mtu = MaxPacketSize
+	}
+	atomic.StoreInt32(&t.mtu, int32(mtu))
+}
+
+func (t *Wrapper) getMTU() int {
+	return int(atomic.LoadInt32(&t.mtu))
+}
+
 // Unwrap returns the underlying tun.Device.
 func (t *Wrapper) Unwrap() tun.Device {
 	return t.tdev
@@ -755,9 +914,14 @@ func (t *Wrapper) Unwrap() tun.Device {
 	metricPacketInDrop          = clientmetric.NewGauge("tstun_in_from_wg_drop")
 	metricPacketInDropFilter    = clientmetric.NewGauge("tstun_in_from_wg_drop_filter")
 	metricPacketInDropSelfDisco = clientmetric.NewGauge("tstun_in_from_wg_drop_self_disco")
+	metricPacketInDropTooBig    = clientmetric.NewGauge("tstun_in_from_wg_drop_too_big")
+
+	metricPacketInTSMPPacketTooBig     = clientmetric.NewGauge("tstun_in_from_wg_tsmp_packet_too_big")
+	metricPacketInDropTSMPPacketTooBig = clientmetric.NewGauge("tstun_in_from_wg_drop_tsmp_packet_too_big")
 
 	metricPacketOut              = clientmetric.NewGauge("tstun_out_to_wg")
 	metricPacketOutDrop          = clientmetric.NewGauge("tstun_out_to_wg_drop")
 	metricPacketOutDropFilter    = clientmetric.NewGauge("tstun_out_to_wg_drop_filter")
 	metricPacketOutDropSelfDisco = clientmetric.NewGauge("tstun_out_to_wg_drop_self_disco")
+	metricPacketOutDropTooBig    = clientmetric.NewGauge("tstun_out_to_wg_drop_too_big")
 )
@@ -11,6 +11,7 @@
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 	"unsafe"
 
 	"go4.org/mem"
@@ -23,6 +24,7 @@
 	"tailscale.com/types/ipproto"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/filter"
 )
 
@@ -531,3 +533,163 @@ func TestFilterDiscoLoop(t *testing.T) {
 		t.Errorf("log output mismatch\n got: %q\nwant: %q\n", got, want)
 	}
 }
+
+func TestCaptureHook(t *testing.T) {
+	_, tun := newFakeTUN(t.Logf, true)
+	defer tun.Close()
+
+	type record struct {
+		path  capture.Path
+		stage capture.Stage
+		pkt   []byte
+		note  string
+	}
+	var got []record
+	tun.InstallCaptureHook(func(path capture.Path, stage capture.Stage, when time.Time, pkt []byte, note string) {
+		got = append(got, record{path, stage, append([]byte(nil), pkt...), note})
+	})
+
+	good := udp4("5.6.7.8", "1.2.3.4", 89, 89)
+	bad := udp4("8.1.1.1", "1.2.3.4", 89, 89)
+	out := udp4("1.2.3.4", "5.6.7.8", 98, 98)
+	tun.Write(good, 0)
+	tun.Write(bad, 0)
+	tun.InjectInboundCopy(good)
+	tun.InjectOutbound(out)
+	var buf [MaxPacketSize]byte
+	if n, err := tun.Read(buf[:], 0); err != nil || n != len(out) {
+		t.Fatalf("Read = %d, %v; want %d, nil", n, err, len(out))
+	}
+
+	want := []record{
+		{capture.FromPeer, capture.PreFilter, good, ""},
+		{capture.FromPeer, capture.PostFilter, good, "accepted by filter"},
+		{capture.FromPeer, capture.PreFilter, bad, ""},
+		{capture.FromPeer, capture.PostFilter, bad, "dropped by filter"},
+		{capture.SynthesizedToLocal, capture.PostFilter, good, ""},
+		{capture.SynthesizedToPeer, capture.PostFilter, out, ""},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("captured %d packets; want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].path != want[i].path || got[i].stage != want[i].stage || !bytes.Equal(got[i].pkt, want[i].pkt) || got[i].note != want[i].note {
+			t.Errorf("packet %d: got %v, %v, %q; want %v, %v, %q", i, got[i].path, got[i].stage, got[i].note, want[i].path, want[i].stage, want[i].note)
+		}
+	}
+
+	tun.InstallCaptureHook(nil)
+	tun.Write(good, 0)
+	if len(got) != len(want) {
+		t.Errorf("packet captured after the hook was removed")
+	}
+}
+
+func TestPacketTooBig(t *testing.T) {
+	_, tun := newFakeTUN(t.Logf, true)
+	defer tun.Close()
+	tun.SetMTU(minMTU4)
+
+	var toLocal [][]byte
+	tun.InstallCaptureHook(func(path capture.Path, stage capture.Stage, when time.Time, pkt []byte, note string) {
+		if path == capture.SynthesizedToLocal {
+			toLocal = append(toLocal, append([]byte(nil), pkt...))
+		}
+	})
+
+	big := packet.Generate(&packet.UDP4Header{
+		IP4Header: packet.IP4Header{
+			Src: netaddr.MustParseIP("5.6.7.8"),
+			Dst: netaddr.MustParseIP("1.2.3.4"),
+		},
+		SrcPort: 89,
+		DstPort: 89,
+	}, make([]byte, 1000))
+	if res := tun.filterIn(udp4("5.6.7.8", "1.2.3.4", 89, 89)); res != filter.Accept {
+		t.Fatalf("small packet: %v; want Accept", res)
+	}
+	if res := tun.filterIn(big); res != filter.Drop {
+		t.Fatalf("big packet: %v; want Drop", res)
+	}
+
+	// The sender of the big packet is told about it.
+	var buf [MaxPacketSize]byte
+	n, err := tun.Read(buf[:], 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p packet.Parsed
+	p.Decode(buf[:n])
+	ptb, ok := p.AsTSMPPacketTooBig()
+	if !ok {
+		t.Fatalf("read %v; want TSMP packet too big", p.String())
+	}
+	if ptb.IPSrc != netaddr.MustParseIP("1.2.3.4") || ptb.IPDst != netaddr.MustParseIP("5.6.7.8") || ptb.MTU != minMTU4 {
+		t.Errorf("got %v; want it from 1.2.3.4 to 5.6.7.8 with MTU %d", ptb, minMTU4)
+	}
+	if !bytes.HasPrefix(big, ptb.Quote) {
+		t.Errorf("quote %02x isn't the start of the big packet", ptb.Quote)
+	}
+
+	// A peer's message about a packet we sent it is turned into
+	// ICMP for our network stack, not letting the MTU go below the
+	// minimum.
+	ours := packet.Generate(&packet.UDP4Header{
+		IP4Header: packet.IP4Header{
+			Src: netaddr.MustParseIP("1.2.3.4"),
+			Dst: netaddr.MustParseIP("5.6.7.8"),
+		},
+		SrcPort: 98,
+		DstPort: 98,
+	}, make([]byte, 1000))
+	ptb = packet.TSMPPacketTooBig{
+		IPSrc: netaddr.MustParseIP("5.6.7.8"),
+		IPDst: netaddr.MustParseIP("1.2.3.4"),
+		MTU:   100,
+		Quote: ours,
+	}
+	if res := tun.filterIn(packet.Generate(ptb, nil)); res != filter.DropSilently {
+		t.Fatalf("TSMP packet too big: %v; want DropSilently", res)
+	}
+	if len(toLocal) != 1 {
+		t.Fatalf("injected %d packets towards the local stack; want 1", len(toLocal))
+	}
+	p.Decode(toLocal[0])
+	if p.IPProto != ipproto.ICMPv4 || p.Src.IP() != ptb.IPSrc || p.Dst.IP() != ptb.IPDst {
+		t.Fatalf("injected %v; want ICMP from %v to %v", p.String(), ptb.IPSrc, ptb.IPDst)
+	}
+	icmp := p.Transport()
+	if typ, code, mtu := packet.ICMP4Type(icmp[0]), packet.ICMP4Code(icmp[1]), binary.BigEndian.Uint16(icmp[6:]); typ != packet.ICMP4Unreachable || code != packet.ICMP4FragmentationNeeded || mtu != minMTU4 {
+		t.Errorf("ICMP type, code, MTU = %v, %v, %d; want %v, %v, %d", typ, code, mtu, packet.ICMP4Unreachable, packet.ICMP4FragmentationNeeded, minMTU4)
+	}
+
+	// Messages about packets we didn't send to their sender are
+	// dropped.
+	toPeer := func(src, dst string) []byte {
+		return packet.Generate(&packet.UDP4Header{
+			IP4Header: packet.IP4Header{
+				Src: netaddr.MustParseIP(src),
+				Dst: netaddr.MustParseIP(dst),
+			},
+			SrcPort: 98,
+			DstPort: 98,
+		}, make([]byte, 1000))
+	}
+	for _, tt := range []struct {
+		name  string
+		quote []byte
+	}{
+		{"other_peer", toPeer("1.2.3.4", "9.9.9.9")},
+		{"not_local", toPeer("9.9.9.9", "5.6.7.8")},
+		{"other_local", toPeer("1.2.5.5", "5.6.7.8")},
+		{"short", ours[:10]},
+	} {
+		ptb.Quote = tt.quote
+		if res := tun.filterIn(packet.Generate(ptb, nil)); res != filter.Drop {
+			t.Errorf("%s: %v; want Drop", tt.name, res)
+		}
+	}
+	if len(toLocal) != 1 {
+		t.Errorf("injected %d packets towards the local stack; want 1", len(toLocal))
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package udpbatch reads UDP packets in batches, to amortize the cost
+// of a system call over many packets.
+//
+// It's only implemented on Linux, where it uses recvmmsg, plus UDP
+// generic receive offload (UDP_GRO) when the kernel supports it.
+//
+// There are no batched writes: the version of wireguard-go in use
+// passes magicsock one packet per conn.Bind Send call, so there would
+// be nothing to batch.
+package udpbatch
+
+import (
+	"net"
+
+	"tailscale.com/util/clientmetric"
+)
+
+// New returns a Conn doing batched reads from pc, or nil if batching
+// isn't supported on this platform or for pc.
+//
+// pc must not be read from other than via the returned Conn.
+func New(pc *net.UDPConn) *Conn {
+	return newConn(pc)
+}
+
+var (
+	metricReadBatches = clientmetric.NewCounter("udpbatch_read_batches")
+	metricReadPackets = clientmetric.NewCounter("udpbatch_read_packets")
+)
@@ -0,0 +1,31 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package udpbatch
+
+import (
+	"errors"
+	"net"
+
+	"inet.af/netaddr"
+)
+
+// Conn reads from a UDP socket in batches. It's unused on this
+// platform, where New always returns nil.
+type Conn struct{}
+
+func newConn(pc *net.UDPConn) *Conn { return nil }
+
+var errUnsupported = errors.New("udpbatch: unsupported on this platform")
+
+// ReadFromNetaddr reads a packet into b.
+func (c *Conn) ReadFromNetaddr(b []byte) (n int, ipp netaddr.IPPort, err error) {
+	return 0, netaddr.IPPort{}, errUnsupported
+}
+
+// GRO reports whether UDP generic receive offload is enabled.
+func (c *Conn) GRO() bool { return false }
@@ -0,0 +1,189 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package udpbatch
+
+import (
+	"io"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+	"inet.af/netaddr"
+	"tailscale.com/util/endian"
+)
+
+const (
+	// udpGRO is the UDP_GRO socket option and control message type,
+	// from linux/udp.h. It's not in x/sys/unix yet.
+	udpGRO = 104
+
+	// batchSize is the most messages read per recvmmsg.
+	batchSize = 8
+
+	// bufSize is the size of each message's receive buffer: big
+	// enough for the largest UDP payload, and so for the packets
+	// GRO coalesces.
+	bufSize = 65535
+)
+
+// batchReader is the batched reading of an ipv4.PacketConn or
+// ipv6.PacketConn. Their Message types are the same.
+type batchReader interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// Conn reads from a UDP socket in batches.
+//
+// The first packet of each batch is read straight into the caller's
+// buffer. Only the rest, which are returned by later calls without a
+// system call, are copied.
+type Conn struct {
+	br  batchReader
+	gro bool // whether UDP_GRO is enabled on the socket
+
+	// The following are owned by the goroutine calling
+	// ReadFromNetaddr.
+	rms   []ipv4.Message
+	rbuf0 []byte // rms[0]'s own buffer, for the rest of its batch
+	rn    int    // number of messages in rms from the last recvmmsg
+	ri    int    // index in rms of the message to return from next
+	roff  int    // offset in rms[ri] of its next segment
+	rseg  int    // segment size of rms[ri]
+}
+
+func newConn(pc *net.UDPConn) *Conn {
+	la, ok := pc.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	rc, err := pc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	c := new(Conn)
+	if la.IP.To4() != nil {
+		c.br = ipv4.NewPacketConn(pc)
+	} else {
+		c.br = ipv6.NewPacketConn(pc)
+	}
+	var groErr error
+	err = rc.Control(func(fd uintptr) {
+		groErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_UDP, udpGRO, 1)
+	})
+	if err != nil {
+		return nil
+	}
+	c.gro = groErr == nil
+
+	c.rms = make([]ipv4.Message, batchSize)
+	for i := range c.rms {
+		c.rms[i].Buffers = [][]byte{make([]byte, bufSize)}
+		c.rms[i].OOB = make([]byte, unix.CmsgSpace(4))
+	}
+	c.rbuf0 = c.rms[0].Buffers[0]
+	return c
+}
+
+// GRO reports whether UDP generic receive offload is enabled.
+func (c *Conn) GRO() bool { return c.gro }
+
+// ReadFromNetaddr reads a packet into b, returning its length and
+// source. It returns packets one at a time from a batch read with
+// recvmmsg, splitting the ones GRO coalesced.
+//
+// b should be big enough for the largest UDP payload, as GRO may
+// coalesce several packets into it. It must not be called
+// concurrently.
+func (c *Conn) ReadFromNetaddr(b []byte) (n int, ipp netaddr.IPPort, err error) {
+	if c.ri < c.rn {
+		return c.readNext(b)
+	}
+	c.ri, c.roff = 0, 0
+	c.rms[0].Buffers[0] = b
+	c.rn, err = c.br.ReadBatch(c.rms, 0)
+	c.rms[0].Buffers[0] = c.rbuf0
+	if err != nil || c.rn == 0 {
+		c.rn = 0
+		return 0, netaddr.IPPort{}, err
+	}
+	metricReadBatches.Add(1)
+	metricReadPackets.Add(1)
+
+	m := &c.rms[0]
+	ipp = addrPort(m)
+	if m.Flags&unix.MSG_TRUNC != 0 {
+		c.advance()
+		return m.N, ipp, io.ErrShortBuffer
+	}
+	seg := segmentSize(m)
+	if m.N <= seg {
+		c.advance()
+		return m.N, ipp, nil
+	}
+	// GRO coalesced several packets into b, which the caller
+	// may reuse before the next call. Keep the rest for then.
+	m.N = copy(c.rbuf0, b[seg:m.N])
+	c.rseg = seg
+	return seg, ipp, nil
+}
+
+// readNext returns the next packet of the current batch.
+func (c *Conn) readNext(b []byte) (n int, ipp netaddr.IPPort, err error) {
+	m := &c.rms[c.ri]
+	seg := m.Buffers[0][c.roff:m.N]
+	if len(seg) > c.rseg {
+		seg = seg[:c.rseg]
+	}
+	n = copy(b, seg)
+	ipp = addrPort(m)
+	c.roff += len(seg)
+	if c.roff >= m.N {
+		c.advance()
+	}
+	metricReadPackets.Add(1)
+	if n < len(seg) {
+		return n, ipp, io.ErrShortBuffer
+	}
+	return n, ipp, nil
+}
+
+// advance moves on to the next message of the current batch.
+func (c *Conn) advance() {
+	c.ri++
+	c.roff = 0
+	if c.ri < c.rn {
+		c.rseg = segmentSize(&c.rms[c.ri])
+	}
+}
+
+func addrPort(m *ipv4.Message) netaddr.IPPort {
+	ua, ok := m.Addr.(*net.UDPAddr)
+	if !ok {
+		return netaddr.IPPort{}
+	}
+	ipp, _ := netaddr.FromStdAddr(ua.IP, ua.Port, ua.Zone)
+	return ipp
+}
+
+// segmentSize returns the size of the segments of the packet read into
+// m, which is less than its length if GRO coalesced it from several.
+func segmentSize(m *ipv4.Message) int {
+	if m.NN == 0 {
+		return m.N
+	}
+	cms, err := unix.ParseSocketControlMessage(m.OOB[:m.NN])
+	if err != nil {
+		return m.N
+	}
+	for _, cm := range cms {
+		if cm.Header.Level == unix.IPPROTO_UDP && cm.Header.Type == udpGRO && len(cm.Data) >= 4 {
+			if s := int(endian.Native.Uint32(cm.Data)); s > 0 {
+				return s
+			}
+		}
+	}
+	return m.N
+}
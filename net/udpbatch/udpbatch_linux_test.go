@@ -0,0 +1,66 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package udpbatch
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"inet.af/netaddr"
+)
+
+func TestRead(t *testing.T) {
+	listen := func() *net.UDPConn {
+		pc, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		return pc
+	}
+	spc, rpc := listen(), listen()
+	rc := New(rpc)
+	if rc == nil {
+		t.Fatal("New returned nil")
+	}
+	t.Logf("GRO=%v", rc.GRO())
+
+	var pkts [][]byte
+	for i := 0; i < 2*batchSize; i++ {
+		pkts = append(pkts, bytes.Repeat([]byte{byte(i)}, 1200))
+	}
+	pkts = append(pkts, []byte("short"))
+	for _, p := range pkts {
+		if _, err := spc.WriteTo(p, rpc.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src := netaddr.MustParseIPPort(spc.LocalAddr().String())
+	buf := make([]byte, bufSize)
+	for i, want := range pkts {
+		n, ipp, err := rc.ReadFromNetaddr(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ipp != src {
+			t.Errorf("packet %d from %v; want %v", i, ipp, src)
+		}
+		if !bytes.Equal(buf[:n], want) {
+			t.Errorf("packet %d is %d bytes %q...; want %d bytes %q...", i, n, buf[:1], len(want), want[:1])
+		}
+	}
+
+	// Reads into a buffer that's too small are reported.
+	if _, err := spc.WriteTo(pkts[0], rpc.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := rc.ReadFromNetaddr(buf[:100]); !errors.Is(err, io.ErrShortBuffer) {
+		t.Errorf("read into short buffer: err = %v; want %v", err, io.ErrShortBuffer)
+	}
+}
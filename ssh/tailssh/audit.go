@@ -0,0 +1,108 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios)
+// +build linux darwin,!ios
+
+package tailssh
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync/atomic"
+
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// errSessionKilled is the error a session is terminated with when
+// killed via the LocalAPI.
+var errSessionKilled = errors.New("session killed")
+
+// loginName returns the login name of the connecting node's user, or
+// its tags if it's a tagged node.
+func (ci *sshConnInfo) loginName() string {
+	if ci.node != nil && len(ci.node.Tags) > 0 {
+		return strings.Join(ci.node.Tags, ",")
+	}
+	if ci.uprof != nil {
+		return ci.uprof.LoginName
+	}
+	return ""
+}
+
+// event returns an audit event of type typ about the connection.
+func (ci *sshConnInfo) event(typ apitype.SSHEventType) apitype.SSHEvent {
+	ev := apitype.SSHEvent{
+		Type:      typ,
+		SrcIP:     ci.src.IP().String(),
+		SSHUser:   ci.sshUser,
+		LoginName: ci.loginName(),
+	}
+	if ci.node != nil {
+		ev.SrcNode = strings.TrimSuffix(ci.node.Name, ".")
+		ev.SrcNodeID = ci.node.StableID
+	}
+	return ev
+}
+
+// event returns an audit event of type typ about the session.
+func (ss *sshSession) event(typ apitype.SSHEventType) apitype.SSHEvent {
+	ev := ss.connInfo.event(typ)
+	ev.SessionID = ss.sharedID
+	ev.LocalUser = ss.localUser.Username
+	ev.Command = ss.RawCommand()
+	ev.Subsystem = ss.Subsystem()
+	return ev
+}
+
+// apiSession returns the LocalAPI description of the session.
+func (ss *sshSession) apiSession() apitype.SSHSession {
+	ci := ss.connInfo
+	s := apitype.SSHSession{
+		ID:        ss.sharedID,
+		Start:     ci.now,
+		SrcIP:     ci.src.IP().String(),
+		LoginName: ci.loginName(),
+		LocalUser: ss.localUser.Username,
+		Command:   ss.RawCommand(),
+		Subsystem: ss.Subsystem(),
+	}
+	if ci.node != nil {
+		s.SrcNode = strings.TrimSuffix(ci.node.Name, ".")
+		s.SrcNodeID = ci.node.StableID
+	}
+	_, _, s.PTY = ss.Pty()
+	return s
+}
+
+// actionString returns a short description of a's outcome for audit
+// events.
+func actionString(a *tailcfg.SSHAction) string {
+	switch {
+	case a == nil:
+		return ""
+	case a.Reject:
+		return "reject"
+	case a.Accept:
+		return "accept"
+	case a.HoldAndDelegate != "":
+		return "hold"
+	}
+	return "reject"
+}
+
+// countingWriter is an io.Writer that counts the bytes written
+// through it to w.
+type countingWriter struct {
+	w io.Writer
+	n *int64 // updated atomically
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
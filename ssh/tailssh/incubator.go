@@ -20,15 +20,18 @@
 	"io"
 	"log"
 	"log/syslog"
+	"net"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 
 	"github.com/creack/pty"
+	"github.com/pkg/sftp"
 	"github.com/tailscale/ssh"
 	"github.com/u-root/u-root/pkg/termios"
 	gossh "golang.org/x/crypto/ssh"
@@ -58,6 +61,9 @@ func init() {
 //
 // If ss.srv.tailscaledPath is empty, this method is equivalent to
 // exec.CommandContext.
+//
+// If ss is an SFTP subsystem session, name and args are ignored and
+// the incubator serves SFTP itself after dropping privileges.
 func (ss *sshSession) newIncubatorCommand(ctx context.Context, name string, args []string) *exec.Cmd {
 	if ss.srv.tailscaledPath == "" {
 		return exec.CommandContext(ctx, name, args...)
@@ -68,18 +74,29 @@ func (ss *sshSession) newIncubatorCommand(ctx context.Context, name string, args
 	if len(ci.node.Tags) > 0 {
 		remoteUser = strings.Join(ci.node.Tags, ",")
 	}
+	groups, err := lu.GroupIds()
+	if err != nil {
+		ss.logf("failed to look up groups of %q: %v", lu.Username, err)
+		groups = []string{lu.Gid}
+	}
 
 	incubatorArgs := []string{
 		"be-child",
 		"ssh",
 		"--uid=" + lu.Uid,
+		"--gid=" + lu.Gid,
+		"--groups=" + strings.Join(groups, ","),
 		"--local-user=" + lu.Username,
 		"--remote-user=" + remoteUser,
 		"--remote-ip=" + ci.src.IP().String(),
-		"--cmd=" + name,
 		"--has-tty=false", // updated in-place by startWithPTY
 		"--tty-name=",     // updated in-place by startWithPTY
 	}
+	if ss.Subsystem() == "sftp" {
+		incubatorArgs = append(incubatorArgs, "--sftp")
+		return exec.CommandContext(ctx, ss.srv.tailscaledPath, incubatorArgs...)
+	}
+	incubatorArgs = append(incubatorArgs, "--cmd="+name)
 	if len(args) > 0 {
 		incubatorArgs = append(incubatorArgs, "--")
 		incubatorArgs = append(incubatorArgs, args...)
@@ -102,12 +119,16 @@ func beIncubator(args []string) error {
 	var (
 		flags      = flag.NewFlagSet("", flag.ExitOnError)
 		uid        = flags.Uint64("uid", 0, "the uid of local-user")
+		gid        = flags.Uint64("gid", 0, "the primary gid of local-user")
+		groups     = flags.String("groups", "", "comma-separated supplementary gids of local-user")
 		localUser  = flags.String("local-user", "", "the user to run as")
 		remoteUser = flags.String("remote-user", "", "the remote user/tags")
 		remoteIP   = flags.String("remote-ip", "", "the remote Tailscale IP")
 		ttyName    = flags.String("tty-name", "", "the tty name (pts/3)")
 		hasTTY     = flags.Bool("has-tty", false, "is the output attached to a tty")
 		cmdName    = flags.String("cmd", "", "the cmd to launch")
+		isSFTP     = flags.Bool("sftp", false, "run the SFTP server instead of a command")
+		dialUnix   = flags.String("dial-unix", "", "relay stdin and stdout to this Unix socket instead of running a command")
 	)
 	if err := flags.Parse(args); err != nil {
 		return err
@@ -127,18 +148,40 @@ func beIncubator(args []string) error {
 	// We can only do this if we are running as root.
 	// This is best effort to still allow running on machines where
 	// we don't support starting session, e.g. darwin.
-	sessionCloser, err := maybeStartLoginSession(logf, uint32(*uid), *localUser, *remoteUser, *remoteIP, *ttyName)
-	if err == nil && sessionCloser != nil {
-		defer sessionCloser()
+	// Port forwards don't log anyone in.
+	if *dialUnix == "" {
+		sessionCloser, err := maybeStartLoginSession(logf, uint32(*uid), *localUser, *remoteUser, *remoteIP, *ttyName)
+		if err == nil && sessionCloser != nil {
+			defer sessionCloser()
+		}
 	}
 	if euid != *uid {
 		// Switch users if required before starting the desired process.
-		if err := syscall.Setuid(int(*uid)); err != nil {
+		// The groups must be dropped first, while we still can.
+		if err := dropPrivileges(*uid, *gid, *groups); err != nil {
 			logf(err.Error())
 			os.Exit(1)
 		}
 	}
 
+	if *dialUnix != "" {
+		return relayUnix(*dialUnix, stdRWC{})
+	}
+
+	if *isSFTP {
+		logf("handling sftp")
+		server, err := sftp.NewServer(stdRWC{})
+		if err != nil {
+			return err
+		}
+		// Serve returns io.EOF when the client ends the session, after
+		// closing any files it left open.
+		if err := server.Serve(); err != nil && err != io.EOF {
+			return err
+		}
+		return nil
+	}
+
 	cmd := exec.Command(*cmdName, cmdArgs...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
@@ -160,6 +203,74 @@ func beIncubator(args []string) error {
 	return cmd.Run()
 }
 
+// dropPrivileges sets the supplementary groups, gid and uid of the
+// process, in that order. groups is a comma-separated list of gids.
+func dropPrivileges(uid, gid uint64, groups string) error {
+	var gids []int
+	for _, g := range strings.Split(groups, ",") {
+		if g == "" {
+			continue
+		}
+		v, err := strconv.Atoi(g)
+		if err != nil {
+			return fmt.Errorf("invalid group id %q: %w", g, err)
+		}
+		gids = append(gids, v)
+	}
+	if err := syscall.Setgroups(gids); err != nil {
+		return fmt.Errorf("Setgroups: %w", err)
+	}
+	if err := syscall.Setgid(int(gid)); err != nil {
+		return fmt.Errorf("Setgid: %w", err)
+	}
+	if err := syscall.Setuid(int(uid)); err != nil {
+		return fmt.Errorf("Setuid: %w", err)
+	}
+	return nil
+}
+
+// relayUnix connects to the Unix socket at path and relays between it
+// and rw until the socket's side of the connection is done. Once
+// connected, it writes a single byte to rw so the parent can tell a
+// successful dial from a failed one before accepting the SSH channel.
+func relayUnix(path string, rw io.ReadWriter) error {
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if _, err := rw.Write([]byte{0}); err != nil {
+		return err
+	}
+	go func() {
+		io.Copy(c, rw)
+		c.(*net.UnixConn).CloseWrite()
+	}()
+	_, err = io.Copy(rw, c)
+	return err
+}
+
+// stdRWC is an io.ReadWriteCloser of the incubator's stdin and stdout,
+// used to serve SFTP.
+type stdRWC struct{}
+
+func (stdRWC) Read(p []byte) (n int, err error) {
+	return os.Stdin.Read(p)
+}
+
+func (stdRWC) Write(b []byte) (n int, err error) {
+	return os.Stdout.Write(b)
+}
+
+// Close closes stdout and stdin. The SFTP server calls it when it
+// fails to handle a packet; Serve then returns once the client sees
+// the end of its output and hangs up, rather than exiting with files
+// still open.
+func (stdRWC) Close() error {
+	os.Stdout.Close()
+	return os.Stdin.Close()
+}
+
 // launchProcess launches an incubator process for the provided session.
 // It is responsible for configuring the process execution environment.
 // The caller can wait for the process to exit by calling cmd.Wait().
@@ -175,6 +286,9 @@ func (ss *sshSession) launchProcess(ctx context.Context) error {
 	}
 
 	ci := ss.connInfo
+	if ss.Subsystem() == "sftp" && ss.srv.tailscaledPath == "" {
+		return errors.New("sftp requires the tailscaled incubator")
+	}
 	cmd := ss.newIncubatorCommand(ctx, shell, args)
 	cmd.Dir = ss.localUser.HomeDir
 	cmd.Env = append(cmd.Env, envForUser(ss.localUser)...)
@@ -201,14 +315,17 @@ func (ss *sshSession) launchProcess(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	go resizeWindow(pty, winCh)
+	go resizeWindow(pty, winCh, ss.recorder)
 	ss.stdout = pty // no stderr for a pty
 	ss.stdin = pty
 	return nil
 }
 
-func resizeWindow(f *os.File, winCh <-chan ssh.Window) {
+// resizeWindow applies window size changes from winCh to the pty f,
+// recording them in rec if non-nil.
+func resizeWindow(f *os.File, winCh <-chan ssh.Window, rec *recording) {
 	for win := range winCh {
+		rec.resize(win)
 		unix.IoctlSetWinsize(int(f.Fd()), syscall.TIOCSWINSZ, &unix.Winsize{
 			Row: uint16(win.Height),
 			Col: uint16(win.Width),
@@ -0,0 +1,220 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios)
+// +build linux darwin,!ios
+
+package tailssh
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/tailscale/ssh"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/types/logger"
+)
+
+// recording is an asciicast v2 recording of an SSH session.
+// See https://github.com/asciinema/asciinema/blob/develop/doc/asciicast-v2.md.
+//
+// All methods are safe to call on a nil *recording, to make the
+// non-recording case easy for callers.
+type recording struct {
+	logf     logger.Logf
+	start    time.Time
+	meta     apitype.SSHSessionRecording
+	metaPath string
+
+	mu  sync.Mutex // guards writes to f and bw
+	f   *os.File   // nil once closed or after a write error
+	bw  *bufio.Writer
+	enc *json.Encoder // writes to bw
+}
+
+// maxRecordings is how many recordings of finished SSH sessions are
+// kept on disk. Older ones are removed as new recordings start.
+// Recordings of active sessions are never removed.
+const maxRecordings = 100
+
+// startNewRecording starts a new recording of ss in the backend's SSH
+// recordings directory, writing its asciicast header and metadata.
+func (ss *sshSession) startNewRecording(ptyReq ssh.Pty) (*recording, error) {
+	dir, err := ss.srv.lb.SSHRecordingsDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := ss.srv.lb.PruneSSHSessionRecordings(maxRecordings-1, ss.srv.isActiveSession); err != nil {
+		ss.logf("recording: pruning old recordings: %v", err)
+	}
+	ci := ss.connInfo
+	meta := apitype.SSHSessionRecording{
+		ID:        ss.sharedID,
+		SrcNode:   strings.TrimSuffix(ci.node.Name, "."),
+		SrcNodeID: ci.node.StableID,
+		SrcIP:     ci.src.IP().String(),
+		LoginName: ci.loginName(),
+		LocalUser: ss.localUser.Username,
+		Command:   ss.RawCommand(),
+		Input:     ss.action.RecordSessionInput,
+	}
+	return newRecording(ss.logf, dir, meta, ptyReq)
+}
+
+// newRecording starts a new recording in dir described by meta, whose
+// ID names its files, of a session with the pty ptyReq.
+func newRecording(logf logger.Logf, dir string, meta apitype.SSHSessionRecording, ptyReq ssh.Pty) (*recording, error) {
+	rec := &recording{
+		logf:     logf,
+		start:    time.Now(),
+		meta:     meta,
+		metaPath: filepath.Join(dir, meta.ID+".json"),
+	}
+	rec.meta.Start = rec.start
+	if err := rec.writeMeta(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, meta.ID+".cast"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	rec.f = f
+	rec.bw = bufio.NewWriter(f)
+	rec.enc = json.NewEncoder(rec.bw)
+
+	type header struct {
+		Version   int               `json:"version"`
+		Width     int               `json:"width"`
+		Height    int               `json:"height"`
+		Timestamp int64             `json:"timestamp"`
+		Command   string            `json:"command,omitempty"`
+		Env       map[string]string `json:"env"`
+	}
+	h := header{
+		Version:   2,
+		Width:     ptyReq.Window.Width,
+		Height:    ptyReq.Window.Height,
+		Timestamp: rec.start.Unix(),
+		Command:   meta.Command,
+		Env: map[string]string{
+			"TERM": ptyReq.Term,
+		},
+	}
+	if err := rec.enc.Encode(h); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := rec.bw.Flush(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return rec, nil
+}
+
+// writeMeta writes rec's metadata file.
+func (rec *recording) writeMeta() error {
+	j, err := json.MarshalIndent(rec.meta, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(rec.metaPath, j, 0600)
+}
+
+// writeEvent writes an asciicast event of type typ ("o", "i" or "r").
+func (rec *recording) writeEvent(typ, data string) {
+	if rec == nil {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.f == nil {
+		return
+	}
+	ev := [3]any{time.Since(rec.start).Seconds(), typ, data}
+	err := rec.enc.Encode(ev)
+	if err == nil {
+		err = rec.bw.Flush()
+	}
+	if err != nil {
+		rec.logf("recording: write failed, stopping recording: %v", err)
+		rec.f.Close()
+		rec.f = nil
+	}
+}
+
+// resize records a terminal window size change.
+func (rec *recording) resize(w ssh.Window) {
+	rec.writeEvent("r", fmt.Sprintf("%dx%d", w.Width, w.Height))
+}
+
+// writer returns an io.Writer that records everything written to it
+// as events of type typ ("o" for output, "i" for input).
+//
+// Its Write method never fails, so it's safe to use with io.TeeReader
+// without a broken recording breaking the session. It's not safe for
+// concurrent use.
+func (rec *recording) writer(typ string) *recordingWriter {
+	return &recordingWriter{rec: rec, typ: typ}
+}
+
+type recordingWriter struct {
+	rec *recording
+	typ string
+
+	// partial is an incomplete UTF-8 sequence at the end of the last
+	// write, held back so a character split across writes isn't
+	// recorded as two invalid ones.
+	partial []byte
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	b := p
+	if len(w.partial) > 0 {
+		b = append(w.partial, p...)
+	}
+	n := len(b) - incompleteRuneSuffix(b)
+	if n > 0 {
+		w.rec.writeEvent(w.typ, string(b[:n]))
+	}
+	w.partial = append(w.partial[:0], b[n:]...)
+	return len(p), nil
+}
+
+// incompleteRuneSuffix returns the length of the incomplete but
+// possibly valid UTF-8 sequence at the end of b, if any.
+func incompleteRuneSuffix(b []byte) int {
+	for n := 1; n < utf8.UTFMax && n <= len(b); n++ {
+		c := b[len(b)-n]
+		if utf8.RuneStart(c) {
+			if c >= utf8.RuneSelf && !utf8.FullRune(b[len(b)-n:]) {
+				return n
+			}
+			return 0
+		}
+	}
+	return 0
+}
+
+// Close finishes the recording, recording its end time in its metadata.
+func (rec *recording) Close() error {
+	if rec == nil {
+		return nil
+	}
+	rec.mu.Lock()
+	if rec.f != nil {
+		rec.f.Close()
+		rec.f = nil
+	}
+	rec.mu.Unlock()
+	rec.meta.End = time.Now()
+	return rec.writeMeta()
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build linux || (darwin && !ios)
+// +build linux darwin,!ios
+
+package tailssh
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/tailscale/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"tailscale.com/tailcfg"
+)
+
+// directStreamLocalChannelData is the extra data of a
+// "direct-streamlocal@openssh.com" channel open request, as
+// specified in OpenSSH's PROTOCOL file, section 2.4.
+type directStreamLocalChannelData struct {
+	SocketPath string
+	Reserved0  string
+	Reserved1  uint32
+}
+
+// handleDirectStreamLocal handles "direct-streamlocal@openssh.com"
+// channels, which forward a connection from the client to a Unix
+// socket on this machine (e.g. "ssh -L 2375:/var/run/docker.sock").
+//
+// It's governed by the same SSHAction.AllowLocalPortForwarding as
+// TCP port forwarding. tailscaled typically runs as root, so the
+// socket is dialed by an incubator running as the local user, leaving
+// the access checks to the kernel.
+func (srv *server) handleDirectStreamLocal(_ *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+	var d directStreamLocalChannelData
+	if err := gossh.Unmarshal(newChan.ExtraData(), &d); err != nil {
+		newChan.Reject(gossh.ConnectionFailed, "error parsing streamlocal data: "+err.Error())
+		return
+	}
+	if !filepath.IsAbs(d.SocketPath) {
+		newChan.Reject(gossh.Prohibited, "socket path must be absolute")
+		return
+	}
+	lu, ok := srv.mayForward(ctx, "streamlocal "+d.SocketPath, func(a *tailcfg.SSHAction) bool { return a.AllowLocalPortForwarding }, nil)
+	if !ok {
+		newChan.Reject(gossh.Prohibited, "port forwarding is disabled")
+		return
+	}
+	if srv.tailscaledPath == "" {
+		newChan.Reject(gossh.Prohibited, "streamlocal forwarding is not supported")
+		return
+	}
+
+	cmd := exec.CommandContext(ctx, srv.tailscaledPath, srv.dialUnixIncubatorArgs(lu, d.SocketPath)...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		newChan.Reject(gossh.ConnectionFailed, "connect failed")
+		return
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		newChan.Reject(gossh.ConnectionFailed, "connect failed")
+		return
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		srv.logf("ssh: starting streamlocal incubator: %v", err)
+		newChan.Reject(gossh.ConnectionFailed, "connect failed")
+		return
+	}
+	// The incubator writes a single byte once it's connected.
+	var connected [1]byte
+	if _, err := io.ReadFull(stdout, connected[:]); err != nil {
+		cmd.Wait()
+		srv.logf("ssh: streamlocal forward to %q as %q failed: %s", d.SocketPath, lu.Username, bytes.TrimSpace(stderr.Bytes()))
+		newChan.Reject(gossh.ConnectionFailed, "connect failed")
+		return
+	}
+
+	ch, reqs, err := newChan.Accept()
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return
+	}
+	go gossh.DiscardRequests(reqs)
+
+	go func() {
+		io.Copy(stdin, ch)
+		stdin.Close()
+	}()
+	go func() {
+		defer ch.Close()
+		io.Copy(ch, stdout)
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+}
+
+// dialUnixIncubatorArgs returns the arguments to run tailscaled as an
+// incubator that connects to the Unix socket at path as lu and relays
+// it over its stdin and stdout.
+func (srv *server) dialUnixIncubatorArgs(lu *user.User, path string) []string {
+	groups, err := lu.GroupIds()
+	if err != nil {
+		srv.logf("failed to look up groups of %q: %v", lu.Username, err)
+		groups = []string{lu.Gid}
+	}
+	return []string{
+		"be-child",
+		"ssh",
+		"--uid=" + lu.Uid,
+		"--gid=" + lu.Gid,
+		"--groups=" + strings.Join(groups, ","),
+		"--local-user=" + lu.Username,
+		"--dial-unix=" + path,
+	}
+}
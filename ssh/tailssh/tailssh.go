@@ -24,10 +24,12 @@
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tailscale/ssh"
 	"inet.af/netaddr"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/envknob"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/logtail/backoff"
@@ -60,28 +62,34 @@ func Handle(logf logger.Logf, lb *ipnlocal.LocalBackend, c net.Conn) error {
 }
 
 func (srv *server) newSSHServer() (*ssh.Server, error) {
+	fwdHandler := &ssh.ForwardedTCPHandler{}
 	ss := &ssh.Server{
 		Handler:           srv.handleSSH,
 		RequestHandlers:   map[string]ssh.RequestHandler{},
 		SubsystemHandlers: map[string]ssh.SubsystemHandler{},
-		// Note: the direct-tcpip channel handler and LocalPortForwardingCallback
-		// only adds support for forwarding ports from the local machine.
-		// TODO(maisem/bradfitz): add remote port forwarding support.
 		ChannelHandlers: map[string]ssh.ChannelHandler{
-			"direct-tcpip": ssh.DirectTCPIPHandler,
+			"direct-tcpip":                   ssh.DirectTCPIPHandler,
+			"direct-streamlocal@openssh.com": srv.handleDirectStreamLocal,
 		},
-		Version:                     "SSH-2.0-Tailscale",
-		LocalPortForwardingCallback: srv.mayForwardLocalPortTo,
+		Version:                       "SSH-2.0-Tailscale",
+		LocalPortForwardingCallback:   srv.mayForwardLocalPortTo,
+		ReversePortForwardingCallback: srv.mayReversePortForwardTo,
 	}
 	for k, v := range ssh.DefaultRequestHandlers {
 		ss.RequestHandlers[k] = v
 	}
+	ss.RequestHandlers["tcpip-forward"] = fwdHandler.HandleSSHRequest
+	ss.RequestHandlers["cancel-tcpip-forward"] = fwdHandler.HandleSSHRequest
 	for k, v := range ssh.DefaultChannelHandlers {
 		ss.ChannelHandlers[k] = v
 	}
 	for k, v := range ssh.DefaultSubsystemHandlers {
 		ss.SubsystemHandlers[k] = v
 	}
+	// SFTP (and thus scp with OpenSSH 9+) goes through the same
+	// policy evaluation as shell and exec sessions; the incubator then
+	// serves it as the local user.
+	ss.SubsystemHandlers["sftp"] = srv.handleSSH
 	keys, err := srv.lb.GetSSH_HostKeys()
 	if err != nil {
 		return nil, err
@@ -109,11 +117,129 @@ type server struct {
 // to the specified host and port.
 // TODO(bradfitz/maisem): should we have more checks on host/port?
 func (srv *server) mayForwardLocalPortTo(ctx ssh.Context, destinationHost string, destinationPort uint32) bool {
-	ss, ok := srv.getSessionForContext(ctx)
+	fwd := "local " + net.JoinHostPort(destinationHost, strconv.Itoa(int(destinationPort)))
+	_, ok := srv.mayForward(ctx, fwd, func(a *tailcfg.SSHAction) bool { return a.AllowLocalPortForwarding }, nil)
+	return ok
+}
+
+// mayReversePortForwardTo reports whether the ctx should be allowed to
+// listen on the specified host and port and forward connections back
+// over SSH ("ssh -R").
+func (srv *server) mayReversePortForwardTo(ctx ssh.Context, bindHost string, bindPort uint32) bool {
+	fwd := "remote " + net.JoinHostPort(bindHost, strconv.Itoa(int(bindPort)))
+	_, ok := srv.mayForward(ctx, fwd, func(a *tailcfg.SSHAction) bool { return a.AllowRemotePortForwarding }, func(lu *user.User) error {
+		return checkRemoteForwardBind(lu, bindHost, bindPort, srv.tailscaleAddrs())
+	})
+	return ok
+}
+
+// tailscaleAddrs returns this node's Tailscale addresses.
+func (srv *server) tailscaleAddrs() []netaddr.IPPrefix {
+	nm := srv.lb.NetMap()
+	if nm == nil {
+		return nil
+	}
+	return nm.Addresses
+}
+
+// checkRemoteForwardBind returns an error if lu may not listen on
+// bindHost:bindPort for a remote port forward.
+//
+// tailscaled typically runs as root, so this behaves like OpenSSH with
+// GatewayPorts=no: only loopback addresses and this node's Tailscale
+// addresses (tsAddrs) may be listened on, so forwarded ports aren't
+// exposed beyond the tailnet, and only root may listen on privileged
+// ports.
+func checkRemoteForwardBind(lu *user.User, bindHost string, bindPort uint32, tsAddrs []netaddr.IPPrefix) error {
+	if bindPort > 65535 {
+		return fmt.Errorf("invalid port %d", bindPort)
+	}
+	if bindPort != 0 && bindPort < 1024 && lu.Uid != "0" {
+		return fmt.Errorf("user %q may not listen on privileged port %d", lu.Username, bindPort)
+	}
+	if bindHost == "localhost" {
+		return nil
+	}
+	ip, err := netaddr.ParseIP(bindHost)
+	if err != nil {
+		return fmt.Errorf("bind address %q is not localhost or an IP address", bindHost)
+	}
+	if ip.IsLoopback() {
+		return nil
+	}
+	for _, p := range tsAddrs {
+		if p.IP() == ip {
+			return nil
+		}
+	}
+	return fmt.Errorf("bind address %v is not a loopback or Tailscale address", ip)
+}
+
+// mayForward reports whether the SSH connection of ctx may do the port
+// forward described by fwd, which is the case when its forwarding
+// action satisfies allowed and, if check is non-nil, check returns no
+// error for its local user. It records the decision as an audit event
+// and, if allowed, returns the local user to forward as.
+func (srv *server) mayForward(ctx ssh.Context, fwd string, allowed func(*tailcfg.SSHAction) bool, check func(*user.User) error) (_ *user.User, ok bool) {
+	a, lu, ev, ok := srv.forwardingAction(ctx)
+	ev.Type = apitype.SSHEventForward
+	ev.Forward = fwd
+	ok = ok && allowed(a)
+	if ok && check != nil {
+		if err := check(lu); err != nil {
+			srv.logf("ssh: %s forward denied: %v", fwd, err)
+			ev.Err = err.Error()
+			ok = false
+		}
+	}
+	if ok {
+		ev.Action = "accept"
+	} else {
+		ev.Action = "reject"
+	}
+	srv.lb.LogSSHEvent(ev)
 	if !ok {
-		return false
+		return nil, false
 	}
-	return ss.action.AllowLocalPortForwarding
+	return lu, true
+}
+
+// forwardingAction returns the SSHAction and local user governing port
+// forwarding for the SSH connection of ctx, along with an audit event
+// describing the connection.
+//
+// Forwarding requests may arrive before, or without ("ssh -N"), any
+// session. If the connection has an active session, its action is used.
+// Otherwise the policy is evaluated for the connection and only
+// immediately accepted actions are honored, as there's no session to
+// show a HoldAndDelegate message on.
+func (srv *server) forwardingAction(ctx ssh.Context) (_ *tailcfg.SSHAction, _ *user.User, _ apitype.SSHEvent, ok bool) {
+	if ss, ok := srv.getSessionForContext(ctx); ok {
+		return ss.action, ss.localUser, ss.event(""), true
+	}
+	ev := apitype.SSHEvent{SSHUser: ctx.User()}
+	if ipp, err := asTailscaleIPPort(ctx.RemoteAddr()); err == nil {
+		ev.SrcIP = ipp.IP().String()
+	}
+	// The forward's own event records the decision.
+	a, ci, localUser, _, err := srv.evaluatePolicy(ctx.User(), ctx.LocalAddr(), ctx.RemoteAddr())
+	if err != nil {
+		srv.logf("ssh: port forwarding denied: %v", err)
+		ev.Err = err.Error()
+		return nil, nil, ev, false
+	}
+	ev = ci.event("")
+	ev.LocalUser = localUser
+	if a.Reject || !a.Accept {
+		return nil, nil, ev, false
+	}
+	lu, err := user.Lookup(localUser)
+	if err != nil {
+		srv.logf("ssh: user Lookup %q: %v", localUser, err)
+		ev.Err = err.Error()
+		return nil, nil, ev, false
+	}
+	return a, lu, ev, true
 }
 
 // sshPolicy returns the SSHPolicy for current node.
@@ -162,27 +288,31 @@ func asTailscaleIPPort(a net.Addr) (netaddr.IPPort, error) {
 // evaluatePolicy returns the SSHAction, sshConnInfo and localUser
 // after evaluating the sshUser and remoteAddr against the SSHPolicy.
 // The remoteAddr and localAddr params must be Tailscale IPs.
-func (srv *server) evaluatePolicy(sshUser string, localAddr, remoteAddr net.Addr) (_ *tailcfg.SSHAction, _ *sshConnInfo, localUser string, _ error) {
+//
+// The decision, accept or reject, is described by the returned
+// SSHEventPolicy event, which is nil if the policy couldn't be
+// evaluated. It's not logged; see evaluatePolicyAndLog.
+func (srv *server) evaluatePolicy(sshUser string, localAddr, remoteAddr net.Addr) (_ *tailcfg.SSHAction, _ *sshConnInfo, localUser string, _ *apitype.SSHEvent, _ error) {
 	logf := srv.logf
 	lb := srv.lb
 	logf("Handling SSH from %v for user %v", remoteAddr, sshUser)
 
 	pol, ok := srv.sshPolicy()
 	if !ok {
-		return nil, nil, "", fmt.Errorf("tsshd: rejecting connection; no SSH policy")
+		return nil, nil, "", nil, fmt.Errorf("tsshd: rejecting connection; no SSH policy")
 	}
 
 	srcIPP, err := asTailscaleIPPort(remoteAddr)
 	if err != nil {
-		return nil, nil, "", fmt.Errorf("tsshd: rejecting: %w", err)
+		return nil, nil, "", nil, fmt.Errorf("tsshd: rejecting: %w", err)
 	}
 	dstIPP, err := asTailscaleIPPort(localAddr)
 	if err != nil {
-		return nil, nil, "", err
+		return nil, nil, "", nil, err
 	}
 	node, uprof, ok := lb.WhoIs(srcIPP)
 	if !ok {
-		return nil, nil, "", fmt.Errorf("Hello, %v. I don't know who you are.\n", srcIPP)
+		return nil, nil, "", nil, fmt.Errorf("Hello, %v. I don't know who you are.\n", srcIPP)
 	}
 
 	ci := &sshConnInfo{
@@ -193,11 +323,27 @@ func (srv *server) evaluatePolicy(sshUser string, localAddr, remoteAddr net.Addr
 		node:    node,
 		uprof:   &uprof,
 	}
-	a, localUser, ok := evalSSHPolicy(pol, ci)
+	a, localUser, rule, ok := evalSSHPolicy(pol, ci)
+	ev := ci.event(apitype.SSHEventPolicy)
+	ev.Rule = rule
 	if !ok {
-		return nil, nil, "", fmt.Errorf("ssh: access denied for %q from %v", uprof.LoginName, ci.src.IP())
+		ev.Action = "reject"
+		ev.Err = "no matching rule"
+		return nil, nil, "", &ev, fmt.Errorf("ssh: access denied for %q from %v", uprof.LoginName, ci.src.IP())
+	}
+	ev.Action = actionString(a)
+	ev.LocalUser = localUser
+	return a, ci, localUser, &ev, nil
+}
+
+// evaluatePolicyAndLog is like evaluatePolicy, but logs the decision
+// as an audit event.
+func (srv *server) evaluatePolicyAndLog(sshUser string, localAddr, remoteAddr net.Addr) (_ *tailcfg.SSHAction, _ *sshConnInfo, localUser string, _ error) {
+	a, ci, localUser, ev, err := srv.evaluatePolicy(sshUser, localAddr, remoteAddr)
+	if ev != nil {
+		srv.lb.LogSSHEvent(*ev)
 	}
-	return a, ci, localUser, nil
+	return a, ci, localUser, err
 }
 
 // handleSSH is invoked when a new SSH connection attempt is made.
@@ -205,7 +351,7 @@ func (srv *server) handleSSH(s ssh.Session) {
 	logf := srv.logf
 
 	sshUser := s.User()
-	action, ci, localUser, err := srv.evaluatePolicy(sshUser, s.LocalAddr(), s.RemoteAddr())
+	action, ci, localUser, err := srv.evaluatePolicyAndLog(sshUser, s.LocalAddr(), s.RemoteAddr())
 	if err != nil {
 		logf(err.Error())
 		s.Exit(1)
@@ -243,6 +389,10 @@ func (srv *server) handleSSH(s ssh.Session) {
 			s.Exit(1)
 			return
 		}
+		ev := ci.event(apitype.SSHEventPolicy)
+		ev.Action = actionString(action)
+		ev.LocalUser = localUser
+		srv.lb.LogSSHEvent(ev)
 	}
 
 	lu, err := user.Lookup(localUser)
@@ -258,6 +408,11 @@ func (srv *server) handleSSH(s ssh.Session) {
 
 // sshSession is an accepted Tailscale SSH session.
 type sshSession struct {
+	// bytesIn and bytesOut count the bytes read from and written to
+	// the client, for audit events. They're accessed atomically;
+	// declared first for alignment reasons.
+	bytesIn, bytesOut int64
+
 	ssh.Session
 	idH      string // the RFC4253 sec8 hash H; don't share outside process
 	sharedID string // ID that's shared with control
@@ -269,6 +424,7 @@ type sshSession struct {
 	action        *tailcfg.SSHAction
 	localUser     *user.User
 	agentListener net.Listener // non-nil if agent-forwarding requested+allowed
+	recorder      *recording   // non-nil if the session is being recorded
 
 	// initialized by launchProcess:
 	cmd    *exec.Cmd
@@ -381,6 +537,15 @@ func (srv *server) startSession(ss *sshSession) {
 	srv.activeSessionBySharedID[ss.sharedID] = ss
 }
 
+// isActiveSession reports whether the session with the provided
+// shared ID, which also names its recording, is active.
+func (srv *server) isActiveSession(sharedID string) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	_, ok := srv.activeSessionBySharedID[sharedID]
+	return ok
+}
+
 // endSession unregisters s from the list of active sessions.
 func (srv *server) endSession(ss *sshSession) {
 	srv.mu.Lock()
@@ -442,6 +607,35 @@ func (ss *sshSession) run() {
 	srv.startSession(ss)
 	defer srv.endSession(ss)
 
+	unregister := srv.lb.RegisterSSHSession(ss.apiSession(), func() {
+		ss.ctx.CloseWithError(userVisibleError{
+			"Session terminated by the machine's administrator.",
+			errSessionKilled,
+		})
+	})
+	defer unregister()
+
+	srv.lb.LogSSHEvent(ss.event(apitype.SSHEventSessionStart))
+	var (
+		exitCode int
+		exitErr  error
+	)
+	defer func() {
+		ev := ss.event(apitype.SSHEventSessionEnd)
+		ev.ExitCode = exitCode
+		ev.BytesIn = atomic.LoadInt64(&ss.bytesIn)
+		ev.BytesOut = atomic.LoadInt64(&ss.bytesOut)
+		if exitErr == nil {
+			if err := ss.ctx.Err(); err != nil && err != errSessionDone {
+				exitErr = err
+			}
+		}
+		if exitErr != nil {
+			ev.Err = exitErr.Error()
+		}
+		srv.lb.LogSSHEvent(ev)
+	}()
+
 	defer ss.ctx.CloseWithError(errSessionDone)
 
 	if ss.action.SesssionDuration != 0 {
@@ -462,6 +656,7 @@ func (ss *sshSession) run() {
 		if lu.Uid != fmt.Sprint(euid) {
 			logf("ssh: can't switch to user %q from process euid %v", localUser, euid)
 			fmt.Fprintf(ss, "can't switch user\n")
+			exitCode, exitErr = 1, errors.New("can't switch user")
 			ss.Exit(1)
 			return
 		}
@@ -477,24 +672,46 @@ func (ss *sshSession) run() {
 		// TODO(maisem/bradfitz): add a way to close all session resources
 		defer ss.agentListener.Close()
 	}
+	if ptyReq, _, isPty := ss.Pty(); isPty && ss.action.RecordSession {
+		rec, err := ss.startNewRecording(ptyReq)
+		if err != nil {
+			// Recording was required by policy; fail closed.
+			logf("ssh: failed to start session recording: %v", err)
+			fmt.Fprintf(ss, "can't start session recording\r\n")
+			exitCode, exitErr = 1, fmt.Errorf("starting session recording: %w", err)
+			ss.Exit(1)
+			return
+		}
+		ss.recorder = rec
+		defer rec.Close()
+	}
 	err := ss.launchProcess(ss.ctx)
 	if err != nil {
 		logf("start failed: %v", err.Error())
+		exitCode, exitErr = 1, err
 		ss.Exit(1)
 		return
 	}
 	go ss.killProcessOnContextDone()
 
+	var stdin io.Reader = ss
+	if ss.recorder != nil && ss.action.RecordSessionInput {
+		stdin = io.TeeReader(ss, ss.recorder.writer("i"))
+	}
 	go func() {
-		_, err := io.Copy(ss.stdin, ss)
+		_, err := io.Copy(countingWriter{ss.stdin, &ss.bytesIn}, stdin)
 		if err != nil {
 			// TODO: don't log in the success case.
 			logf("ssh: stdin copy: %v", err)
 		}
 		ss.stdin.Close()
 	}()
+	var stdout io.Reader = ss.stdout
+	if ss.recorder != nil {
+		stdout = io.TeeReader(ss.stdout, ss.recorder.writer("o"))
+	}
 	go func() {
-		_, err := io.Copy(ss, ss.stdout)
+		_, err := io.Copy(countingWriter{ss, &ss.bytesOut}, stdout)
 		if err != nil {
 			// TODO: don't log in the success case.
 			logf("ssh: stdout copy: %v", err)
@@ -503,7 +720,7 @@ func (ss *sshSession) run() {
 	// stderr is nil for ptys.
 	if ss.stderr != nil {
 		go func() {
-			_, err := io.Copy(ss.Stderr(), ss.stderr)
+			_, err := io.Copy(countingWriter{ss.Stderr(), &ss.bytesOut}, ss.stderr)
 			if err != nil {
 				// TODO: don't log in the success case.
 				logf("ssh: stderr copy: %v", err)
@@ -524,11 +741,13 @@ func (ss *sshSession) run() {
 	if ee, ok := err.(*exec.ExitError); ok {
 		code := ee.ProcessState.ExitCode()
 		logf("ssh: Wait: code=%v", code)
+		exitCode = code
 		ss.Exit(code)
 		return
 	}
 
 	logf("ssh: Wait: %v", err)
+	exitCode, exitErr = 1, err
 	ss.Exit(1)
 	return
 }
@@ -554,13 +773,15 @@ type sshConnInfo struct {
 	uprof *tailcfg.UserProfile
 }
 
-func evalSSHPolicy(pol *tailcfg.SSHPolicy, ci *sshConnInfo) (a *tailcfg.SSHAction, localUser string, ok bool) {
-	for _, r := range pol.Rules {
+// evalSSHPolicy returns the action and local user of the first rule in
+// pol matching ci, along with the rule's 1-based index in pol.Rules.
+func evalSSHPolicy(pol *tailcfg.SSHPolicy, ci *sshConnInfo) (a *tailcfg.SSHAction, localUser string, rule int, ok bool) {
+	for i, r := range pol.Rules {
 		if a, localUser, err := matchRule(r, ci); err == nil {
-			return a, localUser, true
+			return a, localUser, i + 1, true
 		}
 	}
-	return nil, "", false
+	return nil, "", 0, false
 }
 
 // internal errors for testing; they don't escape to callers or logs.
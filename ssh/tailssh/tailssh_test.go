@@ -9,18 +9,24 @@
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/pkg/sftp"
 	"github.com/tailscale/ssh"
+	gossh "golang.org/x/crypto/ssh"
 	"inet.af/netaddr"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/ipn/ipnlocal"
 	"tailscale.com/ipn/store/mem"
 	"tailscale.com/net/tsdial"
@@ -31,6 +37,18 @@
 	"tailscale.com/wgengine"
 )
 
+func TestMain(m *testing.M) {
+	// TestSFTP runs this test binary as the tailscaled incubator.
+	if len(os.Args) > 2 && os.Args[1] == "be-child" && os.Args[2] == "ssh" {
+		if err := beIncubator(os.Args[3:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
 func TestMatchRule(t *testing.T) {
 	someAction := new(tailcfg.SSHAction)
 	tests := []struct {
@@ -308,6 +326,151 @@ func TestSSH(t *testing.T) {
 	})
 }
 
+func TestSFTP(t *testing.T) {
+	var logf logger.Logf = t.Logf
+	eng, err := wgengine.NewFakeUserspaceEngine(logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, err := ipnlocal.NewLocalBackend(logf, "",
+		new(mem.Store),
+		new(tsdial.Dialer),
+		eng, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Shutdown()
+	lb.SetVarRoot(t.TempDir())
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &server{
+		lb:             lb,
+		logf:           logf,
+		tailscaledPath: exe, // see TestMain
+	}
+	ss, err := srv.newSSHServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci := &sshConnInfo{
+		sshUser: "test",
+		src:     netaddr.MustParseIPPort("1.2.3.4:32342"),
+		dst:     netaddr.MustParseIPPort("1.2.3.5:22"),
+		node:    &tailcfg.Node{},
+		uprof:   &tailcfg.UserProfile{},
+	}
+	handler := func(s ssh.Session) {
+		ss := srv.newSSHSession(s, ci, u, &tailcfg.SSHAction{Accept: true})
+		ss.run()
+	}
+	ss.Handler = handler
+	ss.SubsystemHandlers["sftp"] = handler
+
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go ss.HandleConn(c)
+		}
+	}()
+
+	client, err := gossh.Dial("tcp", ln.Addr().String(), &gossh.ClientConfig{
+		User:            "user",
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hello.txt")
+	const content = "hello over sftp\n"
+	f, err := sc.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(f, content); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file was written as the local user, on the local disk.
+	if got, err := os.ReadFile(path); err != nil {
+		t.Fatal(err)
+	} else if string(got) != content {
+		t.Errorf("file contains %q; want %q", got, content)
+	}
+
+	fis, err := sc.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 1 || fis[0].Name() != "hello.txt" || fis[0].Size() != int64(len(content)) {
+		t.Errorf("ReadDir = %v; want just hello.txt", fis)
+	}
+
+	f, err = sc.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != content {
+		t.Errorf("read %q over sftp; want %q", got, content)
+	}
+
+	if err := sc.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("after Remove, Stat = %v; want not exist", err)
+	}
+}
+
+func TestIsActiveSession(t *testing.T) {
+	srv := new(server)
+	ss := &sshSession{idH: "h1", sharedID: "20220405T101112-0102030405"}
+	if srv.isActiveSession(ss.sharedID) {
+		t.Error("session active before it started")
+	}
+	srv.startSession(ss)
+	if !srv.isActiveSession(ss.sharedID) {
+		t.Error("started session not active")
+	}
+	if srv.isActiveSession("20220405T101112-0504030201") {
+		t.Error("unknown session active")
+	}
+	srv.endSession(ss)
+	if srv.isActiveSession(ss.sharedID) {
+		t.Error("ended session still active")
+	}
+}
+
 func parseEnv(out []byte) map[string]string {
 	e := map[string]string{}
 	lineread.Reader(bytes.NewReader(out), func(line []byte) error {
@@ -320,3 +483,247 @@ func parseEnv(out []byte) map[string]string {
 	})
 	return e
 }
+
+// fakeSSHContext is an ssh.Context for a connection whose session
+// has ID H sessionID.
+type fakeSSHContext struct {
+	ssh.Context // nil; for the methods not used in tests
+	sessionID   string
+}
+
+func (c *fakeSSHContext) SessionID() string { return c.sessionID }
+
+// fakeSession is an ssh.Session running no command.
+type fakeSession struct {
+	ssh.Session // nil; for the methods not used in tests
+}
+
+func (fakeSession) RawCommand() string { return "" }
+func (fakeSession) Subsystem() string  { return "" }
+
+func TestMayReversePortForwardTo(t *testing.T) {
+	var logf logger.Logf = t.Logf
+	eng, err := wgengine.NewFakeUserspaceEngine(logf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb, err := ipnlocal.NewLocalBackend(logf, "",
+		new(mem.Store),
+		new(tsdial.Dialer),
+		eng, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lb.Shutdown()
+	srv := &server{
+		lb:   lb,
+		logf: logf,
+	}
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci := &sshConnInfo{
+		sshUser: "test",
+		src:     netaddr.MustParseIPPort("100.100.100.101:32342"),
+		dst:     netaddr.MustParseIPPort("100.100.100.102:22"),
+		node:    &tailcfg.Node{},
+		uprof:   &tailcfg.UserProfile{},
+	}
+	action := &tailcfg.SSHAction{Accept: true}
+	srv.startSession(&sshSession{
+		Session:   fakeSession{},
+		idH:       "h",
+		sharedID:  "shared",
+		logf:      logf,
+		srv:       srv,
+		connInfo:  ci,
+		action:    action,
+		localUser: u,
+	})
+	ctx := &fakeSSHContext{sessionID: "h"}
+
+	if srv.mayReversePortForwardTo(ctx, "localhost", 8080) {
+		t.Errorf("remote forward allowed without AllowRemotePortForwarding")
+	}
+	action.AllowRemotePortForwarding = true
+	if !srv.mayReversePortForwardTo(ctx, "localhost", 8080) {
+		t.Errorf("remote forward to localhost:8080 denied")
+	}
+	if srv.mayReversePortForwardTo(ctx, "0.0.0.0", 8080) {
+		t.Errorf("remote forward to 0.0.0.0:8080 allowed")
+	}
+
+	evs := lb.SSHEvents()
+	if len(evs) != 3 {
+		t.Fatalf("got %d events; want 3", len(evs))
+	}
+	for i, want := range []string{"reject", "accept", "reject"} {
+		if ev := evs[i]; ev.Type != apitype.SSHEventForward || ev.Action != want {
+			t.Errorf("event %d is %v %q; want %v %q", i, ev.Type, ev.Action, apitype.SSHEventForward, want)
+		}
+	}
+}
+
+func TestCheckRemoteForwardBind(t *testing.T) {
+	root := &user.User{Uid: "0", Username: "root"}
+	alice := &user.User{Uid: "1000", Username: "alice"}
+	tsAddrs := []netaddr.IPPrefix{
+		netaddr.MustParseIPPrefix("100.101.102.103/32"),
+		netaddr.MustParseIPPrefix("fd7a:115c:a1e0::1/128"),
+	}
+	tests := []struct {
+		name string
+		lu   *user.User
+		host string
+		port uint32
+		ok   bool
+	}{
+		{"localhost", alice, "localhost", 8080, true},
+		{"loopback4", alice, "127.0.0.1", 8080, true},
+		{"loopback6", alice, "::1", 8080, true},
+		{"tailscale4", alice, "100.101.102.103", 8080, true},
+		{"tailscale6", alice, "fd7a:115c:a1e0::1", 8080, true},
+		{"dynamic_port", alice, "localhost", 0, true},
+		{"all_interfaces", alice, "", 8080, false},
+		{"unspecified4", alice, "0.0.0.0", 8080, false},
+		{"unspecified6", alice, "::", 8080, false},
+		{"other_ip", alice, "192.168.1.2", 8080, false},
+		{"other_tailscale_ip", alice, "100.101.102.104", 8080, false},
+		{"hostname", alice, "example.com", 8080, false},
+		{"privileged_port", alice, "localhost", 80, false},
+		{"privileged_port_root", root, "localhost", 80, true},
+		{"unspecified_root", root, "0.0.0.0", 8080, false},
+		{"bad_port", root, "localhost", 70000, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRemoteForwardBind(tt.lu, tt.host, tt.port, tsAddrs)
+			if (err == nil) != tt.ok {
+				t.Errorf("checkRemoteForwardBind(%q, %q, %d) = %v; want ok=%v", tt.lu.Username, tt.host, tt.port, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestRelayUnix(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "s.sock")
+	ln, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+
+	var out bytes.Buffer
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader("hello"), &out}
+	if err := relayUnix(sock, rw); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "\x00hello"; got != want {
+		t.Errorf("relayed %q; want %q", got, want)
+	}
+
+	out.Reset()
+	if err := relayUnix(filepath.Join(t.TempDir(), "missing.sock"), rw); err == nil {
+		t.Errorf("relay to missing socket succeeded")
+	}
+	if out.Len() != 0 {
+		t.Errorf("failed relay wrote %q", out.Bytes())
+	}
+}
+
+func TestRecording(t *testing.T) {
+	dir := t.TempDir()
+	meta := apitype.SSHSessionRecording{ID: "test", Command: "bash"}
+	rec, err := newRecording(t.Logf, dir, meta, ssh.Pty{
+		Term:   "xterm",
+		Window: ssh.Window{Width: 80, Height: 24},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pretend the session started a while ago, to check event times.
+	rec.start = rec.start.Add(-2 * time.Second)
+
+	w := rec.writer("o")
+	// Split "é" across writes.
+	io.WriteString(w, "h\xc3")
+	io.WriteString(w, "\xa9llo")
+	rec.resize(ssh.Window{Width: 100, Height: 30})
+	io.WriteString(w, "!")
+	if err := rec.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(filepath.Join(dir, "test.cast"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	var h struct {
+		Version   int
+		Width     int
+		Height    int
+		Timestamp int64
+		Command   string
+		Env       map[string]string
+	}
+	if err := dec.Decode(&h); err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != 2 || h.Width != 80 || h.Height != 24 || h.Command != "bash" || h.Env["TERM"] != "xterm" {
+		t.Errorf("bad header %+v", h)
+	}
+	if h.Timestamp != rec.meta.Start.Unix() {
+		t.Errorf("header timestamp = %v; want %v", h.Timestamp, rec.meta.Start.Unix())
+	}
+
+	want := [][2]string{
+		{"o", "h"},
+		{"o", "éllo"},
+		{"r", "100x30"},
+		{"o", "!"},
+	}
+	var last float64
+	for i, e := range want {
+		var ev [3]any
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+		ts, _ := ev[0].(float64)
+		if ts < 2 || ts < last {
+			t.Errorf("event %d at %v; want at least 2 and %v", i, ts, last)
+		}
+		last = ts
+		if ev[1] != e[0] || ev[2] != e[1] {
+			t.Errorf("event %d = %q %q; want %q %q", i, ev[1], ev[2], e[0], e[1])
+		}
+	}
+	if dec.More() {
+		t.Errorf("unexpected extra events")
+	}
+
+	j, err := os.ReadFile(filepath.Join(dir, "test.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotMeta apitype.SSHSessionRecording
+	if err := json.Unmarshal(j, &gotMeta); err != nil {
+		t.Fatal(err)
+	}
+	if gotMeta.ID != "test" || gotMeta.End.IsZero() {
+		t.Errorf("bad metadata %+v", gotMeta)
+	}
+}
@@ -65,7 +65,9 @@
 //    26: 2022-01-12: (nothing, just bumping for 1.20.0)
 //    27: 2022-02-18: start of SSHPolicy being respected
 //    28: 2022-03-09: client can communicate over Noise.
-const CurrentCapabilityVersion CapabilityVersion = 28
+//    29: 2022-03-18: client understands SSHAction.AllowRemotePortForwarding
+//    30: 2022-03-18: client understands SSHAction.RecordSession and RecordSessionInput
+const CurrentCapabilityVersion CapabilityVersion = 30
 
 type StableID string
 
@@ -463,6 +465,7 @@ type Hostinfo struct {
 	Hostname      string             // name of the host the client runs on
 	ShieldsUp     bool               `json:",omitempty"` // indicates whether the host is blocking incoming connections
 	ShareeNode    bool               `json:",omitempty"` // indicates this node exists in netmap because it's owned by a shared-to user
+	PeerRelay     bool               `json:",omitempty"` // indicates this node relays UDP packets between peers that can't reach each other directly
 	GoArch        string             `json:",omitempty"` // the host's GOARCH value (of the running binary)
 	RoutableIPs   []netaddr.IPPrefix `json:",omitempty"` // set of IP ranges this client can route
 	RequestTags   []string           `json:",omitempty"` // set of ACL tags this node wants to claim
@@ -520,6 +523,7 @@ func (v HostinfoView) DeviceModel() string        { return v.ж.DeviceModel }
 func (v HostinfoView) Hostname() string           { return v.ж.Hostname }
 func (v HostinfoView) ShieldsUp() bool            { return v.ж.ShieldsUp }
 func (v HostinfoView) ShareeNode() bool           { return v.ж.ShareeNode }
+func (v HostinfoView) PeerRelay() bool            { return v.ж.PeerRelay }
 func (v HostinfoView) GoArch() string             { return v.ж.GoArch }
 func (v HostinfoView) Equal(v2 HostinfoView) bool { return v.ж.Equal(v2.ж) }
 
@@ -942,6 +946,7 @@ type RegisterResponse struct {
 	EndpointSTUN           = EndpointType(2)
 	EndpointPortmapped     = EndpointType(3)
 	EndpointSTUN4LocalPort = EndpointType(4) // hard NAT: STUN'ed IPv4 address + local fixed port
+	EndpointExplicitConf   = EndpointType(5) // explicitly configured by the user, e.g. a static 1:1 NAT mapping
 )
 
 func (et EndpointType) String() string {
@@ -956,6 +961,8 @@ func (et EndpointType) String() string {
 		return "portmap"
 	case EndpointSTUN4LocalPort:
 		return "stun4localport"
+	case EndpointExplicitConf:
+		return "explicitconf"
 	}
 	return "other"
 }
@@ -1632,6 +1639,20 @@ type SSHAction struct {
 	// AllowLocalPortForwarding, if true, allows accepted connections
 	// to use local port forwarding if requested.
 	AllowLocalPortForwarding bool `json:"allowLocalPortForwarding,omitempty"`
+
+	// AllowRemotePortForwarding, if true, allows accepted connections
+	// to use remote port forwarding ("ssh -R") if requested.
+	AllowRemotePortForwarding bool `json:"allowRemotePortForwarding,omitempty"`
+
+	// RecordSession, if true, records the output of accepted
+	// interactive (PTY) sessions to asciicast files in the node's
+	// state directory.
+	RecordSession bool `json:"recordSession,omitempty"`
+
+	// RecordSessionInput, if true along with RecordSession, also
+	// records the session's input. Input may contain secrets such
+	// as typed passwords.
+	RecordSessionInput bool `json:"recordSessionInput,omitempty"`
 }
 
 // OverTLSPublicKeyResponse is the JSON response to /key?v=<n>
@@ -122,6 +122,7 @@ func (src *Hostinfo) Clone() *Hostinfo {
 	Hostname      string
 	ShieldsUp     bool
 	ShareeNode    bool
+	PeerRelay     bool
 	GoArch        string
 	RoutableIPs   []netaddr.IPPrefix
 	RequestTags   []string
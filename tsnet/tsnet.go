@@ -8,8 +8,13 @@
 package tsnet
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -19,12 +24,15 @@
 	"sync"
 	"time"
 
+	"golang.org/x/sync/singleflight"
 	"inet.af/netaddr"
 	"tailscale.com/client/tailscale"
+	"tailscale.com/client/tailscale/apitype"
 	"tailscale.com/control/controlclient"
 	"tailscale.com/envknob"
 	"tailscale.com/ipn"
 	"tailscale.com/ipn/ipnlocal"
+	"tailscale.com/ipn/ipnstate"
 	"tailscale.com/ipn/localapi"
 	"tailscale.com/ipn/store"
 	"tailscale.com/ipn/store/mem"
@@ -65,22 +73,55 @@ type Server struct {
 	// as an Ephemeral node (https://tailscale.com/kb/1111/ephemeral-nodes/).
 	Ephemeral bool
 
+	// AuthKey, if non-empty, is the auth key used to register the
+	// node if it needs to log in. If empty, the TS_AUTHKEY
+	// environment variable is used.
+	AuthKey string
+
+	// ControlURL optionally specifies the coordination server URL.
+	// If empty, the Tailscale default is used.
+	ControlURL string
+
+	// AdvertiseTags optionally specifies the ACL tags (of the form
+	// "tag:foo") the node requests to be tagged with.
+	AdvertiseTags []string
+
+	// OnNotify, if non-nil, is called with each state change,
+	// netmap update or other notification from the embedded
+	// backend. It is called synchronously and must not block.
+	OnNotify func(ipn.Notify)
+
 	initOnce         sync.Once
 	initErr          error
 	lb               *ipnlocal.LocalBackend
+	netstack         *netstack.Impl
 	linkMon          *monitor.Mon
 	localAPIListener net.Listener
-	rootPath         string // the state directory
+	localClient      *http.Client // talks to localAPIListener
+	rootPath         string       // the state directory
 	hostname         string
 	shutdownCtx      context.Context
 	shutdownCancel   context.CancelFunc
+	certFetches      singleflight.Group // by domain, for ListenTLS
+
+	// certPairForTest, if non-nil, is used instead of CertPair to get
+	// certificates for ListenTLS.
+	certPairForTest func(ctx context.Context, domain string) (certPEM, keyPEM []byte, err error)
 
 	mu        sync.Mutex
 	listeners map[listenKey]*listener
 	dialer    *tsdial.Dialer
+	certs     map[string]*tls.Certificate // domain => parsed cert, for ListenTLS
+	// certRefreshed is when each domain's cached cert was last
+	// refreshed in the background.
+	certRefreshed map[string]time.Time
+	// notifyc is closed and cleared on each backend state or netmap
+	// change, to wake up Up callers. nil means nobody is waiting.
+	notifyc chan struct{}
 }
 
 // Dial connects to the address on the tailnet.
+// The network may be a "tcp" or "udp" type.
 // It will start the server if it has not been started yet.
 func (s *Server) Dial(ctx context.Context, network, address string) (net.Conn, error) {
 	if err := s.Start(); err != nil {
@@ -96,6 +137,51 @@ func (s *Server) Start() error {
 	return s.initErr
 }
 
+// Up connects the server to the tailnet and waits until it is running
+// and has been assigned Tailscale IPs, or until ctx is done.
+//
+// The returned status's TailscaleIPs field contains the node's IPs.
+func (s *Server) Up(ctx context.Context) (*ipnstate.Status, error) {
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+	for {
+		s.mu.Lock()
+		if s.notifyc == nil {
+			s.notifyc = make(chan struct{})
+		}
+		ch := s.notifyc
+		s.mu.Unlock()
+
+		st := s.lb.StatusWithoutPeers()
+		if st.BackendState == ipn.Running.String() && len(st.TailscaleIPs) > 0 {
+			return st, nil
+		}
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("tsnet: waiting for %v state (currently %v): %w", ipn.Running, st.BackendState, ctx.Err())
+		case <-s.shutdownCtx.Done():
+			return nil, fmt.Errorf("tsnet: %w", net.ErrClosed)
+		}
+	}
+}
+
+// notify is the LocalBackend's notify callback.
+func (s *Server) notify(n ipn.Notify) {
+	if n.State != nil || n.NetMap != nil {
+		s.mu.Lock()
+		if s.notifyc != nil {
+			close(s.notifyc)
+			s.notifyc = nil
+		}
+		s.mu.Unlock()
+	}
+	if s.OnNotify != nil {
+		s.OnNotify(n)
+	}
+}
+
 // Close stops the server.
 //
 // It must not be called before or concurrently with Start.
@@ -195,6 +281,7 @@ func (s *Server) start() error {
 	if err := ns.Start(); err != nil {
 		return fmt.Errorf("failed to start netstack: %w", err)
 	}
+	s.netstack = ns
 	s.dialer.UseNetstackForIP = func(ip netaddr.IP) bool {
 		_, ok := eng.PeerForIP(ip)
 		return ok
@@ -202,6 +289,9 @@ func (s *Server) start() error {
 	s.dialer.NetstackDialTCP = func(ctx context.Context, dst netaddr.IPPort) (net.Conn, error) {
 		return ns.DialContextTCP(ctx, dst)
 	}
+	s.dialer.NetstackDialUDP = func(ctx context.Context, dst netaddr.IPPort) (net.Conn, error) {
+		return ns.DialContextUDP(ctx, dst)
+	}
 
 	if s.Store == nil {
 		stateFile := filepath.Join(s.rootPath, "tailscaled.state")
@@ -227,10 +317,13 @@ func (s *Server) start() error {
 	lb.SetDecompressor(func() (controlclient.Decompressor, error) {
 		return smallzstd.NewDecoder(nil)
 	})
+	lb.SetNotifyCallback(s.notify)
 	prefs := ipn.NewPrefs()
 	prefs.Hostname = s.hostname
 	prefs.WantRunning = true
-	authKey := os.Getenv("TS_AUTHKEY")
+	prefs.ControlURL = s.ControlURL
+	prefs.AdvertiseTags = s.AdvertiseTags
+	authKey := s.getAuthKey()
 	err = lb.Start(ipn.Options{
 		StateKey:    ipn.GlobalDaemonStateKey,
 		UpdatePrefs: prefs,
@@ -240,10 +333,10 @@ func (s *Server) start() error {
 		return fmt.Errorf("starting backend: %w", err)
 	}
 	if lb.State() == ipn.NeedsLogin || envknob.Bool("TSNET_FORCE_LOGIN") {
-		logf("LocalBackend state is %v; running StartLoginInteractive...")
+		logf("LocalBackend state is %v; running StartLoginInteractive...", lb.State())
 		s.lb.StartLoginInteractive()
 	} else if authKey != "" {
-		logf("TS_AUTHKEY is set; but state is %v. Ignoring authkey. Re-run with TSNET_FORCE_LOGIN=1 to force use of authkey.")
+		logf("Auth key is set; but state is %v. Ignoring authkey. Re-run with TSNET_FORCE_LOGIN=1 to force use of authkey.", lb.State())
 	}
 	go s.printAuthURLLoop()
 
@@ -258,6 +351,12 @@ func (s *Server) start() error {
 	lal := nettest.Listen("local-tailscaled.sock:80")
 	s.localAPIListener = lal
 
+	s.localClient = &http.Client{
+		Transport: &http.Transport{
+			DialContext: lal.Dial,
+		},
+	}
+
 	// Override the Tailscale client to use the in-process listener.
 	tailscale.TailscaledDialer = lal.Dial
 	go func() {
@@ -268,6 +367,120 @@ func (s *Server) start() error {
 	return nil
 }
 
+// WhoIs returns the owner of the remoteAddr, which must be an IP or
+// IP:port on the tailnet. If remoteAddr is an IP, it must be a
+// Tailscale IP.
+//
+// It is answered in-process by the server's backend, without any
+// dependency on a running tailscaled.
+func (s *Server) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+	ipp, err := netaddr.ParseIPPort(remoteAddr)
+	if err != nil {
+		ip, err := netaddr.ParseIP(remoteAddr)
+		if err != nil {
+			return nil, fmt.Errorf("tsnet: invalid address %q", remoteAddr)
+		}
+		ipp = netaddr.IPPortFrom(ip, 0)
+	}
+	n, u, ok := s.lb.WhoIs(ipp)
+	if !ok {
+		return nil, fmt.Errorf("tsnet: no match for %v", remoteAddr)
+	}
+	return &apitype.WhoIsResponse{
+		Node:        n,
+		UserProfile: &u,
+	}, nil
+}
+
+// Status returns the status of the server, including its peers.
+func (s *Server) Status(ctx context.Context) (*ipnstate.Status, error) {
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+	return s.lb.Status(), nil
+}
+
+// Prefs returns the server's current preferences.
+func (s *Server) Prefs(ctx context.Context) (*ipn.Prefs, error) {
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+	return s.lb.Prefs(), nil
+}
+
+// EditPrefs applies the changes in mp to the server's preferences
+// and returns the resulting preferences.
+func (s *Server) EditPrefs(ctx context.Context, mp *ipn.MaskedPrefs) (*ipn.Prefs, error) {
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+	p, err := s.lb.EditPrefs(mp)
+	if err != nil {
+		return nil, fmt.Errorf("tsnet: %w", err)
+	}
+	return p, nil
+}
+
+// CertPair returns a cert and private key for the provided DNS domain,
+// which must be one of the server's MagicDNS names.
+//
+// It returns a cached certificate from disk if it's still valid.
+func (s *Server) CertPair(ctx context.Context, domain string) (certPEM, keyPEM []byte, err error) {
+	if err := s.Start(); err != nil {
+		return nil, nil, err
+	}
+	res, err := s.localAPIGet(ctx, "/localapi/v0/cert/"+domain+"?type=pair")
+	if err != nil {
+		return nil, nil, err
+	}
+	// with ?type=pair, the response PEM is first the one private
+	// key PEM block, then the cert PEM blocks.
+	i := bytes.Index(res, []byte("--\n--"))
+	if i == -1 {
+		return nil, nil, fmt.Errorf("tsnet: unexpected cert output: no delimiter")
+	}
+	i += len("--\n")
+	keyPEM, certPEM = res[:i], res[i:]
+	if bytes.Contains(certPEM, []byte(" PRIVATE KEY-----")) {
+		return nil, nil, fmt.Errorf("tsnet: unexpected cert output: key in cert")
+	}
+	return certPEM, keyPEM, nil
+}
+
+// localAPIGet does a GET request for path against the server's
+// in-process LocalAPI handler and returns the body of a 200 response.
+func (s *Server) localAPIGet(ctx context.Context, path string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://local-tailscaled.sock"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.localClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("tsnet: %w", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("tsnet: %w", err)
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("tsnet: %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// getAuthKey returns the auth key to use, preferring s.AuthKey over
+// the TS_AUTHKEY environment variable.
+func (s *Server) getAuthKey() string {
+	if s.AuthKey != "" {
+		return s.AuthKey
+	}
+	return os.Getenv("TS_AUTHKEY")
+}
+
 func (s *Server) logf(format string, a ...interface{}) {
 	if s.Logf != nil {
 		s.Logf(format, a...)
@@ -289,7 +502,7 @@ func (s *Server) printAuthURLLoop() {
 		}
 		st := s.lb.StatusWithoutPeers()
 		if st.AuthURL != "" {
-			s.logf("To start this tsnet server, restart with TS_AUTHKEY set, or go to: %s", st.AuthURL)
+			s.logf("To start this tsnet server, restart with an AuthKey or TS_AUTHKEY set, or go to: %s", st.AuthURL)
 		}
 		select {
 		case <-time.After(5 * time.Second):
@@ -392,6 +605,167 @@ func (s *Server) Listen(network, addr string) (net.Listener, error) {
 	return ln, nil
 }
 
+// ListenPacket announces a UDP endpoint only on the Tailscale network.
+// The network must be "udp", "udp4" or "udp6". If the host in addr is
+// empty, packets to any of the node's Tailscale IPs on that port are
+// received.
+// It will start the server if it has not been started yet.
+func (s *Server) ListenPacket(network, addr string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, fmt.Errorf("tsnet: unsupported network %q", network)
+	}
+	if err := s.Start(); err != nil {
+		return nil, err
+	}
+	pc, err := s.netstack.ListenPacket(network, addr)
+	if err != nil {
+		return nil, fmt.Errorf("tsnet: %w", err)
+	}
+	return pc, nil
+}
+
+// ListenTLS announces only on the Tailscale network, wrapping the
+// listener in TLS using certificates for the node's MagicDNS name
+// obtained (and renewed) by the server itself.
+//
+// The network must be a "tcp" type.
+// It will start the server if it has not been started yet.
+func (s *Server) ListenTLS(network, addr string) (net.Listener, error) {
+	ln, err := s.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, &tls.Config{
+		GetCertificate: s.getCertificate,
+	}), nil
+}
+
+// ListenAndServeTLS serves HTTPS requests to h on the Tailscale network
+// at addr (such as ":443"), using ListenTLS.
+//
+// It always returns a non-nil error.
+func (s *Server) ListenAndServeTLS(addr string, h http.Handler) error {
+	ln, err := s.ListenTLS("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return http.Serve(ln, h)
+}
+
+// certRenewalWindow is how long before a cached certificate expires
+// that getCertificate starts asking the backend for it again, which
+// kicks off the backend's background renewal.
+const certRenewalWindow = 14 * 24 * time.Hour
+
+// certRefreshInterval is how often a cached certificate within
+// certRenewalWindow of expiring is refreshed from the backend.
+const certRefreshInterval = time.Minute
+
+// getCertificate is the tls.Config.GetCertificate func for ListenTLS.
+func (s *Server) getCertificate(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	domain, err := s.certDomain(hi.ServerName)
+	if err != nil {
+		return nil, err
+	}
+	return s.cert(hi.Context(), domain)
+}
+
+// cert returns the certificate for domain.
+//
+// A cached certificate is returned until it expires. Once it's within
+// certRenewalWindow of expiring, it's also refreshed in the background.
+// Only when there's no unexpired certificate does cert wait for the
+// backend. Concurrent fetches for a domain are shared.
+func (s *Server) cert(ctx context.Context, domain string) (*tls.Certificate, error) {
+	now := time.Now()
+	s.mu.Lock()
+	cert, ok := s.certs[domain]
+	valid := ok && now.Before(cert.Leaf.NotAfter)
+	refresh := valid && cert.Leaf.NotAfter.Sub(now) < certRenewalWindow && now.Sub(s.certRefreshed[domain]) >= certRefreshInterval
+	if refresh {
+		if s.certRefreshed == nil {
+			s.certRefreshed = map[string]time.Time{}
+		}
+		s.certRefreshed[domain] = now
+	}
+	s.mu.Unlock()
+
+	fetch := func() (interface{}, error) { return s.fetchCert(domain) }
+	if valid {
+		if refresh {
+			// The result is logged by fetchCert.
+			s.certFetches.DoChan(domain, fetch)
+		}
+		return cert, nil
+	}
+	select {
+	case res := <-s.certFetches.DoChan(domain, fetch):
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		return res.Val.(*tls.Certificate), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// fetchCert gets the certificate for domain from the backend and
+// caches it.
+func (s *Server) fetchCert(domain string) (*tls.Certificate, error) {
+	ctx, cancel := context.WithTimeout(s.shutdownCtx, time.Minute)
+	defer cancel()
+	certPair := s.CertPair
+	if s.certPairForTest != nil {
+		certPair = s.certPairForTest
+	}
+	certPEM, keyPEM, err := certPair(ctx, domain)
+	if err != nil {
+		s.logf("tsnet: fetching cert for %s: %v", domain, err)
+		return nil, err
+	}
+	c, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	c.Leaf, err = x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.certs == nil {
+		s.certs = map[string]*tls.Certificate{}
+	}
+	s.certs[domain] = &c
+	return &c, nil
+}
+
+// certDomain returns the cert domain to use for the TLS SNI name
+// serverName. An empty serverName selects the node's first cert
+// domain, and a bare label is expanded to the matching cert domain.
+func (s *Server) certDomain(serverName string) (string, error) {
+	st := s.lb.StatusWithoutPeers()
+	if len(st.CertDomains) == 0 {
+		return "", errors.New("tsnet: no cert domains available; is HTTPS enabled for the tailnet?")
+	}
+	if serverName == "" {
+		return st.CertDomains[0], nil
+	}
+	serverName = strings.TrimSuffix(serverName, ".")
+	for _, d := range st.CertDomains {
+		if d == serverName {
+			return d, nil
+		}
+		if len(d) > len(serverName)+1 && strings.HasPrefix(d, serverName) && d[len(serverName)] == '.' {
+			return d, nil
+		}
+	}
+	return "", fmt.Errorf("tsnet: invalid TLS server name %q", serverName)
+}
+
 type listenKey struct {
 	network string
 	host    string
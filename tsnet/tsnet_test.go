@@ -0,0 +1,546 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tsnet
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn"
+	"tailscale.com/ipn/store/mem"
+	"tailscale.com/net/netns"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstest/integration"
+	"tailscale.com/tstest/integration/testcontrol"
+	"tailscale.com/types/logger"
+)
+
+var verboseNodes = flag.Bool("verbose-nodes", false, "verbose logging from the tsnet servers")
+
+// startControl starts a test control server, with a DERP and STUN
+// server, returning its URL.
+func startControl(t *testing.T) (controlURL string) {
+	return runControl(t, new(testcontrol.Server))
+}
+
+// runControl is like startControl, but runs the provided control
+// server, whose DERPMap and HTTPTestServer it sets.
+func runControl(t *testing.T, control *testcontrol.Server) (controlURL string) {
+	// The test servers are local, so don't mark sockets for the
+	// routing table, which needs privileges.
+	netns.SetEnabled(false)
+	t.Cleanup(func() {
+		netns.SetEnabled(true)
+	})
+
+	control.DERPMap = integration.RunDERPAndSTUN(t, logger.Discard, "127.0.0.1")
+	control.HTTPTestServer = httptest.NewUnstartedServer(control)
+	control.HTTPTestServer.Start()
+	t.Cleanup(control.HTTPTestServer.Close)
+	return control.HTTPTestServer.URL
+}
+
+// newServer returns an ephemeral Server with the given hostname that
+// uses the control server at controlURL. It's closed when the test
+// ends if it was started successfully.
+func newServer(t *testing.T, controlURL, hostname string) *Server {
+	dir := filepath.Join(t.TempDir(), hostname)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Dir:        dir,
+		ControlURL: controlURL,
+		Hostname:   hostname,
+		Store:      new(mem.Store),
+		Ephemeral:  true,
+		Logf:       logger.Discard,
+	}
+	if *verboseNodes {
+		s.Logf = logger.WithPrefix(t.Logf, hostname+": ")
+	}
+	t.Cleanup(func() {
+		if s.localAPIListener != nil {
+			s.Close()
+		}
+	})
+	return s
+}
+
+// startServer starts a Server with newServer and waits for it to be
+// up, returning its Tailscale IPv4 address.
+func startServer(t *testing.T, ctx context.Context, controlURL, hostname string) (*Server, netaddr.IP) {
+	s := newServer(t, controlURL, hostname)
+	st, err := s.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range st.TailscaleIPs {
+		if ip.Is4() {
+			return s, ip
+		}
+	}
+	t.Fatalf("%s has no IPv4 address: %v", hostname, st.TailscaleIPs)
+	panic("unreachable")
+}
+
+func TestListenPacket(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	controlURL := startControl(t)
+	s1, s1ip := startServer(t, ctx, controlURL, "s1")
+	s2, _ := startServer(t, ctx, controlURL, "s2")
+
+	pc, err := s1.ListenPacket("udp", net.JoinHostPort(s1ip.String(), "8081"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	c, err := s2.Dial(ctx, "udp", net.JoinHostPort(s1ip.String(), "8081"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	deadline := time.Now().Add(30 * time.Second)
+	pc.SetDeadline(deadline)
+	c.SetDeadline(deadline)
+
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "ping" {
+		t.Errorf("server read %q; want %q", got, "ping")
+	}
+	if got, want := from.String(), c.LocalAddr().String(); got != want {
+		t.Errorf("server read from %v; want %v", got, want)
+	}
+
+	if _, err := pc.WriteTo([]byte("pong"), from); err != nil {
+		t.Fatal(err)
+	}
+	n, err = c.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "pong" {
+		t.Errorf("client read %q; want %q", got, "pong")
+	}
+}
+
+func TestListenPacketErrors(t *testing.T) {
+	// Bad networks are rejected without starting the server.
+	s := newServer(t, "http://127.0.0.1:1", "bad-network")
+	if _, err := s.ListenPacket("tcp", ":53"); err == nil {
+		t.Error("ListenPacket on tcp succeeded")
+	}
+	if s.lb != nil {
+		t.Error("ListenPacket with a bad network started the server")
+	}
+
+	// Bad addresses are rejected by netstack, which doesn't need the
+	// server to be up.
+	s = newServer(t, "http://127.0.0.1:1", "bad-addr")
+	for _, tt := range []struct{ network, addr string }{
+		{"udp", "53"},
+		{"udp", ":domain"},
+		{"udp", "not-an-ip:53"},
+		{"udp4", "[fd7a:115c:a1e0::1]:53"},
+		{"udp6", "100.64.0.1:53"},
+	} {
+		if _, err := s.ListenPacket(tt.network, tt.addr); err == nil {
+			t.Errorf("ListenPacket(%q, %q) succeeded", tt.network, tt.addr)
+		}
+	}
+}
+
+func TestWhoIs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	controlURL := startControl(t)
+	s1, _ := startServer(t, ctx, controlURL, "s1")
+	_, s2ip := startServer(t, ctx, controlURL, "s2")
+
+	for _, addr := range []string{s2ip.String(), net.JoinHostPort(s2ip.String(), "1234")} {
+		var who *apitype.WhoIsResponse
+		var err error
+		// s1 may not have s2 in its netmap yet.
+		for {
+			who, err = s1.WhoIs(ctx, addr)
+			if err == nil || ctx.Err() != nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Errorf("WhoIs(%q): %v", addr, err)
+			continue
+		}
+		if got := who.Node.Hostinfo.Hostname(); got != "s2" {
+			t.Errorf("WhoIs(%q) host = %q; want s2", addr, got)
+		}
+		if who.UserProfile.ID != who.Node.User || who.UserProfile.LoginName == "" {
+			t.Errorf("WhoIs(%q) user = %+v; want profile of user %v", addr, who.UserProfile, who.Node.User)
+		}
+	}
+
+	for _, addr := range []string{"not-an-ip", "100.100.100.100", "100.100.100.100:80"} {
+		if who, err := s1.WhoIs(ctx, addr); err == nil {
+			t.Errorf("WhoIs(%q) = %v; want error", addr, who.Node.Name)
+		}
+	}
+}
+
+func TestStatusAndPrefs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	controlURL := startControl(t)
+	s, ip := startServer(t, ctx, controlURL, "s1")
+
+	st, err := s.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.BackendState != ipn.Running.String() {
+		t.Errorf("state = %v; want %v", st.BackendState, ipn.Running)
+	}
+	if st.Self.HostName != "s1" {
+		t.Errorf("self hostname = %q; want s1", st.Self.HostName)
+	}
+	if !containsIP(st.TailscaleIPs, ip) {
+		t.Errorf("TailscaleIPs = %v; want %v in them", st.TailscaleIPs, ip)
+	}
+
+	p, err := s.Prefs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Hostname != "s1" || p.ControlURL != controlURL || !p.WantRunning || p.ShieldsUp {
+		t.Errorf("initial prefs = %v", p.Pretty())
+	}
+
+	p, err = s.EditPrefs(ctx, &ipn.MaskedPrefs{
+		Prefs:        ipn.Prefs{ShieldsUp: true},
+		ShieldsUpSet: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.ShieldsUp || p.Hostname != "s1" {
+		t.Errorf("EditPrefs returned %v; want shields up and other prefs kept", p.Pretty())
+	}
+	if p, err := s.Prefs(ctx); err != nil {
+		t.Fatal(err)
+	} else if !p.ShieldsUp {
+		t.Errorf("prefs after EditPrefs = %v; want shields up", p.Pretty())
+	}
+}
+
+func TestCertPairOtherDomain(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	controlURL := startControl(t)
+	s, _ := startServer(t, ctx, controlURL, "s1")
+
+	// The test control server gives out no cert domains, so this
+	// fails before any ACME request is made.
+	if _, _, err := s.CertPair(ctx, "other.example.com"); err == nil {
+		t.Error("CertPair for another node's domain succeeded")
+	}
+}
+
+func TestUpWithAuthKey(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	control := &testcontrol.Server{
+		RequireAuth: true,
+		AuthKey:     "tskey-test",
+	}
+	controlURL := runControl(t, control)
+
+	// The AuthKey field takes precedence over the environment.
+	t.Setenv("TS_AUTHKEY", "tskey-wrong")
+	s := newServer(t, controlURL, "s1")
+	s.AuthKey = "tskey-test"
+	s.AdvertiseTags = []string{"tag:test"}
+	var (
+		mu     sync.Mutex
+		states []ipn.State
+	)
+	s.OnNotify = func(n ipn.Notify) {
+		if n.State != nil {
+			mu.Lock()
+			states = append(states, *n.State)
+			mu.Unlock()
+		}
+	}
+
+	st, err := s.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.BackendState != ipn.Running.String() || len(st.TailscaleIPs) == 0 {
+		t.Errorf("Up returned state %v with IPs %v; want running with IPs", st.BackendState, st.TailscaleIPs)
+	}
+	mu.Lock()
+	if len(states) == 0 || states[len(states)-1] != ipn.Running {
+		t.Errorf("OnNotify saw states %v; want them to end with %v", states, ipn.Running)
+	}
+	mu.Unlock()
+
+	node := control.Node(st.Self.PublicKey)
+	if node == nil {
+		t.Fatal("node not registered with control")
+	}
+	if tags := node.Hostinfo.RequestTags(); tags.Len() != 1 || tags.At(0) != "tag:test" {
+		t.Errorf("requested tags = %v; want [tag:test]", tags.AsSlice())
+	}
+
+	// Once up, Up returns right away.
+	ctx2, cancel2 := context.WithTimeout(ctx, time.Second)
+	defer cancel2()
+	if _, err := s.Up(ctx2); err != nil {
+		t.Errorf("second Up: %v", err)
+	}
+}
+
+func TestUpNeedsLogin(t *testing.T) {
+	controlURL := runControl(t, &testcontrol.Server{RequireAuth: true})
+	t.Setenv("TS_AUTHKEY", "")
+
+	s := newServer(t, controlURL, "s1")
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := s.Up(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Up without auth = %v; want %v", err, context.DeadlineExceeded)
+	}
+
+	s.Close()
+	if _, err := s.Up(context.Background()); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Up after Close = %v; want %v", err, net.ErrClosed)
+	}
+	s.localAPIListener = nil // so the cleanup doesn't close it again
+}
+
+func TestGetAuthKey(t *testing.T) {
+	t.Setenv("TS_AUTHKEY", "tskey-env")
+	s := new(Server)
+	if got := s.getAuthKey(); got != "tskey-env" {
+		t.Errorf("getAuthKey = %q; want the environment's", got)
+	}
+	s.AuthKey = "tskey-field"
+	if got := s.getAuthKey(); got != "tskey-field" {
+		t.Errorf("getAuthKey = %q; want the field's", got)
+	}
+}
+
+func TestListenTLS(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	const domain = "s1.tail-scale.ts.net"
+	controlURL := runControl(t, &testcontrol.Server{
+		DNSConfig: &tailcfg.DNSConfig{CertDomains: []string{domain}},
+	})
+	certPEM, keyPEM := newTestCert(t, domain, time.Now().Add(90*24*time.Hour))
+
+	s1 := newServer(t, controlURL, "s1")
+	s1.certPairForTest = func(ctx context.Context, d string) ([]byte, []byte, error) {
+		if d != domain {
+			return nil, nil, fmt.Errorf("unexpected domain %q", d)
+		}
+		return certPEM, keyPEM, nil
+	}
+	st, err := s1.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, _ := startServer(t, ctx, controlURL, "s2")
+
+	ln, err := s1.ListenTLS("tcp", ":443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, "hello")
+	}()
+
+	c, err := s2.Dial(ctx, "tcp", net.JoinHostPort(st.TailscaleIPs[0].String(), "443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	tc := tls.Client(c, &tls.Config{ServerName: domain, RootCAs: roots})
+	tc.SetDeadline(time.Now().Add(30 * time.Second))
+	got, err := io.ReadAll(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Errorf("read %q; want hello", got)
+	}
+}
+
+func TestCertFetchFailure(t *testing.T) {
+	const domain = "s1.tail-scale.ts.net"
+	now := time.Now()
+	type pair struct{ certPEM, keyPEM []byte }
+	newPair := func(notAfter time.Time) pair {
+		certPEM, keyPEM := newTestCert(t, domain, notAfter)
+		return pair{certPEM, keyPEM}
+	}
+	expiring := newPair(now.Add(time.Hour)) // within certRenewalWindow
+	renewed := newPair(now.Add(90 * 24 * time.Hour))
+
+	var (
+		mu       sync.Mutex
+		next     pair
+		fetchErr error
+	)
+	fetched := make(chan error, 10)
+	s := &Server{
+		Logf:        t.Logf,
+		shutdownCtx: context.Background(),
+		certPairForTest: func(ctx context.Context, d string) ([]byte, []byte, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			fetched <- fetchErr
+			return next.certPEM, next.keyPEM, fetchErr
+		},
+	}
+	set := func(p pair, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		next, fetchErr = p, err
+	}
+	ctx := context.Background()
+	check := func(want pair) {
+		t.Helper()
+		c, err := s.cert(ctx, domain)
+		if err != nil {
+			t.Fatalf("cert: %v", err)
+		}
+		b, _ := pem.Decode(want.certPEM)
+		if !bytes.Equal(c.Certificate[0], b.Bytes) {
+			wantLeaf, _ := x509.ParseCertificate(b.Bytes)
+			t.Fatalf("got cert expiring at %v; want the one expiring at %v", c.Leaf.NotAfter, wantLeaf.NotAfter)
+		}
+	}
+	// waitFetch waits for any fetch in progress to be done.
+	waitFetch := func() {
+		<-s.certFetches.DoChan(domain, func() (interface{}, error) { return nil, nil })
+	}
+
+	set(expiring, nil)
+	check(expiring)
+	<-fetched
+
+	// A failed background refresh keeps serving the unexpired cert.
+	set(pair{}, errors.New("ACME is down"))
+	check(expiring)
+	if err := <-fetched; err == nil {
+		t.Fatal("refresh didn't fail")
+	}
+	waitFetch()
+	check(expiring)
+	select {
+	case <-fetched:
+		t.Error("refreshed again within certRefreshInterval")
+	default:
+	}
+
+	// Once the cert has expired, the failure is returned.
+	expired := newPair(now.Add(-time.Minute))
+	c, err := tls.X509KeyPair(expired.certPEM, expired.keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Leaf, _ = x509.ParseCertificate(c.Certificate[0])
+	s.mu.Lock()
+	s.certs[domain] = &c
+	s.mu.Unlock()
+	if _, err := s.cert(ctx, domain); err == nil {
+		t.Error("expired cert served after failed fetch")
+	}
+	<-fetched
+
+	// And the next successful fetch replaces it.
+	set(renewed, nil)
+	check(renewed)
+	<-fetched
+}
+
+// newTestCert returns a self-signed certificate for domain that
+// expires at notAfter, and its private key.
+func newTestCert(t *testing.T, domain string, notAfter time.Time) (certPEM, keyPEM []byte) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(notAfter.UnixNano()),
+		Subject:               pkix.Name{CommonName: domain},
+		DNSNames:              []string{domain},
+		NotBefore:             notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &k.PublicKey, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM
+}
+
+func containsIP(ips []netaddr.IP, ip netaddr.IP) bool {
+	for _, v := range ips {
+		if v == ip {
+			return true
+		}
+	}
+	return false
+}
@@ -46,6 +46,10 @@ type Server struct {
 	Verbose     bool
 	DNSConfig   *tailcfg.DNSConfig // nil means no DNS config
 
+	// AuthKey, if non-empty, is an auth key with which nodes can
+	// register without interactive auth when RequireAuth is set.
+	AuthKey string
+
 	// ExplicitBaseURL or HTTPTestServer must be set.
 	ExplicitBaseURL string           // e.g. "http://127.0.0.1:1234" with no trailing URL
 	HTTPTestServer  *httptest.Server // if non-nil, used to get BaseURL
@@ -374,6 +378,22 @@ func (s *Server) getUser(nodeKey key.NodePublic) (*tailcfg.User, *tailcfg.Login)
 	return user, login
 }
 
+// allUserProfiles returns the profiles of all users, so nodes can
+// resolve the owners of their peers.
+func (s *Server) allUserProfiles() (res []tailcfg.UserProfile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		res = append(res, tailcfg.UserProfile{
+			ID:          u.ID,
+			LoginName:   u.LoginName,
+			DisplayName: u.DisplayName,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
 // authPathDone returns a close-only struct that's closed when the
 // authPath ("/auth/XXXXXX") has authenticated.
 func (s *Server) authPathDone(authPath string) <-chan struct{} {
@@ -497,6 +517,9 @@ func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request, mkey key.
 	if requireAuth && s.nodeKeyAuthed[nk] {
 		requireAuth = false
 	}
+	if requireAuth && s.AuthKey != "" && req.Auth.AuthKey == s.AuthKey {
+		requireAuth = false
+	}
 	allExpired := s.allExpired
 	s.mu.Unlock()
 
@@ -759,6 +782,7 @@ func (s *Server) MapResponse(req *tailcfg.MapRequest) (res *tailcfg.MapResponse,
 	sort.Slice(res.Peers, func(i, j int) bool {
 		return res.Peers[i].ID < res.Peers[j].ID
 	})
+	res.UserProfiles = s.allUserProfiles()
 
 	v4Prefix := netaddr.IPPrefixFrom(netaddr.IPv4(100, 64, uint8(tailcfg.NodeID(user.ID)>>8), uint8(tailcfg.NodeID(user.ID))), 32)
 	v6Prefix := netaddr.IPPrefixFrom(tsaddr.Tailscale4To6(v4Prefix.IP()), 128)
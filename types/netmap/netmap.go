@@ -40,7 +40,10 @@ type NetworkMap struct {
 	// TODO(maisem) : replace with View.
 	Hostinfo     tailcfg.Hostinfo
 	PacketFilter []filter.Match
-	SSHPolicy    *tailcfg.SSHPolicy // or nil, if not enabled/allowed
+	// PacketFilterRules are the rules PacketFilter was parsed from,
+	// one per Match.
+	PacketFilterRules []tailcfg.FilterRule
+	SSHPolicy         *tailcfg.SSHPolicy // or nil, if not enabled/allowed
 
 	// CollectServices reports whether this node's Tailnet has
 	// requested that info about services be included in HostInfo.
@@ -0,0 +1,159 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package preftype
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/ipproto"
+)
+
+// LocalFilterRule is a node-local packet filter rule, which further
+// restricts the incoming connections that the tailnet's packet filter
+// allows.
+//
+// Local rules are evaluated in order before the tailnet's packet
+// filter. The first one matching a new incoming connection decides
+// whether it's refused (Deny) or left to the tailnet's packet filter.
+//
+// Its text form, as used by "tailscale up --local-filter", is
+// "ACTION:PROTO:PORTS:SRC", where ACTION is "allow" or "deny", PROTO
+// is "tcp", "udp", "sctp", an IP protocol number or "*" for all IP
+// protocols, PORTS is a port, a port range such as "8000-8080" or "*"
+// for all ports, and SRC is the peer's IP address or CIDR prefix, or
+// "*" for all peers.
+// For example, "deny:tcp:22:*" refuses SSH connections from all peers.
+type LocalFilterRule struct {
+	Deny bool
+
+	// Proto is the IP protocol the rule is for, or zero for all.
+	Proto ipproto.Proto
+
+	// PortFirst and PortLast are the inclusive range of the local
+	// ports the rule is for.
+	PortFirst, PortLast uint16
+
+	// Src is the prefix of the peers the rule is for, or the zero
+	// value for all peers.
+	Src netaddr.IPPrefix
+}
+
+// ParseLocalFilterRule parses the text form of a LocalFilterRule.
+func ParseLocalFilterRule(s string) (LocalFilterRule, error) {
+	var r LocalFilterRule
+	f := strings.SplitN(s, ":", 4)
+	if len(f) != 4 {
+		return r, fmt.Errorf("invalid local filter rule %q; want ACTION:PROTO:PORTS:SRC", s)
+	}
+	switch f[0] {
+	case "allow":
+	case "deny":
+		r.Deny = true
+	default:
+		return r, fmt.Errorf("invalid action %q in local filter rule %q; want allow or deny", f[0], s)
+	}
+	switch f[1] {
+	case "*":
+	case "tcp":
+		r.Proto = ipproto.TCP
+	case "udp":
+		r.Proto = ipproto.UDP
+	case "sctp":
+		r.Proto = ipproto.SCTP
+	default:
+		n, err := strconv.ParseUint(f[1], 10, 8)
+		if err != nil || n == 0 {
+			return r, fmt.Errorf("invalid protocol %q in local filter rule %q; want tcp, udp, sctp, an IP protocol number or *", f[1], s)
+		}
+		r.Proto = ipproto.Proto(n)
+	}
+	if f[2] == "*" {
+		r.PortFirst, r.PortLast = 0, 65535
+	} else {
+		first, last := f[2], f[2]
+		if i := strings.IndexByte(f[2], '-'); i >= 0 {
+			first, last = f[2][:i], f[2][i+1:]
+		}
+		pf, err1 := strconv.ParseUint(first, 10, 16)
+		pl, err2 := strconv.ParseUint(last, 10, 16)
+		if err1 != nil || err2 != nil || pf > pl {
+			return r, fmt.Errorf("invalid ports %q in local filter rule %q", f[2], s)
+		}
+		r.PortFirst, r.PortLast = uint16(pf), uint16(pl)
+	}
+	if f[3] != "*" {
+		var err error
+		if strings.Contains(f[3], "/") {
+			r.Src, err = netaddr.ParseIPPrefix(f[3])
+		} else {
+			var ip netaddr.IP
+			ip, err = netaddr.ParseIP(f[3])
+			r.Src = netaddr.IPPrefixFrom(ip, ip.BitLen())
+		}
+		if err != nil {
+			return r, fmt.Errorf("invalid source %q in local filter rule %q", f[3], s)
+		}
+		if r.Src != r.Src.Masked() {
+			return r, fmt.Errorf("source %s in local filter rule %q has non-address bits set; expected %s", r.Src, s, r.Src.Masked())
+		}
+	}
+	return r, nil
+}
+
+// String returns the text form of r.
+func (r LocalFilterRule) String() string {
+	var sb strings.Builder
+	if r.Deny {
+		sb.WriteString("deny:")
+	} else {
+		sb.WriteString("allow:")
+	}
+	switch r.Proto {
+	case 0:
+		sb.WriteString("*")
+	case ipproto.TCP:
+		sb.WriteString("tcp")
+	case ipproto.UDP:
+		sb.WriteString("udp")
+	case ipproto.SCTP:
+		sb.WriteString("sctp")
+	default:
+		sb.WriteString(strconv.Itoa(int(r.Proto)))
+	}
+	switch {
+	case r.PortFirst == 0 && r.PortLast == 65535:
+		sb.WriteString(":*:")
+	case r.PortFirst == r.PortLast:
+		fmt.Fprintf(&sb, ":%d:", r.PortFirst)
+	default:
+		fmt.Fprintf(&sb, ":%d-%d:", r.PortFirst, r.PortLast)
+	}
+	if r.Src.IsZero() {
+		sb.WriteString("*")
+	} else if r.Src.IsSingleIP() {
+		sb.WriteString(r.Src.IP().String())
+	} else {
+		sb.WriteString(r.Src.String())
+	}
+	return sb.String()
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (r LocalFilterRule) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (r *LocalFilterRule) UnmarshalText(text []byte) error {
+	v, err := ParseLocalFilterRule(string(text))
+	if err != nil {
+		return err
+	}
+	*r = v
+	return nil
+}
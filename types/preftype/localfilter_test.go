@@ -0,0 +1,70 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package preftype
+
+import (
+	"encoding/json"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/ipproto"
+)
+
+func TestParseLocalFilterRule(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    LocalFilterRule
+		wantErr bool
+	}{
+		{in: "deny:tcp:22:*", want: LocalFilterRule{Deny: true, Proto: ipproto.TCP, PortFirst: 22, PortLast: 22}},
+		{in: "allow:*:*:100.101.102.103", want: LocalFilterRule{PortLast: 65535, Src: netaddr.MustParseIPPrefix("100.101.102.103/32")}},
+		{in: "deny:udp:5000-6000:fd7a:115c:a1e0::/48", want: LocalFilterRule{Deny: true, Proto: ipproto.UDP, PortFirst: 5000, PortLast: 6000, Src: netaddr.MustParseIPPrefix("fd7a:115c:a1e0::/48")}},
+		{in: "deny:47:*:*", want: LocalFilterRule{Deny: true, Proto: 47, PortLast: 65535}},
+		{in: "deny:tcp:22", wantErr: true},
+		{in: "block:tcp:22:*", wantErr: true},
+		{in: "deny:icmp:*:*", wantErr: true},
+		{in: "deny:tcp:23-22:*", wantErr: true},
+		{in: "deny:tcp:70000:*", wantErr: true},
+		{in: "deny:tcp:22:10.0.0.1/8", wantErr: true},
+		{in: "deny:tcp:22:bogus", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseLocalFilterRule(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseLocalFilterRule(%q) error = %v; wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseLocalFilterRule(%q) = %+v; want %+v", tt.in, got, tt.want)
+		}
+		if s := got.String(); s != tt.in {
+			t.Errorf("String() = %q; want %q", s, tt.in)
+		}
+	}
+}
+
+func TestLocalFilterRuleJSON(t *testing.T) {
+	in := []LocalFilterRule{
+		{Deny: true, Proto: ipproto.TCP, PortFirst: 22, PortLast: 22},
+		{PortLast: 65535, Src: netaddr.MustParseIPPrefix("100.64.0.0/10")},
+	}
+	j, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `["deny:tcp:22:*","allow:*:*:100.64.0.0/10"]`; string(j) != want {
+		t.Errorf("got %s; want %s", j, want)
+	}
+	var out []LocalFilterRule
+	if err := json.Unmarshal(j, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(in) || out[0] != in[0] || out[1] != in[1] {
+		t.Errorf("round trip = %+v; want %+v", out, in)
+	}
+}
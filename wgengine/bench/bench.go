@@ -18,6 +18,7 @@
 	"time"
 
 	"inet.af/netaddr"
+	"tailscale.com/net/udpbatch"
 	"tailscale.com/types/logger"
 )
 
@@ -74,6 +75,12 @@ func main() {
 	case 21:
 		setupUDPTest(logf, traf)
 
+	// Same as 21 but with batched reads, so run both on the same
+	// machine to compare. There's no sample result from the box
+	// above for it yet.
+	case 22:
+		setupBatchUDPTest(logf, traf)
+
 	// tx=1493580 rx=1493580 (0 = 0.00% loss) (12210.4 Mbits/sec)
 	case 31:
 		setupBatchTCPTest(logf, traf)
@@ -312,6 +319,58 @@ func setupUDPTest(logf logger.Logf, traf *TrafficGen) {
 	}()
 }
 
+// Like setupUDPTest, but receive packets in batches, using recvmmsg
+// plus UDP GRO where supported, as magicsock does. Only works on Linux.
+func setupBatchUDPTest(logf logger.Logf, traf *TrafficGen) {
+	la, err := net.ResolveUDPAddr("udp4", "127.0.0.1:0")
+	if err != nil {
+		log.Fatalf("resolve: %v", err)
+	}
+
+	s1, err := net.ListenUDP("udp4", la)
+	if err != nil {
+		log.Fatalf("listen1: %v", err)
+	}
+	s2, err := net.ListenUDP("udp4", la)
+	if err != nil {
+		log.Fatalf("listen2: %v", err)
+	}
+
+	s1.SetWriteBuffer(1024 * 1024)
+	s2.SetReadBuffer(1024 * 1024)
+
+	b2 := udpbatch.New(s2)
+	if b2 == nil {
+		log.Fatalf("UDP batching not supported")
+	}
+	logf("GRO=%v", b2.GRO())
+	a2 := s2.LocalAddr()
+
+	go func() {
+		// transmitter
+		b := make([]byte, 1600)
+		for {
+			n := traf.Generate(b, 16)
+			if n == 0 {
+				break
+			}
+			s1.WriteTo(b[16:n+16], a2)
+		}
+	}()
+
+	go func() {
+		// receiver
+		b := make([]byte, 65535)
+		for traf.Running() {
+			n, _, err := b2.ReadFromNetaddr(b)
+			if err != nil {
+				log.Fatalf("s2.Read: %v", err)
+			}
+			traf.GotPacket(b[:n], 0)
+		}
+	}()
+}
+
 // Instead of a channel, pass packets through a TCP socket.
 // TCP is a single stream, so we can amortize one syscall across
 // multiple packets. 10x amortization seems to make it go ~10x faster,
@@ -8,6 +8,7 @@
 
 import (
 	"fmt"
+	"runtime"
 	"testing"
 	"time"
 
@@ -37,6 +38,13 @@ func BenchmarkUDP(b *testing.B) {
 	run(b, setupUDPTest)
 }
 
+func BenchmarkBatchUDP(b *testing.B) {
+	if runtime.GOOS != "linux" {
+		b.Skip("UDP batching is only supported on Linux")
+	}
+	run(b, setupBatchUDPTest)
+}
+
 func BenchmarkBatchTCP(b *testing.B) {
 	run(b, setupBatchTCPTest)
 }
@@ -0,0 +1,283 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package capture captures the packets passing through a tstun.Wrapper
+// and streams them out in the pcapng format, as read by Wireshark and
+// tcpdump.
+package capture
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Path is where in a tstun.Wrapper's data path a packet was captured.
+type Path uint8
+
+const (
+	// FromLocal is a packet read from the local OS (or netstack),
+	// on its way to a peer.
+	FromLocal Path = iota
+	// FromPeer is a packet received from a peer, on its way to the
+	// local OS (or netstack).
+	FromPeer
+	// SynthesizedToLocal is a packet generated by tailscaled and
+	// injected towards the local OS, such as a MagicDNS ping reply.
+	SynthesizedToLocal
+	// SynthesizedToPeer is a packet generated by tailscaled (or by
+	// netstack, in userspace-networking mode) and injected towards a
+	// peer, such as a TSMP pong.
+	SynthesizedToPeer
+)
+
+func (p Path) String() string {
+	switch p {
+	case FromLocal:
+		return "from-local"
+	case FromPeer:
+		return "from-peer"
+	case SynthesizedToLocal:
+		return "synthesized-to-local"
+	case SynthesizedToPeer:
+		return "synthesized-to-peer"
+	default:
+		return "unknown"
+	}
+}
+
+// Inbound reports whether packets on path p are headed to the local
+// node, rather than away from it.
+func (p Path) Inbound() bool {
+	return p == FromPeer || p == SynthesizedToLocal
+}
+
+// Stage is whether a packet was captured before or after a
+// tstun.Wrapper's packet filter ran on it.
+//
+// Packets from the local OS and from peers are captured at both
+// stages: before the filter, as they arrived, and after it, with what
+// became of them. Packets synthesized by tailscaled don't go through
+// the filter and are only captured after it.
+type Stage uint8
+
+const (
+	PreFilter  Stage = iota // as the packet arrived
+	PostFilter              // once the filter decided what became of it
+)
+
+func (s Stage) String() string {
+	switch s {
+	case PreFilter:
+		return "pre-filter"
+	case PostFilter:
+		return "post-filter"
+	default:
+		return "unknown"
+	}
+}
+
+// Callback is the type of function a tstun.Wrapper calls for each
+// packet it captures. pkt is the packet's IP header and payload, and
+// is only valid during the call. note describes what became of the
+// packet, such as the packet filter's verdict on it; it's empty before
+// the filter.
+type Callback func(path Path, stage Stage, when time.Time, pkt []byte, note string)
+
+// snapLen is the maximum number of bytes captured of a packet.
+const snapLen = 65535
+
+// outputQueueSize is the number of packets that may be waiting to be
+// written to an output before new ones are dropped.
+const outputQueueSize = 256
+
+// Sink streams the packets passed to its LogPacket method, in the
+// pcapng format, to any number of outputs.
+//
+// The zero value is not valid; use New.
+type Sink struct {
+	numOutputs int32 // atomic; len(outputs), read in LogPacket
+
+	mu      sync.Mutex
+	outputs map[chan []byte]bool
+}
+
+// New returns a new Sink with no outputs.
+func New() *Sink {
+	return &Sink{outputs: make(map[chan []byte]bool)}
+}
+
+// NumOutputs returns the number of outputs of s.
+func (s *Sink) NumOutputs() int {
+	return int(atomic.LoadInt32(&s.numOutputs))
+}
+
+// Stream writes a pcapng capture of the packets logged to s to w, until
+// ctx is done or a write fails. If w implements an http.Flusher-style
+// Flush method, it's called after each write.
+//
+// Packets are written asynchronously; if w is slow, packets are
+// dropped rather than delaying the data path.
+func (s *Sink) Stream(ctx context.Context, w io.Writer) error {
+	flush := func() {}
+	if f, ok := w.(interface{ Flush() }); ok {
+		flush = f.Flush
+	}
+	if _, err := w.Write(fileHeader()); err != nil {
+		return err
+	}
+	flush()
+
+	ch := make(chan []byte, outputQueueSize)
+	s.mu.Lock()
+	s.outputs[ch] = true
+	atomic.StoreInt32(&s.numOutputs, int32(len(s.outputs)))
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.outputs, ch)
+		atomic.StoreInt32(&s.numOutputs, int32(len(s.outputs)))
+		s.mu.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case b := <-ch:
+			if _, err := w.Write(b); err != nil {
+				return err
+			}
+			flush()
+		}
+	}
+}
+
+// LogPacket queues the packet pkt, captured on path at stage at when,
+// to be written to all outputs of s, with note as its comment. It's a
+// Callback, so it's called in the data path and must not block.
+//
+// Each stage is written as a separate pcapng interface, so that
+// captures can be filtered by stage.
+func (s *Sink) LogPacket(path Path, stage Stage, when time.Time, pkt []byte, note string) {
+	if s.NumOutputs() == 0 {
+		return
+	}
+	b := packetBlock(path, stage, when, pkt, note)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.outputs {
+		select {
+		case ch <- b:
+		default:
+			// Output queue full; drop it rather than stall packets.
+		}
+	}
+}
+
+// Block types and option codes of the pcapng format. See
+// https://www.ietf.org/archive/id/draft-tuexen-opsawg-pcapng-05.html
+const (
+	blockSectionHeader        = 0x0A0D0D0A
+	blockInterfaceDescription = 0x00000001
+	blockEnhancedPacket       = 0x00000006
+
+	optEndOfOpt = 0
+	optComment  = 1
+	optIfName   = 2   // in interface description blocks
+	optIfTSRes  = 9   // in interface description blocks
+	optEPBFlags = 2   // in enhanced packet blocks
+	linkTypeRaw = 101 // LINKTYPE_RAW: raw IPv4 or IPv6 packets
+
+	epbFlagInbound  = 1
+	epbFlagOutbound = 2
+)
+
+// block is a pcapng block under construction.
+type block []byte
+
+func (b block) u16(v uint16) block { return append(b, byte(v), byte(v>>8)) }
+func (b block) u32(v uint32) block { return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24)) }
+
+// option appends a pcapng option with the given code and value,
+// padded to 32 bits.
+func (b block) option(code uint16, val []byte) block {
+	b = b.u16(code).u16(uint16(len(val)))
+	b = append(b, val...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// finish fills in the length fields of the block, and returns it.
+func (b block) finish() []byte {
+	b = b.u32(0) // trailing length
+	binary.LittleEndian.PutUint32(b[4:], uint32(len(b)))
+	binary.LittleEndian.PutUint32(b[len(b)-4:], uint32(len(b)))
+	return b
+}
+
+func newBlock(typ uint32) block {
+	return block(nil).u32(typ).u32(0) // length filled in by finish
+}
+
+// fileHeader returns the section header and interface description
+// blocks that start a capture. There's one interface per Stage, whose
+// ID is the Stage.
+func fileHeader() []byte {
+	b := newBlock(blockSectionHeader).
+		u32(0x1A2B3C4D).                 // byte-order magic
+		u16(1).u16(0).                   // version 1.0
+		u32(0xFFFFFFFF).u32(0xFFFFFFFF). // section length: unknown
+		u16(optEndOfOpt).u16(0).
+		finish()
+	for _, stage := range []Stage{PreFilter, PostFilter} {
+		idb := newBlock(blockInterfaceDescription).
+			u16(linkTypeRaw).u16(0).
+			u32(snapLen).
+			option(optIfName, []byte("tailscale-"+stage.String())).
+			option(optIfTSRes, []byte{9}). // nanoseconds
+			u16(optEndOfOpt).u16(0).
+			finish()
+		b = append(b, idb...)
+	}
+	return b
+}
+
+// packetBlock returns the enhanced packet block for pkt.
+func packetBlock(path Path, stage Stage, when time.Time, pkt []byte, note string) []byte {
+	origLen := len(pkt)
+	if len(pkt) > snapLen {
+		pkt = pkt[:snapLen]
+	}
+	ts := uint64(when.UnixNano())
+	flags := uint32(epbFlagOutbound)
+	if path.Inbound() {
+		flags = epbFlagInbound
+	}
+	var flagBytes [4]byte
+	binary.LittleEndian.PutUint32(flagBytes[:], flags)
+
+	comment := path.String()
+	if note != "" {
+		comment += ": " + note
+	}
+
+	b := newBlock(blockEnhancedPacket)
+	b = b.u32(uint32(stage)) // interface ID
+	b = b.u32(uint32(ts >> 32)).u32(uint32(ts))
+	b = b.u32(uint32(len(pkt))).u32(uint32(origLen))
+	b = append(b, pkt...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	b = b.option(optEPBFlags, flagBytes[:]).
+		option(optComment, []byte(comment)).
+		u16(optEndOfOpt).u16(0)
+	return b.finish()
+}
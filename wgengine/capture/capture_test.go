@@ -0,0 +1,103 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package capture
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+// readBlock reads a pcapng block from r, returning its type and
+// body, checking that its two length fields agree.
+func readBlock(t *testing.T, r io.Reader) (typ uint32, body []byte) {
+	t.Helper()
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		t.Fatal(err)
+	}
+	typ = binary.LittleEndian.Uint32(hdr[0:])
+	n := binary.LittleEndian.Uint32(hdr[4:])
+	if n%4 != 0 || n < 12 {
+		t.Fatalf("block of type %#x has bad length %d", typ, n)
+	}
+	rest := make([]byte, n-8)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		t.Fatal(err)
+	}
+	if got := binary.LittleEndian.Uint32(rest[len(rest)-4:]); got != n {
+		t.Fatalf("block of type %#x has trailing length %d; want %d", typ, got, n)
+	}
+	return typ, rest[:len(rest)-4]
+}
+
+func TestStream(t *testing.T) {
+	s := New()
+	pr, pw := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- s.Stream(ctx, pw) }()
+
+	if typ, body := readBlock(t, pr); typ != blockSectionHeader || binary.LittleEndian.Uint32(body) != 0x1A2B3C4D {
+		t.Fatalf("first block is %#x, %x; want section header", typ, body)
+	}
+	for _, stage := range []Stage{PreFilter, PostFilter} {
+		typ, body := readBlock(t, pr)
+		if typ != blockInterfaceDescription || binary.LittleEndian.Uint16(body) != linkTypeRaw {
+			t.Fatalf("%v block is %#x, %x; want raw interface description", stage, typ, body)
+		}
+		opts := body[8:]
+		wantName := "tailscale-" + stage.String()
+		if code, n := binary.LittleEndian.Uint16(opts), binary.LittleEndian.Uint16(opts[2:]); code != optIfName || string(opts[4:4+n]) != wantName {
+			t.Errorf("%v interface name option = %d, %q; want %d, %q", stage, code, opts[4:4+n], optIfName, wantName)
+		}
+	}
+	for s.NumOutputs() == 0 {
+		// Stream registers its output after writing the header.
+		time.Sleep(time.Millisecond)
+	}
+
+	pkt := []byte{0x45, 1, 2, 3, 4, 5} // not a multiple of 4 bytes
+	when := time.Unix(1, 2)
+	s.LogPacket(FromPeer, PostFilter, when, pkt, "accepted by filter")
+
+	typ, body := readBlock(t, pr)
+	if typ != blockEnhancedPacket {
+		t.Fatalf("block type = %#x; want enhanced packet", typ)
+	}
+	if id := binary.LittleEndian.Uint32(body); id != uint32(PostFilter) {
+		t.Errorf("interface ID = %d; want %d", id, PostFilter)
+	}
+	ts := uint64(binary.LittleEndian.Uint32(body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(body[8:]))
+	if ts != uint64(when.UnixNano()) {
+		t.Errorf("timestamp = %d; want %d", ts, when.UnixNano())
+	}
+	if capLen, origLen := binary.LittleEndian.Uint32(body[12:]), binary.LittleEndian.Uint32(body[16:]); capLen != 6 || origLen != 6 {
+		t.Errorf("lengths = %d, %d; want 6, 6", capLen, origLen)
+	}
+	if !bytes.Equal(body[20:26], pkt) {
+		t.Errorf("packet = %x; want %x", body[20:26], pkt)
+	}
+	opts := body[28:] // padded to 32 bits
+	if code, flags := binary.LittleEndian.Uint16(opts), binary.LittleEndian.Uint32(opts[4:]); code != optEPBFlags || flags != epbFlagInbound {
+		t.Errorf("flags option = %d, %d; want %d, %d", code, flags, optEPBFlags, epbFlagInbound)
+	}
+	opts = opts[8:]
+	wantComment := "from-peer: accepted by filter"
+	if code, n := binary.LittleEndian.Uint16(opts), binary.LittleEndian.Uint16(opts[2:]); code != optComment || string(opts[4:4+n]) != wantComment {
+		t.Errorf("comment option = %d, %q; want %d, %q", code, opts[4:4+n], optComment, wantComment)
+	}
+
+	cancel()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if n := s.NumOutputs(); n != 0 {
+		t.Errorf("NumOutputs = %d after Stream returned; want 0", n)
+	}
+}
@@ -0,0 +1,325 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/net/flowtrack"
+	"tailscale.com/net/packet"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/util/clientmetric"
+)
+
+// conntrackShards is the number of independently locked shards of a
+// conntrack table.
+const conntrackShards = 16
+
+// defaultConntrackSize is the default maximum number of flows in each
+// of a conntrack table's UDP and TCP tables.
+const defaultConntrackSize = 16384
+
+// Idle timeouts of conntrack entries, by protocol and TCP state.
+const (
+	udpTimeout            = 5 * time.Minute // also used for SCTP
+	tcpSynTimeout         = 2 * time.Minute
+	tcpEstablishedTimeout = 24 * time.Hour
+	tcpClosingTimeout     = 2 * time.Minute
+	tcpClosedTimeout      = 10 * time.Second
+)
+
+var (
+	metricConntrackEvictions = clientmetric.NewCounter("filter_conntrack_evictions")
+	metricConntrackExpired   = clientmetric.NewCounter("filter_conntrack_expired")
+)
+
+// conntrackSizeVal is the size of new conntrack tables, if set by
+// SetConntrackSize. It's accessed atomically.
+var conntrackSizeVal int64
+
+// SetConntrackSize sets the maximum number of UDP and SCTP flows, and
+// separately of TCP connections, tracked by packet filters created
+// afterwards that don't share state with an older filter. A size of
+// zero or less restores the default.
+func SetConntrackSize(size int) {
+	atomic.StoreInt64(&conntrackSizeVal, int64(size))
+}
+
+// conntrackSize returns the configured size of new conntrack tables.
+func conntrackSize() int {
+	if n := atomic.LoadInt64(&conntrackSizeVal); n > 0 {
+		return int(n)
+	}
+	return defaultConntrackSize
+}
+
+// conntrack is a connection tracking table. It's used to accept
+// incoming UDP and SCTP packets that are replies to flows this node
+// initiated, and tracks the state of TCP connections through it to
+// expire them after a timeout that depends on their state.
+//
+// Flows are keyed by their 5-tuple as seen on incoming packets, from
+// the Tailscale peer to the local machine, regardless of which side
+// initiated them.
+//
+// UDP and SCTP flows and TCP connections are kept in separate tables,
+// so long-lived TCP connections can't evict the state that lets UDP
+// replies in. Each table is sharded by flow so that packets of
+// unrelated flows processed concurrently don't contend on a single
+// lock. Each shard is an LRU of bounded size; entries also expire
+// after an idle timeout that depends on the protocol and TCP state.
+type conntrack struct {
+	udp   conntrackTable // UDP and SCTP flows
+	tcp   conntrackTable // TCP connections
+	frags fragTable
+}
+
+type conntrackTable struct {
+	shards [conntrackShards]conntrackShard
+}
+
+type conntrackShard struct {
+	mu  sync.Mutex
+	lru flowtrack.Cache // from flowtrack.Tuple -> *conn
+}
+
+// tcpState is the state of a tracked TCP connection.
+type tcpState uint8
+
+const (
+	tcpNone        tcpState = iota // not TCP
+	tcpSyn                         // SYN seen, handshake in progress
+	tcpEstablished                 // handshake completed
+	tcpClosing                     // FIN seen in either direction
+	tcpClosed                      // RST seen
+)
+
+// conn is the tracked state of a flow.
+type conn struct {
+	state    tcpState
+	lastSeen mono.Time
+	// rule is the counters of the rule that accepted the flow's
+	// first incoming packet, or nil if this node initiated the flow.
+	rule *ruleCounters
+}
+
+// timeout returns how long c may be idle before it expires.
+func (c *conn) timeout() time.Duration {
+	switch c.state {
+	case tcpSyn:
+		return tcpSynTimeout
+	case tcpEstablished:
+		return tcpEstablishedTimeout
+	case tcpClosing:
+		return tcpClosingTimeout
+	case tcpClosed:
+		return tcpClosedTimeout
+	}
+	return udpTimeout
+}
+
+func (c *conn) expired(now mono.Time) bool {
+	return now.Sub(c.lastSeen) > c.timeout()
+}
+
+// updateTCP transitions c's TCP state for a packet with flags. It
+// reports whether the packet started a new connection reusing the
+// flow's 5-tuple.
+func (c *conn) updateTCP(flags packet.TCPFlag) (restarted bool) {
+	switch {
+	case flags&packet.TCPRst != 0:
+		c.state = tcpClosed
+	case flags&packet.TCPFin != 0:
+		if c.state != tcpClosed {
+			c.state = tcpClosing
+		}
+	case flags&packet.TCPSynAck == packet.TCPSyn:
+		// A new SYN on a closed flow is a new connection reusing
+		// the same 5-tuple.
+		if c.state == tcpClosing || c.state == tcpClosed {
+			c.state = tcpSyn
+			return true
+		}
+	case flags&packet.TCPAck != 0:
+		// The RST isn't checked against the connection's sequence
+		// numbers, so it may have been stale or forged. Traffic
+		// after it means the connection is still alive.
+		if c.state == tcpSyn || c.state == tcpClosed {
+			c.state = tcpEstablished
+		}
+	}
+	return false
+}
+
+// newConntrack returns a new conntrack table holding at most size UDP
+// and SCTP flows, and at most size TCP connections.
+func newConntrack(size int) *conntrack {
+	ct := new(conntrack)
+	ct.udp.init(size)
+	ct.tcp.init(size)
+	return ct
+}
+
+func (tb *conntrackTable) init(size int) {
+	perShard := size / conntrackShards
+	if perShard < 1 {
+		perShard = 1
+	}
+	for i := range tb.shards {
+		tb.shards[i].lru.MaxEntries = perShard
+	}
+}
+
+// table returns the table tracking flows of protocol proto, or nil if
+// proto isn't tracked.
+func (ct *conntrack) table(proto ipproto.Proto) *conntrackTable {
+	switch proto {
+	case ipproto.TCP:
+		return &ct.tcp
+	case ipproto.UDP, ipproto.SCTP:
+		return &ct.udp
+	}
+	return nil
+}
+
+// shard returns the shard holding the flow t.
+func (tb *conntrackTable) shard(t flowtrack.Tuple) *conntrackShard {
+	src, dst := t.Src.IP().As16(), t.Dst.IP().As16()
+	h := uint32(t.Src.Port())<<16 | uint32(t.Dst.Port())
+	h ^= binary.BigEndian.Uint32(src[12:]) ^ binary.BigEndian.Uint32(dst[12:])
+	h ^= binary.BigEndian.Uint32(src[8:]) ^ binary.BigEndian.Uint32(dst[8:])
+	h ^= h >> 16
+	h *= 0x45d9f3b
+	h ^= h >> 16
+	return &tb.shards[h%conntrackShards]
+}
+
+// getLocked returns the live entry for t, removing it if it has
+// expired. s.mu must be held.
+func (s *conntrackShard) getLocked(t flowtrack.Tuple, now mono.Time) (*conn, bool) {
+	v, ok := s.lru.Get(t)
+	if !ok {
+		return nil, false
+	}
+	c := v.(*conn)
+	if c.expired(now) {
+		s.lru.Remove(t)
+		metricConntrackExpired.Add(1)
+		return nil, false
+	}
+	return c, true
+}
+
+// addLocked adds a new entry for t, making room for it if the shard
+// is full. s.mu must be held.
+func (s *conntrackShard) addLocked(t flowtrack.Tuple, c *conn, now mono.Time) {
+	if s.lru.Len() >= s.lru.MaxEntries {
+		if _, v, ok := s.lru.Oldest(); ok {
+			if v.(*conn).expired(now) {
+				metricConntrackExpired.Add(1)
+			} else {
+				metricConntrackEvictions.Add(1)
+			}
+			s.lru.RemoveOldest()
+		}
+	}
+	s.lru.Add(t, c)
+}
+
+// inTuple returns the key of the flow of q, which is flowing in
+// direction dir.
+func inTuple(q *packet.Parsed, dir direction) flowtrack.Tuple {
+	if dir == out {
+		return flowtrack.Tuple{Proto: q.IPProto, Src: q.Dst, Dst: q.Src}
+	}
+	return flowtrack.Tuple{Proto: q.IPProto, Src: q.Src, Dst: q.Dst}
+}
+
+// lookup reports whether the incoming packet q belongs to a live flow
+// that this node initiated, refreshing the flow if so.
+//
+// Incoming packets of flows that a rule accepted aren't reported, as
+// they must keep being evaluated against the current rules.
+func (ct *conntrack) lookup(q *packet.Parsed, now mono.Time) bool {
+	t := inTuple(q, in)
+	s := ct.udp.shard(t)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.getLocked(t, now)
+	if !ok || c.rule != nil {
+		return false
+	}
+	c.lastSeen = now
+	return true
+}
+
+// track records that q was allowed through in direction dir. rule is
+// the counters of the rule that accepted q, if any.
+//
+// UDP and SCTP flows are created by outgoing packets, or by incoming
+// packets accepted by a rule. TCP flows are created by a SYN in either
+// direction and then follow the connection's state; other TCP packets
+// don't create flows, so connections that predate the table aren't
+// tracked.
+//
+// It returns the counters of the rule that accepted the flow, if any,
+// and whether q started a new flow.
+func (ct *conntrack) track(q *packet.Parsed, dir direction, now mono.Time, rule *ruleCounters) (flowRule *ruleCounters, isNew bool) {
+	tb := ct.table(q.IPProto)
+	if tb == nil {
+		return nil, false
+	}
+	isTCP := q.IPProto == ipproto.TCP
+	if !isTCP && dir == in && rule == nil {
+		// A reply to a flow this node initiated, which lookup
+		// already refreshed.
+		return nil, false
+	}
+	t := inTuple(q, dir)
+	s := tb.shard(t)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.getLocked(t, now); ok {
+		c.lastSeen = now
+		if isTCP && c.updateTCP(q.TCPFlags) {
+			isNew = true
+			c.rule = rule
+		}
+		if rule != nil {
+			c.rule = rule
+		}
+		return c.rule, isNew
+	}
+	c := &conn{lastSeen: now, rule: rule}
+	if isTCP {
+		if !q.IsTCPSyn() {
+			return nil, false
+		}
+		c.state = tcpSyn
+	}
+	s.addLocked(t, c, now)
+	return rule, true
+}
+
+// numFlows returns the number of flows in ct, including expired ones
+// not yet removed.
+func (ct *conntrack) numFlows() int {
+	return ct.udp.numFlows() + ct.tcp.numFlows()
+}
+
+func (tb *conntrackTable) numFlows() int {
+	n := 0
+	for i := range tb.shards {
+		s := &tb.shards[i]
+		s.mu.Lock()
+		n += s.lru.Len()
+		s.mu.Unlock()
+	}
+	return n
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"testing"
+	"time"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/ipproto"
+)
+
+func TestConntrackUDPTimeout(t *testing.T) {
+	ct := newConntrack(defaultConntrackSize)
+	now := mono.Now()
+
+	req := parsed(ipproto.UDP, "1.2.3.4", "5.6.7.8", 1234, 53)
+	reply := parsed(ipproto.UDP, "5.6.7.8", "1.2.3.4", 53, 1234)
+
+	if ct.lookup(&reply, now) {
+		t.Fatal("reply accepted before any outgoing packet")
+	}
+	ct.track(&reply, in, now, nil)
+	if ct.lookup(&reply, now) {
+		t.Fatal("incoming UDP packet created a flow")
+	}
+	ct.track(&req, out, now, nil)
+	if !ct.lookup(&reply, now.Add(udpTimeout/2)) {
+		t.Fatal("reply not accepted")
+	}
+	// The lookup above refreshed the flow.
+	if !ct.lookup(&reply, now.Add(udpTimeout)) {
+		t.Fatal("reply not accepted after refresh")
+	}
+	if ct.lookup(&reply, now.Add(3*udpTimeout)) {
+		t.Fatal("reply accepted after idle timeout")
+	}
+	if n := ct.numFlows(); n != 0 {
+		t.Fatalf("expired flow not removed; have %d flows", n)
+	}
+}
+
+func TestConntrackTCPStates(t *testing.T) {
+	ct := newConntrack(defaultConntrackSize)
+	now := mono.Now()
+
+	pkt := func(dir direction, flags packet.TCPFlag) *packet.Parsed {
+		var q packet.Parsed
+		if dir == out {
+			q = parsed(ipproto.TCP, "1.2.3.4", "5.6.7.8", 1234, 22)
+		} else {
+			q = parsed(ipproto.TCP, "5.6.7.8", "1.2.3.4", 22, 1234)
+		}
+		q.TCPFlags = flags
+		return &q
+	}
+	state := func() tcpState {
+		t.Helper()
+		s := ct.tcp.shard(inTuple(pkt(in, 0), in))
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		c, ok := s.getLocked(inTuple(pkt(in, 0), in), now)
+		if !ok {
+			return tcpNone
+		}
+		return c.state
+	}
+
+	ct.track(pkt(in, packet.TCPAck), in, now, nil)
+	if got := state(); got != tcpNone {
+		t.Fatalf("non-SYN packet created flow in state %v", got)
+	}
+
+	steps := []struct {
+		dir   direction
+		flags packet.TCPFlag
+		want  tcpState
+	}{
+		{out, packet.TCPSyn, tcpSyn},
+		{in, packet.TCPSynAck, tcpEstablished},
+		{out, packet.TCPAck, tcpEstablished},
+		{in, packet.TCPAck | packet.TCPPsh, tcpEstablished},
+		{in, packet.TCPRst, tcpClosed},                       // bogus
+		{out, packet.TCPAck | packet.TCPPsh, tcpEstablished}, // still alive
+		{out, packet.TCPFin | packet.TCPAck, tcpClosing},
+		{in, packet.TCPAck, tcpClosing},
+		{in, packet.TCPRst, tcpClosed},
+		{out, packet.TCPSyn, tcpSyn}, // 5-tuple reused
+	}
+	for i, st := range steps {
+		ct.track(pkt(st.dir, st.flags), st.dir, now, nil)
+		if got := state(); got != st.want {
+			t.Fatalf("step %d (%v %#x): state = %v; want %v", i, st.dir, st.flags, got, st.want)
+		}
+	}
+
+	ct.track(pkt(in, packet.TCPRst), in, now, nil)
+	now = now.Add(tcpClosedTimeout + time.Second)
+	if got := state(); got != tcpNone {
+		t.Fatalf("closed flow still tracked after timeout; state %v", got)
+	}
+}
+
+func TestConntrackEviction(t *testing.T) {
+	ct := newConntrack(conntrackShards) // one flow per shard
+	now := mono.Now()
+	before := metricConntrackEvictions.Value()
+
+	const flows = 10 * conntrackShards
+	for i := 0; i < flows; i++ {
+		q := parsed(ipproto.UDP, "1.2.3.4", "5.6.7.8", uint16(1000+i), 53)
+		ct.track(&q, out, now, nil)
+	}
+	if n := ct.numFlows(); n > conntrackShards {
+		t.Fatalf("have %d flows; want at most %d", n, conntrackShards)
+	}
+	evicted := metricConntrackEvictions.Value() - before
+	if want := int64(flows - ct.numFlows()); evicted != want {
+		t.Fatalf("evictions = %d; want %d", evicted, want)
+	}
+}
+
+func TestConntrackTCPDoesNotEvictUDP(t *testing.T) {
+	ct := newConntrack(conntrackShards) // one flow per shard
+	now := mono.Now()
+
+	req := parsed(ipproto.UDP, "1.2.3.4", "5.6.7.8", 1234, 53)
+	reply := parsed(ipproto.UDP, "5.6.7.8", "1.2.3.4", 53, 1234)
+	ct.track(&req, out, now, nil)
+	for i := 0; i < 10*conntrackShards; i++ {
+		syn := parsed(ipproto.TCP, "1.2.3.4", "5.6.7.8", uint16(1000+i), 22)
+		ct.track(&syn, out, now, nil)
+	}
+	if !ct.lookup(&reply, now) {
+		t.Fatal("TCP connections evicted UDP reply state")
+	}
+}
+
+func TestFilterTCPBogusReset(t *testing.T) {
+	acl := newFilter(t.Logf)
+	pkt := func(dir direction, flags packet.TCPFlag) *packet.Parsed {
+		var q packet.Parsed
+		if dir == out {
+			q = parsed(ipproto.TCP, "1.2.3.4", "8.1.1.1", 1234, 22)
+		} else {
+			q = parsed(ipproto.TCP, "8.1.1.1", "1.2.3.4", 22, 1234)
+		}
+		q.TCPFlags = flags
+		return &q
+	}
+	state := func() tcpState {
+		tup := inTuple(pkt(in, 0), in)
+		s := acl.state.tcp.shard(tup)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if c, ok := s.getLocked(tup, mono.Now()); ok {
+			return c.state
+		}
+		return tcpNone
+	}
+
+	acl.RunOut(pkt(out, packet.TCPSyn), 0)
+	if got := acl.RunIn(pkt(in, packet.TCPSynAck), 0); got != Accept {
+		t.Fatalf("SYN-ACK: got %v; want Accept", got)
+	}
+	acl.RunOut(pkt(out, packet.TCPAck), 0)
+
+	// A RST that's stale, spoofed or reordered, in either direction,
+	// doesn't cut off the live connection.
+	for _, dir := range []direction{in, out} {
+		if dir == in {
+			acl.RunIn(pkt(in, packet.TCPRst), 0)
+		} else {
+			acl.RunOut(pkt(out, packet.TCPRst), 0)
+		}
+		for i := 0; i < 3; i++ {
+			if got := acl.RunIn(pkt(in, packet.TCPAck|packet.TCPPsh), 0); got != Accept {
+				t.Fatalf("after %v RST, packet %d: got %v; want Accept", dir, i, got)
+			}
+			acl.RunOut(pkt(out, packet.TCPAck), 0)
+		}
+		if got := state(); got != tcpEstablished {
+			t.Fatalf("after %v RST and traffic: state = %v; want %v", dir, got, tcpEstablished)
+		}
+	}
+}
+
+func TestSetConntrackSize(t *testing.T) {
+	defer SetConntrackSize(0)
+	SetConntrackSize(100)
+	if got := conntrackSize(); got != 100 {
+		t.Errorf("conntrackSize = %d; want 100", got)
+	}
+	SetConntrackSize(0)
+	if got := conntrackSize(); got != defaultConntrackSize {
+		t.Errorf("conntrackSize = %d; want default %d", got, defaultConntrackSize)
+	}
+}
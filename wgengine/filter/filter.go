@@ -7,13 +7,12 @@
 
 import (
 	"fmt"
-	"sync"
 	"time"
 
 	"inet.af/netaddr"
 	"tailscale.com/envknob"
-	"tailscale.com/net/flowtrack"
 	"tailscale.com/net/packet"
+	"tailscale.com/tstime/mono"
 	"tailscale.com/tstime/rate"
 	"tailscale.com/types/ipproto"
 	"tailscale.com/types/logger"
@@ -38,24 +37,37 @@ type Filter struct {
 	// match is to drop the packet.
 	matches4 matches
 	matches6 matches
+	// matcher4 and matcher6 are matches4 and matches6 compiled for
+	// fast matching. They're what packets are matched against.
+	matcher4 *matcher
+	matcher6 *matcher
+	// rules4 and rules6 are the hit counters of the rules in
+	// matches4 and matches6, respectively.
+	rules4 []*ruleCounters
+	rules6 []*ruleCounters
+	// rules are the hit counters of all rules, in the order of the
+	// matches passed to New.
+	rules []*ruleCounters
+	// localRules4 and localRules6 are the node-local rules, by
+	// family, compiled; nil if there are none. localDeny4 and
+	// localDeny6 are whether each of them denies rather than
+	// allows. See SetLocalRules.
+	localRules4 *matcher
+	localRules6 *matcher
+	localDeny4  []bool
+	localDeny6  []bool
+	// flowLog, if non-nil, is called with each new flow accepted or
+	// dropped by the filter. See SetFlowLogger.
+	flowLog func(Flow)
 	// state is the connection tracking state attached to this
 	// filter. It is used to allow incoming traffic that is a response
 	// to an outbound connection that this node made, even if those
 	// incoming packets don't get accepted by matches above.
-	state *filterState
+	state *conntrack
 
 	shieldsUp bool
 }
 
-// filterState is a state cache of past seen packets.
-type filterState struct {
-	mu  sync.Mutex
-	lru *flowtrack.Cache // from flowtrack.Tuple -> nil
-}
-
-// lruMax is the size of the LRU cache in filterState.
-const lruMax = 512
-
 // Response is a verdict from the packet filter.
 type Response int
 
@@ -162,30 +174,53 @@ func NewShieldsUpFilter(localNets *netaddr.IPSet, logIPs *netaddr.IPSet, shareSt
 // shares state with the previous one, to enable changing rules at
 // runtime without breaking existing stateful flows.
 func New(matches []Match, localNets *netaddr.IPSet, logIPs *netaddr.IPSet, shareStateWith *Filter, logf logger.Logf) *Filter {
-	var state *filterState
+	var state *conntrack
+	var oldRules map[string]*ruleCounters
 	if shareStateWith != nil {
 		state = shareStateWith.state
+		// Keep counting hits of rules that are unchanged.
+		oldRules = make(map[string]*ruleCounters, len(shareStateWith.rules))
+		for _, rc := range shareStateWith.rules {
+			oldRules[rc.match] = rc
+		}
 	} else {
-		state = &filterState{
-			lru: &flowtrack.Cache{MaxEntries: lruMax},
+		state = newConntrack(conntrackSize())
+	}
+	rules := make([]*ruleCounters, len(matches))
+	for i, m := range matches {
+		k := m.String()
+		if rc, ok := oldRules[k]; ok {
+			rules[i] = rc
+		} else {
+			rules[i] = &ruleCounters{match: k}
 		}
 	}
 	f := &Filter{
-		logf:     logf,
-		matches4: matchesFamily(matches, netaddr.IP.Is4),
-		matches6: matchesFamily(matches, netaddr.IP.Is6),
-		local:    localNets,
-		logIPs:   logIPs,
-		state:    state,
+		logf:   logf,
+		local:  localNets,
+		logIPs: logIPs,
+		rules:  rules,
+		state:  state,
+	}
+	var idx4, idx6 []int
+	f.matches4, idx4 = matchesFamily(matches, netaddr.IP.Is4)
+	f.matches6, idx6 = matchesFamily(matches, netaddr.IP.Is6)
+	for _, i := range idx4 {
+		f.rules4 = append(f.rules4, rules[i])
 	}
+	for _, i := range idx6 {
+		f.rules6 = append(f.rules6, rules[i])
+	}
+	f.matcher4 = newMatcher(f.matches4, true)
+	f.matcher6 = newMatcher(f.matches6, false)
 	return f
 }
 
 // matchesFamily returns the subset of ms for which keep(srcNet.IP)
-// and keep(dstNet.IP) are both true.
-func matchesFamily(ms matches, keep func(netaddr.IP) bool) matches {
-	var ret matches
-	for _, m := range ms {
+// and keep(dstNet.IP) are both true, along with the indices in ms of
+// the returned Matches.
+func matchesFamily(ms matches, keep func(netaddr.IP) bool) (ret matches, idx []int) {
+	for i, m := range ms {
 		var retm Match
 		retm.IPProto = m.IPProto
 		for _, src := range m.Srcs {
@@ -200,9 +235,10 @@ func matchesFamily(ms matches, keep func(netaddr.IP) bool) matches {
 		}
 		if len(retm.Srcs) > 0 && len(retm.Dsts) > 0 {
 			ret = append(ret, retm)
+			idx = append(idx, i)
 		}
 	}
-	return ret
+	return ret, idx
 }
 
 func maybeHexdump(flag RunFlags, b []byte) string {
@@ -269,53 +305,125 @@ func (f *Filter) logRateLimit(runflags RunFlags, q *packet.Parsed, dir direction
 // CheckTCP determines whether TCP traffic from srcIP to dstIP:dstPort
 // is allowed.
 func (f *Filter) CheckTCP(srcIP, dstIP netaddr.IP, dstPort uint16) Response {
+	return f.Check(ipproto.TCP, netaddr.IPPortFrom(srcIP, 0), netaddr.IPPortFrom(dstIP, dstPort), true).Verdict
+}
+
+// CheckResult is the result of Filter.Check.
+type CheckResult struct {
+	Verdict Response
+	Reason  string // why, as it would be logged
+
+	// Rule is the index, in the Matches the filter was created with,
+	// of the rule that accepted the packet, or -1 if none did.
+	Rule int
+	// Match is that rule, as formatted by Match.String.
+	Match string
+}
+
+// Check evaluates the filter for a synthesized packet of protocol
+// proto from src to dst, as the first packet of its flow (for TCP, a
+// SYN). incoming is whether the packet is from a Tailscale peer to
+// this node, as opposed to from this node to a Tailscale peer.
+//
+// The packet isn't tracked, counted or logged.
+func (f *Filter) Check(proto ipproto.Proto, src, dst netaddr.IPPort, incoming bool) CheckResult {
+	res := CheckResult{Verdict: Drop, Rule: -1}
 	pkt := &packet.Parsed{}
 	pkt.Decode(dummyPacket) // initialize private fields
 	switch {
-	case (srcIP.Is4() && dstIP.Is6()) || (srcIP.Is6() && srcIP.Is4()):
-		// Mistmatched address families, no filters will
-		// match.
-		return Drop
-	case srcIP.Is4():
+	case src.IP().Is4() != dst.IP().Is4():
+		res.Reason = "mismatched address families"
+		return res
+	case src.IP().Is4():
 		pkt.IPVersion = 4
-	case srcIP.Is6():
+	case src.IP().Is6():
 		pkt.IPVersion = 6
 	default:
-		panic("unreachable")
+		res.Reason = "not-ip"
+		return res
+	}
+	pkt.Src = src
+	pkt.Dst = dst
+	pkt.IPProto = proto
+	if proto == ipproto.TCP {
+		pkt.TCPFlags = packet.TCPSyn
 	}
-	pkt.Src = netaddr.IPPortFrom(srcIP, 0)
-	pkt.Dst = netaddr.IPPortFrom(dstIP, dstPort)
-	pkt.IPProto = ipproto.TCP
-	pkt.TCPFlags = packet.TCPSyn
 
-	return f.RunIn(pkt, 0)
+	res.Verdict, res.Reason = preCheck(pkt)
+	if res.Verdict != noVerdict {
+		return res
+	}
+	if !incoming {
+		// Like runOut, without tracking the packet.
+		res.Verdict, res.Reason = Accept, "ok out"
+		return res
+	}
+	var rule *ruleCounters
+	res.Verdict, res.Reason, rule = f.evalIn(pkt)
+	if res.Verdict == Drop && f.shieldsUp {
+		res.Reason = "shields up: " + res.Reason
+	}
+	if rule != nil {
+		res.Match = rule.match
+		for i, rc := range f.rules {
+			if rc == rule {
+				res.Rule = i
+				break
+			}
+		}
+	}
+	return res
 }
 
 // ShieldsUp reports whether this is a "shields up" (block everything
 // incoming) filter.
 func (f *Filter) ShieldsUp() bool { return f.shieldsUp }
 
+// IsLocal reports whether ip is in the set of IPs that are local to
+// this node.
+func (f *Filter) IsLocal(ip netaddr.IP) bool { return f.local.Contains(ip) }
+
 // RunIn determines whether this node is allowed to receive q from a
 // Tailscale peer.
 func (f *Filter) RunIn(q *packet.Parsed, rf RunFlags) Response {
+	r, rule, evaluated := f.runIn(q, rf)
+	if evaluated {
+		f.noteFlow(q, in, r, rule)
+	}
+	return r
+}
+
+// runIn is RunIn without updating the connection tracking state, rule
+// counters and flow log with the packet.
+//
+// It returns the counters of the rule that accepted q, if any, and
+// whether q was evaluated against the rules at all, as opposed to
+// being decided by the direction-agnostic checks in pre.
+func (f *Filter) runIn(q *packet.Parsed, rf RunFlags) (r Response, rule *ruleCounters, evaluated bool) {
 	dir := in
-	r := f.pre(q, rf, dir)
+	r = f.pre(q, rf, dir)
 	if r == Accept || r == Drop {
 		// already logged
-		return r
+		return r, nil, false
 	}
 
 	var why string
+	r, why, rule = f.evalIn(q)
+	f.logRateLimit(rf, q, dir, r, why)
+	return r, rule, true
+}
+
+// evalIn evaluates the rules for the incoming packet q, which pre
+// didn't decide on. It returns the counters of the rule that accepted
+// q, if any.
+func (f *Filter) evalIn(q *packet.Parsed) (r Response, why string, rule *ruleCounters) {
 	switch q.IPVersion {
 	case 4:
-		r, why = f.runIn4(q)
+		return f.runIn4(q)
 	case 6:
-		r, why = f.runIn6(q)
-	default:
-		r, why = Drop, "not-ip"
+		return f.runIn6(q)
 	}
-	f.logRateLimit(rf, q, dir, r, why)
-	return r
+	return Drop, "not-ip", nil
 }
 
 // RunOut determines whether this node is allowed to send q to a
@@ -332,12 +440,35 @@ func (f *Filter) RunOut(q *packet.Parsed, rf RunFlags) Response {
 	return r
 }
 
-func (f *Filter) runIn4(q *packet.Parsed) (r Response, why string) {
+// noteFlow updates the connection tracking state, the rule counters
+// and the flow log with q, flowing in direction dir, which the rules
+// decided to r. rule is the counters of the rule that accepted q, if
+// any.
+func (f *Filter) noteFlow(q *packet.Parsed, dir direction, r Response, rule *ruleCounters) {
+	now := mono.Now()
+	if r != Accept {
+		if dir == in && q.MoreFrags {
+			// Drop the rest of the packet too.
+			f.state.frags.drop(q, now)
+		}
+		f.logFlow(q, dir, r, nil)
+		return
+	}
+	flowRule, isNew := f.state.track(q, dir, now, rule)
+	if dir == in && flowRule != nil {
+		flowRule.add(q, isNew)
+	}
+	if isNew {
+		f.logFlow(q, dir, r, flowRule)
+	}
+}
+
+func (f *Filter) runIn4(q *packet.Parsed) (r Response, why string, rule *ruleCounters) {
 	// A compromised peer could try to send us packets for
 	// destinations we didn't explicitly advertise. This check is to
 	// prevent that.
 	if !f.local.Contains(q.Dst.IP()) {
-		return Drop, "destination not allowed"
+		return Drop, "destination not allowed", nil
 	}
 
 	switch q.IPProto {
@@ -348,10 +479,12 @@ func (f *Filter) runIn4(q *packet.Parsed) (r Response, why string) {
 			//  We could choose to reject all packets that aren't
 			//  related to an existing ICMP-Echo, TCP, or UDP
 			//  session.
-			return Accept, "icmp response ok"
-		} else if f.matches4.matchIPsOnly(q) {
+			return Accept, "icmp response ok", nil
+		} else if f.localDenied(q) {
+			return Drop, "denied by local rule", nil
+		} else if f.matcher4.matchIPsOnly(q) {
 			// If any port is open to an IP, allow ICMP to it.
-			return Accept, "icmp ok"
+			return Accept, "icmp ok", nil
 		}
 	case ipproto.TCP:
 		// For TCP, we want to allow *outgoing* connections,
@@ -363,41 +496,44 @@ func (f *Filter) runIn4(q *packet.Parsed) (r Response, why string) {
 		// It happens to also be much faster.
 		// TODO(apenwarr): Skip the rest of decoding in this path?
 		if !q.IsTCPSyn() {
-			return Accept, "tcp non-syn"
+			return Accept, "tcp non-syn", nil
+		}
+		if f.localDenied(q) {
+			return Drop, "denied by local rule", nil
 		}
-		if f.matches4.match(q) {
-			return Accept, "tcp ok"
+		if i := f.matcher4.match(q); i >= 0 {
+			return Accept, "tcp ok", f.rules4[i]
 		}
 	case ipproto.UDP, ipproto.SCTP:
-		t := flowtrack.Tuple{Proto: q.IPProto, Src: q.Src, Dst: q.Dst}
-
-		f.state.mu.Lock()
-		_, ok := f.state.lru.Get(t)
-		f.state.mu.Unlock()
-
-		if ok {
-			return Accept, "cached"
+		if f.state.lookup(q, mono.Now()) {
+			return Accept, "cached", nil
+		}
+		if f.localDenied(q) {
+			return Drop, "denied by local rule", nil
 		}
-		if f.matches4.match(q) {
-			return Accept, "ok"
+		if i := f.matcher4.match(q); i >= 0 {
+			return Accept, "ok", f.rules4[i]
 		}
 	case ipproto.TSMP:
-		return Accept, "tsmp ok"
+		return Accept, "tsmp ok", nil
 	default:
-		if f.matches4.matchProtoAndIPsOnlyIfAllPorts(q) {
-			return Accept, "otherproto ok"
+		if f.localDenied(q) {
+			return Drop, "denied by local rule", nil
 		}
-		return Drop, "Unknown proto"
+		if f.matcher4.matchProtoAndIPsOnlyIfAllPorts(q) {
+			return Accept, "otherproto ok", nil
+		}
+		return Drop, "Unknown proto", nil
 	}
-	return Drop, "no rules matched"
+	return Drop, "no rules matched", nil
 }
 
-func (f *Filter) runIn6(q *packet.Parsed) (r Response, why string) {
+func (f *Filter) runIn6(q *packet.Parsed) (r Response, why string, rule *ruleCounters) {
 	// A compromised peer could try to send us packets for
 	// destinations we didn't explicitly advertise. This check is to
 	// prevent that.
 	if !f.local.Contains(q.Dst.IP()) {
-		return Drop, "destination not allowed"
+		return Drop, "destination not allowed", nil
 	}
 
 	switch q.IPProto {
@@ -408,10 +544,12 @@ func (f *Filter) runIn6(q *packet.Parsed) (r Response, why string) {
 			//  We could choose to reject all packets that aren't
 			//  related to an existing ICMP-Echo, TCP, or UDP
 			//  session.
-			return Accept, "icmp response ok"
-		} else if f.matches6.matchIPsOnly(q) {
+			return Accept, "icmp response ok", nil
+		} else if f.localDenied(q) {
+			return Drop, "denied by local rule", nil
+		} else if f.matcher6.matchIPsOnly(q) {
 			// If any port is open to an IP, allow ICMP to it.
-			return Accept, "icmp ok"
+			return Accept, "icmp ok", nil
 		}
 	case ipproto.TCP:
 		// For TCP, we want to allow *outgoing* connections,
@@ -423,47 +561,41 @@ func (f *Filter) runIn6(q *packet.Parsed) (r Response, why string) {
 		// It happens to also be much faster.
 		// TODO(apenwarr): Skip the rest of decoding in this path?
 		if q.IPProto == ipproto.TCP && !q.IsTCPSyn() {
-			return Accept, "tcp non-syn"
+			return Accept, "tcp non-syn", nil
+		}
+		if f.localDenied(q) {
+			return Drop, "denied by local rule", nil
 		}
-		if f.matches6.match(q) {
-			return Accept, "tcp ok"
+		if i := f.matcher6.match(q); i >= 0 {
+			return Accept, "tcp ok", f.rules6[i]
 		}
 	case ipproto.UDP, ipproto.SCTP:
-		t := flowtrack.Tuple{Proto: q.IPProto, Src: q.Src, Dst: q.Dst}
-
-		f.state.mu.Lock()
-		_, ok := f.state.lru.Get(t)
-		f.state.mu.Unlock()
-
-		if ok {
-			return Accept, "cached"
+		if f.state.lookup(q, mono.Now()) {
+			return Accept, "cached", nil
 		}
-		if f.matches6.match(q) {
-			return Accept, "ok"
+		if f.localDenied(q) {
+			return Drop, "denied by local rule", nil
+		}
+		if i := f.matcher6.match(q); i >= 0 {
+			return Accept, "ok", f.rules6[i]
 		}
 	case ipproto.TSMP:
-		return Accept, "tsmp ok"
+		return Accept, "tsmp ok", nil
 	default:
-		if f.matches6.matchProtoAndIPsOnlyIfAllPorts(q) {
-			return Accept, "otherproto ok"
+		if f.localDenied(q) {
+			return Drop, "denied by local rule", nil
+		}
+		if f.matcher6.matchProtoAndIPsOnlyIfAllPorts(q) {
+			return Accept, "otherproto ok", nil
 		}
-		return Drop, "Unknown proto"
+		return Drop, "Unknown proto", nil
 	}
-	return Drop, "no rules matched"
+	return Drop, "no rules matched", nil
 }
 
 // runIn runs the output-specific part of the filter logic.
 func (f *Filter) runOut(q *packet.Parsed) (r Response, why string) {
-	switch q.IPProto {
-	case ipproto.UDP, ipproto.SCTP:
-		tuple := flowtrack.Tuple{
-			Proto: q.IPProto,
-			Src:   q.Dst, Dst: q.Src, // src/dst reversed
-		}
-		f.state.mu.Lock()
-		f.state.lru.Add(tuple, nil)
-		f.state.mu.Unlock()
-	}
+	f.noteFlow(q, out, Accept, nil)
 	return Accept, "ok out"
 }
 
@@ -492,37 +624,48 @@ func (d direction) String() string {
 // pre runs the direction-agnostic filter logic. dir is only used for
 // logging.
 func (f *Filter) pre(q *packet.Parsed, rf RunFlags, dir direction) Response {
+	r, why := preCheck(q)
+	if r == Accept && q.IPProto == ipproto.Fragment && dir == in && f.state.frags.dropped(q, mono.Now()) {
+		// Fragments after the first get the first fragment's
+		// verdict, if it was seen.
+		r, why = Drop, "fragment of dropped packet"
+	}
+	if r != noVerdict && why != "keepalive" {
+		f.logRateLimit(rf, q, dir, r, why)
+	}
+	return r
+}
+
+// preCheck is the direction-agnostic filter logic. It returns
+// noVerdict if the rest of the filter needs to run, and otherwise
+// the verdict and why.
+func preCheck(q *packet.Parsed) (r Response, why string) {
 	if len(q.Buffer()) == 0 {
 		// wireguard keepalive packet, always permit.
-		return Accept
+		return Accept, "keepalive"
 	}
 	if len(q.Buffer()) < 20 {
-		f.logRateLimit(rf, q, dir, Drop, "too short")
-		return Drop
+		return Drop, "too short"
 	}
 
 	if q.Dst.IP().IsMulticast() {
-		f.logRateLimit(rf, q, dir, Drop, "multicast")
-		return Drop
+		return Drop, "multicast"
 	}
 	if q.Dst.IP().IsLinkLocalUnicast() && q.Dst.IP() != gcpDNSAddr {
-		f.logRateLimit(rf, q, dir, Drop, "link-local-unicast")
-		return Drop
+		return Drop, "link-local-unicast"
 	}
 
 	switch q.IPProto {
 	case ipproto.Unknown:
 		// Unknown packets are dangerous; always drop them.
-		f.logRateLimit(rf, q, dir, Drop, "unknown")
-		return Drop
+		return Drop, "unknown"
 	case ipproto.Fragment:
 		// Fragments after the first always need to be passed through.
 		// Very small fragments are considered Junk by Parsed.
-		f.logRateLimit(rf, q, dir, Accept, "fragment")
-		return Accept
+		return Accept, "fragment"
 	}
 
-	return noVerdict
+	return noVerdict, ""
 }
 
 // loggingAllowed reports whether p can appear in logs at all.
@@ -10,6 +10,7 @@
 	"reflect"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -134,7 +135,7 @@ type InOut struct {
 		if test.p.IPVersion == 6 {
 			aclFunc = acl.runIn6
 		}
-		if got, why := aclFunc(&test.p); test.want != got {
+		if got, why, _ := aclFunc(&test.p); test.want != got {
 			t.Errorf("#%d runIn got=%v want=%v why=%q packet:%v", i, got, test.want, why, test.p)
 		}
 		if test.p.IPProto == ipproto.TCP {
@@ -149,7 +150,7 @@ type InOut struct {
 			}
 			// TCP and UDP are treated equivalently in the filter - verify that.
 			test.p.IPProto = ipproto.UDP
-			if got, why := aclFunc(&test.p); test.want != got {
+			if got, why, _ := aclFunc(&test.p); test.want != got {
 				t.Errorf("#%d runIn (UDP) got=%v want=%v why=%q packet:%v", i, got, test.want, why, test.p)
 			}
 		}
@@ -326,6 +327,47 @@ func BenchmarkFilter(b *testing.B) {
 	}
 }
 
+// BenchmarkFilterUDPFlows benchmarks the connection tracking of the
+// filter with many concurrent UDP flows, as seen on busy subnet
+// routers.
+func BenchmarkFilterUDPFlows(b *testing.B) {
+	for _, flows := range []int{100, 10000, 100000} {
+		outs := make([]packet.Parsed, flows)
+		ins := make([]packet.Parsed, flows)
+		for i := range outs {
+			peer := fmt.Sprintf("10.%d.%d.%d", byte(i>>16), byte(i>>8), byte(i))
+			outs[i] = parsed(ipproto.UDP, "102.102.102.102", peer, 4242, 53)
+			ins[i] = parsed(ipproto.UDP, peer, "102.102.102.102", 53, 4242)
+		}
+		b.Run(fmt.Sprintf("flows=%d", flows), func(b *testing.B) {
+			acl := newFilter(b.Logf)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				j := i % flows
+				acl.RunOut(&outs[j], 0)
+				acl.RunIn(&ins[j], 0)
+			}
+		})
+		b.Run(fmt.Sprintf("flows=%d/parallel", flows), func(b *testing.B) {
+			acl := newFilter(b.Logf)
+			var next uint32
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				j := int(atomic.AddUint32(&next, 7919)) % flows
+				for pb.Next() {
+					acl.RunOut(&outs[j], 0)
+					acl.RunIn(&ins[j], 0)
+					if j++; j == flows {
+						j = 0
+					}
+				}
+			})
+		})
+	}
+}
+
 func TestPreFilter(t *testing.T) {
 	packets := []struct {
 		desc string
@@ -826,6 +868,55 @@ func TestMatchesFromFilterRules(t *testing.T) {
 	}
 }
 
+func TestCheck(t *testing.T) {
+	acl := newFilter(t.Logf)
+	tests := []struct {
+		name     string
+		proto    ipproto.Proto
+		src, dst string
+		incoming bool
+		want     Response
+		reason   string
+		rule     int
+	}{
+		{"tcp_ok", ipproto.TCP, "8.1.1.1:0", "1.2.3.4:22", true, Accept, "tcp ok", 0},
+		{"udp_ok", ipproto.UDP, "2.2.2.2:0", "8.1.1.1:22", true, Accept, "ok", 3},
+		{"sctp_ok", ipproto.SCTP, "9.1.1.1:0", "5.6.7.8:23", true, Accept, "ok", 1},
+		{"tcp6_ok", ipproto.TCP, "[::1]:0", "[2001::1]:22", true, Accept, "tcp ok", 7},
+		{"no_match", ipproto.UDP, "3.3.3.3:0", "1.2.3.4:22", true, Drop, "no rules matched", -1},
+		{"not_local", ipproto.TCP, "8.1.1.1:0", "9.9.9.9:22", true, Drop, "destination not allowed", -1},
+		{"multicast", ipproto.UDP, "8.1.1.1:0", "224.0.0.1:22", true, Drop, "multicast", -1},
+		{"mixed_families", ipproto.TCP, "8.1.1.1:0", "[2001::1]:22", true, Drop, "mismatched address families", -1},
+		{"out", ipproto.UDP, "1.2.3.4:0", "3.3.3.3:53", false, Accept, "ok out", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := acl.Check(tt.proto, mustIPPort(tt.src), mustIPPort(tt.dst), tt.incoming)
+			if got.Verdict != tt.want || got.Reason != tt.reason || got.Rule != tt.rule {
+				t.Errorf("got %v, %q, rule %d; want %v, %q, rule %d", got.Verdict, got.Reason, got.Rule, tt.want, tt.reason, tt.rule)
+			}
+			if got.Rule >= 0 && got.Match != acl.rules[got.Rule].match {
+				t.Errorf("Match = %q; want %q", got.Match, acl.rules[got.Rule].match)
+			}
+		})
+	}
+	// Nothing was tracked or counted.
+	if n := acl.state.numFlows(); n != 0 {
+		t.Errorf("Check created %d flows", n)
+	}
+	for i, st := range acl.RuleStats() {
+		if st.Packets != 0 {
+			t.Errorf("Check counted %d packets for rule %d", st.Packets, i)
+		}
+	}
+
+	su := NewShieldsUpFilter(acl.local, acl.logIPs, nil, t.Logf)
+	got := su.Check(ipproto.TCP, mustIPPort("8.1.1.1:0"), mustIPPort("1.2.3.4:22"), true)
+	if want := "shields up: no rules matched"; got.Verdict != Drop || got.Reason != want {
+		t.Errorf("shields up: got %v, %q; want Drop, %q", got.Verdict, got.Reason, want)
+	}
+}
+
 func TestNewAllowAllForTest(t *testing.T) {
 	f := NewAllowAllForTest(logger.Discard)
 	src := netaddr.MustParseIP("100.100.2.3")
@@ -0,0 +1,120 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/net/flowtrack"
+	"tailscale.com/net/packet"
+	"tailscale.com/tstime/rate"
+)
+
+// ruleCounters are the hit counters of a rule (a Match) of the filter.
+//
+// They're shared between filters with the same rule when the rules
+// are updated (see New's shareStateWith), so they count for as long
+// as the rule exists.
+type ruleCounters struct {
+	// Accessed atomically; declared first for alignment reasons.
+	packets int64
+	bytes   int64
+	flows   int64
+
+	match string // the rule's Match.String
+}
+
+// add counts the incoming packet q as accepted by the rule.
+// newFlow is whether q started a new flow.
+func (rc *ruleCounters) add(q *packet.Parsed, newFlow bool) {
+	atomic.AddInt64(&rc.packets, 1)
+	atomic.AddInt64(&rc.bytes, int64(len(q.Buffer())))
+	if newFlow {
+		atomic.AddInt64(&rc.flows, 1)
+	}
+}
+
+// RuleStats are the hit counters of a rule of the filter.
+type RuleStats struct {
+	// Match is the rule, as formatted by Match.String.
+	Match string
+
+	// Packets and Bytes are the incoming packets accepted by the
+	// rule, including later packets of the TCP, UDP and SCTP flows
+	// it accepted.
+	Packets int64
+	Bytes   int64
+
+	// Flows is the number of incoming TCP, UDP and SCTP flows the
+	// rule accepted.
+	Flows int64
+}
+
+// RuleStats returns the hit counters of the filter's rules, in the
+// order of the Matches the filter was created with.
+func (f *Filter) RuleStats() []RuleStats {
+	ret := make([]RuleStats, len(f.rules))
+	for i, rc := range f.rules {
+		ret[i] = RuleStats{
+			Match:   rc.match,
+			Packets: atomic.LoadInt64(&rc.packets),
+			Bytes:   atomic.LoadInt64(&rc.bytes),
+			Flows:   atomic.LoadInt64(&rc.flows),
+		}
+	}
+	return ret
+}
+
+// Flow is a new network flow accepted or dropped by the filter, for
+// flow logging.
+type Flow struct {
+	flowtrack.Tuple // as seen on the flow's first packet
+
+	// Incoming is whether the flow was initiated by the Tailscale
+	// peer, rather than by this node.
+	Incoming bool
+
+	// Verdict is the filter's verdict on the flow's first packet.
+	Verdict Response
+
+	// Rule is the rule that accepted the flow, as formatted by
+	// Match.String, or empty if it wasn't accepted by a rule.
+	Rule string
+}
+
+// flowLogBucket limits the rate of flow logs, so that a flood of
+// packets can't flood the logs.
+var flowLogBucket = rate.NewLimiter(rate.Every(10*time.Millisecond), 100)
+
+// SetFlowLogger sets a func to be called with each new flow accepted
+// or dropped by the filter, if both its source and destination IPs
+// may be logged (see New's logIPs).
+//
+// Flows are rate limited. Every dropped incoming packet is reported
+// as a dropped flow.
+//
+// It must be called before the filter is used.
+func (f *Filter) SetFlowLogger(fn func(Flow)) {
+	f.flowLog = fn
+}
+
+// logFlow reports the new flow started by q, flowing in direction dir,
+// to the flow logger, if any. rule is the counters of the rule that
+// accepted the flow, if any.
+func (f *Filter) logFlow(q *packet.Parsed, dir direction, r Response, rule *ruleCounters) {
+	if f.flowLog == nil || !f.loggingAllowed(q) || !flowLogBucket.Allow() {
+		return
+	}
+	fl := Flow{
+		Tuple:    flowtrack.Tuple{Proto: q.IPProto, Src: q.Src, Dst: q.Dst},
+		Incoming: dir == in,
+		Verdict:  r,
+	}
+	if rule != nil {
+		fl.Rule = rule.match
+	}
+	f.flowLog(fl)
+}
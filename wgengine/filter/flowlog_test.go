@@ -0,0 +1,83 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"testing"
+
+	"tailscale.com/net/flowtrack"
+	"tailscale.com/net/packet"
+	"tailscale.com/tstime/rate"
+	"tailscale.com/types/ipproto"
+)
+
+func TestRuleStatsAndFlowLog(t *testing.T) {
+	oldBucket := flowLogBucket
+	flowLogBucket = rate.NewLimiter(2^32, 2^32)
+	defer func() { flowLogBucket = oldBucket }()
+
+	acl := newFilter(t.Logf)
+	var flows []Flow
+	acl.SetFlowLogger(func(fl Flow) { flows = append(flows, fl) })
+
+	udp := parsed(ipproto.UDP, "8.1.1.1", "1.2.3.4", 999, 22)    // rule 0
+	tcpSyn := parsed(ipproto.TCP, "2.2.2.2", "8.1.1.1", 999, 22) // rule 3
+	tcpAck := tcpSyn
+	tcpAck.TCPFlags = packet.TCPAck
+	denied := parsed(ipproto.UDP, "3.3.3.3", "1.2.3.4", 999, 22)
+
+	for _, q := range []*packet.Parsed{&udp, &udp, &tcpSyn, &tcpAck, &tcpAck} {
+		if got := acl.RunIn(q, 0); got != Accept {
+			t.Fatalf("RunIn(%v) = %v; want Accept", q, got)
+		}
+	}
+	if got := acl.RunIn(&denied, 0); got != Drop {
+		t.Fatalf("RunIn(%v) = %v; want Drop", &denied, got)
+	}
+
+	stats := acl.RuleStats()
+	if len(stats) != len(acl.rules) {
+		t.Fatalf("got %d rule stats; want %d", len(stats), len(acl.rules))
+	}
+	check := func(stats []RuleStats, i int, packets, flows int64) {
+		t.Helper()
+		st := stats[i]
+		if st.Packets != packets || st.Flows != flows {
+			t.Errorf("rule %d: packets, flows = %d, %d; want %d, %d", i, st.Packets, st.Flows, packets, flows)
+		}
+		if want := packets * int64(len(udp.Buffer())); st.Bytes != want {
+			t.Errorf("rule %d: bytes = %d; want %d", i, st.Bytes, want)
+		}
+	}
+	check(stats, 0, 2, 1)
+	check(stats, 3, 3, 1)
+	check(stats, 1, 0, 0)
+
+	want := []Flow{
+		{Tuple: tupleOf(&udp), Incoming: true, Verdict: Accept, Rule: stats[0].Match},
+		{Tuple: tupleOf(&tcpSyn), Incoming: true, Verdict: Accept, Rule: stats[3].Match},
+		{Tuple: tupleOf(&denied), Incoming: true, Verdict: Drop},
+	}
+	if len(flows) != len(want) {
+		t.Fatalf("got flows %+v; want %+v", flows, want)
+	}
+	for i := range want {
+		if flows[i] != want[i] {
+			t.Errorf("flow %d = %+v; want %+v", i, flows[i], want[i])
+		}
+	}
+
+	// Counters of unchanged rules survive filter updates.
+	acl2 := New(acl.matches4[:1], acl.local, acl.logIPs, acl, t.Logf)
+	check(acl2.RuleStats(), 0, 2, 1)
+	if got := acl2.RunIn(&udp, 0); got != Accept {
+		t.Fatalf("RunIn(%v) = %v; want Accept", &udp, got)
+	}
+	check(acl2.RuleStats(), 0, 3, 1)
+}
+
+func tupleOf(q *packet.Parsed) flowtrack.Tuple {
+	return flowtrack.Tuple{Proto: q.IPProto, Src: q.Src, Dst: q.Dst}
+}
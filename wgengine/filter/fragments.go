@@ -0,0 +1,118 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/ipproto"
+	"tailscale.com/util/clientmetric"
+)
+
+// fragTimeout is how long after dropping the first fragment of a
+// packet its later fragments are dropped. It's the IPv6 reassembly
+// timeout (RFC 8200), which is longer than the usual IPv4 one.
+const fragTimeout = 60 * time.Second
+
+// maxFragPackets is the maximum number of fragmented packets tracked
+// by a fragTable.
+const maxFragPackets = 4096
+
+var metricFragEvictions = clientmetric.NewCounter("filter_frag_evictions")
+
+// fragKey identifies the fragments of an IP packet, as in RFC 791
+// and RFC 8200.
+type fragKey struct {
+	src, dst netaddr.IP
+	proto    ipproto.Proto
+	id       uint32
+}
+
+// fragTable tracks the fragmented incoming packets whose first
+// fragment was dropped by the filter.
+//
+// Only the first fragment of a packet has its subprotocol header, so
+// later fragments can't be matched against the filter's rules.
+// Instead, they're dropped if the first fragment of the same packet
+// was, and otherwise accepted. Later fragments that arrive before the
+// first one are accepted, as the receiver can't reassemble the packet
+// without the first fragment anyway.
+//
+// It's an LRU of bounded size, so a peer sending many fragmented
+// packets can't make it grow without bound. Evicting an entry only
+// lets the rest of the dropped packet's fragments through.
+type fragTable struct {
+	mu sync.Mutex
+	m  map[fragKey]*list.Element // of *fragEntry
+	ll *list.List                // most recently dropped at front
+}
+
+type fragEntry struct {
+	key     fragKey
+	dropped mono.Time // when the first fragment was dropped
+}
+
+func fragKeyOf(q *packet.Parsed) fragKey {
+	return fragKey{src: q.Src.IP(), dst: q.Dst.IP(), proto: q.FragProto, id: q.FragID}
+}
+
+// drop records that the first fragment q of a packet was dropped.
+func (ft *fragTable) drop(q *packet.Parsed, now mono.Time) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	if ft.m == nil {
+		ft.m = make(map[fragKey]*list.Element)
+		ft.ll = list.New()
+	}
+	k := fragKeyOf(q)
+	if ele, ok := ft.m[k]; ok {
+		ele.Value.(*fragEntry).dropped = now
+		ft.ll.MoveToFront(ele)
+		return
+	}
+	ft.m[k] = ft.ll.PushFront(&fragEntry{key: k, dropped: now})
+	for len(ft.m) > maxFragPackets {
+		oldest := ft.ll.Back()
+		if now.Sub(oldest.Value.(*fragEntry).dropped) <= fragTimeout {
+			metricFragEvictions.Add(1)
+		}
+		ft.removeLocked(oldest)
+	}
+}
+
+// dropped reports whether the first fragment of the packet that the
+// later fragment q belongs to was dropped.
+func (ft *fragTable) dropped(q *packet.Parsed, now mono.Time) bool {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	ele, ok := ft.m[fragKeyOf(q)]
+	if !ok {
+		return false
+	}
+	if now.Sub(ele.Value.(*fragEntry).dropped) > fragTimeout {
+		ft.removeLocked(ele)
+		return false
+	}
+	// Keep the entry until it expires: the last fragment may arrive
+	// before the ones in the middle.
+	return true
+}
+
+func (ft *fragTable) removeLocked(ele *list.Element) {
+	ft.ll.Remove(ele)
+	delete(ft.m, ele.Value.(*fragEntry).key)
+}
+
+// len returns the number of packets tracked by ft.
+func (ft *fragTable) len() int {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	return len(ft.m)
+}
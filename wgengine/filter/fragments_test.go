@@ -0,0 +1,127 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/ipproto"
+)
+
+// frag4 returns a fragment of an IPv4 UDP packet from src to dst:dport
+// with IP ID id, at the given offset in bytes.
+func frag4(src, dst string, dport, id, offset uint16, more bool) []byte {
+	h := packet.UDP4Header{
+		IP4Header: packet.IP4Header{
+			IPID: id,
+			Src:  mustIP(src),
+			Dst:  mustIP(dst),
+		},
+		SrcPort: 999,
+		DstPort: dport,
+	}
+	b := packet.Generate(h, make([]byte, 100))
+	flags := offset / 8
+	if more {
+		flags |= 0x2000
+	}
+	binary.BigEndian.PutUint16(b[6:8], flags)
+	return b
+}
+
+func TestFragments(t *testing.T) {
+	acl := newFilter(t.Logf)
+	otherProto := frag4("8.1.1.1", "1.2.3.4", 23, 3, 1480, false)
+	otherProto[9] = byte(ipproto.TCP)
+	steps := []struct {
+		name string
+		pkt  []byte
+		want Response
+	}{
+		{"later_before_first", frag4("8.1.1.1", "1.2.3.4", 22, 1, 1480, true), Accept},
+		{"first", frag4("8.1.1.1", "1.2.3.4", 22, 1, 0, true), Accept},
+		{"middle", frag4("8.1.1.1", "1.2.3.4", 22, 1, 1480, true), Accept},
+		{"last", frag4("8.1.1.1", "1.2.3.4", 22, 1, 2960, false), Accept},
+		{"denied_later_before_first", frag4("8.1.1.1", "1.2.3.4", 23, 3, 2960, false), Accept},
+		{"denied_first", frag4("8.1.1.1", "1.2.3.4", 23, 3, 0, true), Drop},
+		{"denied_middle", frag4("8.1.1.1", "1.2.3.4", 23, 3, 1480, true), Drop},
+		{"denied_last", frag4("8.1.1.1", "1.2.3.4", 23, 3, 2960, false), Drop},
+		{"other_packet", frag4("8.1.1.1", "1.2.3.4", 23, 4, 1480, false), Accept},
+		{"other_src", frag4("8.2.2.2", "1.2.3.4", 23, 3, 1480, false), Accept},
+		{"other_proto", otherProto, Accept},
+	}
+	for _, st := range steps {
+		q := &packet.Parsed{}
+		q.Decode(st.pkt)
+		if got := acl.RunIn(q, 0); got != st.want {
+			t.Errorf("%s: RunIn(%v) = %v; want %v", st.name, q, got, st.want)
+		}
+	}
+
+	// Outgoing fragments are always allowed.
+	q := &packet.Parsed{}
+	q.Decode(frag4("1.2.3.4", "8.1.1.1", 23, 3, 1480, false))
+	if got := acl.RunOut(q, 0); got != Accept {
+		t.Errorf("RunOut(%v) = %v; want Accept", q, got)
+	}
+
+	// The fragment state survives filter changes.
+	acl2 := New(nil, acl.local, acl.logIPs, acl, t.Logf)
+	q.Decode(frag4("8.1.1.1", "1.2.3.4", 23, 3, 4440, false))
+	if got := acl2.RunIn(q, 0); got != Drop {
+		t.Errorf("after New: RunIn(%v) = %v; want Drop", q, got)
+	}
+}
+
+func TestFragTableEviction(t *testing.T) {
+	var ft fragTable
+	now := mono.Now()
+	before := metricFragEvictions.Value()
+	frag := func(id uint32) *packet.Parsed {
+		return &packet.Parsed{
+			IPVersion:  4,
+			IPProto:    ipproto.Fragment,
+			Src:        netaddr.IPPortFrom(mustIP("8.1.1.1"), 0),
+			Dst:        netaddr.IPPortFrom(mustIP("1.2.3.4"), 0),
+			FragID:     id,
+			FragOffset: 1480,
+			FragProto:  ipproto.UDP,
+		}
+	}
+
+	const extra = 10
+	for id := uint32(0); id < maxFragPackets+extra; id++ {
+		ft.drop(frag(id), now)
+	}
+	if n := ft.len(); n != maxFragPackets {
+		t.Fatalf("have %d packets; want %d", n, maxFragPackets)
+	}
+	if got := metricFragEvictions.Value() - before; got != extra {
+		t.Errorf("evictions = %d; want %d", got, extra)
+	}
+	// The least recently dropped packets were evicted.
+	for id := uint32(0); id < extra; id++ {
+		if ft.dropped(frag(id), now) {
+			t.Errorf("packet %d not evicted", id)
+		}
+	}
+	if !ft.dropped(frag(extra), now) {
+		t.Errorf("packet %d evicted", extra)
+	}
+
+	// Entries expire.
+	later := now.Add(fragTimeout + time.Second)
+	if ft.dropped(frag(extra), later) {
+		t.Error("expired packet still dropped")
+	}
+	if n := ft.len(); n != maxFragPackets-1 {
+		t.Errorf("have %d packets; want %d", n, maxFragPackets-1)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+)
+
+// LocalRule is a node-local rule, configured on the node rather than
+// by the tailnet's packet filter. Local rules can only restrict the
+// incoming traffic that the filter's Matches allow.
+type LocalRule struct {
+	Match
+	// Deny is whether packets matching the rule are dropped. If
+	// false, they're not subject to the later local rules.
+	Deny bool
+}
+
+// SetLocalRules sets the node-local rules of the filter.
+//
+// New incoming flows are checked against the local rules, in order,
+// before the filter's Matches. The first local rule that matches
+// decides: a packet matching a Deny rule is dropped, and a packet
+// matching any other rule is evaluated by the Matches as if there
+// were no local rules. Packets matching no local rule are evaluated
+// by the Matches as well.
+//
+// It must be called before the filter is used.
+func (f *Filter) SetLocalRules(rules []LocalRule) {
+	f.localRules4, f.localDeny4 = compileLocalRules(rules, true)
+	f.localRules6, f.localDeny6 = compileLocalRules(rules, false)
+}
+
+// compileLocalRules compiles the parts of rules of the IPv4 family if
+// is4 or else of the IPv6 family, returning nil if there are none, and
+// whether each compiled rule denies.
+func compileLocalRules(rules []LocalRule, is4 bool) (*matcher, []bool) {
+	ms := make(matches, len(rules))
+	for i, r := range rules {
+		ms[i] = r.Match
+	}
+	keep := netaddr.IP.Is6
+	if is4 {
+		keep = netaddr.IP.Is4
+	}
+	ms, idx := matchesFamily(ms, keep)
+	if len(ms) == 0 {
+		return nil, nil
+	}
+	deny := make([]bool, len(idx))
+	for j, i := range idx {
+		deny[j] = rules[i].Deny
+	}
+	return newMatcher(ms, is4), deny
+}
+
+// localDenied reports whether a local rule denies the incoming
+// packet q.
+func (f *Filter) localDenied(q *packet.Parsed) bool {
+	mr, deny := f.localRules6, f.localDeny6
+	if q.IPVersion == 4 {
+		mr, deny = f.localRules4, f.localDeny4
+	}
+	if mr == nil {
+		return false
+	}
+	i := mr.match(q)
+	return i >= 0 && deny[i]
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"testing"
+
+	"tailscale.com/net/packet"
+	"tailscale.com/types/ipproto"
+)
+
+func TestLocalRules(t *testing.T) {
+	acl := newFilter(t.Logf)
+	acl.SetLocalRules([]LocalRule{
+		{Match: m(nets("8.2.2.2"), netports("0.0.0.0/0:22"))},
+		{Match: m(nets("0.0.0.0/0", "::/0"), netports("0.0.0.0/0:22", "::/0:22")), Deny: true},
+		{Match: m(nets("0.0.0.0/0"), netports("0.0.0.0/0:*"), ipproto.SCTP), Deny: true},
+	})
+	tests := []struct {
+		name     string
+		proto    ipproto.Proto
+		src, dst string
+		want     Response
+		reason   string
+	}{
+		{"allowed_src", ipproto.TCP, "8.2.2.2:0", "1.2.3.4:22", Accept, "tcp ok"},
+		{"denied", ipproto.TCP, "8.1.1.1:0", "1.2.3.4:22", Drop, "denied by local rule"},
+		{"denied_udp", ipproto.UDP, "2.2.2.2:0", "8.1.1.1:22", Drop, "denied by local rule"},
+		{"denied_v6", ipproto.TCP, "[::1]:0", "[2001::1]:22", Drop, "denied by local rule"},
+		{"denied_proto", ipproto.SCTP, "9.1.1.1:0", "5.6.7.8:23", Drop, "denied by local rule"},
+		{"other_port", ipproto.TCP, "8.1.1.1:0", "5.6.7.8:23", Accept, "tcp ok"},
+		{"filter_still_applies", ipproto.TCP, "8.2.2.2:0", "1.2.3.4:23", Drop, "no rules matched"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := acl.Check(tt.proto, mustIPPort(tt.src), mustIPPort(tt.dst), true)
+			if got.Verdict != tt.want || got.Reason != tt.reason {
+				t.Errorf("got %v, %q; want %v, %q", got.Verdict, got.Reason, tt.want, tt.reason)
+			}
+		})
+	}
+
+	// Packets, not just checks, are dropped.
+	q := &packet.Parsed{}
+	q.Decode(raw4(ipproto.TCP, "8.1.1.1", "1.2.3.4", 999, 22, 0))
+	if got := acl.RunIn(q, 0); got != Drop {
+		t.Errorf("RunIn = %v; want Drop", got)
+	}
+}
@@ -82,8 +82,10 @@ func (m Match) String() string {
 
 type matches []Match
 
-func (ms matches) match(q *packet.Parsed) bool {
-	for _, m := range ms {
+// match returns the index of the first Match in ms that matches q, or
+// -1 if none does.
+func (ms matches) match(q *packet.Parsed) int {
+	for i, m := range ms {
 		if !protoInList(q.IPProto, m.IPProto) {
 			continue
 		}
@@ -97,10 +99,10 @@ func (ms matches) match(q *packet.Parsed) bool {
 			if !dst.Ports.contains(q.Dst.Port()) {
 				continue
 			}
-			return true
+			return i
 		}
 	}
-	return false
+	return -1
 }
 
 func (ms matches) matchIPsOnly(q *packet.Parsed) bool {
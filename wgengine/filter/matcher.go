@@ -0,0 +1,205 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"sort"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+	"tailscale.com/types/ipproto"
+)
+
+// matcher is matches compiled into an index, so that packets can be
+// matched against thousands of Matches without scanning them all.
+//
+// Destinations are indexed by prefix: for each distinct prefix length
+// among the Dsts, a hash table maps the masked prefix to the rules
+// that have it as a destination, in rule order. Matching a packet
+// then takes one table lookup per distinct prefix length, followed by
+// checks of the protocol, port and source of only the rules with a
+// destination containing the packet's. Each rule's sources are a
+// sorted list of IP ranges, searched in logarithmic time.
+//
+// A matcher answers the same as the matches it was compiled from,
+// which remain the reference implementation.
+type matcher struct {
+	rules []compiledMatch
+	// addrOff is the number of leading bits of the 16 byte form of
+	// addresses that aren't part of the prefixes: 96 for IPv4, whose
+	// addresses are IPv4-mapped IPv6 addresses in that form.
+	addrOff int
+	dstLens []uint8 // distinct prefix lengths of dsts, longest first
+	dsts    map[dstKey][]dstEntry
+}
+
+// compiledMatch is a Match in a form fast to evaluate.
+type compiledMatch struct {
+	protos  [4]uint64         // bitset of the IP protocols
+	srcsAll bool              // whether srcs contains every address of the family
+	srcs    []netaddr.IPRange // sorted, non-overlapping
+}
+
+// dstKey is a destination prefix, as indexed by a matcher.
+type dstKey struct {
+	bits uint8    // prefix length
+	addr [16]byte // masked to bits, in 16 byte form
+}
+
+// dstEntry is a destination of a rule, as indexed by a matcher.
+type dstEntry struct {
+	rule  int // index of the rule in matcher.rules
+	ports PortRange
+}
+
+// matchMode selects which parts of a Match a matcher evaluates. See
+// the matches methods of the same names.
+type matchMode uint8
+
+const (
+	matchFull                  matchMode = iota // matches.match
+	matchIPsOnly                                // matches.matchIPsOnly
+	matchProtoAndIPsIfAllPorts                  // matches.matchProtoAndIPsOnlyIfAllPorts
+)
+
+// newMatcher compiles ms, all of whose prefixes are of the IPv4 family
+// if is4 or else of the IPv6 family, into a matcher.
+func newMatcher(ms matches, is4 bool) *matcher {
+	mr := &matcher{
+		rules: make([]compiledMatch, len(ms)),
+		dsts:  make(map[dstKey][]dstEntry),
+	}
+	if is4 {
+		mr.addrOff = 96
+	}
+	lens := map[uint8]bool{}
+	for i, m := range ms {
+		cm := &mr.rules[i]
+		for _, p := range m.IPProto {
+			cm.protos[p>>6] |= 1 << (p & 63)
+		}
+		var sb netaddr.IPSetBuilder
+		for _, src := range m.Srcs {
+			if src.Bits() == 0 {
+				cm.srcsAll = true
+			}
+			sb.AddPrefix(src)
+		}
+		if !cm.srcsAll {
+			srcs, _ := sb.IPSet()
+			cm.srcs = srcs.Ranges()
+		}
+		for _, dst := range m.Dsts {
+			k := mr.key(dst.Net.IP(), dst.Net.Bits())
+			// Rules are added in order, so each key's entries
+			// are sorted by rule.
+			mr.dsts[k] = append(mr.dsts[k], dstEntry{rule: i, ports: dst.Ports})
+			lens[k.bits] = true
+		}
+	}
+	for bits := range lens {
+		mr.dstLens = append(mr.dstLens, bits)
+	}
+	sort.Slice(mr.dstLens, func(i, j int) bool { return mr.dstLens[i] > mr.dstLens[j] })
+	return mr
+}
+
+// key returns the index key of the prefix of ip of length bits.
+func (mr *matcher) key(ip netaddr.IP, bits uint8) dstKey {
+	return dstKey{bits: bits, addr: maskAddr(ip.As16(), mr.addrOff+int(bits))}
+}
+
+// maskAddr returns a with all but its first bits bits cleared.
+func maskAddr(a [16]byte, bits int) [16]byte {
+	for i := range a {
+		switch {
+		case bits >= 8:
+			bits -= 8
+		case bits > 0:
+			a[i] &^= 0xff >> bits
+			bits = 0
+		default:
+			a[i] = 0
+		}
+	}
+	return a
+}
+
+// match returns the index of the first Match that matches q, or -1 if
+// none does. It's the compiled equivalent of matches.match.
+func (mr *matcher) match(q *packet.Parsed) int {
+	return mr.first(q, matchFull)
+}
+
+// matchIPsOnly is the compiled equivalent of matches.matchIPsOnly.
+func (mr *matcher) matchIPsOnly(q *packet.Parsed) bool {
+	return mr.first(q, matchIPsOnly) >= 0
+}
+
+// matchProtoAndIPsOnlyIfAllPorts is the compiled equivalent of
+// matches.matchProtoAndIPsOnlyIfAllPorts.
+func (mr *matcher) matchProtoAndIPsOnlyIfAllPorts(q *packet.Parsed) bool {
+	return mr.first(q, matchProtoAndIPsIfAllPorts) >= 0
+}
+
+// first returns the index of the first rule that matches q in mode,
+// or -1 if none does.
+func (mr *matcher) first(q *packet.Parsed, mode matchMode) int {
+	dst := q.Dst.IP()
+	best := -1
+	for _, bits := range mr.dstLens {
+		for _, e := range mr.dsts[mr.key(dst, bits)] {
+			if best >= 0 && e.rule >= best {
+				// Only an earlier rule could be a better
+				// match, and entries are sorted by rule.
+				break
+			}
+			if mr.entryMatches(e, q, mode) {
+				best = e.rule
+				break
+			}
+		}
+	}
+	return best
+}
+
+// entryMatches reports whether q matches the dst entry e in mode,
+// given that e's prefix contains q's destination.
+func (mr *matcher) entryMatches(e dstEntry, q *packet.Parsed, mode matchMode) bool {
+	cm := &mr.rules[e.rule]
+	switch mode {
+	case matchFull:
+		if !cm.hasProto(q.IPProto) || !e.ports.contains(q.Dst.Port()) {
+			return false
+		}
+	case matchProtoAndIPsIfAllPorts:
+		if !cm.hasProto(q.IPProto) || e.ports != allPorts {
+			return false
+		}
+	}
+	return cm.hasSrc(q.Src.IP())
+}
+
+func (cm *compiledMatch) hasProto(p ipproto.Proto) bool {
+	return cm.protos[p>>6]&(1<<(p&63)) != 0
+}
+
+func (cm *compiledMatch) hasSrc(ip netaddr.IP) bool {
+	if cm.srcsAll {
+		return true
+	}
+	// Find the first range that doesn't end before ip.
+	rs := cm.srcs
+	lo, hi := 0, len(rs)
+	for lo < hi {
+		m := int(uint(lo+hi) >> 1)
+		if rs[m].To().Less(ip) {
+			lo = m + 1
+		} else {
+			hi = m
+		}
+	}
+	return lo < len(rs) && !ip.Less(rs[lo].From())
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/net/packet"
+	"tailscale.com/types/ipproto"
+)
+
+// randMatches returns n random IPv4 Matches, with addresses drawn from
+// a small space so that they overlap.
+func randMatches(rnd *rand.Rand, n int) matches {
+	randPrefix := func() netaddr.IPPrefix {
+		bits := []uint8{0, 8, 16, 24, 30, 32}[rnd.Intn(6)]
+		ip := netaddr.IPv4(10, byte(rnd.Intn(4)), byte(rnd.Intn(4)), byte(rnd.Intn(8)))
+		p, _ := ip.Prefix(bits)
+		return p
+	}
+	randPorts := func() PortRange {
+		switch rnd.Intn(3) {
+		case 0:
+			return allPorts
+		case 1:
+			p := uint16(20 + rnd.Intn(5))
+			return PortRange{p, p}
+		}
+		first := uint16(20 + rnd.Intn(5))
+		return PortRange{first, first + uint16(rnd.Intn(5))}
+	}
+	protos := []ipproto.Proto{ipproto.TCP, ipproto.UDP, ipproto.ICMPv4, ipproto.SCTP}
+
+	ms := make(matches, n)
+	for i := range ms {
+		m := &ms[i]
+		for j := 1 + rnd.Intn(2); j > 0; j-- {
+			m.IPProto = append(m.IPProto, protos[rnd.Intn(len(protos))])
+		}
+		for j := 1 + rnd.Intn(3); j > 0; j-- {
+			m.Srcs = append(m.Srcs, randPrefix())
+		}
+		for j := 1 + rnd.Intn(3); j > 0; j-- {
+			m.Dsts = append(m.Dsts, NetPortRange{Net: randPrefix(), Ports: randPorts()})
+		}
+	}
+	return ms
+}
+
+func TestMatcherEquivalence(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	protos := []ipproto.Proto{ipproto.TCP, ipproto.UDP, ipproto.ICMPv4, ipproto.SCTP, ipproto.IGMP}
+	randIP := func() string {
+		return fmt.Sprintf("10.%d.%d.%d", rnd.Intn(4), rnd.Intn(4), rnd.Intn(8))
+	}
+	for iter := 0; iter < 100; iter++ {
+		ms := randMatches(rnd, 1+rnd.Intn(50))
+		mr := newMatcher(ms, true)
+		for i := 0; i < 1000; i++ {
+			q := parsed(protos[rnd.Intn(len(protos))], randIP(), randIP(), 999, uint16(18+rnd.Intn(10)))
+			if got, want := mr.match(&q), ms.match(&q); got != want {
+				t.Fatalf("match(%v) = %d; want %d\nmatches: %v", &q, got, want, ms)
+			}
+			if got, want := mr.matchIPsOnly(&q), ms.matchIPsOnly(&q); got != want {
+				t.Fatalf("matchIPsOnly(%v) = %v; want %v\nmatches: %v", &q, got, want, ms)
+			}
+			if got, want := mr.matchProtoAndIPsOnlyIfAllPorts(&q), ms.matchProtoAndIPsOnlyIfAllPorts(&q); got != want {
+				t.Fatalf("matchProtoAndIPsOnlyIfAllPorts(%v) = %v; want %v\nmatches: %v", &q, got, want, ms)
+			}
+		}
+	}
+}
+
+func TestMatcherIPv6(t *testing.T) {
+	ms := matches{
+		m(nets("::1", "::2"), netports("2001::1:22", "2001::2:22")),
+		m(nets("fd7a:115c:a1e0::/48"), netports("2001::/16:80-90")),
+		m(nets("::/0"), netports("::/0:443")),
+	}
+	mr := newMatcher(ms, false)
+	tests := []struct {
+		src, dst string
+		dport    uint16
+		want     int
+	}{
+		{"::1", "2001::1", 22, 0},
+		{"::2", "2001::2", 22, 0},
+		{"::3", "2001::2", 22, -1},
+		{"fd7a:115c:a1e0::5", "2001:1::1", 85, 1},
+		{"fd7a:115c:a1e1::5", "2001:1::1", 85, -1},
+		{"fd7a:115c:a1e0::5", "2002::1", 85, -1},
+		{"1234::1", "2002::1", 443, 2},
+		{"::1", "2001::1", 443, 2},
+	}
+	for _, tt := range tests {
+		q := parsed(ipproto.TCP, tt.src, tt.dst, 999, tt.dport)
+		if got, want := mr.match(&q), ms.match(&q); got != tt.want || want != tt.want {
+			t.Errorf("match(%v) = %d, linear %d; want %d", &q, got, want, tt.want)
+		}
+	}
+}
+
+// manyMatches returns n Matches, each allowing TCP from a distinct
+// IP to a distinct ip:port, as in a large tailnet's ACLs.
+func manyMatches(n int) matches {
+	ms := make(matches, n)
+	for i := range ms {
+		src := netaddr.IPv4(100, 64, byte(i>>8), byte(i))
+		dst := netaddr.IPv4(100, 100, byte(i>>8), byte(i))
+		ms[i] = Match{
+			IPProto: []ipproto.Proto{ipproto.TCP, ipproto.UDP},
+			Srcs:    []netaddr.IPPrefix{netaddr.IPPrefixFrom(src, 32)},
+			Dsts: []NetPortRange{{
+				Net:   netaddr.IPPrefixFrom(dst, 32),
+				Ports: PortRange{22, 22},
+			}},
+		}
+	}
+	return ms
+}
+
+func BenchmarkMatch(b *testing.B) {
+	for _, n := range []int{10, 1000, 10000} {
+		ms := manyMatches(n)
+		mr := newMatcher(ms, true)
+		// The worst case for a linear scan: only the last rule
+		// matches.
+		last := n - 1
+		q := parsed(ipproto.TCP,
+			fmt.Sprintf("100.64.%d.%d", byte(last>>8), byte(last)),
+			fmt.Sprintf("100.100.%d.%d", byte(last>>8), byte(last)),
+			999, 22)
+		if mr.match(&q) != last || ms.match(&q) != last {
+			b.Fatal("benchmark packet doesn't match the last rule")
+		}
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ms.match(&q)
+			}
+		})
+		b.Run(fmt.Sprintf("compiled/%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				mr.match(&q)
+			}
+		})
+	}
+}
+
+func BenchmarkFilterManyRules(b *testing.B) {
+	const n = 10000
+	var localNets netaddr.IPSetBuilder
+	localNets.AddPrefix(netaddr.MustParseIPPrefix("100.100.0.0/16"))
+	localNetsSet, _ := localNets.IPSet()
+	acl := New(manyMatches(n), localNetsSet, &netaddr.IPSet{}, nil, b.Logf)
+	pkt := raw4(ipproto.TCP, "100.64.39.15", "100.100.39.15", 999, 22, 0) // rule 9999
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q := &packet.Parsed{}
+		q.Decode(pkt)
+		if acl.RunIn(q, 0) != Accept {
+			b.Fatal("packet not accepted")
+		}
+	}
+}
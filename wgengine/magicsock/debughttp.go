@@ -24,7 +24,15 @@
 // It's accessible either from tailscaled's debug port (at
 // /debug/magicsock) or via peerapi to a peer that's owned by the same
 // user (so they can e.g. inspect their phones).
+//
+// With a format=json query parameter, it instead serves the recent
+// path history of each peer as JSON; see PathHistories.
 func (c *Conn) ServeHTTPDebug(w http.ResponseWriter, r *http.Request) {
+	if r.FormValue("format") == "json" {
+		c.serveHTTPDebugJSON(w, r)
+		return
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -167,6 +175,12 @@ func printEndpointHTML(w io.Writer, ep *endpoint) {
 			fmt.Fprintf(w, "<li>disco-learned-at: %v ago</li>\n", now.Sub(s.lastGotPing).Round(time.Second))
 		}
 		fmt.Fprintf(w, "<li>callMeMaybeTime: %v</li>\n", s.callMeMaybeTime)
+		fmt.Fprintf(w, "<li>path MTU: %v (probed %v ago, %v probes pending)", s.mtu, fmtMono(s.lastMTUProbe), s.mtuProbesPending)
+		if s.mtuBlackHole {
+			io.WriteString(w, " <b>black hole</b>")
+		}
+		io.WriteString(w, "</li>\n")
+		fmt.Fprintf(w, "<li>pings: %v sent, %v lost</li>\n", s.pingsSent, s.pingsLost)
 		for i := range s.recentPongs {
 			if i == 5 {
 				break
@@ -181,6 +195,14 @@ func printEndpointHTML(w io.Writer, ep *endpoint) {
 	}
 	io.WriteString(w, "</ul>")
 
+	if len(ep.pathSwitches) > 0 {
+		io.WriteString(w, "<p>Path switches:</p><ul>")
+		for i := len(ep.pathSwitches) - 1; i >= 0; i-- {
+			ps := ep.pathSwitches[i]
+			fmt.Fprintf(w, "<li>%v ago: %v => %v (%s)</li>\n", fmtMono(ps.at), ps.from, ps.to, html.EscapeString(ps.reason))
+		}
+		io.WriteString(w, "</ul>")
+	}
 }
 
 func peerDebugName(p *tailcfg.Node) string {
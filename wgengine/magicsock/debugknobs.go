@@ -33,6 +33,11 @@
 	debugReSTUNStopOnIdle = envknob.Bool("TS_DEBUG_RESTUN_STOP_ON_IDLE")
 	// debugAlwaysDERP disables the use of UDP, forcing all peer communication over DERP.
 	debugAlwaysDERP = envknob.Bool("TS_DEBUG_ALWAYS_USE_DERP")
+	// debugDisableMTUProbes disables path MTU probing of direct paths.
+	debugDisableMTUProbes = envknob.Bool("TS_DEBUG_DISABLE_MTU_PROBES")
+	// debugDisableUDPBatching disables batched UDP reads (recvmmsg
+	// and UDP GRO) on Linux.
+	debugDisableUDPBatching = envknob.Bool("TS_DEBUG_DISABLE_UDP_BATCHING")
 )
 
 // inTest reports whether the running program is a test that set the
@@ -16,6 +16,8 @@
 	logDerpVerbose                   = false
 	debugReSTUNStopOnIdle            = false
 	debugAlwaysDERP                  = false
+	debugDisableMTUProbes            = false
+	debugDisableUDPBatching          = false
 )
 
 func inTest() bool { return false }
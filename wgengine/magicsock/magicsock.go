@@ -45,6 +45,7 @@
 	"tailscale.com/net/portmapper"
 	"tailscale.com/net/stun"
 	"tailscale.com/net/tsaddr"
+	"tailscale.com/net/udpbatch"
 	"tailscale.com/syncs"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstime"
@@ -236,8 +237,9 @@ type Conn struct {
 	derpActiveFunc         func()
 	idleFunc               func() time.Duration // nil means unknown
 	testOnlyPacketListener nettype.PacketListener
-	noteRecvActivity       func(key.NodePublic) // or nil, see Options.NoteRecvActivity
-	linkMon                *monitor.Mon         // or nil
+	noteRecvActivity       func(key.NodePublic)      // or nil, see Options.NoteRecvActivity
+	pathMTUChanged         func(key.NodePublic, int) // or nil, see Options.PathMTUChanged
+	linkMon                *monitor.Mon              // or nil
 
 	// ================================================================
 	// No locking required to access these fields, either because
@@ -302,6 +304,10 @@ type Conn struct {
 	havePrivateKey  syncs.AtomicBool
 	publicKeyAtomic atomic.Value // of key.NodePublic (or NodeKey zero value if !havePrivateKey)
 
+	// peerRelay is whether this node relays packets between
+	// peers; see SetPeerRelay.
+	peerRelay syncs.AtomicBool
+
 	// derpMapAtomic is the same as derpMap, but without requiring
 	// sync.Mutex. For use with NewRegionClient's callback, to avoid
 	// lock ordering deadlocks. See issue 3726 and mu field docs.
@@ -312,6 +318,10 @@ type Conn struct {
 	// port is the preferred port from opts.Port; 0 means auto.
 	port syncs.AtomicUint32
 
+	// mtu is the MTU of the Tailscale interface, from SetMTU; 0
+	// means the default.
+	mtu syncs.AtomicUint32
+
 	// ============================================================
 	// mu guards all following fields; see userspaceEngine lock
 	// ordering rules against the engine. For derphttp, mu must
@@ -390,6 +400,19 @@ type Conn struct {
 	// magicsock could do with any complexity reduction it can get.
 	netInfoLast *tailcfg.NetInfo
 
+	// staticEndpoints are the manually configured endpoints
+	// advertised in addition to the discovered ones; see
+	// SetStaticEndpoints.
+	staticEndpoints []netaddr.IPPort
+
+	// relayID and relayKey map between the node keys of the peers
+	// offering to relay packets and their relay IDs, the ports of
+	// their relayMagicIPAddr fake endpoint addresses. lastRelayID
+	// is the last relay ID assigned.
+	relayID     map[key.NodePublic]uint16
+	relayKey    map[uint16]key.NodePublic
+	lastRelayID uint16
+
 	derpMap     *tailcfg.DERPMap // nil (or zero regions/nodes) means DERP is disabled
 	netMap      *netmap.NetworkMap
 	privateKey  key.NodePrivate    // WireGuard private key for this node
@@ -504,6 +527,15 @@ type Options struct {
 	// not hold Conn.mu while calling it.
 	NoteRecvActivity func(key.NodePublic)
 
+	// PathMTUChanged, if provided, is called with a peer's node key
+	// and path MTU whenever the path MTU of the direct path used to
+	// reach the peer changes. Zero means it's unknown, including
+	// when packets to the peer are relayed over DERP, which carries
+	// packets of any size.
+	// It's called with the Conn's internal locks held, so it must not
+	// call back into the Conn.
+	PathMTUChanged func(key.NodePublic, int)
+
 	// LinkMonitor is the link monitor to use.
 	// With one, the portmapper won't be used.
 	LinkMonitor *monitor.Mon
@@ -560,6 +592,7 @@ func NewConn(opts Options) (*Conn, error) {
 	c.idleFunc = opts.IdleFunc
 	c.testOnlyPacketListener = opts.TestOnlyPacketListener
 	c.noteRecvActivity = opts.NoteRecvActivity
+	c.pathMTUChanged = opts.PathMTUChanged
 	c.portMapper = portmapper.NewClient(logger.WithPrefix(c.logf, "portmapper: "), c.onPortMapChanged)
 	if opts.LinkMonitor != nil {
 		c.portMapper.SetGatewayLookupFunc(opts.LinkMonitor.GatewayAndSelfIP)
@@ -889,6 +922,12 @@ func (c *Conn) LastRecvActivityOfNodeKey(nk key.NodePublic) string {
 	return mono.Since(saw).Round(time.Second).String()
 }
 
+// SetMTU sets the MTU of the Tailscale interface, which bounds the
+// packet sizes path MTU probes check. Zero means the default.
+func (c *Conn) SetMTU(mtu int) {
+	c.mtu.Set(uint32(mtu))
+}
+
 // Ping handles a "tailscale ping" CLI query.
 func (c *Conn) Ping(peer *tailcfg.Node, res *ipnstate.PingResult, cb func(*ipnstate.PingResult)) {
 	c.mu.Lock()
@@ -922,6 +961,10 @@ func (c *Conn) Ping(peer *tailcfg.Node, res *ipnstate.PingResult, cb func(*ipnst
 // c.mu must be held
 func (c *Conn) populateCLIPingResponseLocked(res *ipnstate.PingResult, latency time.Duration, ep netaddr.IPPort) {
 	res.LatencySeconds = latency.Seconds()
+	if ep.IP() == relayMagicIPAddr {
+		res.PeerRelay = c.relayIPLocked(ep)
+		return
+	}
 	if ep.IP() != derpMagicIPAddr {
 		res.Endpoint = ep.String()
 		return
@@ -1037,7 +1080,15 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]tailcfg.Endpoint, erro
 	nr, err := c.updateNetInfo(ctx)
 	if err != nil {
 		c.logf("magicsock.Conn.determineEndpoints: updateNetInfo: %v", err)
-		return nil, err
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		// Still advertise the static endpoints, and whatever
+		// the last successful netcheck found.
+		nr, _ = c.lastNetCheckReport.Load().(*netcheck.Report)
+		if nr == nil {
+			nr = new(netcheck.Report)
+		}
 	}
 
 	if runtime.GOOS == "js" {
@@ -1069,6 +1120,15 @@ func (c *Conn) determineEndpoints(ctx context.Context) ([]tailcfg.Endpoint, erro
 		}
 	}
 
+	// Explicitly configured endpoints go first, so they're
+	// advertised as such even if STUN also finds them.
+	c.mu.Lock()
+	staticEndpoints := c.staticEndpoints
+	c.mu.Unlock()
+	for _, ep := range staticEndpoints {
+		addAddr(ep, tailcfg.EndpointExplicitConf)
+	}
+
 	// If we didn't have a portmap earlier, maybe it's done by now.
 	if !havePortmap {
 		portmapExt, havePortmap = c.portMapper.GetCachedMappingOrStartCreatingOne()
@@ -1255,6 +1315,9 @@ func (c *Conn) sendUDPStd(addr *net.UDPAddr, b []byte) (sent bool, err error) {
 // IPv6 address when the local machine doesn't have IPv6 support
 // returns (false, nil); it's not an error, but nothing was sent.
 func (c *Conn) sendAddr(addr netaddr.IPPort, pubKey key.NodePublic, b []byte) (sent bool, err error) {
+	if addr.IP() == relayMagicIPAddr {
+		return c.sendRelay(addr, pubKey, b)
+	}
 	if addr.IP() != derpMagicIPAddr {
 		return c.sendUDP(addr, b)
 	}
@@ -1509,6 +1572,7 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netaddr.IPPort, d
 
 	defer health.SetDERPRegionConnectedState(regionID, false)
 	defer health.SetDERPRegionHealth(regionID, "")
+	defer health.SetDERPRegionWebsocketFallback(regionID, false)
 
 	// peerPresent is the set of senders we know are present on this
 	// connection, based on messages we've received from the server.
@@ -1566,6 +1630,7 @@ func (c *Conn) runDerpReader(ctx context.Context, derpFakeAddr netaddr.IPPort, d
 		case derp.ServerInfoMessage:
 			health.SetDERPRegionConnectedState(regionID, true)
 			health.SetDERPRegionHealth(regionID, "") // until declared otherwise
+			health.SetDERPRegionWebsocketFallback(regionID, dc.UsingWebsocketFallback())
 			c.logf("magicsock: derp-%d connected; connGen=%v", regionID, connGen)
 			continue
 		case derp.ReceivedPacket:
@@ -1658,7 +1723,7 @@ func (c *Conn) receiveIPv6(b []byte) (int, conn.Endpoint, error) {
 		if err != nil {
 			return 0, nil, err
 		}
-		if ep, ok := c.receiveIP(b[:n], ipp, &c.ippEndpoint6); ok {
+		if n, ep, ok := c.receiveIP(b[:n], ipp, &c.ippEndpoint6); ok {
 			metricRecvDataIPv6.Add(1)
 			return n, ep, nil
 		}
@@ -1674,7 +1739,7 @@ func (c *Conn) receiveIPv4(b []byte) (n int, ep conn.Endpoint, err error) {
 		if err != nil {
 			return 0, nil, err
 		}
-		if ep, ok := c.receiveIP(b[:n], ipp, &c.ippEndpoint4); ok {
+		if n, ep, ok := c.receiveIP(b[:n], ipp, &c.ippEndpoint4); ok {
 			metricRecvDataIPv4.Add(1)
 			return n, ep, nil
 		}
@@ -1684,20 +1749,29 @@ func (c *Conn) receiveIPv4(b []byte) (n int, ep conn.Endpoint, err error) {
 // receiveIP is the shared bits of ReceiveIPv4 and ReceiveIPv6.
 //
 // ok is whether this read should be reported up to wireguard-go (our
-// caller).
-func (c *Conn) receiveIP(b []byte, ipp netaddr.IPPort, cache *ippEndpointCache) (ep *endpoint, ok bool) {
+// caller). n is the length of the packet to report, which is less than
+// len(b) if it arrived via a peer relay.
+func (c *Conn) receiveIP(b []byte, ipp netaddr.IPPort, cache *ippEndpointCache) (n int, ep *endpoint, ok bool) {
 	if stun.Is(b) {
 		c.stunReceiveFunc.Load().(func([]byte, netaddr.IPPort))(b, ipp)
-		return nil, false
+		return 0, nil, false
 	}
 	if c.handleDiscoMessage(b, ipp, key.NodePublic{}) {
-		return nil, false
+		return 0, nil, false
+	}
+	if isRelayFrame(b) {
+		n, ep = c.handleRelayFrame(b, ipp)
+		if n == 0 {
+			return 0, nil, false
+		}
+		ep.noteRecvActivity()
+		return n, ep, true
 	}
 	if !c.havePrivateKey.Get() {
 		// If we have no private key, we're logged out or
 		// stopped. Don't try to pass these wireguard packets
 		// up to wireguard-go; it'll just complain (issue 1167).
-		return nil, false
+		return 0, nil, false
 	}
 	if cache.ipp == ipp && cache.de != nil && cache.gen == cache.de.numStopAndReset() {
 		ep = cache.de
@@ -1706,7 +1780,7 @@ func (c *Conn) receiveIP(b []byte, ipp netaddr.IPPort, cache *ippEndpointCache)
 		de, ok := c.peerMap.endpointForIPPort(ipp)
 		c.mu.Unlock()
 		if !ok {
-			return nil, false
+			return 0, nil, false
 		}
 		cache.ipp = ipp
 		cache.de = de
@@ -1714,7 +1788,7 @@ func (c *Conn) receiveIP(b []byte, ipp netaddr.IPPort, cache *ippEndpointCache)
 		ep = de
 	}
 	ep.noteRecvActivity()
-	return ep, true
+	return len(b), ep, true
 }
 
 // receiveDERP reads a packet from c.derpRecvCh into b and returns the associated endpoint.
@@ -1859,8 +1933,10 @@ func (c *Conn) sendDiscoMessage(dst netaddr.IPPort, dstKey key.NodePublic, dstDi
 //
 // For messages received over DERP, the src.IP() will be derpMagicIP (with
 // src.Port() being the region ID) and the derpNodeSrc will be the node key
-// it was received from at the DERP layer. derpNodeSrc is zero when received
-// over UDP.
+// it was received from at the DERP layer. Likewise, for messages received
+// via a peer relay, src.IP() will be relayMagicIPAddr (with src.Port()
+// being the relay ID) and derpNodeSrc will be the node key the relay
+// received it from. derpNodeSrc is zero when received directly over UDP.
 func (c *Conn) handleDiscoMessage(msg []byte, src netaddr.IPPort, derpNodeSrc key.NodePublic) (isDiscoMsg bool) {
 	const headerLen = len(disco.Magic) + key.DiscoPublicRawLen
 	if len(msg) < headerLen || string(msg[:len(disco.Magic)]) != disco.Magic {
@@ -2030,12 +2106,14 @@ func (c *Conn) unambiguousNodeKeyOfPingLocked(dm *disco.Ping, dk key.DiscoPublic
 }
 
 // di is the discoInfo of the source of the ping.
-// derpNodeSrc is non-zero if the ping arrived via DERP.
+// derpNodeSrc is non-zero if the ping arrived via DERP or a peer relay.
 func (c *Conn) handlePingLocked(dm *disco.Ping, src netaddr.IPPort, di *discoInfo, derpNodeSrc key.NodePublic) {
 	likelyHeartBeat := src == di.lastPingFrom && time.Since(di.lastPingTime) < 5*time.Second
 	di.lastPingFrom = src
 	di.lastPingTime = time.Now()
-	isDerp := src.IP() == derpMagicIPAddr
+	// Pings via DERP or a peer relay come from a shared fake
+	// address, and carry the node key they're from.
+	isDerp := src.IP() == derpMagicIPAddr || src.IP() == relayMagicIPAddr
 
 	// If we can figure out with certainty which node key this disco
 	// message is for, eagerly update our IP<>node and disco<>node
@@ -2266,6 +2344,33 @@ func (c *Conn) UpdatePeers(newPeers map[key.NodePublic]struct{}) {
 	}
 }
 
+// SetStaticEndpoints sets the manually configured endpoints, such as
+// the public ip:port of a static 1:1 NAT or port forward, that c
+// advertises to peers in addition to the endpoints it discovers.
+func (c *Conn) SetStaticEndpoints(eps []netaddr.IPPort) {
+	c.mu.Lock()
+	if ipPortsEqual(eps, c.staticEndpoints) {
+		c.mu.Unlock()
+		return
+	}
+	c.staticEndpoints = append(eps[:0:0], eps...)
+	c.mu.Unlock()
+
+	c.ReSTUN("static-endpoint-change")
+}
+
+func ipPortsEqual(a, b []netaddr.IPPort) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // SetDERPMap controls which (if any) DERP servers are used.
 // A nil value means to disable DERP; it's disabled by default.
 func (c *Conn) SetDERPMap(dm *tailcfg.DERPMap) {
@@ -2342,6 +2447,7 @@ func (c *Conn) SetNetworkMap(nm *netmap.NetworkMap) {
 	}
 
 	metricNumPeers.Set(int64(len(nm.Peers)))
+	c.updateRelaysLocked(nm.Peers)
 
 	c.logf("[v1] magicsock: got updated network map; %d peers", len(nm.Peers))
 	if numNoDisco != 0 {
@@ -2844,7 +2950,7 @@ func (c *Conn) bindSocket(rucPtr **RebindingUDPConn, network string, curPortFate
 
 	if debugAlwaysDERP {
 		c.logf("disabled %v per TS_DEBUG_ALWAYS_USE_DERP", network)
-		ruc.pconn = newBlockForeverConn()
+		ruc.setConnLocked(newBlockForeverConn())
 		return nil
 	}
 
@@ -2878,7 +2984,7 @@ func (c *Conn) bindSocket(rucPtr **RebindingUDPConn, network string, curPortFate
 			continue
 		}
 		// Success.
-		ruc.pconn = pconn
+		ruc.setConnLocked(pconn)
 		if network == "udp4" {
 			health.SetUDP4Unbound(false)
 		}
@@ -2889,7 +2995,7 @@ func (c *Conn) bindSocket(rucPtr **RebindingUDPConn, network string, curPortFate
 	// Set pconn to a dummy conn whose reads block until closed.
 	// This keeps the receive funcs alive for a future in which
 	// we get a link change and we can try binding again.
-	ruc.pconn = newBlockForeverConn()
+	ruc.setConnLocked(newBlockForeverConn())
 	if network == "udp4" {
 		health.SetUDP4Unbound(true)
 	}
@@ -2993,6 +3099,25 @@ func (c *Conn) ParseEndpoint(nodeKeyStr string) (conn.Endpoint, error) {
 type RebindingUDPConn struct {
 	mu    sync.Mutex
 	pconn net.PacketConn
+
+	// batch, if non-nil, reads from pconn in batches. Once it's
+	// set, pconn must only be read from via batch: with UDP GRO
+	// enabled, a plain read could return several coalesced packets.
+	// It's not safe for concurrent reads, so only one goroutine may
+	// read from c at a time, as receiveIPv4 and receiveIPv6 do.
+	batch *udpbatch.Conn
+}
+
+// setConnLocked sets c's current pconn to p, reading from it in
+// batches if supported.
+//
+// c.mu must be held.
+func (c *RebindingUDPConn) setConnLocked(p net.PacketConn) {
+	c.pconn = p
+	c.batch = nil
+	if uc, ok := p.(*net.UDPConn); ok && !debugDisableUDPBatching {
+		c.batch = udpbatch.New(uc)
+	}
 }
 
 // currentConn returns c's current pconn.
@@ -3002,12 +3127,31 @@ func (c *RebindingUDPConn) currentConn() net.PacketConn {
 	return c.pconn
 }
 
+// currentBatchConn returns c's current pconn and its batch reader,
+// which may be nil.
+func (c *RebindingUDPConn) currentBatchConn() (net.PacketConn, *udpbatch.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pconn, c.batch
+}
+
 // ReadFrom reads a packet from c into b.
 // It returns the number of bytes copied and the source address.
 func (c *RebindingUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
 	for {
-		pconn := c.currentConn()
-		n, addr, err := pconn.ReadFrom(b)
+		pconn, batch := c.currentBatchConn()
+		var n int
+		var addr net.Addr
+		var err error
+		if batch != nil {
+			var ipp netaddr.IPPort
+			n, ipp, err = batch.ReadFromNetaddr(b)
+			if err == nil {
+				addr = ipp.UDPAddr()
+			}
+		} else {
+			n, addr, err = pconn.ReadFrom(b)
+		}
 		if err != nil && pconn != c.currentConn() {
 			continue
 		}
@@ -3024,12 +3168,15 @@ func (c *RebindingUDPConn) ReadFrom(b []byte) (int, net.Addr, error) {
 // when c's underlying connection is a net.UDPConn.
 func (c *RebindingUDPConn) ReadFromNetaddr(b []byte) (n int, ipp netaddr.IPPort, err error) {
 	for {
-		pconn := c.currentConn()
+		pconn, batch := c.currentBatchConn()
 
 		// Optimization: Treat *net.UDPConn specially.
-		// This lets us avoid allocations by calling ReadFromUDPAddrPort.
+		// This lets us avoid allocations by calling ReadFromUDPAddrPort,
+		// or better, by reading many packets per system call.
 		// The non-*net.UDPConn case works, but it allocates.
-		if udpConn, ok := pconn.(*net.UDPConn); ok {
+		if batch != nil {
+			n, ipp, err = batch.ReadFromNetaddr(b)
+		} else if udpConn, ok := pconn.(*net.UDPConn); ok {
 			var ap netip.AddrPort
 			n, ap, err = udpConn.ReadFromUDPAddrPort(b)
 			ipp = netconv.AsIPPort(ap)
@@ -3279,10 +3426,14 @@ type endpoint struct {
 	bestAddr           addrLatency // best non-DERP path; zero if none
 	bestAddrAt         mono.Time   // time best address re-confirmed
 	trustBestAddrUntil mono.Time   // time when bestAddr expires
+	pathMTU            int         // path MTU of bestAddr last passed to Conn.pathMTUChanged; 0 if unknown
 	sentPing           map[stun.TxID]sentPing
 	endpointState      map[netaddr.IPPort]*endpointState
 	isCallMeMaybeEP    map[netaddr.IPPort]bool
 
+	lastPath     sendPath     // path of the last recorded path switch; see notePathLocked
+	pathSwitches []pathSwitch // recent path switches, oldest first; up to maxPathSwitches
+
 	pendingCLIPings []pendingCLIPing // any outstanding "tailscale ping" commands running
 }
 
@@ -3339,6 +3490,37 @@ type pendingCLIPing struct {
 	// resetting the counter, as the first pings likely didn't through
 	// the firewall)
 	discoPingInterval = 5 * time.Second
+
+	// mtuProbeInterval is the minimum time between rounds of path
+	// MTU probes to an endpoint.
+	mtuProbeInterval = 10 * time.Minute
+
+	// mtuDegradedProbeInterval is the minimum time between rounds
+	// of path MTU probes to an endpoint that didn't answer probes
+	// of every size, so that losing a probe doesn't lower its MTU
+	// for long.
+	mtuDegradedProbeInterval = time.Minute
+
+	// mtuProbeSizes are the tunneled packet sizes, in bytes, that
+	// path MTU probes check an endpoint can carry, in increasing
+	// order, along with the MTU of the Tailscale interface if it's
+	// bigger; see Conn.mtuProbeSizes. The first is the default MTU of
+	// the Tailscale interface; endpoints that can't carry it aren't
+	// used.
+	mtuProbeSizes = []int{1280, 1360, 1400, 1420, 1440}
+)
+
+const (
+	// wgPacketOverhead is how much bigger, in bytes, a WireGuard
+	// transport packet is than the packet it tunnels: a 16 byte
+	// header and a 16 byte authentication tag.
+	wgPacketOverhead = 32
+
+	// discoPingLen is the size, in bytes, of a disco ping with a
+	// NodeKey and no padding, as sent by sendDiscoMessage: the
+	// magic, the sender's disco key, a nonce, 16 bytes of NaCl box
+	// overhead, and the message type, version, TxID and NodeKey.
+	discoPingLen = len(disco.Magic) + key.DiscoPublicRawLen + disco.NonceLen + 16 + 2 + 12 + key.NodePublicRawLen
 )
 
 // endpointState is some state and history for a specific endpoint of
@@ -3363,6 +3545,37 @@ type endpointState struct {
 	recentPongs []pongReply // ring buffer up to pongHistoryCount entries
 	recentPong  uint16      // index into recentPongs of most recent; older before, wrapped
 
+	// pingsSent and pingsLost are the number of disco pings sent to
+	// this endpoint, and of those that got no pong, not counting
+	// path MTU probes.
+	pingsSent int
+	pingsLost int
+
+	// mtu is the largest tunneled packet size, in bytes, that the
+	// last two rounds of path MTU probes found this endpoint to
+	// carry, or zero if there hasn't been one. A size only counts
+	// as too big once its probes got no answer in two rounds in a
+	// row, so that a single lost probe doesn't lower the MTU.
+	mtu int
+	// mtuBlackHole is whether the last two rounds of path MTU
+	// probes found that this endpoint drops packets of the
+	// smallest probed size, so it mustn't be used as the best
+	// address.
+	mtuBlackHole bool
+	// mtuProbed is whether a round of path MTU probes completed,
+	// and mtuLastProbeMax the largest size answered in the last
+	// one.
+	mtuProbed       bool
+	mtuLastProbeMax int
+	// lastMTUProbe is when the last round of path MTU probes started.
+	lastMTUProbe mono.Time
+	// mtuProbesPending is the number of path MTU probes of the
+	// current round that are neither answered nor timed out.
+	mtuProbesPending int
+	// mtuProbeMax is the largest size answered in the current
+	// round of path MTU probes.
+	mtuProbeMax int
+
 	index int16 // index in nodecfg.Node.Endpoints; meaningless if lastGotPing non-zero
 }
 
@@ -3370,6 +3583,11 @@ type endpointState struct {
 // a endpoint's endpoints are being updated from a new network map.
 const indexSentinelDeleted = -1
 
+// indexRelay is the endpointState.index of the paths via peer relays,
+// which aren't in nodecfg.Node.Endpoints but are kept while the relay
+// is in the network map.
+const indexRelay = -2
+
 // shouldDeleteLocked reports whether we should delete this endpoint.
 func (st *endpointState) shouldDeleteLocked() bool {
 	switch {
@@ -3388,6 +3606,8 @@ func (de *endpoint) deleteEndpointLocked(ep netaddr.IPPort) {
 	delete(de.endpointState, ep)
 	if de.bestAddr.IPPort == ep {
 		de.bestAddr = addrLatency{}
+		de.notePathLocked(mono.Now(), fmt.Sprintf("%v no longer a candidate", ep))
+		de.updatePathMTULocked()
 	}
 }
 
@@ -3406,6 +3626,7 @@ type sentPing struct {
 	at      mono.Time
 	timer   *time.Timer // timeout timer
 	purpose discoPingPurpose
+	size    int // for pingMTUProbe, the tunneled packet size probed
 }
 
 // initFakeUDPAddr populates fakeWGAddr with a globally unique fake UDPAddr.
@@ -3577,6 +3798,16 @@ func (de *endpoint) send(b []byte) error {
 	if de.canP2P() && (udpAddr.IsZero() || now.After(de.trustBestAddrUntil)) {
 		de.sendPingsLocked(now, true)
 	}
+	if (sendPath{udpAddr, derpAddr}) != de.lastPath {
+		reason := "no direct path"
+		switch {
+		case !udpAddr.IsZero() && !derpAddr.IsZero():
+			reason = "no recent pong from " + udpAddr.String()
+		case !udpAddr.IsZero():
+			reason = "direct path confirmed"
+		}
+		de.notePathLocked(now, reason)
+	}
 	de.noteActiveLocked()
 	de.mu.Unlock()
 
@@ -3603,9 +3834,18 @@ func (de *endpoint) pingTimeout(txid stun.TxID) {
 	if !ok {
 		return
 	}
+	if sp.purpose == pingMTUProbe {
+		// Expected if the probe was bigger than the path MTU.
+		de.removeSentPingLocked(txid, sp)
+		de.noteMTUProbeDoneLocked(sp, false)
+		return
+	}
 	if debugDisco || de.bestAddr.IsZero() || mono.Now().After(de.trustBestAddrUntil) {
 		de.c.logf("[v1] magicsock: disco: timeout waiting for pong %x from %v (%v, %v)", txid[:6], sp.to, de.publicKey.ShortString(), de.discoShort)
 	}
+	if st, ok := de.endpointState[sp.to]; ok {
+		st.pingsLost++
+	}
 	de.removeSentPingLocked(txid, sp)
 }
 
@@ -3616,6 +3856,11 @@ func (de *endpoint) forgetPing(txid stun.TxID) {
 	defer de.mu.Unlock()
 	if sp, ok := de.sentPing[txid]; ok {
 		de.removeSentPingLocked(txid, sp)
+		if sp.purpose == pingMTUProbe {
+			de.noteMTUProbeDoneLocked(sp, false)
+		} else if st, ok := de.endpointState[sp.to]; ok {
+			st.pingsLost++
+		}
 	}
 }
 
@@ -3633,11 +3878,19 @@ func (de *endpoint) removeSentPingLocked(txid stun.TxID, sp sentPing) {
 //
 // The caller should use de.discoKey as the discoKey argument.
 // It is passed in so that sendDiscoPing doesn't need to lock de.mu.
-func (de *endpoint) sendDiscoPing(ep netaddr.IPPort, discoKey key.DiscoPublic, txid stun.TxID, logLevel discoLogLevel) {
+//
+// If size is non-zero, the ping is padded to be as big as a WireGuard
+// packet tunneling a packet of size bytes.
+func (de *endpoint) sendDiscoPing(ep netaddr.IPPort, discoKey key.DiscoPublic, txid stun.TxID, size int, logLevel discoLogLevel) {
 	selfPubKey, _ := de.c.publicKeyAtomic.Load().(key.NodePublic)
+	var padding int
+	if size > 0 {
+		padding = size + wgPacketOverhead - discoPingLen
+	}
 	sent, _ := de.c.sendDiscoMessage(ep, de.publicKey, discoKey, &disco.Ping{
 		TxID:    [12]byte(txid),
 		NodeKey: selfPubKey,
+		Padding: padding,
 	}, logLevel)
 	if !sent {
 		de.forgetPing(txid)
@@ -3660,6 +3913,11 @@ func (de *endpoint) sendDiscoPing(ep netaddr.IPPort, discoKey key.DiscoPublic, t
 	// pingCLI means that the user is running "tailscale ping"
 	// from the CLI. These types of pings can go over DERP.
 	pingCLI
+
+	// pingMTUProbe means that the purpose of a ping was to see
+	// whether a path carries packets of a particular size. These
+	// pings are padded, and are never sent over DERP.
+	pingMTUProbe
 )
 
 func (de *endpoint) startPingLocked(ep netaddr.IPPort, now mono.Time, purpose discoPingPurpose) {
@@ -3687,11 +3945,138 @@ func (de *endpoint) startPingLocked(ep netaddr.IPPort, now mono.Time, purpose di
 		timer:   time.AfterFunc(pingTimeoutDuration, func() { de.pingTimeout(txid) }),
 		purpose: purpose,
 	}
+	if st, ok := de.endpointState[ep]; ok {
+		st.pingsSent++
+	}
 	logLevel := discoLog
 	if purpose == pingHeartbeat {
 		logLevel = discoVerboseLog
 	}
-	go de.sendDiscoPing(ep, de.discoKey, txid, logLevel)
+	go de.sendDiscoPing(ep, de.discoKey, txid, 0, logLevel)
+}
+
+// mtuProbeSizes returns the sizes of a round of path MTU probes: those
+// of mtuProbeSizes no bigger than the MTU of the Tailscale interface,
+// then that MTU. Without a configured MTU, it's all of mtuProbeSizes.
+func (c *Conn) mtuProbeSizes() []int {
+	mtu := int(c.mtu.Get())
+	if mtu == 0 || mtu == mtuProbeSizes[len(mtuProbeSizes)-1] {
+		return mtuProbeSizes
+	}
+	sizes := mtuProbeSizes[:1:1]
+	for _, size := range mtuProbeSizes[1:] {
+		if size < mtu {
+			sizes = append(sizes, size)
+		}
+	}
+	if mtu > sizes[len(sizes)-1] {
+		sizes = append(sizes, mtu)
+	}
+	return sizes
+}
+
+// startMTUProbesLocked starts a round of path MTU probes to ep: a
+// padded ping of each of Conn.mtuProbeSizes. noteMTUProbeDoneLocked
+// records the result once they're all answered or timed out.
+func (de *endpoint) startMTUProbesLocked(ep netaddr.IPPort, now mono.Time) {
+	if runtime.GOOS == "js" || debugDisableMTUProbes {
+		return
+	}
+	st, ok := de.endpointState[ep]
+	if !ok || st.mtuProbesPending > 0 {
+		return
+	}
+	sizes := de.c.mtuProbeSizes()
+	st.lastMTUProbe = now
+	st.mtuProbesPending = len(sizes)
+	st.mtuProbeMax = 0
+	for _, size := range sizes {
+		txid := stun.NewTxID()
+		de.sentPing[txid] = sentPing{
+			to:      ep,
+			at:      now,
+			timer:   time.AfterFunc(pingTimeoutDuration, func() { de.pingTimeout(txid) }),
+			purpose: pingMTUProbe,
+			size:    size,
+		}
+		go de.sendDiscoPing(ep, de.discoKey, txid, size, discoVerboseLog)
+	}
+}
+
+// mtuProbeDueLocked reports whether it's time for a round of path MTU
+// probes to the endpoint with state st. Endpoints that didn't answer
+// probes of every size are probed again sooner, in case it was just
+// the probes that were lost.
+func (de *endpoint) mtuProbeDueLocked(st *endpointState, now mono.Time) bool {
+	if st.lastMTUProbe.IsZero() {
+		return true
+	}
+	interval := mtuProbeInterval
+	if sizes := de.c.mtuProbeSizes(); st.mtuLastProbeMax < sizes[len(sizes)-1] {
+		interval = mtuDegradedProbeInterval
+	}
+	return now.Sub(st.lastMTUProbe) > interval
+}
+
+// noteMTUProbeDoneLocked records that the path MTU probe sp was
+// answered, if ok, or else that it timed out or failed to send. Once
+// all the probes of its round are done, it updates the path MTU of
+// the probed endpoint, no longer using the endpoint if it drops
+// packets of even the smallest probed size.
+func (de *endpoint) noteMTUProbeDoneLocked(sp sentPing, ok bool) {
+	st, found := de.endpointState[sp.to]
+	if !found || st.mtuProbesPending == 0 {
+		return
+	}
+	if ok && sp.size > st.mtuProbeMax {
+		st.mtuProbeMax = sp.size
+	}
+	st.mtuProbesPending--
+	if st.mtuProbesPending > 0 {
+		return
+	}
+	// Sizes only count as too big if they got no answer in the
+	// previous round either. Before the first round, assume the
+	// endpoint carries the smallest size, as it did without probes.
+	mtu, last := st.mtuProbeMax, mtuProbeSizes[0]
+	if st.mtuProbed {
+		last = st.mtuLastProbeMax
+	}
+	if last > mtu {
+		mtu = last
+	}
+	st.mtuProbed = true
+	st.mtuLastProbeMax = st.mtuProbeMax
+	if mtu != st.mtu {
+		de.c.logf("[v1] magicsock: disco: node %v %v path MTU via %v is %v", de.publicKey.ShortString(), de.discoShort, sp.to, mtu)
+	}
+	st.mtu = mtu
+	st.mtuBlackHole = st.mtu < mtuProbeSizes[0]
+	if st.mtuBlackHole && de.bestAddr.IPPort == sp.to {
+		de.c.logf("magicsock: disco: node %v %v drops full-size packets via %v; no longer using it", de.publicKey.ShortString(), de.discoShort, sp.to)
+		de.bestAddr = addrLatency{}
+		de.trustBestAddrUntil = 0
+		de.notePathLocked(mono.Now(), fmt.Sprintf("%v drops full-size packets", sp.to))
+	}
+	de.updatePathMTULocked()
+}
+
+// updatePathMTULocked tells Conn.pathMTUChanged about any change in
+// the path MTU of de.bestAddr.
+func (de *endpoint) updatePathMTULocked() {
+	var mtu int
+	if !de.bestAddr.IsZero() {
+		if st, ok := de.endpointState[de.bestAddr.IPPort]; ok {
+			mtu = st.mtu
+		}
+	}
+	if mtu == de.pathMTU {
+		return
+	}
+	de.pathMTU = mtu
+	if f := de.c.pathMTUChanged; f != nil {
+		f(de.publicKey, mtu)
+	}
 }
 
 func (de *endpoint) sendPingsLocked(now mono.Time, sendCallMeMaybe bool) {
@@ -3742,11 +4127,15 @@ func (de *endpoint) updateFromNode(n *tailcfg.Node) {
 		de.discoShort = de.discoKey.ShortString()
 		de.resetLocked()
 	}
+	oldDERP := de.derpAddr
 	if n.DERP == "" {
 		de.derpAddr = netaddr.IPPort{}
 	} else {
 		de.derpAddr, _ = netaddr.ParseIPPort(n.DERP)
 	}
+	if de.derpAddr != oldDERP && !oldDERP.IsZero() {
+		de.notePathLocked(mono.Now(), "home DERP region changed")
+	}
 
 	for _, st := range de.endpointState {
 		st.index = indexSentinelDeleted // assume deleted until updated in next loop
@@ -3767,6 +4156,7 @@ func (de *endpoint) updateFromNode(n *tailcfg.Node) {
 			de.endpointState[ipp] = &endpointState{index: int16(i)}
 		}
 	}
+	de.addRelayCandidatesLocked() // c.mu is held by SetNetworkMap
 
 	// Now delete anything unless it's still in the network map or
 	// was a recently discovered endpoint.
@@ -3821,6 +4211,7 @@ func (de *endpoint) noteConnectivityChange() {
 	defer de.mu.Unlock()
 
 	de.trustBestAddrUntil = 0
+	de.notePathLocked(mono.Now(), "network connectivity changed")
 }
 
 // handlePongConnLocked handles a Pong message (a reply to an earlier ping).
@@ -3832,6 +4223,7 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netad
 	defer de.mu.Unlock()
 
 	isDerp := src.IP() == derpMagicIPAddr
+	isRelay := src.IP() == relayMagicIPAddr
 
 	sp, ok := de.sentPing[m.TxID]
 	if !ok {
@@ -3845,6 +4237,11 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netad
 	now := mono.Now()
 	latency := now.Sub(sp.at)
 
+	if sp.purpose == pingMTUProbe {
+		de.noteMTUProbeDoneLocked(sp, !isDerp)
+		return
+	}
+
 	if !isDerp {
 		st, ok := de.endpointState[sp.to]
 		if !ok {
@@ -3852,7 +4249,9 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netad
 			return
 		}
 
-		de.c.peerMap.setNodeKeyForIPPort(src, de.publicKey)
+		if !isRelay {
+			de.c.peerMap.setNodeKeyForIPPort(src, de.publicKey)
+		}
 
 		st.addPongReplyLocked(pongReply{
 			latency: latency,
@@ -3860,6 +4259,10 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netad
 			from:    src,
 			pongSrc: m.Src,
 		})
+
+		if !isRelay && de.mtuProbeDueLocked(st, now) {
+			de.startMTUProbesLocked(sp.to, now)
+		}
 	}
 
 	if sp.purpose != pingHeartbeat {
@@ -3878,7 +4281,7 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netad
 
 	// Promote this pong response to our current best address if it's lower latency.
 	// TODO(bradfitz): decide how latency vs. preference order affects decision
-	if !isDerp {
+	if st := de.endpointState[sp.to]; !isDerp && (st == nil || !st.mtuBlackHole) {
 		thisPong := addrLatency{sp.to, latency}
 		if betterAddr(thisPong, de.bestAddr) {
 			de.c.logf("magicsock: disco: node %v %v now using %v", de.publicKey.ShortString(), de.discoShort, sp.to)
@@ -3888,6 +4291,10 @@ func (de *endpoint) handlePongConnLocked(m *disco.Pong, di *discoInfo, src netad
 			de.bestAddr.latency = latency
 			de.bestAddrAt = now
 			de.trustBestAddrUntil = now.Add(trustUDPAddrDuration)
+			if (sendPath{udp: sp.to}) != de.lastPath {
+				de.notePathLocked(now, fmt.Sprintf("pong from %v in %v", sp.to, latency.Round(time.Millisecond/10)))
+			}
+			de.updatePathMTULocked()
 		}
 	}
 	return
@@ -3910,6 +4317,11 @@ func betterAddr(a, b addrLatency) bool {
 	if a.IsZero() {
 		return false
 	}
+	if aRelay, bRelay := a.IP() == relayMagicIPAddr, b.IP() == relayMagicIPAddr; aRelay != bRelay {
+		// Prefer a direct path to one via a peer relay, which
+		// costs the relay's bandwidth.
+		return bRelay
+	}
 	if a.IP().Is6() && b.IP().Is4() {
 		// Prefer IPv6 for being a bit more robust, as long as
 		// the latencies are roughly equivalent.
@@ -4022,8 +4434,13 @@ func (de *endpoint) populatePeerStatus(ps *ipnstate.PeerStatus) {
 	ps.LastWrite = de.lastSend.WallTime()
 	ps.Active = now.Sub(de.lastSend) < sessionActiveTimeout
 
-	if udpAddr, derpAddr := de.addrForSendLocked(now); !udpAddr.IsZero() && derpAddr.IsZero() {
+	if udpAddr, derpAddr := de.addrForSendLocked(now); udpAddr.IP() == relayMagicIPAddr && derpAddr.IsZero() {
+		ps.PeerRelay = de.c.relayIPLocked(udpAddr)
+	} else if !udpAddr.IsZero() && derpAddr.IsZero() {
 		ps.CurAddr = udpAddr.String()
+		if st, ok := de.endpointState[udpAddr]; ok {
+			ps.PathMTU = st.mtu
+		}
 	}
 }
 
@@ -4057,10 +4474,13 @@ func (de *endpoint) resetLocked() {
 	de.trustBestAddrUntil = 0
 	for _, es := range de.endpointState {
 		es.lastPing = 0
+		es.mtuProbesPending = 0
 	}
 	for txid, sp := range de.sentPing {
 		de.removeSentPingLocked(txid, sp)
 	}
+	de.notePathLocked(mono.Now(), "reset")
+	de.updatePathMTULocked()
 }
 
 func (de *endpoint) numStopAndReset() int64 {
@@ -19,6 +19,7 @@
 	"net/http/httptest"
 	"net/netip"
 	"os"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
@@ -33,12 +34,15 @@
 	"inet.af/netaddr"
 	"tailscale.com/derp"
 	"tailscale.com/derp/derphttp"
+	"tailscale.com/disco"
 	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/net/stun"
 	"tailscale.com/net/stun/stuntest"
 	"tailscale.com/net/tstun"
 	"tailscale.com/tailcfg"
 	"tailscale.com/tstest"
 	"tailscale.com/tstest/natlab"
+	"tailscale.com/tstime/mono"
 	"tailscale.com/types/key"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/netmap"
@@ -832,6 +836,90 @@ func TestActiveDiscovery(t *testing.T) {
 	})
 }
 
+// TestPeerRelay verifies that two magicStacks behind NATs that prevent
+// a direct path between them reach each other via a third that offers
+// to relay.
+func TestPeerRelay(t *testing.T) {
+	tstest.PanicOnLog()
+	tstest.ResourceCheck(t)
+
+	mstun := &natlab.Machine{Name: "stun"}
+	mrelay := &natlab.Machine{Name: "relay"}
+	m1 := &natlab.Machine{Name: "m1"}
+	m2 := &natlab.Machine{Name: "m2"}
+	nat1 := &natlab.Machine{Name: "nat1"}
+	nat2 := &natlab.Machine{Name: "nat2"}
+
+	inet := natlab.NewInternet()
+	lan1 := &natlab.Network{
+		Name:    "lan1",
+		Prefix4: netaddr.MustParseIPPrefix("192.168.0.0/24"),
+	}
+	lan2 := &natlab.Network{
+		Name:    "lan2",
+		Prefix4: netaddr.MustParseIPPrefix("192.168.1.0/24"),
+	}
+
+	sif := mstun.Attach("eth0", inet)
+	mrelay.Attach("eth0", inet)
+	nat1WAN := nat1.Attach("wan", inet)
+	nat1LAN := nat1.Attach("lan1", lan1)
+	nat2WAN := nat2.Attach("wan", inet)
+	nat2LAN := nat2.Attach("lan2", lan2)
+	m1.Attach("eth0", lan1)
+	m2.Attach("eth0", lan2)
+	lan1.SetDefaultGateway(nat1LAN)
+	lan2.SetDefaultGateway(nat2LAN)
+
+	// Both NATs map each destination to a different port, so
+	// neither side can learn a mapping that works for the other.
+	nat1.PacketHandler = &natlab.SNAT44{
+		Machine:           nat1,
+		ExternalInterface: nat1WAN,
+		Type:              natlab.AddressAndPortDependentNAT,
+		Firewall: &natlab.Firewall{
+			TrustedInterface: nat1LAN,
+		},
+	}
+	nat2.PacketHandler = &natlab.SNAT44{
+		Machine:           nat2,
+		ExternalInterface: nat2WAN,
+		Type:              natlab.AddressAndPortDependentNAT,
+		Firewall: &natlab.Firewall{
+			TrustedInterface: nat2LAN,
+		},
+	}
+
+	logf, closeLogf := logger.LogfCloser(t.Logf)
+	defer closeLogf()
+
+	derpMap, cleanup := runDERPAndStun(t, logf, mstun, sif.V4())
+	defer cleanup()
+
+	ms1 := newMagicStack(t, logger.WithPrefix(logf, "conn1: "), m1, derpMap)
+	defer ms1.Close()
+	ms2 := newMagicStack(t, logger.WithPrefix(logf, "conn2: "), m2, derpMap)
+	defer ms2.Close()
+	relay := newMagicStack(t, logger.WithPrefix(logf, "relay: "), mrelay, derpMap)
+	defer relay.Close()
+	relay.conn.SetPeerRelay(true)
+
+	cleanup = meshStacks(logf, func(idx int, nm *netmap.NetworkMap) {
+		for _, p := range nm.Peers {
+			if p.Key == relay.Public() {
+				p.Hostinfo = (&tailcfg.Hostinfo{PeerRelay: true}).View()
+			}
+		}
+	}, ms1, ms2, relay)
+	defer cleanup()
+
+	cleanup = newPinger(t, logf, ms1, ms2)
+	defer cleanup()
+
+	mustPeerRelay(t, logf, ms1, ms2, relay)
+	mustPeerRelay(t, logf, ms2, ms1, relay)
+}
+
 type devices struct {
 	m1   nettype.PacketListener
 	m1IP netaddr.IP
@@ -975,6 +1063,26 @@ func mustDirect(t *testing.T, logf logger.Logf, m1, m2 *magicStack) {
 	t.Errorf("magicsock did not find a direct path from %s to %s", m1, m2)
 }
 
+func mustPeerRelay(t *testing.T, logf logger.Logf, m1, m2, relay *magicStack) {
+	lastLog := time.Now().Add(-time.Minute)
+	relayIP := relay.IP().String()
+	for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		pst := m1.Status().Peer[m2.Public()]
+		if pst.PeerRelay == relayIP {
+			logf("relayed link %s->%s found via %s", m1, m2, pst.PeerRelay)
+			return
+		}
+		if pst.CurAddr != "" {
+			t.Fatalf("unexpected direct path %s->%s with addr %s", m1, m2, pst.CurAddr)
+		}
+		if now := time.Now(); now.Sub(lastLog) > time.Second {
+			logf("no relayed path %s->%s yet", m1, m2)
+			lastLog = now
+		}
+	}
+	t.Errorf("magicsock did not find a path from %s to %s via relay %s", m1, m2, relay)
+}
+
 func testTwoDevicePing(t *testing.T, d *devices) {
 	tstest.PanicOnLog()
 	tstest.ResourceCheck(t)
@@ -1633,6 +1741,22 @@ func TestBetterAddr(t *testing.T) {
 			b:    al("[2001::5]:123", 100*ms),
 			want: true,
 		},
+		// Prefer a direct path to a peer relay, even if slower:
+		{
+			a:    al("1.2.3.4:555", 100*ms),
+			b:    al("127.3.3.41:1", 30*ms),
+			want: true,
+		},
+		{
+			a:    al("127.3.3.41:1", 30*ms),
+			b:    al("[2001::5]:123", 100*ms),
+			want: false,
+		},
+		{
+			a:    al("127.3.3.41:1", 30*ms),
+			b:    al("127.3.3.41:2", 40*ms),
+			want: true,
+		},
 	}
 	for _, tt := range tests {
 		got := betterAddr(tt.a, tt.b)
@@ -1648,6 +1772,186 @@ func TestBetterAddr(t *testing.T) {
 
 }
 
+func TestMTUProbes(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	ep := netaddr.MustParseIPPort("1.2.3.4:555")
+	de := &endpoint{
+		c:             c,
+		sentPing:      map[stun.TxID]sentPing{},
+		endpointState: map[netaddr.IPPort]*endpointState{ep: {}},
+		bestAddr:      addrLatency{ep, time.Millisecond},
+		derpAddr:      netaddr.IPPortFrom(derpMagicIPAddr, 1),
+	}
+	st := de.endpointState[ep]
+	var mtus []int
+	c.pathMTUChanged = func(k key.NodePublic, mtu int) { mtus = append(mtus, mtu) }
+
+	// round runs a round of probes, of which those of the first n
+	// sizes, and not of size lost, are answered.
+	round := func(n, lost int) {
+		st.lastMTUProbe = mono.Now()
+		st.mtuProbesPending = len(mtuProbeSizes)
+		st.mtuProbeMax = 0
+		for i, size := range mtuProbeSizes {
+			de.noteMTUProbeDoneLocked(sentPing{to: ep, purpose: pingMTUProbe, size: size}, i < n && size != lost)
+		}
+	}
+	check := func(step string, wantMTU int, wantBlackHole bool) {
+		t.Helper()
+		if st.mtu != wantMTU || st.mtuBlackHole != wantBlackHole {
+			t.Errorf("%s: mtu = %v, black hole = %v; want %v, %v", step, st.mtu, st.mtuBlackHole, wantMTU, wantBlackHole)
+		}
+		if de.bestAddr.IsZero() != wantBlackHole {
+			t.Errorf("%s: best addr = %v; want it cleared iff a black hole", step, de.bestAddr)
+		}
+	}
+	all := len(mtuProbeSizes)
+	top := mtuProbeSizes[all-1]
+
+	round(2, 0)
+	check("after 2 answers", mtuProbeSizes[1], false)
+	if de.pathMTU != mtuProbeSizes[1] {
+		t.Errorf("pathMTU = %v; want %v", de.pathMTU, mtuProbeSizes[1])
+	}
+
+	round(all, 0)
+	check("after all answers", top, false)
+	if de.mtuProbeDueLocked(st, st.lastMTUProbe.Add(mtuDegradedProbeInterval+time.Second)) {
+		t.Error("probe due again before mtuProbeInterval after all answers")
+	}
+
+	// Losing one probe doesn't lower the MTU, but makes the next
+	// round come sooner.
+	round(all, top)
+	check("after losing the biggest probe", top, false)
+	if !de.mtuProbeDueLocked(st, st.lastMTUProbe.Add(mtuDegradedProbeInterval+time.Second)) {
+		t.Error("probe not due after mtuDegradedProbeInterval after a lost probe")
+	}
+	round(all, 0)
+	check("after all answers again", top, false)
+
+	// Nor does losing all but the smallest once, but twice does.
+	round(1, 0)
+	check("after 1 answer", top, false)
+	round(1, 0)
+	check("after 1 answer twice", mtuProbeSizes[0], false)
+
+	// Nor does losing all of them once.
+	round(0, 0)
+	check("after losing all probes once", mtuProbeSizes[0], false)
+
+	// Losing them twice in a row does.
+	round(0, 0)
+	check("after losing all probes twice", 0, true)
+
+	if want := []int{mtuProbeSizes[1], top, mtuProbeSizes[0], 0}; !reflect.DeepEqual(mtus, want) {
+		t.Errorf("path MTU changes = %v; want %v", mtus, want)
+	}
+}
+
+func TestConnMTUProbeSizes(t *testing.T) {
+	tests := []struct {
+		mtu  int
+		want []int
+	}{
+		{0, mtuProbeSizes},
+		{1200, []int{1280}},
+		{1280, []int{1280}},
+		{1400, []int{1280, 1360, 1400}},
+		{1410, []int{1280, 1360, 1400, 1410}},
+		{1440, mtuProbeSizes},
+		{9000, append(append([]int(nil), mtuProbeSizes...), 9000)},
+	}
+	for _, tt := range tests {
+		c := newConn()
+		c.SetMTU(tt.mtu)
+		if got := c.mtuProbeSizes(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("mtu %v: sizes = %v; want %v", tt.mtu, got, tt.want)
+		}
+	}
+}
+
+func TestMTUProbeSize(t *testing.T) {
+	priv, peer := key.NewDisco(), key.NewDisco()
+	for _, size := range mtuProbeSizes {
+		m := &disco.Ping{
+			NodeKey: key.NewNode().Public(),
+			Padding: size + wgPacketOverhead - discoPingLen,
+		}
+		box := priv.Shared(peer.Public()).Seal(m.AppendMarshal(nil))
+		got := len(disco.Magic) + key.DiscoPublicRawLen + len(box)
+		if want := size + wgPacketOverhead; got != want {
+			t.Errorf("probe for %v is %v bytes; want %v", size, got, want)
+		}
+	}
+}
+
+func TestPathHistory(t *testing.T) {
+	c := newConn()
+	c.logf = t.Logf
+	ep := netaddr.MustParseIPPort("1.2.3.4:555")
+	derp := netaddr.IPPortFrom(derpMagicIPAddr, 1)
+	de := &endpoint{
+		c:             c,
+		sentPing:      map[stun.TxID]sentPing{},
+		endpointState: map[netaddr.IPPort]*endpointState{ep: {}},
+		derpAddr:      derp,
+	}
+	now := mono.Now()
+	de.notePathLocked(now, "no direct path")
+	de.notePathLocked(now, "no direct path") // not a switch
+	de.bestAddr = addrLatency{ep, time.Millisecond}
+	de.trustBestAddrUntil = now.Add(time.Minute)
+	de.notePathLocked(now, "pong")
+	de.trustBestAddrUntil = 0
+	de.notePathLocked(now, "expired")
+
+	st := de.endpointState[ep]
+	for i := 1; i <= pongHistoryCount+2; i++ {
+		st.addPongReplyLocked(pongReply{latency: time.Duration(i) * time.Millisecond, pongAt: now})
+	}
+	st.pingsSent, st.pingsLost = 10, 3
+
+	h := de.pathHistory()
+	if h.CurPath != "1.2.3.4:555+derp-1" {
+		t.Errorf("CurPath = %q; want 1.2.3.4:555+derp-1", h.CurPath)
+	}
+	var got []string
+	for _, ps := range h.Switches {
+		got = append(got, fmt.Sprintf("%s => %s (%s)", ps.From, ps.To, ps.Reason))
+	}
+	want := []string{
+		" => derp-1 (no direct path)",
+		"derp-1 => 1.2.3.4:555 (pong)",
+		"1.2.3.4:555 => 1.2.3.4:555+derp-1 (expired)",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("switches = %q; want %q", got, want)
+	}
+	if len(h.Candidates) != 1 {
+		t.Fatalf("got %d candidates; want 1", len(h.Candidates))
+	}
+	pc := h.Candidates[0]
+	if !pc.Best || pc.PingsSent != 10 || pc.PingsLost != 3 {
+		t.Errorf("candidate = %+v; want best, with 10 pings sent and 3 lost", pc)
+	}
+	if len(pc.Latency) != pongHistoryCount {
+		t.Fatalf("got %d latency samples; want %d", len(pc.Latency), pongHistoryCount)
+	}
+	if first, last := pc.Latency[0].LatencySeconds, pc.Latency[len(pc.Latency)-1].LatencySeconds; first != 0.003 || last != float64(pongHistoryCount+2)/1000 {
+		t.Errorf("latency samples from %v to %v; want oldest first, from 0.003 to %v", first, last, float64(pongHistoryCount+2)/1000)
+	}
+
+	for i := 0; i < maxPathSwitches*2; i++ {
+		de.trustBestAddrUntil = now.Add(time.Duration(i%2)*time.Minute - time.Second)
+		de.notePathLocked(now, "flap")
+	}
+	if len(de.pathSwitches) != maxPathSwitches {
+		t.Errorf("kept %d path switches; want %d", len(de.pathSwitches), maxPathSwitches)
+	}
+}
+
 func epStrings(eps []tailcfg.Endpoint) (ret []string) {
 	for _, ep := range eps {
 		ret = append(ret, ep.Addr.String())
@@ -0,0 +1,158 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"inet.af/netaddr"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/key"
+)
+
+// maxPathSwitches is how many path switches are kept per endpoint.
+const maxPathSwitches = 32
+
+// sendPath is the path packets to an endpoint are sent over, as
+// returned by addrForSendLocked.
+type sendPath struct {
+	udp, derp netaddr.IPPort
+}
+
+func (p sendPath) String() string {
+	switch {
+	case p == sendPath{}:
+		return "none"
+	case p.udp.IsZero():
+		return derpStr(p.derp.String())
+	case p.derp.IsZero():
+		return relayStr(p.udp.String())
+	default:
+		return relayStr(p.udp.String()) + "+" + derpStr(p.derp.String())
+	}
+}
+
+// pathSwitch is a change of an endpoint's sendPath.
+type pathSwitch struct {
+	at       mono.Time
+	from, to sendPath
+	reason   string
+}
+
+// notePathLocked records a path switch, for the given reason, if the
+// path addrForSendLocked picks at now differs from the last one
+// recorded.
+//
+// de.mu must be held.
+func (de *endpoint) notePathLocked(now mono.Time, reason string) {
+	udpAddr, derpAddr := de.addrForSendLocked(now)
+	p := sendPath{udpAddr, derpAddr}
+	if p == de.lastPath {
+		return
+	}
+	if len(de.pathSwitches) == maxPathSwitches {
+		copy(de.pathSwitches, de.pathSwitches[1:])
+		de.pathSwitches = de.pathSwitches[:maxPathSwitches-1]
+	}
+	de.pathSwitches = append(de.pathSwitches, pathSwitch{
+		at:     now,
+		from:   de.lastPath,
+		to:     p,
+		reason: reason,
+	})
+	de.lastPath = p
+}
+
+// pathHistory returns the recent history of the paths used to reach de.
+func (de *endpoint) pathHistory() *ipnstate.PeerPathHistory {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+
+	pathStr := func(p sendPath) string {
+		if p == (sendPath{}) {
+			return ""
+		}
+		return p.String()
+	}
+	udpAddr, derpAddr := de.addrForSendLocked(mono.Now())
+	h := &ipnstate.PeerPathHistory{
+		PublicKey: de.publicKey,
+		CurPath:   pathStr(sendPath{udpAddr, derpAddr}),
+	}
+
+	eps := make([]netaddr.IPPort, 0, len(de.endpointState))
+	for ipp := range de.endpointState {
+		eps = append(eps, ipp)
+	}
+	sort.Slice(eps, func(i, j int) bool { return ipPortLess(eps[i], eps[j]) })
+	for _, ipp := range eps {
+		st := de.endpointState[ipp]
+		pc := ipnstate.PathCandidate{
+			Addr:      ipp.String(),
+			Best:      ipp == de.bestAddr.IPPort,
+			PingsSent: st.pingsSent,
+			PingsLost: st.pingsLost,
+			MTU:       st.mtu,
+		}
+		n := len(st.recentPongs)
+		for i := 0; i < n; i++ {
+			// Oldest first: start just after the most recent.
+			pr := st.recentPongs[(int(st.recentPong)+1+i)%n]
+			pc.Latency = append(pc.Latency, ipnstate.PathLatency{
+				When:           pr.pongAt.WallTime(),
+				LatencySeconds: pr.latency.Seconds(),
+			})
+		}
+		h.Candidates = append(h.Candidates, pc)
+	}
+
+	for _, ps := range de.pathSwitches {
+		h.Switches = append(h.Switches, ipnstate.PathSwitch{
+			When:   ps.at.WallTime(),
+			From:   pathStr(ps.from),
+			To:     pathStr(ps.to),
+			Reason: ps.reason,
+		})
+	}
+	return h
+}
+
+// PeerPathHistory returns the recent history of the paths used to
+// reach the peer with node key nk. ok is false if there's no such
+// peer.
+func (c *Conn) PeerPathHistory(nk key.NodePublic) (h *ipnstate.PeerPathHistory, ok bool) {
+	c.mu.Lock()
+	ep, ok := c.peerMap.endpointForNodeKey(nk)
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return ep.pathHistory(), true
+}
+
+// PathHistories returns the recent history of the paths used to reach
+// each peer, sorted by node key.
+func (c *Conn) PathHistories() []*ipnstate.PeerPathHistory {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ret := make([]*ipnstate.PeerPathHistory, 0, c.peerMap.nodeCount())
+	c.peerMap.forEachEndpoint(func(ep *endpoint) {
+		ret = append(ret, ep.pathHistory())
+	})
+	sort.Slice(ret, func(i, j int) bool { return ret[i].PublicKey.Less(ret[j].PublicKey) })
+	return ret
+}
+
+// serveHTTPDebugJSON serves the path histories of c's peers as JSON,
+// for ServeHTTPDebug's format=json mode.
+func (c *Conn) serveHTTPDebugJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	e.Encode(c.PathHistories())
+}
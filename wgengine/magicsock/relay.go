@@ -0,0 +1,306 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package magicsock
+
+import (
+	"strings"
+
+	"go4.org/mem"
+	"inet.af/netaddr"
+	"tailscale.com/tailcfg"
+	"tailscale.com/tstime/mono"
+	"tailscale.com/types/key"
+	"tailscale.com/util/clientmetric"
+)
+
+// Peer relays are peers that offer (via tailcfg.Hostinfo.PeerRelay)
+// to forward UDP packets between two of their peers that can't reach
+// each other directly, but that can each reach the relay directly.
+// They're an alternative to DERP, whose paths are discovered, measured
+// and selected by disco pings like any other candidate endpoint.
+//
+// A path via a relay is represented by a fake endpoint address: the
+// relayMagicIPAddr IP with the relay's ID, assigned locally when the
+// relay appears in the network map, as port. Packets sent to it are
+// wrapped in a relay frame and sent to the relay's direct address.
+//
+// A relay frame has the form:
+//
+//  * magic   [6]byte
+//  * type    byte (relayFrameForward or relayFrameDeliver)
+//  * nodeKey [32]byte
+//  * payload (a WireGuard or disco packet)
+//
+// A relay receiving a relayFrameForward frame from a peer it has a
+// direct path to, for a peer it also has a trusted direct path to,
+// rewrites it in place into a relayFrameDeliver frame with the
+// sender's node key and sends it on. Relays don't chain: packets are
+// only forwarded over direct paths.
+
+// relayMagicIP is a fake WireGuard endpoint IP address that means to
+// send via a peer relay. When used, the port number of the WireGuard
+// endpoint is the ID of the relay to use.
+//
+// Mnemonic: the address after DerpMagicIP.
+const relayMagicIP = "127.3.3.41"
+
+var relayMagicIPAddr = netaddr.MustParseIP(relayMagicIP)
+
+// relayMagic is the prefix of relay frames. Like disco.Magic, it
+// can't be the start of a WireGuard packet.
+const relayMagic = "TS\xf0\x9f\x94\x81" // 6 bytes: 0x54 53 f0 9f 94 81
+
+// Relay frame types.
+const (
+	// relayFrameForward is a frame sent to a relay. Its node key is
+	// the destination's.
+	relayFrameForward = 1
+
+	// relayFrameDeliver is a frame sent by a relay. Its node key is
+	// the source's.
+	relayFrameDeliver = 2
+)
+
+const relayHeaderLen = len(relayMagic) + 1 + key.NodePublicRawLen
+
+// relayStr replaces relayMagicIP addresses in s with "relay-N", like
+// derpStr does for DERP addresses.
+func relayStr(s string) string { return strings.ReplaceAll(s, relayMagicIP+":", "relay-") }
+
+// isRelayFrame reports whether b looks like a relay frame.
+func isRelayFrame(b []byte) bool {
+	return len(b) >= relayHeaderLen && string(b[:len(relayMagic)]) == relayMagic
+}
+
+// SetPeerRelay sets whether c relays packets between peers that can't
+// reach each other directly. The relay role is advertised to peers
+// separately, in tailcfg.Hostinfo.PeerRelay.
+func (c *Conn) SetPeerRelay(v bool) {
+	if c.peerRelay.Get() == v {
+		return
+	}
+	c.peerRelay.Set(v)
+	c.logf("magicsock: peer relay enabled: %v", v)
+}
+
+// updateRelaysLocked updates the IDs of the peers offering to relay,
+// keeping the IDs of the ones already known.
+//
+// c.mu must be held.
+func (c *Conn) updateRelaysLocked(peers []*tailcfg.Node) {
+	old := c.relayID
+	c.relayID = make(map[key.NodePublic]uint16)
+	if c.relayKey == nil {
+		c.relayKey = make(map[uint16]key.NodePublic)
+	}
+	for _, n := range peers {
+		if n.DiscoKey.IsZero() || !n.Hostinfo.Valid() || !n.Hostinfo.PeerRelay() {
+			continue
+		}
+		id, ok := old[n.Key]
+		if !ok {
+			id = c.nextRelayIDLocked()
+			c.relayKey[id] = n.Key
+		}
+		c.relayID[n.Key] = id
+	}
+	for nk, id := range old {
+		if _, ok := c.relayID[nk]; !ok {
+			delete(c.relayKey, id)
+		}
+	}
+	metricNumPeerRelays.Set(int64(len(c.relayID)))
+}
+
+// nextRelayIDLocked returns an unused non-zero relay ID.
+//
+// c.mu must be held.
+func (c *Conn) nextRelayIDLocked() uint16 {
+	for {
+		c.lastRelayID++
+		if _, ok := c.relayKey[c.lastRelayID]; c.lastRelayID != 0 && !ok {
+			return c.lastRelayID
+		}
+	}
+}
+
+// relayIPLocked returns the Tailscale IP of the relay with the fake
+// endpoint address ipp, or the empty string if it's unknown.
+//
+// c.mu must be held.
+func (c *Conn) relayIPLocked(ipp netaddr.IPPort) string {
+	nk, ok := c.relayKey[ipp.Port()]
+	if !ok || c.netMap == nil {
+		return ""
+	}
+	for _, n := range c.netMap.Peers {
+		if n.Key == nk && len(n.Addresses) > 0 {
+			return n.Addresses[0].IP().String()
+		}
+	}
+	return ""
+}
+
+// sendRelay sends b to the peer dst via the relay with the fake
+// endpoint address addr. See sendAddr's docs on the return value
+// meanings.
+func (c *Conn) sendRelay(addr netaddr.IPPort, dst key.NodePublic, b []byte) (sent bool, err error) {
+	c.mu.Lock()
+	var relay *endpoint
+	nk, ok := c.relayKey[addr.Port()]
+	if ok {
+		relay, ok = c.peerMap.endpointForNodeKey(nk)
+	}
+	c.mu.Unlock()
+	if !ok || dst.IsZero() {
+		metricSendRelayError.Add(1)
+		return false, nil
+	}
+	relayAddr, ok := relay.directAddrForRelay()
+	if !ok {
+		metricSendRelayError.Add(1)
+		return false, nil
+	}
+
+	// TODO: this makes garbage, like sendAddr does for DERP.
+	pkt := make([]byte, 0, relayHeaderLen+len(b))
+	pkt = append(pkt, relayMagic...)
+	pkt = append(pkt, relayFrameForward)
+	pkt = dst.AppendTo(pkt)
+	pkt = append(pkt, b...)
+	sent, err = c.sendUDP(relayAddr, pkt)
+	if sent {
+		metricSendRelay.Add(1)
+	}
+	return sent, err
+}
+
+// directAddrForRelay returns the trusted direct address of de, for
+// relaying packets to or via de. ok is false if there's none, in which
+// case discovery of one is started.
+func (de *endpoint) directAddrForRelay() (ipp netaddr.IPPort, ok bool) {
+	de.mu.Lock()
+	defer de.mu.Unlock()
+	now := mono.Now()
+	udpAddr, derpAddr := de.addrForSendLocked(now)
+	if udpAddr.IsZero() || !derpAddr.IsZero() || udpAddr.IP() == relayMagicIPAddr {
+		if de.canP2P() && now.Sub(de.lastFullPing) > discoPingInterval {
+			de.sendPingsLocked(now, true)
+		}
+		de.noteActiveLocked()
+		return netaddr.IPPort{}, false
+	}
+	de.noteActiveLocked()
+	return udpAddr, true
+}
+
+// handleRelayFrame handles relay frame b received from src over UDP.
+//
+// A relayFrameForward frame is forwarded, if c is a relay. For a
+// relayFrameDeliver frame, a disco payload is handled and a WireGuard
+// payload is moved to the start of b, in which case its length and
+// sender are returned. Otherwise, n is zero.
+func (c *Conn) handleRelayFrame(b []byte, src netaddr.IPPort) (n int, ep *endpoint) {
+	typ := b[len(relayMagic)]
+	nk := key.NodePublicFromRaw32(mem.B(b[len(relayMagic)+1 : relayHeaderLen]))
+	if typ == relayFrameForward {
+		c.forwardRelayFrame(b, src, nk)
+		return 0, nil
+	}
+	if typ != relayFrameDeliver {
+		metricRecvRelayBad.Add(1)
+		return 0, nil
+	}
+
+	c.mu.Lock()
+	relay, ok := c.peerMap.endpointForIPPort(src)
+	var id uint16
+	if ok {
+		id, ok = c.relayID[relay.publicKey]
+	}
+	c.mu.Unlock()
+	if !ok {
+		// Not from a relay we know of.
+		metricRecvRelayBad.Add(1)
+		return 0, nil
+	}
+	payload := b[relayHeaderLen:]
+	if c.handleDiscoMessage(payload, netaddr.IPPortFrom(relayMagicIPAddr, id), nk) {
+		return 0, nil
+	}
+	if !c.havePrivateKey.Get() {
+		return 0, nil
+	}
+	c.mu.Lock()
+	ep, ok = c.peerMap.endpointForNodeKey(nk)
+	c.mu.Unlock()
+	if !ok {
+		return 0, nil
+	}
+	metricRecvDataRelay.Add(1)
+	return copy(b, payload), ep
+}
+
+// forwardRelayFrame forwards relay frame b, for the peer dst, from
+// src to dst, if c is a relay with trusted direct paths to both.
+func (c *Conn) forwardRelayFrame(b []byte, src netaddr.IPPort, dst key.NodePublic) {
+	if !c.peerRelay.Get() {
+		metricRelayDropped.Add(1)
+		return
+	}
+	c.mu.Lock()
+	from, ok := c.peerMap.endpointForIPPort(src)
+	var to *endpoint
+	if ok {
+		to, ok = c.peerMap.endpointForNodeKey(dst)
+	}
+	c.mu.Unlock()
+	if !ok || from == to {
+		metricRelayDropped.Add(1)
+		return
+	}
+	dstAddr, ok := to.directAddrForRelay()
+	if !ok {
+		metricRelayDropped.Add(1)
+		return
+	}
+	// The two headers are the same size, so rewrite it in place.
+	b[len(relayMagic)] = relayFrameDeliver
+	raw := from.publicKey.Raw32()
+	copy(b[len(relayMagic)+1:], raw[:])
+	if sent, _ := c.sendUDP(dstAddr, b); sent {
+		metricRelayForwarded.Add(1)
+	} else {
+		metricRelayDropped.Add(1)
+	}
+}
+
+// addRelayCandidatesLocked adds the paths via each known relay, other
+// than de itself, as candidate endpoints of de.
+//
+// c.mu and de.mu must be held.
+func (de *endpoint) addRelayCandidatesLocked() {
+	for nk, id := range de.c.relayID {
+		if nk == de.publicKey {
+			continue
+		}
+		ipp := netaddr.IPPortFrom(relayMagicIPAddr, id)
+		if st, ok := de.endpointState[ipp]; ok {
+			st.index = indexRelay
+		} else {
+			de.endpointState[ipp] = &endpointState{index: indexRelay}
+		}
+	}
+}
+
+var (
+	metricNumPeerRelays  = clientmetric.NewGauge("magicsock_num_peer_relays")
+	metricSendRelay      = clientmetric.NewCounter("magicsock_send_relay")
+	metricSendRelayError = clientmetric.NewCounter("magicsock_send_relay_error")
+	metricRecvDataRelay  = clientmetric.NewCounter("magicsock_recv_data_relay")
+	metricRecvRelayBad   = clientmetric.NewCounter("magicsock_recv_relay_bad")
+	metricRelayForwarded = clientmetric.NewCounter("magicsock_relay_forwarded")
+	metricRelayDropped   = clientmetric.NewCounter("magicsock_relay_dropped")
+)
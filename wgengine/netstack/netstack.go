@@ -371,6 +371,62 @@ func (ns *Impl) DialContextUDP(ctx context.Context, ipp netaddr.IPPort) (*gonet.
 	return gonet.DialUDP(ns.ipstack, nil, remoteAddress, ipType)
 }
 
+// ListenPacket binds a UDP endpoint in netstack to the provided
+// network and ip:port address, returning it as a net.PacketConn.
+//
+// The network must be "udp", "udp4" or "udp6". If the IP in address is
+// empty, the endpoint is bound to all of this node's addresses of the
+// network's family; for "udp", that's both IPv4 and IPv6.
+//
+// Inbound packets destined to a bound endpoint are delivered to it
+// rather than to the UDP forwarder.
+func (ns *Impl) ListenPacket(network, address string) (*gonet.UDPConn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	var ip netaddr.IP
+	if host != "" {
+		ip, err = netaddr.ParseIP(host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var ipType tcpip.NetworkProtocolNumber
+	switch network {
+	case "udp4":
+		ipType = ipv4.ProtocolNumber
+	case "udp6":
+		ipType = ipv6.ProtocolNumber
+	case "udp":
+		// An unspecified IPv6 bind is dual-stack in netstack, so
+		// use that if there's no IP to pick the family from.
+		ipType = ipv6.ProtocolNumber
+		if ip.Is4() {
+			ipType = ipv4.ProtocolNumber
+		}
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+	if ip.IsValid() && ip.Is4() != (ipType == ipv4.ProtocolNumber) {
+		return nil, fmt.Errorf("address %v is not valid for network %q", ip, network)
+	}
+
+	localAddress := &tcpip.FullAddress{
+		NIC:  nicID,
+		Port: uint16(port),
+	}
+	if ip.IsValid() {
+		localAddress.Addr = tcpip.Address(ip.IPAddr().IP)
+	}
+	return gonet.DialUDP(ns.ipstack, localAddress, nil, ipType)
+}
+
 func (ns *Impl) injectOutbound() {
 	for {
 		pkt := ns.linkEP.ReadContext(ns.ctx)
@@ -0,0 +1,120 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/key"
+	"tailscale.com/wgengine/wgcfg"
+)
+
+// peerMTUs tracks the path MTUs of peers, as found by magicsock, for
+// tstun.Wrapper.PeerMTU, which looks them up for every large outgoing
+// packet. Lookups don't take any locks: updates, which are rare,
+// build a new lookup func.
+//
+// Its zero value is ready to use.
+type peerMTUs struct {
+	mu     sync.Mutex                            // guards mtus and routes, and serializes updates to lookup
+	mtus   map[key.NodePublic]int                // known path MTUs
+	routes map[key.NodePublic][]netaddr.IPPrefix // AllowedIPs of each peer
+
+	lookup atomic.Value // of func(netaddr.IP) (mtu int, ok bool)
+}
+
+// get returns the path MTU to the peer that packets to ip are sent to,
+// if it's known.
+func (m *peerMTUs) get(ip netaddr.IP) (mtu int, ok bool) {
+	f, _ := m.lookup.Load().(func(netaddr.IP) (int, bool))
+	if f == nil {
+		return 0, false
+	}
+	return f(ip)
+}
+
+// setMTU records the path MTU of the peer with node key k. Zero means
+// it's unknown. It's a magicsock.Options.PathMTUChanged func.
+func (m *peerMTUs) setMTU(k key.NodePublic, mtu int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if mtu == 0 {
+		if _, ok := m.mtus[k]; !ok {
+			return
+		}
+		delete(m.mtus, k)
+	} else {
+		if m.mtus == nil {
+			m.mtus = map[key.NodePublic]int{}
+		}
+		m.mtus[k] = mtu
+	}
+	m.updateLocked()
+}
+
+// setPeers records the AllowedIPs of peers, forgetting the path MTUs
+// of any others.
+func (m *peerMTUs) setPeers(peers []wgcfg.Peer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.routes = make(map[key.NodePublic][]netaddr.IPPrefix, len(peers))
+	for _, p := range peers {
+		m.routes[p.PublicKey] = p.AllowedIPs
+	}
+	for k := range m.mtus {
+		if _, ok := m.routes[k]; !ok {
+			delete(m.mtus, k)
+		}
+	}
+	m.updateLocked()
+}
+
+func (m *peerMTUs) updateLocked() {
+	if len(m.mtus) == 0 {
+		m.lookup.Store(func(netaddr.IP) (int, bool) { return 0, false })
+		return
+	}
+	type prefixMTU struct {
+		p   netaddr.IPPrefix
+		mtu int
+	}
+	ips := map[netaddr.IP]int{}
+	var prefixes []prefixMTU
+	var prefixesKnown bool // whether any of prefixes has a known MTU
+	for k, routes := range m.routes {
+		mtu := m.mtus[k]
+		for _, p := range routes {
+			if p.IsSingleIP() {
+				ips[p.IP()] = mtu
+				continue
+			}
+			prefixes = append(prefixes, prefixMTU{p, mtu})
+			prefixesKnown = prefixesKnown || mtu != 0
+		}
+	}
+	if !prefixesKnown {
+		// Packets to any of the prefixes have no known path MTU,
+		// so there's no need to look for the most specific.
+		prefixes = nil
+	}
+	// Like wireguard-go, send to the peer with the most specific
+	// route. Subnet routes are rare enough to just do the slow
+	// linear thing.
+	sort.Slice(prefixes, func(i, j int) bool { return prefixes[i].p.Bits() > prefixes[j].p.Bits() })
+	m.lookup.Store(func(ip netaddr.IP) (int, bool) {
+		if mtu, ok := ips[ip]; ok {
+			return mtu, mtu != 0
+		}
+		for _, pm := range prefixes {
+			if pm.p.Contains(ip) {
+				return pm.mtu, pm.mtu != 0
+			}
+		}
+		return 0, false
+	})
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2022 Tailscale Inc & AUTHORS All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wgengine
+
+import (
+	"testing"
+
+	"inet.af/netaddr"
+	"tailscale.com/types/key"
+	"tailscale.com/wgengine/wgcfg"
+)
+
+func TestPeerMTUs(t *testing.T) {
+	a, b, c := key.NewNode().Public(), key.NewNode().Public(), key.NewNode().Public()
+	peer := func(k key.NodePublic, routes ...string) wgcfg.Peer {
+		p := wgcfg.Peer{PublicKey: k}
+		for _, r := range routes {
+			p.AllowedIPs = append(p.AllowedIPs, netaddr.MustParseIPPrefix(r))
+		}
+		return p
+	}
+
+	var m peerMTUs
+	check := func(ip string, wantMTU int, wantOK bool) {
+		t.Helper()
+		if mtu, ok := m.get(netaddr.MustParseIP(ip)); mtu != wantMTU || ok != wantOK {
+			t.Errorf("get(%v) = %v, %v; want %v, %v", ip, mtu, ok, wantMTU, wantOK)
+		}
+	}
+	check("100.64.0.1", 0, false)
+
+	m.setPeers([]wgcfg.Peer{
+		peer(a, "100.64.0.1/32", "10.0.0.0/8"),
+		peer(b, "100.64.0.2/32", "10.1.0.0/16"),
+		peer(c, "100.64.0.3/32"),
+	})
+	check("100.64.0.1", 0, false)
+
+	m.setMTU(a, 1400)
+	check("100.64.0.1", 1400, true)
+	check("10.2.0.1", 1400, true)
+	check("10.1.0.1", 0, false) // more specific route via b
+	check("100.64.0.2", 0, false)
+	check("192.168.0.1", 0, false)
+
+	m.setMTU(b, 1360)
+	check("10.1.0.1", 1360, true)
+	check("100.64.0.2", 1360, true)
+
+	m.setMTU(a, 0)
+	check("100.64.0.1", 0, false)
+	check("10.2.0.1", 0, false)
+	check("10.1.0.1", 1360, true)
+
+	// Peers that are removed are forgotten.
+	m.setPeers([]wgcfg.Peer{peer(c, "100.64.0.3/32")})
+	m.setPeers([]wgcfg.Peer{peer(b, "100.64.0.2/32")})
+	check("100.64.0.2", 0, false)
+}
@@ -66,6 +66,12 @@ type Config struct {
 	// routing rules apply.
 	LocalRoutes []netaddr.IPPrefix
 
+	// MTU is the MTU of the Tailscale interface. Zero means to
+	// leave it as the interface was created. Only Linux sets the
+	// interface's MTU; on other platforms, it just limits the size
+	// of the packets accepted from peers.
+	MTU int
+
 	// Linux-only things below, ignored on other platforms.
 	SubnetRoutes     []netaddr.IPPrefix     // subnets being advertised to other Tailscale nodes
 	SNATSubnetRoutes bool                   // SNAT traffic to local subnets
@@ -24,6 +24,7 @@
 	"inet.af/netaddr"
 	"tailscale.com/envknob"
 	"tailscale.com/net/tsaddr"
+	"tailscale.com/net/tstun"
 	"tailscale.com/syncs"
 	"tailscale.com/types/logger"
 	"tailscale.com/types/preftype"
@@ -93,6 +94,7 @@ type linuxRouter struct {
 	localRoutes      map[netaddr.IPPrefix]bool
 	snatSubnetRoutes bool
 	netfilterMode    preftype.NetfilterMode
+	mtu              int // last MTU set from Config, or 0 for the default
 
 	// ruleRestorePending is whether a timer has been started to
 	// restore deleted ip rules.
@@ -314,6 +316,25 @@ func (r *linuxRouter) Set(cfg *Config) error {
 	}
 	r.addrs = newAddrs
 
+	switch {
+	case cfg.MTU == r.mtu:
+		// state already correct, nothing to do.
+	case cfg.MTU == 0:
+		// An MTU was set before but no longer is, so go back to
+		// the one the interface was created with.
+		if err := r.setMTU(tstun.DefaultMTU()); err != nil {
+			errs = append(errs, err)
+		} else {
+			r.mtu = 0
+		}
+	default:
+		if err := r.setMTU(cfg.MTU); err != nil {
+			errs = append(errs, err)
+		} else {
+			r.mtu = cfg.MTU
+		}
+	}
+
 	switch {
 	case cfg.SNATSubnetRoutes == r.snatSubnetRoutes:
 		// state already correct, nothing to do.
@@ -754,6 +775,18 @@ func (r *linuxRouter) upInterface() error {
 	return netlink.LinkSetUp(link)
 }
 
+// setMTU sets the MTU of the tunnel interface.
+func (r *linuxRouter) setMTU(mtu int) error {
+	if r.useIPCommand() {
+		return r.cmd.run("ip", "link", "set", "dev", r.tunname, "mtu", strconv.Itoa(mtu))
+	}
+	link, err := r.link()
+	if err != nil {
+		return fmt.Errorf("setting interface MTU, %w", err)
+	}
+	return netlink.LinkSetMTU(link, mtu)
+}
+
 // downInterface sets the tunnel interface administratively down.
 func (r *linuxRouter) downInterface() error {
 	if r.useIPCommand() {
@@ -10,6 +10,7 @@
 	"math/rand"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"testing"
@@ -18,6 +19,7 @@
 	"github.com/vishvananda/netlink"
 	"golang.zx2c4.com/wireguard/tun"
 	"inet.af/netaddr"
+	"tailscale.com/net/tstun"
 	"tailscale.com/tstest"
 	"tailscale.com/types/logger"
 	"tailscale.com/wgengine/monitor"
@@ -315,6 +317,33 @@ func TestRouterStates(t *testing.T) {
 ip route add throw 10.0.0.0/8 table 52
 ip route add throw 192.168.0.0/24 table 52` + basic,
 		},
+		{
+			name: "addr and routes with mtu",
+			in: &Config{
+				LocalAddrs:    mustCIDRs("100.101.102.104/10"),
+				Routes:        mustCIDRs("100.100.100.100/32"),
+				MTU:           1400,
+				NetfilterMode: netfilterOff,
+			},
+			want: `
+up
+mtu 1400
+ip addr add 100.101.102.104/10 dev tailscale0
+ip route add 100.100.100.100/32 dev tailscale0 table 52` + basic,
+		},
+		{
+			name: "addr and routes with mtu reset",
+			in: &Config{
+				LocalAddrs:    mustCIDRs("100.101.102.104/10"),
+				Routes:        mustCIDRs("100.100.100.100/32"),
+				NetfilterMode: netfilterOff,
+			},
+			want: `
+up
+mtu ` + strconv.Itoa(tstun.DefaultMTU()) + `
+ip addr add 100.101.102.104/10 dev tailscale0
+ip route add 100.100.100.100/32 dev tailscale0 table 52` + basic,
+		},
 	}
 
 	mon, err := monitor.New(logger.Discard)
@@ -475,6 +504,7 @@ func (n *fakeNetfilter) DeleteChain(table, chain string) error {
 type fakeOS struct {
 	t          *testing.T
 	up         bool
+	mtu        string
 	ips        []string
 	routes     []string
 	rules      []string
@@ -499,6 +529,9 @@ func (o *fakeOS) String() string {
 	} else {
 		b.WriteString("down\n")
 	}
+	if o.mtu != "" {
+		fmt.Fprintf(&b, "mtu %s\n", o.mtu)
+	}
 
 	for _, ip := range o.ips {
 		fmt.Fprintf(&b, "ip addr add %s\n", ip)
@@ -571,6 +604,10 @@ func (o *fakeOS) run(args ...string) error {
 		case "set dev tailscale0 down":
 			o.up = false
 		default:
+			if mtu := strings.TrimPrefix(got, "set dev tailscale0 mtu "); mtu != got {
+				o.mtu = mtu
+				return nil
+			}
 			return unexpected()
 		}
 		return nil
@@ -19,6 +19,7 @@
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/magicsock"
 	"tailscale.com/wgengine/monitor"
@@ -87,6 +88,9 @@ func (e *watchdogEngine) GetFilter() *filter.Filter {
 func (e *watchdogEngine) SetFilter(filt *filter.Filter) {
 	e.watchdog("SetFilter", func() { e.wrap.SetFilter(filt) })
 }
+func (e *watchdogEngine) InstallCaptureHook(cb capture.Callback) {
+	e.wrap.InstallCaptureHook(cb)
+}
 func (e *watchdogEngine) SetStatusCallback(cb StatusCallback) {
 	e.watchdog("SetStatusCallback", func() { e.wrap.SetStatusCallback(cb) })
 }
@@ -105,6 +109,12 @@ func (e *watchdogEngine) LinkChange(isExpensive bool) {
 func (e *watchdogEngine) SetDERPMap(m *tailcfg.DERPMap) {
 	e.watchdog("SetDERPMap", func() { e.wrap.SetDERPMap(m) })
 }
+func (e *watchdogEngine) SetStaticEndpoints(eps []netaddr.IPPort) {
+	e.watchdog("SetStaticEndpoints", func() { e.wrap.SetStaticEndpoints(eps) })
+}
+func (e *watchdogEngine) SetPeerRelay(v bool) {
+	e.watchdog("SetPeerRelay", func() { e.wrap.SetPeerRelay(v) })
+}
 func (e *watchdogEngine) SetNetworkMap(nm *netmap.NetworkMap) {
 	e.watchdog("SetNetworkMap", func() { e.wrap.SetNetworkMap(nm) })
 }
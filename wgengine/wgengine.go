@@ -13,6 +13,7 @@
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 	"tailscale.com/types/netmap"
+	"tailscale.com/wgengine/capture"
 	"tailscale.com/wgengine/filter"
 	"tailscale.com/wgengine/monitor"
 	"tailscale.com/wgengine/router"
@@ -86,6 +87,10 @@ type Engine interface {
 	// SetFilter updates the packet filter.
 	SetFilter(*filter.Filter)
 
+	// InstallCaptureHook sets the function called with each packet
+	// passing through the engine's TUN wrapper, or clears it if nil.
+	InstallCaptureHook(capture.Callback)
+
 	// SetStatusCallback sets the function to call when the
 	// WireGuard status changes.
 	SetStatusCallback(StatusCallback)
@@ -127,6 +132,15 @@ type Engine interface {
 	// is configured.
 	SetDERPMap(*tailcfg.DERPMap)
 
+	// SetStaticEndpoints sets the manually configured endpoints
+	// (ip:port) to advertise to peers, in addition to the ones
+	// discovered via STUN, port mapping and local interfaces.
+	SetStaticEndpoints([]netaddr.IPPort)
+
+	// SetPeerRelay sets whether this node relays UDP packets
+	// between peers that can't reach each other directly.
+	SetPeerRelay(bool)
+
 	// SetNetworkMap informs the engine of the latest network map
 	// from the server. The network map's DERPMap field should be
 	// ignored as as it might be disabled; get it from SetDERPMap